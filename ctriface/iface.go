@@ -500,9 +500,11 @@ func (o *Orchestrator) LoadSnapshot(ctx context.Context, vmID string) (*metrics.
 	}
 
 	if o.GetUPFEnabled() {
-		if err := o.memoryManager.FetchState(vmID); err != nil {
+		pages, err := o.memoryManager.FetchStateWithContext(ctx, vmID)
+		if err != nil {
 			return nil, err
 		}
+		logger.Debugf("Fetched %d working set pages", pages)
 	}
 
 	tStart = time.Now()
@@ -516,7 +518,7 @@ func (o *Orchestrator) LoadSnapshot(ctx context.Context, vmID string) (*metrics.
 	}()
 
 	if o.GetUPFEnabled() {
-		if activateErr = o.memoryManager.Activate(vmID); activateErr != nil {
+		if activateErr = o.memoryManager.ActivateWithContext(ctx, vmID); activateErr != nil {
 			logger.Warn("Failed to activate VM in the memory manager", activateErr)
 		}
 	}
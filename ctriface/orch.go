@@ -119,7 +119,10 @@ func NewOrchestrator(snapshotter, hostIface string, opts ...OrchestratorOption)
 		managerCfg := manager.MemoryManagerCfg{
 			MetricsModeOn: o.isMetricsMode,
 		}
-		o.memoryManager = manager.NewMemoryManager(managerCfg)
+		o.memoryManager, err = manager.NewMemoryManager(managerCfg)
+		if err != nil {
+			log.Fatal("Failed to create the memory manager", err)
+		}
 	}
 
 	log.Info("Creating containerd client")
@@ -29,6 +29,7 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"strconv"
 	"sync"
@@ -42,6 +43,7 @@ import (
 
 	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 
+	"github.com/ease-lab/vhive/utils/benchmarking/eventing/proto"
 	"github.com/ease-lab/vhive/utils/benchmarking/eventing/vhivemetadata"
 
 	"github.com/ease-lab/vhive/examples/endpoint"
@@ -51,23 +53,53 @@ import (
 const TimeseriesDBAddr = "10.96.0.84:90"
 
 var (
-	completed   int64
-	latSlice    LatencySlice
-	portFlag    *int
-	grpcTimeout time.Duration
-	withTracing *bool
-	workflowIDs map[*endpoint.Endpoint]string
+	completed         int64
+	eventingIssued    int64
+	servingIssued     int64
+	servingFailed     int64
+	failed            int64
+	retriedOK         int64
+	maxRetries        int
+	retryBackoff      time.Duration
+	latSlice          LatencySlice
+	portFlag          *int
+	grpcTimeout       time.Duration
+	experimentTimeout time.Duration
+	invocationsOutput *invocationWriter
+	withTracing       *bool
+	workflowIDs       map[*endpoint.Endpoint]string
 )
 
 func main() {
 	endpointsFile := flag.String("endpointsFile", "endpoints.json", "File with endpoints' metadata")
 	rps := flag.Int("rps", 1, "Target requests per second")
 	runDuration := flag.Int("time", 5, "Run the experiment for X seconds")
+	duration := flag.Duration("duration", 0, "Run the experiment for the duration, overrides -time if set")
+	poisson := flag.Bool("poisson", false, "Issue the requests with Poisson inter-arrival times at the target RPS")
 	latencyOutputFile := flag.String("latf", "lat.csv", "CSV file for the latency measurements in microseconds")
+	flag.IntVar(&maxRetries, "retries", 0, "Re-issue a failed invocation up to X times before counting it as failed")
+	flag.DurationVar(&retryBackoff, "retryBackoff", 100*time.Millisecond, "Backoff before the first retry, doubled for every next one")
+	invocationsFile := flag.String("invf", "", "File for the per-invocation results of the eventing invocations, disabled if empty")
+	invocationsFormat := flag.String("invFormat", "csv", "Format of the per-invocation results file: csv or json")
 	portFlag = flag.Int("port", 80, "The port that functions listen to")
 	withTracing = flag.Bool("trace", false, "Enable tracing in the client")
 	zipkin := flag.String("zipkin", "http://localhost:9411/api/v2/spans", "zipkin url")
 	debug := flag.Bool("dbg", false, "Enable debug logging")
+	maxFailedRatio := flag.Float64("maxFailedRatio", 0.5, "Exit with an error if a larger fraction of the eventing and serving invocations did not complete")
+	percentiles := flag.Bool("percentiles", false, "Print the mean, p50, p90, p99 and max latencies")
+	warmup := flag.Int("warmup", 0, "Issue X warm-up invocations at the target RPS before the measured experiment")
+	experimentName := flag.String("experiment", "invoker", "Name of the experiment that labels the Prometheus results and the metadata of the results")
+	experimentTag := flag.String("tag", "", "Tag of the experiment that is recorded in the metadata of the results")
+	promFile := flag.String("promFile", "", "File for the Prometheus results in the node_exporter textfile format, disabled if empty")
+	pushgateway := flag.String("pushgateway", "", "URL of the Prometheus Pushgateway to push the results to, disabled if empty")
+	warmupDuration := flag.Duration("warmupDuration", 0, "Issue warm-up invocations at the target RPS for the duration, overrides -warmup if set")
+	tsdbCAFile = flag.String("tsdbCA", "", "CA certificate to verify the TimeseriesDB with, enables TLS")
+	tsdbCertFile = flag.String("tsdbCert", "", "Client certificate for mutual TLS with the TimeseriesDB, requires -tsdbCA")
+	tsdbKeyFile = flag.String("tsdbKey", "", "Key of the client certificate for mutual TLS with the TimeseriesDB")
+	tsdbInsecure = flag.Bool("tsdbInsecure", false, "Connect to the TimeseriesDB without TLS if -tsdbCA is not set")
+	persistentTSDB := flag.Bool("tsdbPersistent", false, "Connect to the TimeseriesDB before the warm-up instead of when the experiment starts")
+	flag.DurationVar(&progressInterval, "progressInterval", 0, "Log the rolling latency percentiles of the invocations so far every interval during the experiment, disabled if 0")
+	flag.DurationVar(&experimentTimeout, "experimentTimeout", 30*time.Second, "Timeout for starting and ending the experiment in the TimeseriesDB")
 	grpcTimeout = time.Duration(*flag.Int("grpcTimeout", 30, "Timeout in seconds for gRPC requests")) * time.Second
 
 	flag.Parse()
@@ -104,9 +136,71 @@ func main() {
 		defer shutdown()
 	}
 
-	realRPS := runExperiment(endpoints, *runDuration, *rps)
+	if *duration == 0 {
+		*duration = time.Duration(*runDuration) * time.Second
+	}
+
+	if *invocationsFile != "" {
+		meta := newExperimentMetadata(*experimentName, *experimentTag, endpoints)
+		invocationsOutput, err = newInvocationWriter(*invocationsFile, *invocationsFormat, meta)
+		if err != nil {
+			log.Fatal("Failed to create the invocations file: ", err)
+		}
+	}
+
+	if *persistentTSDB && usesEventing(endpoints) {
+		// the experiment starts without dialing the TimeseriesDB
+		if err := Connect(TimeseriesDBAddr); err != nil {
+			log.Fatal("Failed to connect to the TimeseriesDB: ", err)
+		}
+	}
+
+	if *warmup > 0 || *warmupDuration > 0 {
+		issued, warmupFailed := warmUp(endpoints, *warmup, *warmupDuration, *rps)
+		log.Infof("Warm-up issued / failed requests: %d, %d", issued, warmupFailed)
+	}
+
+	realRPS, statuses := runExperiment(endpoints, *duration, *rps, *poisson)
+	if err := Close(); err != nil {
+		log.Warn("Failed to close the connection to the TimeseriesDB: ", err)
+	}
+
+	if invocationsOutput != nil {
+		if err := invocationsOutput.close(); err != nil {
+			log.Fatal("Failed to write the invocations file: ", err)
+		}
+		log.Info("The per-invocation results are saved in ", *invocationsFile)
+	}
 
 	writeLatencies(realRPS, *latencyOutputFile)
+
+	if *percentiles {
+		printLatencyStats(getDurations())
+		if functions := getFunctionDurations(); len(functions) > 1 {
+			printFunctionLatencyStats(functions)
+		}
+	}
+
+	if *promFile != "" || *pushgateway != "" {
+		results := prometheusResults(*experimentName, getDurations(), getFunctionDurations(), statuses)
+		if *promFile != "" {
+			if err := writePrometheusTextfile(*promFile, results); err != nil {
+				log.Fatal("Failed to write the Prometheus textfile: ", err)
+			}
+			log.Info("The Prometheus results are saved in ", *promFile)
+		}
+		if *pushgateway != "" {
+			if err := pushPrometheusResults(*pushgateway, *experimentName, results); err != nil {
+				log.Fatal("Failed to push the results to the Pushgateway: ", err)
+			}
+			log.Info("The results are pushed to the Pushgateway at ", *pushgateway)
+		}
+	}
+
+	failedRatio := logInvocationStatuses(statuses, atomic.LoadInt64(&servingIssued), atomic.LoadInt64(&servingFailed))
+	if failedRatio > *maxFailedRatio {
+		log.Fatalf("%.2f of the invocations did not complete, the maximum is %.2f", failedRatio, *maxFailedRatio)
+	}
 }
 
 func readEndpoints(path string) (endpoints []*endpoint.Endpoint, _ error) {
@@ -120,13 +214,31 @@ func readEndpoints(path string) (endpoints []*endpoint.Endpoint, _ error) {
 	return
 }
 
-func runExperiment(endpoints []*endpoint.Endpoint, runDuration, targetRPS int) (realRPS float64) {
+// runExperiment issues the requests open-loop, i.e., at the target rate regardless of their
+// latency, for the duration. The inter-arrival times are either fixed or exponentially distributed.
+func runExperiment(endpoints []*endpoint.Endpoint, runDuration time.Duration, targetRPS int, poisson bool) (realRPS float64, statuses map[proto.InvocationStatus]int) {
 	var issued int
 
 	Start(TimeseriesDBAddr, endpoints, workflowIDs)
 
-	timeout := time.After(time.Duration(runDuration) * time.Second)
-	tick := time.Tick(time.Duration(1000/targetRPS) * time.Millisecond)
+	stopProgressReports := func() {}
+	if progressInterval > 0 {
+		stopProgressReports = startProgressReports(progressInterval)
+	}
+
+	interval := time.Second / time.Duration(targetRPS)
+	nextInterval := func() time.Duration {
+		if poisson {
+			return time.Duration(rand.ExpFloat64() * float64(interval))
+		}
+		return interval
+	}
+
+	timeout := time.After(runDuration)
+	// the requests are scheduled at absolute times, so that issuing them does not delay the next ones
+	next := time.Now().Add(nextInterval())
+	tick := time.NewTimer(time.Until(next))
+	defer tick.Stop()
 	var (
 		start time.Time
 		once  sync.Once
@@ -137,12 +249,21 @@ func runExperiment(endpoints []*endpoint.Endpoint, runDuration, targetRPS int) (
 		case <-timeout:
 			duration := time.Since(start).Seconds()
 			realRPS = float64(completed) / duration
-			addDurations(End())
+			stopProgressReports()
+			var durations map[string][]time.Duration
+			durations, statuses = End()
+			addWorkflowDurations(endpoints, durations)
 			log.Infof("Issued / completed requests: %d, %d", issued, completed)
+			if maxRetries > 0 {
+				log.Infof("Failed / succeeded after retries requests: %d, %d", atomic.LoadInt64(&failed), atomic.LoadInt64(&retriedOK))
+			}
 			log.Infof("Real / target RPS: %.2f / %v", realRPS, targetRPS)
 			log.Println("Experiment finished!")
 			return
-		case <-tick:
+		case <-tick.C:
+			next = next.Add(nextInterval())
+			tick.Reset(time.Until(next))
+
 			once.Do(func() {
 				start = time.Now()
 			})
@@ -157,22 +278,58 @@ func runExperiment(endpoints []*endpoint.Endpoint, runDuration, targetRPS int) (
 	}
 }
 
-func SayHello(address, workflowID string) {
+// warmUp issues the warm-up invocations at the target rate, either n of them or as many as fit
+// in the duration if it is set, and waits for them to return. They precede Start(), so that
+// neither the TimeseriesDB nor the invoker's counters and latencies account for them.
+func warmUp(endpoints []*endpoint.Endpoint, n int, duration time.Duration, targetRPS int) (issued int, failures int64) {
+	var wg sync.WaitGroup
+
+	deadline := time.Now().Add(duration)
+	done := func() bool {
+		if duration > 0 {
+			return !time.Now().Before(deadline)
+		}
+		return issued == n
+	}
+
+	tick := time.NewTicker(time.Second / time.Duration(targetRPS))
+	defer tick.Stop()
+
+	for ; !done(); issued++ {
+		ep := endpoints[issued%len(endpoints)]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := SayHello(fmt.Sprintf("%s:%d", ep.Hostname, *portFlag), workflowIDs[ep]); err != nil {
+				log.Debugf("Warm-up invocation of %v failed, err=%v", ep.Hostname, err)
+				atomic.AddInt64(&failures, 1)
+			}
+		}()
+		<-tick.C
+	}
+
+	wg.Wait()
+	return issued, atomic.LoadInt64(&failures)
+}
+
+func SayHello(address, workflowID string) error {
 	dialOptions := []grpc.DialOption{grpc.WithBlock(), grpc.WithInsecure()}
 	if *withTracing {
 		dialOptions = append(dialOptions, grpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor()))
 	}
-	conn, err := grpc.Dial(address, dialOptions...)
+
+	// the timeout bounds both connecting to the function and the request
+	ctx, cancel := context.WithTimeout(context.Background(), grpcTimeout)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, address, dialOptions...)
 	if err != nil {
-		log.Fatalf("did not connect: %v", err)
+		return fmt.Errorf("failed to connect to %v: %w", address, err)
 	}
 	defer conn.Close()
 
 	c := NewGreeterClient(conn)
 
-	ctx, cancel := context.WithTimeout(context.Background(), grpcTimeout)
-	defer cancel()
-
 	_, err = c.SayHello(ctx, &HelloRequest{
 		Name: "faas",
 		VHiveMetadata: vhivemetadata.MakeVHiveMetadata(
@@ -181,8 +338,33 @@ func SayHello(address, workflowID string) {
 			time.Now().UTC(),
 		),
 	})
-	if err != nil {
-		log.Warnf("Failed to invoke %v, err=%v", address, err)
+	return err
+}
+
+// invokeWithRetries invokes the function, re-issuing a failed invocation up to maxRetries times
+// with an exponential backoff, and counts the invocations that failed or only succeeded after a retry.
+// It returns the start time of the last attempt and the error of the invocation if all the attempts failed.
+func invokeWithRetries(address, workflowID string) (start time.Time, err error) {
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		start = time.Now()
+		err = SayHello(address, workflowID)
+		if err == nil {
+			if attempt > 0 {
+				atomic.AddInt64(&retriedOK, 1)
+			}
+			return start, nil
+		}
+
+		if attempt == maxRetries {
+			log.Warnf("Failed to invoke %v, err=%v", address, err)
+			atomic.AddInt64(&failed, 1)
+			return start, err
+		}
+
+		log.Debugf("Retrying to invoke %v in %v, err=%v", address, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
 	}
 }
 
@@ -190,7 +372,8 @@ func invokeEventingFunction(endpoint *endpoint.Endpoint) {
 	address := fmt.Sprintf("%s:%d", endpoint.Hostname, *portFlag)
 	log.Debug("Invoking asynchronously by the address: %v", address)
 
-	SayHello(address, workflowIDs[endpoint])
+	atomic.AddInt64(&eventingIssued, 1)
+	invokeWithRetries(address, workflowIDs[endpoint])
 
 	atomic.AddInt64(&completed, 1)
 
@@ -198,42 +381,87 @@ func invokeEventingFunction(endpoint *endpoint.Endpoint) {
 }
 
 func invokeServingFunction(endpoint *endpoint.Endpoint) {
-	defer getDuration(startMeasurement(endpoint.Hostname)) // measure entire invocation time
-
 	address := fmt.Sprintf("%s:%d", endpoint.Hostname, *portFlag)
 	log.Debug("Invoking by the address: %v", address)
 
-	SayHello(address, workflowIDs[endpoint])
+	atomic.AddInt64(&servingIssued, 1)
+
+	// only the successful attempt is measured, neither the failed attempts and the backoffs
+	// before it nor the invocations that failed altogether
+	if start, err := invokeWithRetries(address, workflowIDs[endpoint]); err == nil {
+		getDuration(endpoint.Hostname, start)
+	} else {
+		atomic.AddInt64(&servingFailed, 1)
+	}
 
 	atomic.AddInt64(&completed, 1)
 
 	return
 }
 
-// LatencySlice is a thread-safe slice to hold a slice of latency measurements.
+// LatencySlice is a thread-safe slice to hold a slice of latency measurements,
+// which are also grouped by the hostname of the invoked function.
 type LatencySlice struct {
 	sync.Mutex
-	slice []int64
-}
-
-func startMeasurement(msg string) (string, time.Time) {
-	return msg, time.Now()
+	slice       []int64
+	perFunction map[string][]int64
 }
 
 func getDuration(msg string, start time.Time) {
 	latency := time.Since(start)
 	log.Debugf("Invoked %v in %v usec\n", msg, latency.Microseconds())
-	addDurations([]time.Duration{latency})
+	addDurations(msg, []time.Duration{latency})
 }
 
-func addDurations(ds []time.Duration) {
+func addDurations(function string, ds []time.Duration) {
 	latSlice.Lock()
+	if latSlice.perFunction == nil {
+		latSlice.perFunction = make(map[string][]int64)
+	}
 	for _, d := range ds {
 		latSlice.slice = append(latSlice.slice, d.Microseconds())
+		latSlice.perFunction[function] = append(latSlice.perFunction[function], d.Microseconds())
 	}
 	latSlice.Unlock()
 }
 
+// addWorkflowDurations adds the durations of the eventing invocations, grouped by the ID of their
+// workflow, to the latency measurements of the functions of the workflows
+func addWorkflowDurations(endpoints []*endpoint.Endpoint, durations map[string][]time.Duration) {
+	for _, ep := range endpoints {
+		addDurations(ep.Hostname, durations[workflowIDs[ep]])
+	}
+}
+
+func getDurations() []time.Duration {
+	latSlice.Lock()
+	defer latSlice.Unlock()
+
+	durations := make([]time.Duration, 0, len(latSlice.slice))
+	for _, lat := range latSlice.slice {
+		durations = append(durations, time.Duration(lat)*time.Microsecond)
+	}
+
+	return durations
+}
+
+// getFunctionDurations returns the latency measurements grouped by the hostname of the invoked function
+func getFunctionDurations() map[string][]time.Duration {
+	latSlice.Lock()
+	defer latSlice.Unlock()
+
+	functions := make(map[string][]time.Duration, len(latSlice.perFunction))
+	for function, lats := range latSlice.perFunction {
+		durations := make([]time.Duration, 0, len(lats))
+		for _, lat := range lats {
+			durations = append(durations, time.Duration(lat)*time.Microsecond)
+		}
+		functions[function] = durations
+	}
+
+	return functions
+}
+
 func writeLatencies(rps float64, latencyOutputFile string) {
 	latSlice.Lock()
 	defer latSlice.Unlock()
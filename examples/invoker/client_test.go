@@ -0,0 +1,709 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/ease-lab/vhive/examples/endpoint"
+	"github.com/ease-lab/vhive/utils/benchmarking/eventing/proto"
+)
+
+// fakeTimeseriesDB counts the experiments and returns result as the results of every one.
+type fakeTimeseriesDB struct {
+	proto.UnimplementedTimeseriesServer
+
+	mu      sync.Mutex
+	started int
+	ended   int
+	result  *proto.ExperimentResult
+}
+
+func (db *fakeTimeseriesDB) StartExperiment(context.Context, *proto.ExperimentDefinition) (*empty.Empty, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.started++
+	return &empty.Empty{}, nil
+}
+
+func (db *fakeTimeseriesDB) EndExperiment(context.Context, *empty.Empty) (*proto.ExperimentResult, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.ended++
+	if db.result == nil {
+		return &proto.ExperimentResult{}, nil
+	}
+	return db.result, nil
+}
+
+// partialTimeseriesDB also reports result as the partial results of the experiment.
+type partialTimeseriesDB struct {
+	fakeTimeseriesDB
+}
+
+func (db *partialTimeseriesDB) GetPartialResults(context.Context, *empty.Empty) (*proto.ExperimentResult, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.result, nil
+}
+
+// countingListener counts the connections to the fake TimeseriesDB.
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return conn, err
+}
+
+// serveTimeseriesDB serves srv on a local port, in plaintext unless opts set the credentials,
+// sets the flags of the invoker to connect to it in plaintext, and returns its address.
+func serveTimeseriesDB(t *testing.T, srv proto.TimeseriesServer, opts ...grpc.ServerOption) (string, *countingListener) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "Failed to listen")
+	counting := &countingListener{Listener: lis}
+
+	grpcServer := grpc.NewServer(opts...)
+	proto.RegisterTimeseriesServer(grpcServer, srv)
+	go grpcServer.Serve(counting)
+	t.Cleanup(grpcServer.Stop)
+
+	setTimeseriesDBFlags("", "", "", true)
+	withTracing = new(bool)
+	experimentTimeout = 5 * time.Second
+
+	return lis.Addr().String(), counting
+}
+
+func setTimeseriesDBFlags(caFile, certFile, keyFile string, insecure bool) {
+	tsdbCAFile, tsdbCertFile, tsdbKeyFile, tsdbInsecure = &caFile, &certFile, &keyFile, &insecure
+}
+
+func eventingEndpoint() ([]*endpoint.Endpoint, map[*endpoint.Endpoint]string) {
+	ep := &endpoint.Endpoint{
+		Hostname: "producer",
+		Eventing: true,
+		Matchers: map[string]string{"type": "greeting", "source": "consumer"},
+	}
+	return []*endpoint.Endpoint{ep}, map[*endpoint.Endpoint]string{ep: "wfid"}
+}
+
+func TestPersistentConnection(t *testing.T) {
+	db := &fakeTimeseriesDB{}
+	addr, lis := serveTimeseriesDB(t, db)
+	endpoints, ids := eventingEndpoint()
+
+	require.NoError(t, Connect(addr), "Failed to connect")
+	require.Error(t, Connect(addr), "Connected twice")
+
+	for i := 0; i < 3; i++ {
+		Start(addr, endpoints, ids)
+		require.Error(t, Close(), "Closed the connection during an experiment")
+		End()
+	}
+	require.NoError(t, Close(), "Failed to close the connection")
+	require.Nil(t, tsdbConn, "Close left the connection set")
+
+	db.mu.Lock()
+	require.Equal(t, 3, db.started)
+	require.Equal(t, 3, db.ended)
+	db.mu.Unlock()
+	require.EqualValues(t, 1, atomic.LoadInt32(&lis.accepted), "The experiments did not reuse the connection")
+
+	// Without Connect, every experiment dials its own connection.
+	for i := 0; i < 2; i++ {
+		Start(addr, endpoints, ids)
+		End()
+	}
+	require.Nil(t, tsdbConn, "End left the connection of the experiment open")
+	require.EqualValues(t, 3, atomic.LoadInt32(&lis.accepted))
+	require.NoError(t, Close(), "Close without Connect failed")
+}
+
+func TestStartWithTracing(t *testing.T) {
+	db := &fakeTimeseriesDB{}
+	addr, lis := serveTimeseriesDB(t, db)
+	endpoints, ids := eventingEndpoint()
+
+	// the tracing interceptor is added to the blocking dial, which connects before the first request
+	*withTracing = true
+	t.Cleanup(func() { *withTracing = false })
+
+	Start(addr, endpoints, ids)
+	db.mu.Lock()
+	require.Equal(t, 1, db.started, "The experiment did not start on the first request")
+	db.mu.Unlock()
+
+	End()
+	db.mu.Lock()
+	require.Equal(t, 1, db.ended)
+	db.mu.Unlock()
+	require.EqualValues(t, 1, atomic.LoadInt32(&lis.accepted), "The experiment did not use a single connection")
+}
+
+func TestComputeLatencyStats(t *testing.T) {
+	_, ok := computeLatencyStats(nil)
+	require.False(t, ok, "Summarized no durations")
+
+	// 100ms, 99ms, ..., 1ms
+	durations := make([]time.Duration, 100)
+	for i := range durations {
+		durations[i] = time.Duration(100-i) * time.Millisecond
+	}
+
+	stats, ok := computeLatencyStats(durations)
+	require.True(t, ok)
+	require.Equal(t, LatencyStats{
+		Count: 100,
+		Mean:  50500 * time.Microsecond,
+		P50:   50 * time.Millisecond,
+		P90:   90 * time.Millisecond,
+		P99:   99 * time.Millisecond,
+		Max:   100 * time.Millisecond,
+	}, stats)
+	require.Equal(t, 100*time.Millisecond, durations[0], "Sorted the durations in place")
+
+	stats, ok = computeLatencyStats([]time.Duration{time.Second})
+	require.True(t, ok)
+	require.Equal(t, LatencyStats{Count: 1, Mean: time.Second, P50: time.Second, P90: time.Second, P99: time.Second, Max: time.Second}, stats)
+}
+
+func TestLogInvocationStatuses(t *testing.T) {
+	require.Zero(t, logInvocationStatuses(nil, 0, 0), "No invocations failed")
+	require.Zero(t, logInvocationStatuses(map[proto.InvocationStatus]int{proto.InvocationStatus_COMPLETED: 4}, 0, 0))
+	require.Equal(t, 0.25, logInvocationStatuses(map[proto.InvocationStatus]int{
+		proto.InvocationStatus_COMPLETED: 3,
+		proto.InvocationStatus_CANCELLED: 1,
+	}, 0, 0))
+	require.Equal(t, 1.0, logInvocationStatuses(map[proto.InvocationStatus]int{proto.InvocationStatus_CANCELLED: 2}, 0, 0))
+
+	// the failed serving invocations count as well, so that only serving functions can fail the experiment
+	require.Equal(t, 0.75, logInvocationStatuses(nil, 4, 3), "Failed serving invocations are not counted")
+	require.Equal(t, 0.5, logInvocationStatuses(map[proto.InvocationStatus]int{
+		proto.InvocationStatus_COMPLETED: 1,
+		proto.InvocationStatus_NULL:      1,
+	}, 2, 1))
+}
+
+func TestEndStatuses(t *testing.T) {
+	invokedOn := time.Now()
+	db := &fakeTimeseriesDB{}
+	db.result = &proto.ExperimentResult{WorkflowResults: map[string]*proto.WorkflowResult{
+		"wfid": {Invocations: append(testInvocations(invokedOn),
+			&proto.InvocationDescriptor{Id: "C", InvokedOn: timestamppb.New(invokedOn), Status: proto.InvocationStatus_NULL},
+			&proto.InvocationDescriptor{
+				Id:        "D",
+				InvokedOn: timestamppb.New(invokedOn),
+				Duration:  durationpb.New(2 * time.Millisecond),
+				Status:    proto.InvocationStatus_COMPLETED,
+			},
+		)},
+	}}
+	addr, _ := serveTimeseriesDB(t, db)
+	endpoints, ids := eventingEndpoint()
+
+	Start(addr, endpoints, ids)
+	durations, statuses := End()
+
+	require.Equal(t, map[proto.InvocationStatus]int{
+		proto.InvocationStatus_COMPLETED: 2,
+		proto.InvocationStatus_CANCELLED: 1,
+		proto.InvocationStatus_NULL:      1,
+	}, statuses, "Wrong number of invocations per status")
+	require.Equal(t, map[string][]time.Duration{
+		"wfid": {1500 * time.Microsecond, 2 * time.Millisecond},
+	}, durations, "Only the durations of the completed invocations must be returned")
+}
+
+func testInvocations(invokedOn time.Time) []*proto.InvocationDescriptor {
+	return []*proto.InvocationDescriptor{
+		{
+			Id:        "A",
+			InvokedOn: timestamppb.New(invokedOn),
+			Duration:  durationpb.New(1500 * time.Microsecond),
+			Status:    proto.InvocationStatus_COMPLETED,
+		},
+		{
+			Id:        "B",
+			InvokedOn: timestamppb.New(invokedOn),
+			Status:    proto.InvocationStatus_CANCELLED,
+		},
+	}
+}
+
+func TestInvocationWriter(t *testing.T) {
+	invokedOn := time.Date(2021, 7, 1, 10, 0, 0, 0, time.UTC)
+	completedOn := invokedOn.Add(1500 * time.Microsecond).Format(time.RFC3339Nano)
+	meta := experimentMetadata{Experiment: "exp", StartedOn: invokedOn.Format(time.RFC3339Nano), Functions: []string{"producer"}}
+
+	_, err := newInvocationWriter(filepath.Join(t.TempDir(), "inv.xml"), "xml", meta)
+	require.Error(t, err, "Accepted an unsupported format")
+
+	t.Run("CSV", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "inv.csv")
+		w, err := newInvocationWriter(path, "csv", meta)
+		require.NoError(t, err, "Failed to create the writer")
+		for _, inv := range testInvocations(invokedOn) {
+			require.NoError(t, w.write("wfid", inv), "Failed to write an invocation")
+		}
+		require.NoError(t, w.close(), "Failed to close the writer")
+
+		file, err := os.Open(path)
+		require.NoError(t, err)
+		defer file.Close()
+
+		reader := bufio.NewReader(file)
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		require.True(t, strings.HasPrefix(line, "# "), "The file does not start with the metadata")
+		var readMeta experimentMetadata
+		require.NoError(t, json.Unmarshal([]byte(line[2:]), &readMeta), "Failed to parse the metadata")
+		require.Equal(t, meta, readMeta)
+
+		records, err := csv.NewReader(reader).ReadAll()
+		require.NoError(t, err, "Failed to parse the CSV")
+		require.Equal(t, [][]string{
+			{"workflow_id", "id", "status", "invoked_on", "duration_us", "completed_on"},
+			{"wfid", "A", "COMPLETED", invokedOn.Format(time.RFC3339Nano), "1500", completedOn},
+			{"wfid", "B", "CANCELLED", invokedOn.Format(time.RFC3339Nano), "0", ""},
+		}, records)
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "inv.json")
+		w, err := newInvocationWriter(path, "json", meta)
+		require.NoError(t, err, "Failed to create the writer")
+		for _, inv := range testInvocations(invokedOn) {
+			require.NoError(t, w.write("wfid", inv), "Failed to write an invocation")
+		}
+		require.NoError(t, w.close(), "Failed to close the writer")
+
+		file, err := os.Open(path)
+		require.NoError(t, err)
+		defer file.Close()
+
+		dec := json.NewDecoder(file)
+		var header struct {
+			Metadata experimentMetadata `json:"metadata"`
+		}
+		require.NoError(t, dec.Decode(&header), "Failed to parse the metadata")
+		require.Equal(t, meta, header.Metadata)
+
+		var results []invocationResult
+		for dec.More() {
+			var res invocationResult
+			require.NoError(t, dec.Decode(&res), "Failed to parse an invocation")
+			results = append(results, res)
+		}
+		require.Equal(t, []invocationResult{
+			{WorkflowID: "wfid", ID: "A", Status: "COMPLETED", InvokedOn: invokedOn.Format(time.RFC3339Nano), DurationUs: 1500, CompletedOn: completedOn},
+			{WorkflowID: "wfid", ID: "B", Status: "CANCELLED", InvokedOn: invokedOn.Format(time.RFC3339Nano)},
+		}, results)
+	})
+}
+
+func TestPrometheusResults(t *testing.T) {
+	results := prometheusResults("exp",
+		[]time.Duration{time.Second, 2 * time.Second},
+		map[string][]time.Duration{
+			"producer": {2 * time.Second},
+			"consumer": {time.Second},
+			"idle":     nil,
+		},
+		map[proto.InvocationStatus]int{
+			proto.InvocationStatus_CANCELLED: 1,
+			proto.InvocationStatus_COMPLETED: 2,
+		})
+
+	require.Equal(t, `# HELP invoker_latency_seconds Latency of the completed invocations.
+# TYPE invoker_latency_seconds summary
+invoker_latency_seconds{experiment="exp",function="all",quantile="0.5"} 1
+invoker_latency_seconds{experiment="exp",function="all",quantile="0.9"} 2
+invoker_latency_seconds{experiment="exp",function="all",quantile="0.99"} 2
+invoker_latency_seconds{experiment="exp",function="all",quantile="1"} 2
+invoker_latency_seconds_sum{experiment="exp",function="all"} 3
+invoker_latency_seconds_count{experiment="exp",function="all"} 2
+invoker_latency_seconds{experiment="exp",function="consumer",quantile="0.5"} 1
+invoker_latency_seconds{experiment="exp",function="consumer",quantile="0.9"} 1
+invoker_latency_seconds{experiment="exp",function="consumer",quantile="0.99"} 1
+invoker_latency_seconds{experiment="exp",function="consumer",quantile="1"} 1
+invoker_latency_seconds_sum{experiment="exp",function="consumer"} 1
+invoker_latency_seconds_count{experiment="exp",function="consumer"} 1
+invoker_latency_seconds{experiment="exp",function="producer",quantile="0.5"} 2
+invoker_latency_seconds{experiment="exp",function="producer",quantile="0.9"} 2
+invoker_latency_seconds{experiment="exp",function="producer",quantile="0.99"} 2
+invoker_latency_seconds{experiment="exp",function="producer",quantile="1"} 2
+invoker_latency_seconds_sum{experiment="exp",function="producer"} 2
+invoker_latency_seconds_count{experiment="exp",function="producer"} 1
+# HELP invoker_eventing_invocations Eventing invocations returned by the TimeseriesDB per status.
+# TYPE invoker_eventing_invocations gauge
+invoker_eventing_invocations{experiment="exp",status="COMPLETED"} 2
+invoker_eventing_invocations{experiment="exp",status="CANCELLED"} 1
+`, string(results))
+
+	path := filepath.Join(t.TempDir(), "invoker.prom")
+	require.NoError(t, writePrometheusTextfile(path, results), "Failed to write the textfile")
+	written, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, results, written)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0644), info.Mode().Perm())
+
+	var pushed []byte
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.URL.Path != "/metrics/job/invoker/experiment/exp" {
+			http.Error(w, "unexpected push "+r.Method+" "+r.URL.Path, http.StatusBadRequest)
+			return
+		}
+		pushed, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer gateway.Close()
+
+	require.NoError(t, pushPrometheusResults(gateway.URL+"/", "exp", results), "Failed to push the results")
+	require.Equal(t, results, pushed)
+	require.Error(t, pushPrometheusResults(gateway.URL+"/prefix", "exp", results), "Ignored the error of the Pushgateway")
+}
+
+// writeTestCertificate writes a self-signed certificate of 127.0.0.1 and its key to dir,
+// serving both as the CA and as the certificate of the server and the client.
+func writeTestCertificate(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "timeseriesdb"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+func TestTimeseriesDBCredentials(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir)
+	emptyFile := filepath.Join(dir, "empty.pem")
+	require.NoError(t, ioutil.WriteFile(emptyFile, nil, 0644))
+
+	for _, tc := range []struct {
+		name                      string
+		caFile, certFile, keyFile string
+		insecure                  bool
+		ok                        bool
+	}{
+		{name: "NoTLS", insecure: false},
+		{name: "Insecure", insecure: true, ok: true},
+		{name: "CertWithoutCA", certFile: certFile, keyFile: keyFile, insecure: true},
+		{name: "KeyWithoutCA", keyFile: keyFile, insecure: true},
+		{name: "MissingCA", caFile: filepath.Join(dir, "missing.pem")},
+		{name: "EmptyCA", caFile: emptyFile},
+		{name: "CertWithoutKey", caFile: certFile, certFile: certFile},
+		{name: "TLS", caFile: certFile, ok: true},
+		{name: "MutualTLS", caFile: certFile, certFile: certFile, keyFile: keyFile, ok: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setTimeseriesDBFlags(tc.caFile, tc.certFile, tc.keyFile, tc.insecure)
+			creds, err := timeseriesDBCredentials()
+			if !tc.ok {
+				require.Error(t, err, "Accepted invalid flags")
+				return
+			}
+			require.NoError(t, err, "Rejected valid flags")
+			require.NotNil(t, creds)
+		})
+	}
+
+	// Run an experiment over mutual TLS verified against the CA file.
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	caPEM, err := ioutil.ReadFile(certFile)
+	require.NoError(t, err)
+	require.True(t, roots.AppendCertsFromPEM(caPEM))
+	serverCreds := credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    roots,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+
+	db := &fakeTimeseriesDB{}
+	addr, _ := serveTimeseriesDB(t, db, grpc.Creds(serverCreds))
+	setTimeseriesDBFlags(certFile, certFile, keyFile, false)
+
+	endpoints, ids := eventingEndpoint()
+	Start(addr, endpoints, ids)
+	End()
+
+	db.mu.Lock()
+	require.Equal(t, 1, db.started)
+	require.Equal(t, 1, db.ended)
+	db.mu.Unlock()
+}
+
+func TestNewExperimentMetadata(t *testing.T) {
+	defer func(commit string) { gitCommit = commit }(gitCommit)
+	gitCommit = "1e364449"
+
+	before := time.Now()
+	meta := newExperimentMetadata("exp", "tag", []*endpoint.Endpoint{{Hostname: "producer"}, {Hostname: "consumer"}})
+
+	require.Equal(t, "exp", meta.Experiment)
+	require.Equal(t, "tag", meta.Tag)
+	require.Equal(t, "1e364449", meta.Commit)
+	require.Equal(t, []string{"consumer", "producer"}, meta.Functions)
+
+	startedOn, err := time.Parse(time.RFC3339Nano, meta.StartedOn)
+	require.NoError(t, err, "Failed to parse the start time")
+	require.False(t, startedOn.Before(before.Truncate(time.Second)), "The start time precedes the experiment")
+
+	// The flags of the test binary stand in for the flags of the invoker.
+	var flags int
+	flag.VisitAll(func(f *flag.Flag) {
+		flags++
+		require.Equal(t, f.Value.String(), meta.Flags[f.Name], "The metadata misses the value of -"+f.Name)
+	})
+	require.Len(t, meta.Flags, flags)
+}
+
+// dialBufconn serves srv in memory and returns a connection to it.
+func dialBufconn(t *testing.T, srv proto.TimeseriesServer) *grpc.ClientConn {
+	lis := bufconn.Listen(1 << 20)
+	grpcServer := grpc.NewServer()
+	proto.RegisterTimeseriesServer(grpcServer, srv)
+	go grpcServer.Serve(lis)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.Dial("bufnet", grpc.WithInsecure(),
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }))
+	require.NoError(t, err, "Failed to dial the in-memory TimeseriesDB")
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// startExperimentOn makes conn the connection of a running experiment for the duration of the test.
+func startExperimentOn(t *testing.T, conn *grpc.ClientConn) {
+	experimentTimeout = 5 * time.Second
+
+	lock.Lock()
+	tsdbClient, started = proto.NewTimeseriesClient(conn), true
+	lock.Unlock()
+
+	t.Cleanup(func() {
+		lock.Lock()
+		tsdbClient, started = nil, false
+		lock.Unlock()
+	})
+}
+
+func TestWorkflowDurations(t *testing.T) {
+	invokedOn := time.Now()
+	completed := func(id string, d time.Duration) *proto.InvocationDescriptor {
+		return &proto.InvocationDescriptor{
+			Id:        id,
+			InvokedOn: timestamppb.New(invokedOn),
+			Duration:  durationpb.New(d),
+			Status:    proto.InvocationStatus_COMPLETED,
+		}
+	}
+
+	db := &fakeTimeseriesDB{}
+	db.result = &proto.ExperimentResult{WorkflowResults: map[string]*proto.WorkflowResult{
+		"wf1": {Invocations: []*proto.InvocationDescriptor{completed("A", time.Millisecond), completed("B", 3*time.Millisecond)}},
+		"wf2": {Invocations: []*proto.InvocationDescriptor{completed("C", 2*time.Millisecond)}},
+	}}
+	addr, _ := serveTimeseriesDB(t, db)
+
+	producer := &endpoint.Endpoint{Hostname: "producer", Eventing: true}
+	chained := &endpoint.Endpoint{Hostname: "chained", Eventing: true}
+	endpoints := []*endpoint.Endpoint{producer, chained}
+	workflowIDs = map[*endpoint.Endpoint]string{producer: "wf1", chained: "wf2"}
+	latSlice = LatencySlice{}
+
+	Start(addr, endpoints, workflowIDs)
+	durations, _ := End()
+	require.Equal(t, map[string][]time.Duration{
+		"wf1": {time.Millisecond, 3 * time.Millisecond},
+		"wf2": {2 * time.Millisecond},
+	}, durations, "The durations are not grouped by workflow")
+
+	addWorkflowDurations(endpoints, durations)
+	require.Equal(t, map[string][]time.Duration{
+		"producer": {time.Millisecond, 3 * time.Millisecond},
+		"chained":  {2 * time.Millisecond},
+	}, getFunctionDurations(), "The durations are not grouped by the hostname of the function")
+	require.Len(t, getDurations(), 3)
+}
+
+func TestPartialResults(t *testing.T) {
+	durations, err := PartialResults()
+	require.NoError(t, err, "Polled without an experiment")
+	require.Empty(t, durations)
+
+	t.Run("Unsupported", func(t *testing.T) {
+		startExperimentOn(t, dialBufconn(t, &fakeTimeseriesDB{}))
+
+		_, err := PartialResults()
+		require.True(t, errors.Is(err, errPartialResultsUnsupported), "Unimplemented is not reported as unsupported")
+	})
+
+	t.Run("Supported", func(t *testing.T) {
+		db := &partialTimeseriesDB{}
+		db.result = &proto.ExperimentResult{WorkflowResults: map[string]*proto.WorkflowResult{
+			"wfid": {Invocations: testInvocations(time.Now())},
+		}}
+		startExperimentOn(t, dialBufconn(t, db))
+
+		durations, err := PartialResults()
+		require.NoError(t, err, "Failed to poll the partial results")
+		require.Equal(t, []time.Duration{1500 * time.Microsecond}, durations, "Incomplete invocations are reported")
+	})
+}
+
+// flakyGreeter fails the invocations until it has failed failures of them.
+type flakyGreeter struct {
+	UnimplementedGreeterServer
+
+	failures int32
+	calls    int32
+}
+
+func (g *flakyGreeter) SayHello(context.Context, *HelloRequest) (*HelloReply, error) {
+	if atomic.AddInt32(&g.calls, 1) <= atomic.LoadInt32(&g.failures) {
+		return nil, status.Error(codes.Unavailable, "function is not ready")
+	}
+	return &HelloReply{Message: "Hello faas"}, nil
+}
+
+// serveGreeter serves srv on a local port, sets the port flag of the invoker to it,
+// and returns the endpoint of the function.
+func serveGreeter(t *testing.T, srv GreeterServer) *endpoint.Endpoint {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "Failed to listen")
+
+	grpcServer := grpc.NewServer()
+	RegisterGreeterServer(grpcServer, srv)
+	go grpcServer.Serve(lis)
+	t.Cleanup(grpcServer.Stop)
+
+	port := lis.Addr().(*net.TCPAddr).Port
+	portFlag = &port
+
+	return &endpoint.Endpoint{Hostname: "127.0.0.1"}
+}
+
+func TestInvokeWithRetries(t *testing.T) {
+	greeter := &flakyGreeter{failures: 2}
+	ep := serveGreeter(t, greeter)
+
+	withTracing = new(bool)
+	grpcTimeout = 5 * time.Second
+	maxRetries, retryBackoff = 2, 200*time.Millisecond
+	latSlice = LatencySlice{}
+	atomic.StoreInt64(&failed, 0)
+	atomic.StoreInt64(&retriedOK, 0)
+
+	invokeServingFunction(ep)
+	require.EqualValues(t, 3, atomic.LoadInt32(&greeter.calls), "Failed attempts are not retried")
+	require.EqualValues(t, 1, atomic.LoadInt64(&retriedOK), "Invocation is not counted as succeeded after retries")
+	require.Zero(t, atomic.LoadInt64(&failed), "Invocation is counted as failed")
+
+	durations := getFunctionDurations()[ep.Hostname]
+	require.Len(t, durations, 1, "Successful invocation is not measured")
+	require.True(t, durations[0] < retryBackoff, "Failed attempts and backoffs are measured")
+
+	atomic.StoreInt32(&greeter.calls, 0)
+	atomic.StoreInt32(&greeter.failures, 3)
+	invokeServingFunction(ep)
+	require.EqualValues(t, 3, atomic.LoadInt32(&greeter.calls), "Invocation is retried more than -retries times")
+	require.EqualValues(t, 1, atomic.LoadInt64(&failed), "Invocation is not counted as failed")
+	require.Len(t, getDurations(), 1, "Failed invocation is measured")
+}
+
+func TestSayHelloDialFailure(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "Failed to listen")
+	address := lis.Addr().String()
+	require.NoError(t, lis.Close(), "Failed to close the listener")
+
+	withTracing = new(bool)
+	grpcTimeout = 100 * time.Millisecond
+
+	// the invoker keeps running, so that the invocation can be retried
+	require.Error(t, SayHello(address, "wfid"), "Connecting to a function that does not listen succeeded")
+}
@@ -0,0 +1,144 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/ease-lab/vhive/utils/benchmarking/eventing/proto"
+)
+
+// invocationResult is a per-invocation record written by invocationWriter.
+type invocationResult struct {
+	WorkflowID  string `json:"workflowId"`
+	ID          string `json:"id"`
+	Status      string `json:"status"`
+	InvokedOn   string `json:"invokedOn,omitempty"`
+	DurationUs  int64  `json:"durationUs"`
+	CompletedOn string `json:"completedOn,omitempty"`
+}
+
+// invocationWriter streams the per-invocation results to a file, either as CSV
+// or as JSON with one object per line. The file starts with the metadata of the
+// experiment: a comment line with the metadata as JSON for CSV, which readers skip
+// with csv.Reader.Comment set to '#', or an object with the metadata field for JSON.
+type invocationWriter struct {
+	file    *os.File
+	buf     *bufio.Writer
+	csvEnc  *csv.Writer
+	jsonEnc *json.Encoder
+}
+
+// newInvocationWriter creates the file at the path and writes the metadata, followed by
+// the header if the format is CSV.
+func newInvocationWriter(path, format string, meta experimentMetadata) (*invocationWriter, error) {
+	if format != "csv" && format != "json" {
+		return nil, fmt.Errorf("unsupported invocations file format: %s", format)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &invocationWriter{file: file, buf: bufio.NewWriter(file)}
+	if format == "json" {
+		w.jsonEnc = json.NewEncoder(w.buf)
+		if err := w.jsonEnc.Encode(struct {
+			Metadata experimentMetadata `json:"metadata"`
+		}{meta}); err != nil {
+			file.Close()
+			return nil, err
+		}
+		return w, nil
+	}
+
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(w.buf, "# %s\n", metaJSON); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	w.csvEnc = csv.NewWriter(w.buf)
+	header := []string{"workflow_id", "id", "status", "invoked_on", "duration_us", "completed_on"}
+	if err := w.csvEnc.Write(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *invocationWriter) write(workflowID string, inv *proto.InvocationDescriptor) error {
+	res := invocationResult{
+		WorkflowID: workflowID,
+		ID:         inv.Id,
+		Status:     inv.Status.String(),
+		DurationUs: inv.Duration.AsDuration().Microseconds(),
+	}
+	if inv.InvokedOn != nil {
+		invokedOn := inv.InvokedOn.AsTime()
+		res.InvokedOn = invokedOn.Format(time.RFC3339Nano)
+		// The duration spans until the last completion event arrived
+		if inv.Status == proto.InvocationStatus_COMPLETED {
+			res.CompletedOn = invokedOn.Add(inv.Duration.AsDuration()).Format(time.RFC3339Nano)
+		}
+	}
+
+	if w.jsonEnc != nil {
+		return w.jsonEnc.Encode(&res)
+	}
+	return w.csvEnc.Write([]string{
+		res.WorkflowID,
+		res.ID,
+		res.Status,
+		res.InvokedOn,
+		strconv.FormatInt(res.DurationUs, 10),
+		res.CompletedOn,
+	})
+}
+
+// close flushes the buffered results and closes the file.
+func (w *invocationWriter) close() error {
+	if w.csvEnc != nil {
+		w.csvEnc.Flush()
+		if err := w.csvEnc.Error(); err != nil {
+			w.file.Close()
+			return err
+		}
+	}
+	if err := w.buf.Flush(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
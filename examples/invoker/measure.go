@@ -2,39 +2,140 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/protobuf/ptypes/empty"
 	log "github.com/sirupsen/logrus"
 	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 
 	"github.com/ease-lab/vhive/utils/benchmarking/eventing/proto"
 
 	"github.com/ease-lab/vhive/examples/endpoint"
 )
 
+// The connection to the TimeseriesDB is either per experiment, i.e., dialed by Start and closed
+// by End, or persistent, i.e., dialed by Connect, reused by any number of Start/End cycles,
+// and closed by Close.
 var (
-	tsdbConn   *grpc.ClientConn
-	tsdbClient proto.TimeseriesClient
-	lock       sync.Mutex
+	tsdbConn       *grpc.ClientConn
+	tsdbClient     proto.TimeseriesClient
+	lock           sync.Mutex
+	tsdbPersistent bool
+	started        bool
 )
 
+// Connect dials a persistent connection to the TimeseriesDB that the following experiments reuse,
+// it is called by main if -tsdbPersistent is set.
+func Connect(tdbAddr string) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if tsdbConn != nil {
+		return errors.New("already connected to the TimeseriesDB")
+	}
+
+	conn, err := dialTimeseriesDB(tdbAddr)
+	if err != nil {
+		return err
+	}
+	tsdbConn, tsdbClient, tsdbPersistent = conn, proto.NewTimeseriesClient(conn), true
+	return nil
+}
+
+// Close closes the persistent connection to the TimeseriesDB, it must not be called
+// while an experiment is running.
+func Close() error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if started {
+		return errors.New("cannot close the connection to the TimeseriesDB during an experiment")
+	}
+	if !tsdbPersistent {
+		return nil
+	}
+
+	err := tsdbConn.Close()
+	tsdbConn, tsdbClient, tsdbPersistent = nil, nil, false
+	return err
+}
+
+// TLS settings of the connection to the TimeseriesDB, set by the flags
+var (
+	tsdbCAFile   *string
+	tsdbCertFile *string
+	tsdbKeyFile  *string
+	tsdbInsecure *bool
+)
+
+// timeseriesDBCredentials returns the transport credentials of the connection to the TimeseriesDB:
+// TLS verified against the CA certificate, mutual if a client certificate is given, or plaintext
+// only if explicitly requested
+func timeseriesDBCredentials() (grpc.DialOption, error) {
+	if *tsdbCAFile == "" {
+		if *tsdbCertFile != "" || *tsdbKeyFile != "" {
+			return nil, errors.New("the client certificate of the TimeseriesDB requires -tsdbCA")
+		}
+		if !*tsdbInsecure {
+			return nil, errors.New("set -tsdbCA to connect to the TimeseriesDB with TLS, or -tsdbInsecure to connect without")
+		}
+		return grpc.WithInsecure(), nil
+	}
+
+	caPEM, err := ioutil.ReadFile(*tsdbCAFile)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in %s", *tsdbCAFile)
+	}
+	config := &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+
+	if *tsdbCertFile != "" || *tsdbKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(*tsdbCertFile, *tsdbKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return grpc.WithTransportCredentials(credentials.NewTLS(config)), nil
+}
+
+func dialTimeseriesDB(tdbAddr string) (*grpc.ClientConn, error) {
+	creds, err := timeseriesDBCredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	// the tracing interceptor is independent of the transport credentials
+	dialOptions := []grpc.DialOption{grpc.WithBlock(), creds}
+	if *withTracing {
+		dialOptions = append(dialOptions, grpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor()))
+	}
+	return grpc.Dial(tdbAddr, dialOptions...)
+}
+
+// Start starts the experiment in the TimeseriesDB, dialing it unless connected by Connect.
 func Start(tdbAddr string, endpoints []*endpoint.Endpoint, workflowIDs map[*endpoint.Endpoint]string) {
 	lock.Lock()
 	defer lock.Unlock()
 
 	// Start the TimeseriesDB only if there exist at least one endpoint
 	// that uses eventing
-	enable := false
-	for _, endpoint := range endpoints {
-		if endpoint.Eventing {
-			enable = true
-			break
-		}
-	}
-	if !enable {
+	if !usesEventing(endpoints) {
 		return
 	}
 
@@ -52,51 +153,103 @@ func Start(tdbAddr string, endpoints []*endpoint.Endpoint, workflowIDs map[*endp
 		}
 	}
 
-	dialOptions := []grpc.DialOption{grpc.WithBlock(), grpc.WithInsecure()}
-	if *withTracing {
-		dialOptions = append(dialOptions, grpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor()))
-	}
-	var err error
-	tsdbConn, err = grpc.Dial(tdbAddr, dialOptions...)
-	if err != nil {
-		log.Fatalf("did not connect: %v", err)
+	if !tsdbPersistent {
+		conn, err := dialTimeseriesDB(tdbAddr)
+		if err != nil {
+			log.Fatalf("did not connect: %v", err)
+		}
+		tsdbConn, tsdbClient = conn, proto.NewTimeseriesClient(conn)
 	}
 
-	tsdbClient = proto.NewTimeseriesClient(tsdbConn)
-	ctx, cancel := context.WithTimeout(context.Background(), grpcTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), experimentTimeout)
 	defer cancel()
 
 	if _, err := tsdbClient.StartExperiment(ctx, &proto.ExperimentDefinition{WorkflowDefinitions: workflowDefinitions}); err != nil {
 		log.Fatalln("failed to start experiment", err)
 	}
+	started = true
 }
 
-func End() (durations []time.Duration) {
+// usesEventing returns true if any of the endpoints uses eventing, and thus the TimeseriesDB.
+func usesEventing(endpoints []*endpoint.Endpoint) bool {
+	for _, endpoint := range endpoints {
+		if endpoint.Eventing {
+			return true
+		}
+	}
+	return false
+}
+
+// End ends the experiment and returns the durations of the completed invocations grouped by
+// the ID of their workflow, along with the number of the invocations per status
+func End() (durations map[string][]time.Duration, statuses map[proto.InvocationStatus]int) {
 	lock.Lock()
 	defer lock.Unlock()
 
 	// TimeseriesDB is started only if there existed at least one endpoint
-	// that used eventing; tsdbConn is nil if not started.
-	if tsdbConn == nil {
+	// that used eventing.
+	if !started {
 		return
 	}
+	started = false
 
-	defer tsdbConn.Close()
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	if !tsdbPersistent {
+		defer func() {
+			tsdbConn.Close()
+			tsdbConn, tsdbClient = nil, nil
+		}()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), experimentTimeout)
 	defer cancel()
 	res, err := tsdbClient.EndExperiment(ctx, &empty.Empty{})
+	if status.Code(err) == codes.DeadlineExceeded {
+		log.Fatalf("failed to end experiment in %v: expected %d invocations, received none (consider increasing -experimentTimeout)",
+			experimentTimeout, atomic.LoadInt64(&eventingIssued))
+	}
 	if err != nil {
 		log.Fatalln("failed to end experiment", err)
 	}
 
-	for _, wrk := range res.WorkflowResults {
+	var received int
+	durations = make(map[string][]time.Duration)
+	statuses = make(map[proto.InvocationStatus]int)
+	for workflowID, wrk := range res.WorkflowResults {
+		received += len(wrk.Invocations)
 		for _, inv := range wrk.Invocations {
+			statuses[inv.Status]++
+			if invocationsOutput != nil {
+				if err := invocationsOutput.write(workflowID, inv); err != nil {
+					log.Fatalln("failed to write the invocation results", err)
+				}
+			}
 			// Skip incomplete invocations
 			if inv.Status != proto.InvocationStatus_COMPLETED {
 				continue
 			}
-			durations = append(durations, inv.Duration.AsDuration())
+			durations[workflowID] = append(durations[workflowID], inv.Duration.AsDuration())
 		}
 	}
+	if expected := atomic.LoadInt64(&eventingIssued); int64(received) < expected {
+		log.Warnf("TimeseriesDB returned fewer invocations than expected: expected %d, received %d", expected, received)
+	}
 	return
 }
+
+// logInvocationStatuses prints the number of eventing invocations per status and of the serving
+// invocations that failed, and returns the fraction of all the invocations that did not complete.
+func logInvocationStatuses(statuses map[proto.InvocationStatus]int, servingIssued, servingFailed int64) (failedRatio float64) {
+	var total int
+	for invStatus, count := range statuses {
+		log.Infof("Invocations with status %s: %d", invStatus, count)
+		total += count
+	}
+	if servingIssued > 0 {
+		log.Infof("Serving invocations issued / failed: %d, %d", servingIssued, servingFailed)
+	}
+
+	incomplete := total - statuses[proto.InvocationStatus_COMPLETED] + int(servingFailed)
+	if total += int(servingIssued); total == 0 {
+		return 0
+	}
+	return float64(incomplete) / float64(total)
+}
@@ -0,0 +1,69 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"flag"
+	"sort"
+	"time"
+
+	"github.com/ease-lab/vhive/examples/endpoint"
+)
+
+// gitCommit is the commit the invoker is built from, set by the Makefile with -ldflags.
+var gitCommit string
+
+// experimentMetadata describes the experiment that the results were measured in,
+// so that the archived results are self-describing.
+type experimentMetadata struct {
+	Experiment string            `json:"experiment"`
+	Tag        string            `json:"tag,omitempty"`
+	Commit     string            `json:"commit,omitempty"`
+	StartedOn  string            `json:"startedOn"`
+	Functions  []string          `json:"functions"`
+	Flags      map[string]string `json:"flags"`
+}
+
+// newExperimentMetadata captures the values of all flags, including the defaults,
+// and the sorted hostnames of the functions of the experiment.
+func newExperimentMetadata(name, tag string, endpoints []*endpoint.Endpoint) experimentMetadata {
+	meta := experimentMetadata{
+		Experiment: name,
+		Tag:        tag,
+		Commit:     gitCommit,
+		StartedOn:  time.Now().Format(time.RFC3339Nano),
+		Functions:  make([]string, 0, len(endpoints)),
+		Flags:      make(map[string]string),
+	}
+
+	for _, ep := range endpoints {
+		meta.Functions = append(meta.Functions, ep.Hostname)
+	}
+	sort.Strings(meta.Functions)
+
+	flag.VisitAll(func(f *flag.Flag) {
+		meta.Flags[f.Name] = f.Value.String()
+	})
+
+	return meta
+}
@@ -0,0 +1,134 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/empty"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/ease-lab/vhive/utils/benchmarking/eventing/proto"
+)
+
+// errPartialResultsUnsupported is returned by PartialResults if the TimeseriesDB predates the
+// GetPartialResults RPC.
+var errPartialResultsUnsupported = errors.New("the TimeseriesDB reports the results only upon the end of the experiment")
+
+// progressInterval is the interval of the progress reports during the experiment, set by the flag.
+var progressInterval time.Duration
+
+// PartialResults returns the durations of the eventing invocations completed so far without ending
+// the experiment, none if no experiment is started in the TimeseriesDB.
+func PartialResults() ([]time.Duration, error) {
+	lock.Lock()
+	client, running := tsdbClient, started
+	lock.Unlock()
+
+	if !running {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), experimentTimeout)
+	defer cancel()
+
+	res, err := client.GetPartialResults(ctx, &empty.Empty{})
+	if status.Code(err) == codes.Unimplemented {
+		return nil, errPartialResultsUnsupported
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var durations []time.Duration
+	for _, wrk := range res.WorkflowResults {
+		for _, inv := range wrk.Invocations {
+			if inv.Status == proto.InvocationStatus_COMPLETED {
+				durations = append(durations, inv.Duration.AsDuration())
+			}
+		}
+	}
+	return durations, nil
+}
+
+// startProgressReports logs the rolling latency percentiles of the invocations completed so far
+// every interval until the returned function is called, which must happen before End(). The serving
+// latencies are measured by the invoker, while the eventing ones are polled from the TimeseriesDB
+// unless it predates GetPartialResults, in which case the reports fall back to the serving latencies.
+func startProgressReports(interval time.Duration) (stop func()) {
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		pollEventing := true
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			logRollingStats(log.WithField("invocations", "serving"), getDurations())
+
+			if !pollEventing {
+				continue
+			}
+			durations, err := PartialResults()
+			switch {
+			case errors.Is(err, errPartialResultsUnsupported):
+				log.Infof("Reporting the serving latencies only: %v", err)
+				pollEventing = false
+			case err != nil:
+				log.Warnf("Failed to poll the partial results of the experiment: %v", err)
+			default:
+				logRollingStats(log.WithField("invocations", "eventing"), durations)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+func logRollingStats(logger *log.Entry, durations []time.Duration) {
+	stats, ok := computeLatencyStats(durations)
+	if !ok {
+		return
+	}
+
+	logger.Infof("Rolling latency over %d invocations so far (usec): p50=%d p90=%d p99=%d max=%d",
+		stats.Count, stats.P50.Microseconds(), stats.P90.Microseconds(), stats.P99.Microseconds(), stats.Max.Microseconds())
+}
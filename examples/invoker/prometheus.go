@@ -0,0 +1,138 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ease-lab/vhive/utils/benchmarking/eventing/proto"
+)
+
+// prometheusResults formats the latency summaries and the invocation counts of an experiment
+// in the Prometheus text exposition format. The latencies are labelled with the experiment
+// and the function, function="all" for the aggregate over all functions.
+func prometheusResults(experiment string, all []time.Duration, functions map[string][]time.Duration,
+	statuses map[proto.InvocationStatus]int) []byte {
+	var buf bytes.Buffer
+
+	names := make([]string, 0, len(functions))
+	for name := range functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(&buf, "# HELP invoker_latency_seconds Latency of the completed invocations.")
+	fmt.Fprintln(&buf, "# TYPE invoker_latency_seconds summary")
+	writeLatencySummary(&buf, experiment, "all", all)
+	for _, name := range names {
+		writeLatencySummary(&buf, experiment, name, functions[name])
+	}
+
+	invStatuses := make([]proto.InvocationStatus, 0, len(statuses))
+	for invStatus := range statuses {
+		invStatuses = append(invStatuses, invStatus)
+	}
+	sort.Slice(invStatuses, func(i, j int) bool { return invStatuses[i] < invStatuses[j] })
+
+	fmt.Fprintln(&buf, "# HELP invoker_eventing_invocations Eventing invocations returned by the TimeseriesDB per status.")
+	fmt.Fprintln(&buf, "# TYPE invoker_eventing_invocations gauge")
+	for _, invStatus := range invStatuses {
+		fmt.Fprintf(&buf, "invoker_eventing_invocations{experiment=%q,status=%q} %d\n",
+			experiment, invStatus.String(), statuses[invStatus])
+	}
+
+	return buf.Bytes()
+}
+
+func writeLatencySummary(buf *bytes.Buffer, experiment, function string, durations []time.Duration) {
+	stats, ok := computeLatencyStats(durations)
+	if !ok {
+		return
+	}
+
+	labels := fmt.Sprintf("experiment=%q,function=%q", experiment, function)
+	for _, q := range []struct {
+		quantile string
+		value    time.Duration
+	}{{"0.5", stats.P50}, {"0.9", stats.P90}, {"0.99", stats.P99}, {"1", stats.Max}} {
+		fmt.Fprintf(buf, "invoker_latency_seconds{%s,quantile=%q} %g\n", labels, q.quantile, q.value.Seconds())
+	}
+	fmt.Fprintf(buf, "invoker_latency_seconds_sum{%s} %g\n", labels, stats.Mean.Seconds()*float64(stats.Count))
+	fmt.Fprintf(buf, "invoker_latency_seconds_count{%s} %d\n", labels, stats.Count)
+}
+
+// writePrometheusTextfile writes the results for the textfile collector of node_exporter,
+// renaming a temporary file so that the collector never reads a partial file
+func writePrometheusTextfile(path string, results []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(results); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// pushPrometheusResults replaces the metrics of the experiment's group in the Pushgateway
+func pushPrometheusResults(gatewayURL, experiment string, results []byte) error {
+	pushURL := fmt.Sprintf("%s/metrics/job/invoker/experiment/%s",
+		strings.TrimSuffix(gatewayURL, "/"), url.PathEscape(experiment))
+
+	req, err := http.NewRequest(http.MethodPut, pushURL, bytes.NewReader(results))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	client := http.Client{Timeout: grpcTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("pushgateway returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// LatencyStats is a summary of latency measurements.
+type LatencyStats struct {
+	Count                    int
+	Mean, P50, P90, P99, Max time.Duration
+}
+
+// computeLatencyStats summarizes the durations, returning false if there are none,
+// e.g., if no invocation completed.
+func computeLatencyStats(durations []time.Duration) (LatencyStats, bool) {
+	if len(durations) == 0 {
+		return LatencyStats{}, false
+	}
+
+	sorted := make([]time.Duration, len(durations))
+	copy(sorted, durations)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var sum time.Duration
+	for _, d := range sorted {
+		sum += d
+	}
+
+	return LatencyStats{
+		Count: len(sorted),
+		Mean:  sum / time.Duration(len(sorted)),
+		P50:   percentile(sorted, 50),
+		P90:   percentile(sorted, 90),
+		P99:   percentile(sorted, 99),
+		Max:   sorted[len(sorted)-1],
+	}, true
+}
+
+// percentile returns the nearest-rank p-th percentile of the non-empty sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(p/100*float64(len(sorted)) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(sorted) {
+		rank = len(sorted)
+	}
+
+	return sorted[rank-1]
+}
+
+// printLatencyStats logs the summary of the durations.
+func printLatencyStats(durations []time.Duration) {
+	printStats(log.NewEntry(log.StandardLogger()), durations)
+}
+
+// printFunctionLatencyStats logs the summary of the durations of every function, sorted by hostname.
+func printFunctionLatencyStats(functions map[string][]time.Duration) {
+	names := make([]string, 0, len(functions))
+	for name := range functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		printStats(log.WithField("function", name), functions[name])
+	}
+}
+
+func printStats(logger *log.Entry, durations []time.Duration) {
+	stats, ok := computeLatencyStats(durations)
+	if !ok {
+		logger.Warn("No latency measurements, all invocations are incomplete")
+		return
+	}
+
+	logger.Infof("Latency over %d invocations (usec): mean=%d p50=%d p90=%d p99=%d max=%d",
+		stats.Count, stats.Mean.Microseconds(), stats.P50.Microseconds(), stats.P90.Microseconds(),
+		stats.P99.Microseconds(), stats.Max.Microseconds())
+}
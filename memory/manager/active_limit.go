@@ -0,0 +1,85 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"context"
+)
+
+// ActiveVMCount Returns the number of the VMs that are active, or being activated,
+// i.e., that hold one of the slots of MaxActiveVMs
+func (m *MemoryManager) ActiveVMCount() int {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.activeVMs
+}
+
+// acquireActiveSlot Takes a slot of MaxActiveVMs for the VM being activated. If all of them
+// are taken, it fails with ErrTooManyActiveVMs or, with QueueActivations, waits until a slot
+// is released or the context is done.
+func (m *MemoryManager) acquireActiveSlot(ctx context.Context, state *SnapshotState) error {
+	for {
+		m.Lock()
+		switch {
+		case m.isShutdown:
+			m.Unlock()
+			return ErrShutdown
+		case m.MaxActiveVMs <= 0 || m.activeVMs < m.MaxActiveVMs:
+			m.activeVMs++
+			state.holdsActiveSlot = true
+			m.Unlock()
+			return nil
+		case !m.QueueActivations:
+			m.Unlock()
+			return ErrTooManyActiveVMs
+		}
+		freed := m.slotFreed
+		m.Unlock()
+
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// releaseActiveSlot Releases the slot of MaxActiveVMs held by the VM, if any, waking up
+// the queued activations. Must be called with the manager locked.
+func (m *MemoryManager) releaseActiveSlot(state *SnapshotState) {
+	if !state.holdsActiveSlot {
+		return
+	}
+
+	state.holdsActiveSlot = false
+	m.activeVMs--
+	m.wakeQueuedActivations()
+}
+
+// wakeQueuedActivations Wakes up the activations waiting for a slot of MaxActiveVMs.
+// Must be called with the manager locked.
+func (m *MemoryManager) wakeQueuedActivations() {
+	close(m.slotFreed)
+	m.slotFreed = make(chan struct{})
+}
@@ -0,0 +1,122 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// registerActiveLimitVMs Registers the VMs with the manager, returning the fake VMs
+// that pass their uffds upon each activation
+func registerActiveLimitVMs(t *testing.T, manager *MemoryManager, vmIDs ...string) map[string]<-chan *fakeVM {
+	vms := make(map[string]<-chan *fakeVM)
+	for _, vmID := range vmIDs {
+		stateCfg := prepareSnapshotStateCfg(t, vmID, 4*os.Getpagesize())
+		stateCfg.IsLazyMode = true
+		vms[vmID] = serveFakeUFFDs(t, &stateCfg)
+
+		require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+	}
+
+	return vms
+}
+
+func TestMaxActiveVMsReject(t *testing.T) {
+	manager := newTestManager(t, MemoryManagerCfg{MaxActiveVMs: 2})
+	vms := registerActiveLimitVMs(t, manager, "1", "2", "3")
+
+	for _, vmID := range []string{"1", "2"} {
+		require.NoError(t, manager.Activate(vmID), "Failed to activate VM")
+		<-vms[vmID]
+	}
+	require.Equal(t, 2, manager.ActiveVMCount(), "Wrong number of active VMs")
+
+	err := manager.Activate("3")
+	require.True(t, errors.Is(err, ErrTooManyActiveVMs), "Activation beyond the limit must be rejected")
+	require.False(t, manager.instances["3"].isActive, "Rejected VM must be left inactive")
+	require.Equal(t, 2, manager.ActiveVMCount(), "Rejected VM must not take a slot")
+
+	require.NoError(t, manager.Deactivate("1"), "Failed to deactivate VM")
+	require.Equal(t, 1, manager.ActiveVMCount(), "Deactivated VM must release its slot")
+
+	require.NoError(t, manager.Activate("3"), "Failed to activate VM once a slot is released")
+	<-vms["3"]
+	require.Equal(t, 2, manager.ActiveVMCount(), "Wrong number of active VMs")
+
+	for _, vmID := range []string{"2", "3"} {
+		require.NoError(t, manager.Deactivate(vmID), "Failed to deactivate VM")
+	}
+	require.Zero(t, manager.ActiveVMCount(), "All slots must be released")
+}
+
+func TestMaxActiveVMsQueue(t *testing.T) {
+	manager := newTestManager(t, MemoryManagerCfg{MaxActiveVMs: 1, QueueActivations: true})
+	vms := registerActiveLimitVMs(t, manager, "1", "2")
+
+	require.NoError(t, manager.Activate("1"), "Failed to activate VM")
+	<-vms["1"]
+
+	// the queued activation is aborted once its context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	err := manager.ActivateWithContext(ctx, "2")
+	cancel()
+	require.True(t, errors.Is(err, context.DeadlineExceeded), "Queued activation must time out")
+	require.False(t, manager.instances["2"].isActive, "Timed out VM must be left inactive")
+
+	activated := make(chan error, 1)
+	go func() { activated <- manager.Activate("2") }()
+
+	select {
+	case err := <-activated:
+		t.Fatalf("Activation beyond the limit must be queued, returned %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	require.NoError(t, manager.Deactivate("1"), "Failed to deactivate VM")
+	require.NoError(t, <-activated, "Queued activation must succeed once a slot is released")
+	<-vms["2"]
+	require.Equal(t, 1, manager.ActiveVMCount(), "Wrong number of active VMs")
+
+	require.NoError(t, manager.Deactivate("2"), "Failed to deactivate VM")
+}
+
+func TestMaxActiveVMsShutdown(t *testing.T) {
+	manager := newTestManager(t, MemoryManagerCfg{MaxActiveVMs: 1, QueueActivations: true})
+	vms := registerActiveLimitVMs(t, manager, "1", "2")
+
+	require.NoError(t, manager.Activate("1"), "Failed to activate VM")
+	<-vms["1"]
+
+	activated := make(chan error, 1)
+	go func() { activated <- manager.Activate("2") }()
+	time.Sleep(10 * time.Millisecond)
+
+	require.NoError(t, manager.Shutdown(context.Background()), "Failed to shut down")
+	require.True(t, errors.Is(<-activated, ErrShutdown), "Queued activation must fail upon shutdown")
+}
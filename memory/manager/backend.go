@@ -0,0 +1,151 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"syscall"
+)
+
+// FaultBackend Name of the backend that serves the page faults of the VMs
+type FaultBackend string
+
+const (
+	// AutoBackend Serves the page faults with userfaultfd unless the kernel lacks it,
+	// in which case it falls back to preloading the guest memory
+	AutoBackend FaultBackend = ""
+	// UFFDBackend Serves the page faults received over the uffd of the VM
+	UFFDBackend FaultBackend = "uffd"
+	// PreloadBackend Reads the whole guest memory upon activation and serves no page faults,
+	// for the kernels without userfaultfd, where the VM is restored from the guest memory file.
+	// Record and replay, write protection and eager restore are unsupported.
+	PreloadBackend FaultBackend = "preload"
+)
+
+// faultBackend Serves the page faults of an active VM
+type faultBackend interface {
+	// activate Starts serving the page faults once the guest memory is mapped,
+	// the guest memory is unmapped by the caller upon an error
+	activate(ctx context.Context, s *SnapshotState) error
+	// deactivate Stops serving the page faults before the guest memory is unmapped
+	deactivate(ctx context.Context, s *SnapshotState) error
+	// isServing Returns true if the page faults of the active VM are served
+	isServing(s *SnapshotState) bool
+}
+
+// newFaultBackend Returns the backend by its name, choosing it automatically based on
+// the capabilities, or nil if the name is unknown
+func newFaultBackend(name FaultBackend, caps Capabilities) faultBackend {
+	switch name {
+	case AutoBackend:
+		// other errors, e.g., EPERM, do not prevent serving the uffd received from the VM
+		if errors.Is(caps.ProbeErr, syscall.ENOSYS) {
+			return preloadBackend{}
+		}
+		return uffdBackend{}
+	case UFFDBackend:
+		return uffdBackend{}
+	case PreloadBackend:
+		return preloadBackend{}
+	default:
+		return nil
+	}
+}
+
+type uffdBackend struct{}
+
+func (uffdBackend) activate(ctx context.Context, s *SnapshotState) error {
+	if err := s.getUFFD(ctx); err != nil {
+		return err
+	}
+
+	s.setupStateOnActivate()
+	s.traceCtx = ctx
+
+	readyCh := make(chan error)
+	go s.pollUserPageFaults(readyCh)
+
+	if err := <-readyCh; err != nil {
+		s.userFaultFD.Close()
+		s.userFaultFD = nil
+		s.resetStateOnDeactivate()
+		return fmt.Errorf("failed to register the epoller: %w", err)
+	}
+
+	return nil
+}
+
+func (uffdBackend) deactivate(ctx context.Context, s *SnapshotState) error {
+	s.stopPolling()
+	if err := s.waitInflightFaults(ctx); err != nil {
+		return fmt.Errorf("failed to wait for the in-flight page faults: %w", err)
+	}
+
+	s.userFaultFD.Close()
+	s.userFaultFD = nil
+
+	return nil
+}
+
+func (uffdBackend) isServing(s *SnapshotState) bool {
+	return s.isServing()
+}
+
+type preloadBackend struct{}
+
+// preloadSink keeps the reads of the guest memory from being optimized away
+var preloadSink uint32
+
+func (preloadBackend) activate(ctx context.Context, s *SnapshotState) error {
+	s.setupStateOnActivate()
+	s.traceCtx = ctx
+
+	// reading a byte of every page makes the whole guest memory resident
+	var sum byte
+	for offset := 0; offset < len(s.guestMem); offset += s.PageSize {
+		if offset%(1<<20) == 0 {
+			if err := ctx.Err(); err != nil {
+				s.resetStateOnDeactivate()
+				return err
+			}
+		}
+		sum += s.guestMem[offset]
+	}
+	atomic.AddUint32(&preloadSink, uint32(sum))
+
+	pages := s.servedPages.SetRange(0, s.servedPages.Len())
+	atomic.StoreInt64(&s.servedPagesNum, int64(pages))
+
+	return nil
+}
+
+func (preloadBackend) deactivate(ctx context.Context, s *SnapshotState) error {
+	return nil
+}
+
+func (preloadBackend) isServing(s *SnapshotState) bool {
+	return s.isActive
+}
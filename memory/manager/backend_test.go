@@ -0,0 +1,113 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewFaultBackend(t *testing.T) {
+	noUFFD := Capabilities{ProbeErr: fmt.Errorf("failed to probe userfaultfd: %w", syscall.ENOSYS)}
+	noPerm := Capabilities{ProbeErr: fmt.Errorf("failed to probe userfaultfd: %w", syscall.EPERM)}
+
+	require.Equal(t, uffdBackend{}, newFaultBackend(AutoBackend, Capabilities{ZeroPage: true}))
+	require.Equal(t, preloadBackend{}, newFaultBackend(AutoBackend, noUFFD), "Must fall back to preloading")
+	require.Equal(t, uffdBackend{}, newFaultBackend(AutoBackend, noPerm), "Received uffds can be served without permissions")
+	require.Equal(t, uffdBackend{}, newFaultBackend(UFFDBackend, noUFFD), "Configured backend must not be replaced")
+	require.Equal(t, preloadBackend{}, newFaultBackend(PreloadBackend, Capabilities{ZeroPage: true}))
+	require.Nil(t, newFaultBackend("mmap", Capabilities{}), "Unknown backend must be rejected")
+}
+
+func TestNewMemoryManagerUnknownBackend(t *testing.T) {
+	manager, err := NewMemoryManager(MemoryManagerCfg{Backend: "mmap"})
+	require.True(t, errors.Is(err, ErrInvalidConfig), "Unknown backend must be rejected")
+	require.Nil(t, manager)
+}
+
+func TestNewMemoryManagerConfigErrors(t *testing.T) {
+	_, err := NewMemoryManager(MemoryManagerCfg{
+		Backend:               "mmap",
+		StateFS:               &memFS{},
+		RemoteStore:           newMemStore(),
+		WorkingSetCompression: "lz4",
+	})
+
+	var configErrs *ConfigErrors
+	require.True(t, errors.As(err, &configErrs), "Initialization must return the list of problems")
+	require.Len(t, configErrs.Errs, 3, "Every problem must be reported")
+	require.True(t, errors.Is(err, ErrInvalidConfig), "Problems must wrap ErrInvalidConfig")
+	require.Contains(t, err.Error(), "fault backend")
+	require.Contains(t, err.Error(), "remote store")
+	require.Contains(t, err.Error(), "working set compression")
+}
+
+func TestPreloadBackend(t *testing.T) {
+	defer stubCapabilities(Capabilities{ProbeErr: fmt.Errorf("failed to probe userfaultfd: %w", syscall.ENOSYS)})()
+
+	manager := newTestManager(t, MemoryManagerCfg{})
+	stateCfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+	stateCfg.IsLazyMode = true
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+
+	for i := 0; i < 2; i++ {
+		// no uffd is received from the VM socket, which does not exist
+		require.NoError(t, manager.Activate("1"), "Failed to activate VM")
+		require.NoError(t, manager.ActivateIdempotent(context.Background(), "1"), "Preloaded VM must be served")
+
+		pages, _, err := manager.WorkingSetSize("1")
+		require.NoError(t, err, "Failed to get the working set size")
+		require.Equal(t, 4, pages, "Whole guest memory must be preloaded")
+
+		require.NoError(t, manager.Deactivate("1"), "Failed to deactivate VM")
+	}
+
+	require.NoError(t, manager.DeregisterVM("1"), "Failed to deregister VM")
+}
+
+func TestPreloadBackendUnsupported(t *testing.T) {
+	manager := newTestManager(t, MemoryManagerCfg{Backend: PreloadBackend})
+
+	for _, tc := range []struct {
+		name string
+		set  func(cfg *SnapshotStateCfg)
+	}{
+		{"record", func(cfg *SnapshotStateCfg) {}},
+		{"write-protect", func(cfg *SnapshotStateCfg) { cfg.IsLazyMode, cfg.WriteProtect = true, true }},
+		{"eager", func(cfg *SnapshotStateCfg) { cfg.IsLazyMode, cfg.EagerRestore = true, true }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			stateCfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+			tc.set(&stateCfg)
+
+			err := manager.RegisterVM(stateCfg)
+			require.True(t, errors.Is(err, ErrUnsupported), "Mode requiring userfaultfd must be rejected")
+		})
+	}
+}
@@ -0,0 +1,174 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// baseImage Read-only mapping of a guest memory image that is shared by the instances of
+// a snapshot family. Each instance installs the pages it diverges in from its own guest
+// memory file, i.e., its overlay, and all other pages from the base image.
+type baseImage struct {
+	mem  []byte
+	refs int // number of the registered instances that use the image
+}
+
+// baseImageFor Returns the mapping of the base image, mapping it for the first instance.
+// Must be called with the manager unlocked, the image is mapped outside of the lock.
+func (m *MemoryManager) baseImageFor(path string, size int) (*baseImage, error) {
+	m.Lock()
+	base, err := m.acquireBaseImage(path, size)
+	m.Unlock()
+	if base != nil || err != nil {
+		return base, err
+	}
+
+	mem, err := mapBaseImage(m.StateFS, path, size)
+	if err != nil {
+		return nil, err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	if base, err := m.acquireBaseImage(path, size); base != nil || err != nil {
+		// mapped for another instance meanwhile
+		if err := unix.Munmap(mem); err != nil {
+			log.Errorf("Failed to munmap base image %s: %v", path, err)
+		}
+		return base, err
+	}
+
+	base = &baseImage{mem: mem, refs: 1}
+	m.baseImages[path] = base
+
+	return base, nil
+}
+
+// acquireBaseImage Returns the base image with a reference taken, or nil if it is not mapped.
+// Must be called with the manager locked.
+func (m *MemoryManager) acquireBaseImage(path string, size int) (*baseImage, error) {
+	base, ok := m.baseImages[path]
+	if !ok {
+		return nil, nil
+	}
+
+	if len(base.mem) != size {
+		return nil, fmt.Errorf("%w: base image %s is mapped with a different size", ErrInvalidConfig, path)
+	}
+	base.refs++
+
+	return base, nil
+}
+
+// mapBaseImage Maps the base image read-only
+func mapBaseImage(fsys StateFS, path string, size int) ([]byte, error) {
+	f, err := openMappableFile(fsys, path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// accessing the mapping past the end of the file raises SIGBUS
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fileInfo.Size() < int64(size) {
+		return nil, fmt.Errorf("%w: base image %s is truncated: expected %d bytes, found %d",
+			ErrInvalidConfig, path, size, fileInfo.Size())
+	}
+
+	return unix.Mmap(int(f.Fd()), 0, size, unix.PROT_READ, unix.MAP_SHARED)
+}
+
+// releaseBaseImage Unmaps the base image once no instance uses it.
+// Must be called with the manager locked.
+func (m *MemoryManager) releaseBaseImage(path string) {
+	base, ok := m.baseImages[path]
+	if !ok {
+		return
+	}
+
+	base.refs--
+	if base.refs == 0 {
+		if err := unix.Munmap(base.mem); err != nil {
+			log.Errorf("Failed to munmap base image %s: %v", path, err)
+		}
+		delete(m.baseImages, path)
+	}
+}
+
+// loadOverlayPages Reads the pages in which the instance diverges from the base image,
+// none if there is no overlay
+func loadOverlayPages(fsys StateFS, path string, pages int) (*pageBitmap, error) {
+	if path == "" {
+		return newPageBitmap(pages), nil
+	}
+
+	data, err := readStateFile(fsys, path)
+	if err != nil {
+		return nil, err
+	}
+
+	overlay, err := decodePageBitmap(data, pages)
+	if err != nil {
+		return nil, fmt.Errorf("%w: overlay pages file %s is corrupt: %v", ErrInvalidConfig, path, err)
+	}
+
+	return overlay, nil
+}
+
+// hasOverlayFile Returns false if the instance is installed from the base image only,
+// in which case it has no guest memory file to map
+func (s *SnapshotState) hasOverlayFile() bool {
+	return s.base == nil || s.OverlayPagesPath != ""
+}
+
+// clipToSource Returns the memory that the page is installed from, either the overlay or
+// the base image, and the part of the run [first, first+num) around the page that is installed
+// from the same memory
+func (s *SnapshotState) clipToSource(page, first, num int) ([]byte, int, int) {
+	if s.base == nil {
+		return s.guestMem, first, num
+	}
+
+	inOverlay := s.overlayPages.Test(page)
+
+	start, end := page, page+1
+	for start > first && s.overlayPages.Test(start-1) == inOverlay {
+		start--
+	}
+	for end < first+num && s.overlayPages.Test(end) == inOverlay {
+		end++
+	}
+
+	if inOverlay {
+		return s.guestMem, start, end - start
+	}
+	return s.base.mem, start, end - start
+}
@@ -0,0 +1,158 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/require"
+)
+
+type sourcedInstall struct {
+	src, dst, len uint64
+}
+
+// stubSourcedInstallRegion Records the sources of the installed regions, returns the function
+// that restores the real implementation
+func stubSourcedInstallRegion(installs *[]sourcedInstall) func() {
+	installer, restore := stubInstaller()
+	installer.copy = func(fd int, src, dst, mode, len uint64) error {
+		*installs = append(*installs, sourcedInstall{src: src, dst: dst, len: len})
+		return nil
+	}
+
+	return restore
+}
+
+// newTestBaseImageState Creates an activated snapshot state with 4 pages installed in single chunks
+// from a base image, or from its guest memory for the overlay pages
+func newTestBaseImageState(overlayPages ...int) (*SnapshotState, *baseImage) {
+	state := newTestSnapshotState(4, 4)
+	state.IsLazyMode = true
+
+	base := &baseImage{mem: make([]byte, state.GuestMemSize), refs: 1}
+	for i := range base.mem {
+		base.mem[i] = 0xaa
+	}
+	state.base = base
+	state.overlayPages = newPageBitmap(4)
+	for _, page := range overlayPages {
+		state.overlayPages.Set(page)
+	}
+
+	return state, base
+}
+
+func addressOf(mem []byte, offset int) uint64 {
+	return uint64(uintptr(unsafe.Pointer(&mem[offset])))
+}
+
+func TestServePageFaultBaseImage(t *testing.T) {
+	var installs []sourcedInstall
+	defer stubSourcedInstallRegion(&installs)()
+
+	pageSize := os.Getpagesize()
+
+	t.Run("base-only", func(t *testing.T) {
+		installs = nil
+		state, base := newTestBaseImageState()
+
+		require.NoError(t, state.servePageFault(-1, testStartAddress), "Failed to serve page fault")
+		require.Equal(t, []sourcedInstall{
+			{src: addressOf(base.mem, 0), dst: testStartAddress, len: uint64(4 * pageSize)},
+		}, installs, "Whole chunk must be installed from the base image")
+	})
+
+	t.Run("overlay-hit", func(t *testing.T) {
+		installs = nil
+		state, _ := newTestBaseImageState(2)
+
+		require.NoError(t, state.servePageFault(-1, testStartAddress+uint64(2*pageSize)), "Failed to serve page fault")
+		require.Equal(t, []sourcedInstall{
+			{src: addressOf(state.guestMem, 2*pageSize), dst: testStartAddress + uint64(2*pageSize), len: uint64(pageSize)},
+		}, installs, "Overlay page must be installed from the guest memory of the VM")
+	})
+
+	t.Run("overlay-miss", func(t *testing.T) {
+		installs = nil
+		state, base := newTestBaseImageState(2)
+
+		require.NoError(t, state.servePageFault(-1, testStartAddress), "Failed to serve page fault")
+		require.Equal(t, []sourcedInstall{
+			{src: addressOf(base.mem, 0), dst: testStartAddress, len: uint64(2 * pageSize)},
+		}, installs, "Chunk must be installed from the base image up to the overlay page")
+	})
+}
+
+func TestRegisterVMBaseImage(t *testing.T) {
+	pages := 4
+	basePath := filepath.Join(t.TempDir(), "base_mem_file")
+	prepareGuestMemoryFile(basePath, pages*os.Getpagesize())
+
+	manager := newTestManager(t, MemoryManagerCfg{})
+
+	// base-only VM without a guest memory file of its own
+	onlyCfg := prepareSnapshotStateCfg(t, "1", pages*os.Getpagesize())
+	onlyCfg.IsLazyMode = true
+	onlyCfg.BaseImagePath = basePath
+	require.NoError(t, os.Remove(onlyCfg.GuestMemPath), "Failed to remove the guest memory file")
+	require.NoError(t, manager.RegisterVM(onlyCfg), "Failed to register base-only VM")
+	require.NoError(t, manager.instances["1"].mapGuestMemory(context.Background()), "Base-only VM must not map a guest memory file")
+
+	overlayCfg := prepareSnapshotStateCfg(t, "2", pages*os.Getpagesize())
+	overlayCfg.IsLazyMode = true
+	overlayCfg.BaseImagePath = basePath
+	overlayCfg.OverlayPagesPath = filepath.Join(overlayCfg.BaseDir, "overlay")
+	overlay := newPageBitmap(pages)
+	overlay.Set(1)
+	require.NoError(t, ioutil.WriteFile(overlayCfg.OverlayPagesPath, overlay.encode(), 0644), "Failed to write overlay pages")
+	require.NoError(t, manager.RegisterVM(overlayCfg), "Failed to register overlay VM")
+	require.Equal(t, overlay, manager.instances["2"].overlayPages, "Wrong overlay pages")
+
+	require.Len(t, manager.baseImages, 1, "Base image must be mapped once")
+	require.Equal(t, 2, manager.baseImages[basePath].refs, "Base image must be shared")
+
+	require.NoError(t, manager.DeregisterVM("1"), "Failed to deregister VM")
+	require.NoError(t, manager.DeregisterVM("2"), "Failed to deregister VM")
+	require.Empty(t, manager.baseImages, "Base image must be unmapped once unused")
+
+	corruptCfg := prepareSnapshotStateCfg(t, "3", pages*os.Getpagesize())
+	corruptCfg.IsLazyMode = true
+	corruptCfg.BaseImagePath = basePath
+	corruptCfg.OverlayPagesPath = filepath.Join(corruptCfg.BaseDir, "overlay")
+	require.NoError(t, ioutil.WriteFile(corruptCfg.OverlayPagesPath, []byte("corrupt"), 0644), "Failed to write overlay pages")
+	err := manager.RegisterVM(corruptCfg)
+	require.True(t, errors.Is(err, ErrInvalidConfig), "Corrupt overlay pages must be rejected")
+
+	recordCfg := prepareSnapshotStateCfg(t, "4", pages*os.Getpagesize())
+	recordCfg.BaseImagePath = basePath
+	err = manager.RegisterVM(recordCfg)
+	require.True(t, errors.Is(err, ErrInvalidConfig), "Base image must be rejected in record mode")
+	require.Empty(t, manager.baseImages, "Rejected VMs must not map the base image")
+}
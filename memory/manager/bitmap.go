@@ -0,0 +1,150 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+// pageBitmap Tracks a set of guest memory pages, indexed by page number
+type pageBitmap struct {
+	words []uint64
+	size  int
+}
+
+func newPageBitmap(size int) *pageBitmap {
+	b := new(pageBitmap)
+	b.size = size
+	b.words = make([]uint64, (size+63)/64)
+
+	return b
+}
+
+// Len Returns the number of pages tracked by the bitmap
+func (b *pageBitmap) Len() int {
+	return b.size
+}
+
+// Test Returns true if the page is in the set
+func (b *pageBitmap) Test(page int) bool {
+	return b.words[page/64]&(1<<uint(page%64)) != 0
+}
+
+// Set Adds the page to the set
+func (b *pageBitmap) Set(page int) {
+	b.words[page/64] |= 1 << uint(page%64)
+}
+
+// SetRange Adds pages [page, page+num) to the set, returns the number of added pages
+func (b *pageBitmap) SetRange(page, num int) int {
+	added := 0
+	for i := page; i < page+num; i++ {
+		if !b.Test(i) {
+			b.Set(i)
+			added++
+		}
+	}
+
+	return added
+}
+
+// Clear Removes the page from the set
+func (b *pageBitmap) Clear(page int) {
+	b.words[page/64] &^= 1 << uint(page%64)
+}
+
+// ClearRange Removes pages [page, page+num) from the set, returns the number of removed pages
+func (b *pageBitmap) ClearRange(page, num int) int {
+	removed := 0
+	for i := page; i < page+num; i++ {
+		if b.Test(i) {
+			b.Clear(i)
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// Count Returns the number of pages in the set
+func (b *pageBitmap) Count() int {
+	count := 0
+	for _, w := range b.words {
+		count += bits.OnesCount64(w)
+	}
+
+	return count
+}
+
+// Reset Removes all pages from the set
+func (b *pageBitmap) Reset() {
+	for i := range b.words {
+		b.words[i] = 0
+	}
+}
+
+// encode Serializes the set as little-endian 64-bit words
+func (b *pageBitmap) encode() []byte {
+	data := make([]byte, 8*len(b.words))
+	for i, w := range b.words {
+		binary.LittleEndian.PutUint64(data[8*i:], w)
+	}
+
+	return data
+}
+
+// decodePageBitmap Deserializes a set of the size encoded by encode
+func decodePageBitmap(data []byte, size int) (*pageBitmap, error) {
+	b := newPageBitmap(size)
+	if len(data) != 8*len(b.words) {
+		return nil, fmt.Errorf("expected %d bytes for %d pages, found %d bytes", 8*len(b.words), size, len(data))
+	}
+
+	for i := range b.words {
+		b.words[i] = binary.LittleEndian.Uint64(data[8*i:])
+	}
+
+	return b, nil
+}
+
+// runs Calls the function for every run of contiguous pages [first, first+num) in the set,
+// in ascending order, until it returns false
+func (b *pageBitmap) runs(fn func(first, num int) bool) {
+	for page := 0; page < b.size; {
+		if !b.Test(page) {
+			page++
+			continue
+		}
+
+		first := page
+		for page < b.size && b.Test(page) {
+			page++
+		}
+
+		if !fn(first, page-first) {
+			return
+		}
+	}
+}
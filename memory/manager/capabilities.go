@@ -0,0 +1,142 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+/*
+#define _GNU_SOURCE
+
+#include <errno.h>
+#include <fcntl.h>
+#include <linux/userfaultfd.h>
+#include <sys/ioctl.h>
+#include <sys/syscall.h>
+#include <unistd.h>
+
+#ifndef UFFD_FEATURE_MINOR_HUGETLBFS
+#define UFFD_FEATURE_MINOR_HUGETLBFS (1 << 9)
+#endif
+#ifndef UFFD_FEATURE_MINOR_SHMEM
+#define UFFD_FEATURE_MINOR_SHMEM (1 << 10)
+#endif
+
+// probe_uffd_api Creates a uffd to query the features that the kernel supports,
+// returns 0 or the errno of the failed call
+static int probe_uffd_api(unsigned long long *features) {
+    struct uffdio_api uffdio_api;
+    long uffd;
+    int err = 0;
+
+    uffd = syscall(__NR_userfaultfd, O_CLOEXEC | O_NONBLOCK);
+    if (uffd == -1)
+        return errno;
+
+    uffdio_api.api = UFFD_API;
+    uffdio_api.features = 0;
+    if (ioctl(uffd, UFFDIO_API, &uffdio_api) == -1)
+        err = errno;
+    else
+        *features = uffdio_api.features;
+
+    close(uffd);
+
+    return err;
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Capabilities The userfaultfd features that the kernel supports
+type Capabilities struct {
+	Features     uint64 // UFFD_FEATURE_* bits reported by UFFDIO_API
+	ZeroPage     bool   // UFFDIO_ZEROPAGE for the anonymous guest memory
+	WriteProtect bool   // write-protect faults, see SnapshotStateCfg.WriteProtect
+	MinorFaults  bool   // minor faults of the hugetlbfs or shmem guest memory
+	SoftDirty    bool   // soft-dirty bits of the pages, which track the dirty pages without WriteProtect
+	ProbeErr     error  // error probing the kernel, in which case no feature is assumed
+}
+
+// probeCapabilitiesFunc probes the kernel once per memory manager, replaced in tests
+var probeCapabilitiesFunc = probeCapabilities
+
+// probeCapabilities Issues UFFDIO_API on a new uffd to detect the supported features
+func probeCapabilities() Capabilities {
+	var features C.ulonglong
+
+	if errno := C.probe_uffd_api(&features); errno != 0 {
+		return Capabilities{ProbeErr: fmt.Errorf("failed to probe userfaultfd: %w", syscall.Errno(errno))}
+	}
+
+	return Capabilities{
+		Features:     uint64(features),
+		ZeroPage:     true, // supported for the anonymous memory since userfaultfd was introduced
+		WriteProtect: uint64(features)&uint64(C.UFFD_FEATURE_PAGEFAULT_FLAG_WP) != 0,
+		MinorFaults:  uint64(features)&uint64(C.UFFD_FEATURE_MINOR_HUGETLBFS|C.UFFD_FEATURE_MINOR_SHMEM) != 0,
+		SoftDirty:    probeSoftDirty(),
+	}
+}
+
+// Capabilities Returns the userfaultfd features that the kernel supports
+func (m *MemoryManager) Capabilities() Capabilities {
+	return m.capabilities
+}
+
+// checkCapabilities Returns an error if the VM requires a feature the kernel does not support
+func (m *MemoryManager) checkCapabilities(cfg SnapshotStateCfg) error {
+	if _, ok := m.backend.(preloadBackend); ok {
+		switch {
+		case !cfg.IsLazyMode:
+			return fmt.Errorf("%w: record and replay without userfaultfd", ErrUnsupported)
+		case cfg.WriteProtect:
+			return fmt.Errorf("%w: write-protect faults without userfaultfd", ErrUnsupported)
+		case cfg.EagerRestore:
+			return fmt.Errorf("%w: eager restore without userfaultfd", ErrUnsupported)
+		case cfg.MinorFaults:
+			return fmt.Errorf("%w: minor faults without userfaultfd", ErrUnsupported)
+		}
+	}
+
+	if cfg.WriteProtect && !m.capabilities.WriteProtect && !m.capabilities.SoftDirty {
+		return fmt.Errorf("%w: write-protect faults nor soft-dirty bits", ErrUnsupported)
+	}
+
+	if cfg.MinorFaults && !m.capabilities.MinorFaults {
+		return fmt.Errorf("%w: minor faults", ErrUnsupported)
+	}
+
+	return nil
+}
+
+func (m *MemoryManager) logCapabilities() {
+	if m.capabilities.ProbeErr != nil {
+		log.Warnf("Assuming no userfaultfd features: %v", m.capabilities.ProbeErr)
+		return
+	}
+
+	log.Debugf("Detected userfaultfd features %#x", m.capabilities.Features)
+}
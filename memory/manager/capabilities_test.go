@@ -0,0 +1,86 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// stubCapabilities Makes the memory managers detect the capabilities instead of probing the kernel,
+// returns the function that restores the real probe
+func stubCapabilities(caps Capabilities) func() {
+	probeCapabilitiesFunc = func() Capabilities { return caps }
+
+	return func() { probeCapabilitiesFunc = probeCapabilities }
+}
+
+func TestProbeCapabilities(t *testing.T) {
+	caps := probeCapabilities()
+	if caps.ProbeErr != nil {
+		require.Equal(t, Capabilities{ProbeErr: caps.ProbeErr}, caps, "No feature must be assumed if probing fails")
+		return
+	}
+
+	require.True(t, caps.ZeroPage, "UFFDIO_ZEROPAGE must be supported by any userfaultfd")
+}
+
+func TestRegisterVMUnsupportedWriteProtect(t *testing.T) {
+	defer stubCapabilities(Capabilities{ZeroPage: true})()
+
+	manager := newTestManager(t, MemoryManagerCfg{})
+	require.Equal(t, Capabilities{ZeroPage: true}, manager.Capabilities(), "Wrong detected capabilities")
+
+	stateCfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+	stateCfg.WriteProtect = true
+
+	err := manager.RegisterVM(stateCfg)
+	require.True(t, errors.Is(err, ErrUnsupported), "Unsupported write protection must be rejected")
+	require.NotContains(t, manager.instances, "1", "VM must not be registered")
+
+	stateCfg.WriteProtect = false
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+}
+
+func TestRegisterVMUnsupportedZeroPage(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+	defer stubCapabilities(Capabilities{})()
+
+	manager := newTestManager(t, MemoryManagerCfg{})
+	stateCfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+	stateCfg.IsLazyMode = true
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+
+	state := manager.instances["1"]
+	state.guestMem = make([]byte, state.GuestMemSize)
+	state.setupStateOnActivate()
+
+	err := state.servePageFault(-1, testStartAddress)
+	require.NoError(t, err, "Failed to serve page fault")
+	require.Len(t, installs, 1, "Wrong number of installs")
+	require.False(t, installs[0].zero, "Zero-filled page must be copied without UFFDIO_ZEROPAGE")
+}
@@ -0,0 +1,298 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"container/list"
+	"sync"
+)
+
+// CacheEviction Policy that a size-capped cache evicts its entries by to stay within its budget
+type CacheEviction int
+
+const (
+	// LRUEviction Evicts the least recently used entry
+	LRUEviction CacheEviction = iota
+	// ClockEviction Evicts the first entry that the hand of the clock finds unused since it last
+	// passed it, which approximates LRU without reordering the entries upon every hit
+	ClockEviction
+)
+
+// CacheStats Counters of a size-capped cache of the pages
+type CacheStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	Entries   int
+	Bytes     int // total cost of the entries
+	Budget    int // in bytes, unlimited if 0
+}
+
+// cappedCache Cache whose entries cost up to a budget of bytes in total, evicting the entries by its
+// policy to admit new ones beyond it. The pinned entries are never evicted, e.g., while a page is
+// installed from them. It is safe for concurrent use. The eviction callback runs with the cache
+// locked, within the call of add that evicts the entry, so it must not call the cache.
+type cappedCache struct {
+	sync.Mutex
+	budget  int
+	bytes   int
+	policy  CacheEviction
+	entries map[interface{}]*list.Element
+	order   *list.List    // entries, the most recently used first for LRU, in the order of the clock for CLOCK
+	hand    *list.Element // next entry the clock examines, the first one if nil
+	onEvict func(key, value interface{})
+
+	hits, misses, evictions int64
+}
+
+type cacheEntry struct {
+	key, value interface{}
+	cost       int
+	pins       int
+	referenced bool // used since the hand of the clock passed it
+}
+
+// newCappedCache Returns an empty cache of the budget in bytes, which is unlimited if 0,
+// calling onEvict, if set, with every evicted entry
+func newCappedCache(budget int, policy CacheEviction, onEvict func(key, value interface{})) *cappedCache {
+	return &cappedCache{
+		budget:  budget,
+		policy:  policy,
+		entries: make(map[interface{}]*list.Element),
+		order:   list.New(),
+		onEvict: onEvict,
+	}
+}
+
+// get Returns the value of the key if it is cached, counting the hit or the miss
+func (c *cappedCache) get(key interface{}) (interface{}, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	entry, ok := c.lookup(key)
+	if !ok {
+		return nil, false
+	}
+
+	return entry.value, true
+}
+
+// acquire Returns the value of the key like get, pinning the entry until it is released
+func (c *cappedCache) acquire(key interface{}) (interface{}, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	entry, ok := c.lookup(key)
+	if !ok {
+		return nil, false
+	}
+	entry.pins++
+
+	return entry.value, true
+}
+
+// release Unpins the entry of the key that has been acquired
+func (c *cappedCache) release(key interface{}) {
+	c.Lock()
+	defer c.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*cacheEntry).pins--
+	}
+}
+
+// lookup Returns the entry of the key, marking it as used. Must be called with the cache locked.
+func (c *cappedCache) lookup(key interface{}) (*cacheEntry, bool) {
+	elem, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+
+	c.hits++
+	c.touch(elem)
+
+	return elem.Value.(*cacheEntry), true
+}
+
+// touch Marks the entry as used. Must be called with the cache locked.
+func (c *cappedCache) touch(elem *list.Element) {
+	if c.policy == ClockEviction {
+		elem.Value.(*cacheEntry).referenced = true
+	} else {
+		c.order.MoveToFront(elem)
+	}
+}
+
+// contains Returns true if the key is cached, without counting a hit or a miss
+func (c *cappedCache) contains(key interface{}) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	_, ok := c.entries[key]
+	return ok
+}
+
+// add Caches the value of the key, replacing its previous value, and evicts the unpinned entries
+// until the cache is within its budget. Returns false, caching nothing, if the cost of the entry
+// exceeds the budget or the pinned entries leave no room for it.
+func (c *cappedCache) add(key, value interface{}, cost int) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.budget > 0 && cost > c.budget {
+		return false
+	}
+
+	elem, ok := c.entries[key]
+	if ok {
+		entry := elem.Value.(*cacheEntry)
+		c.bytes += cost - entry.cost
+		entry.value, entry.cost = value, cost
+		c.touch(elem)
+	} else {
+		entry := &cacheEntry{key: key, value: value, cost: cost, referenced: true}
+		switch {
+		case c.policy != ClockEviction:
+			elem = c.order.PushFront(entry)
+		case c.hand != nil:
+			// the new entry is examined last by the clock
+			elem = c.order.InsertBefore(entry, c.hand)
+		default:
+			elem = c.order.PushBack(entry)
+		}
+		c.entries[key] = elem
+		c.bytes += cost
+	}
+
+	if !c.evictFor(0, elem) {
+		// the pinned entries take up the budget
+		c.remove(elem)
+		return false
+	}
+
+	return true
+}
+
+// makeRoom Evicts the unpinned entries until an entry of the cost fits within the budget,
+// returns false if the pinned entries leave no room for it
+func (c *cappedCache) makeRoom(cost int) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.evictFor(cost, nil)
+}
+
+// evictFor Evicts the entries other than keep until cost more bytes fit within the budget.
+// Must be called with the cache locked.
+func (c *cappedCache) evictFor(cost int, keep *list.Element) bool {
+	for c.budget > 0 && c.bytes+cost > c.budget {
+		victim := c.victim(keep)
+		if victim == nil {
+			return false
+		}
+
+		c.evictions++
+		entry := c.remove(victim)
+		if c.onEvict != nil {
+			c.onEvict(entry.key, entry.value)
+		}
+	}
+
+	return true
+}
+
+// victim Returns the entry other than keep to evict by the policy, nil if every other entry
+// is pinned. Must be called with the cache locked.
+func (c *cappedCache) victim(keep *list.Element) *list.Element {
+	if c.policy != ClockEviction {
+		for elem := c.order.Back(); elem != nil; elem = elem.Prev() {
+			if elem != keep && elem.Value.(*cacheEntry).pins == 0 {
+				return elem
+			}
+		}
+		return nil
+	}
+
+	// the hand clears the referenced bits in the first round and finds an unreferenced entry in the second
+	for i := 0; i < 2*c.order.Len(); i++ {
+		elem := c.hand
+		if elem == nil {
+			elem = c.order.Front()
+		}
+		c.hand = elem.Next()
+
+		entry := elem.Value.(*cacheEntry)
+		switch {
+		case elem == keep, entry.pins > 0:
+		case entry.referenced:
+			entry.referenced = false
+		default:
+			return elem
+		}
+	}
+
+	return nil
+}
+
+// remove Drops the entry from the cache. Must be called with the cache locked.
+func (c *cappedCache) remove(elem *list.Element) *cacheEntry {
+	if c.hand == elem {
+		c.hand = elem.Next()
+	}
+
+	entry := c.order.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.cost
+
+	return entry
+}
+
+// removeIf Drops the entries whose key matches, without counting them as evicted
+func (c *cappedCache) removeIf(match func(key interface{}) bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	for elem := c.order.Front(); elem != nil; {
+		next := elem.Next()
+		if match(elem.Value.(*cacheEntry).key) {
+			c.remove(elem)
+		}
+		elem = next
+	}
+}
+
+// stats Returns the counters of the cache
+func (c *cappedCache) stats() CacheStats {
+	c.Lock()
+	defer c.Unlock()
+
+	return CacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Entries:   len(c.entries),
+		Bytes:     c.bytes,
+		Budget:    c.budget,
+	}
+}
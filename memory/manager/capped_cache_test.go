@@ -0,0 +1,158 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCappedCacheLRU(t *testing.T) {
+	var evicted []interface{}
+	cache := newCappedCache(30, LRUEviction, func(key, value interface{}) { evicted = append(evicted, key) })
+
+	for _, key := range []string{"a", "b", "c"} {
+		require.True(t, cache.add(key, key, 10), "Entry within the budget must be cached")
+	}
+	_, ok := cache.get("a")
+	require.True(t, ok, "Cached entry must be found")
+
+	// b is the least recently used entry
+	require.True(t, cache.add("d", "d", 10), "Entry must be cached by evicting another one")
+	require.Equal(t, []interface{}{"b"}, evicted, "Least recently used entry must be evicted")
+
+	// a larger entry evicts as many entries as it needs room for
+	require.True(t, cache.add("e", "e", 20), "Entry must be cached by evicting other ones")
+	require.Equal(t, []interface{}{"b", "c", "a"}, evicted, "Least recently used entries must be evicted")
+
+	require.False(t, cache.add("f", "f", 40), "Entry beyond the budget must not be cached")
+	_, ok = cache.get("b")
+	require.False(t, ok, "Evicted entry must not be found")
+
+	require.Equal(t, CacheStats{Hits: 1, Misses: 1, Evictions: 3, Entries: 2, Bytes: 30, Budget: 30}, cache.stats(),
+		"Wrong counters of the cache")
+}
+
+func TestCappedCacheClock(t *testing.T) {
+	var evicted []interface{}
+	cache := newCappedCache(3, ClockEviction, func(key, value interface{}) { evicted = append(evicted, key) })
+
+	for _, key := range []string{"a", "b", "c"} {
+		require.True(t, cache.add(key, key, 1), "Entry within the budget must be cached")
+	}
+
+	// the hand clears the referenced bits of the new entries, and evicts the first one in its second round
+	require.True(t, cache.add("d", "d", 1), "Entry must be cached by evicting another one")
+	require.Equal(t, []interface{}{"a"}, evicted, "First entry of the clock must be evicted")
+
+	// b is used, so the hand gives it a second chance
+	_, ok := cache.get("b")
+	require.True(t, ok, "Cached entry must be found")
+	require.True(t, cache.add("e", "e", 1), "Entry must be cached by evicting another one")
+	require.Equal(t, []interface{}{"a", "c"}, evicted, "Unused entry must be evicted")
+
+	for _, key := range []string{"b", "d", "e"} {
+		require.True(t, cache.contains(key), "Used and new entries must be kept")
+	}
+	require.EqualValues(t, 2, cache.stats().Evictions, "Wrong number of the evictions")
+}
+
+func TestCappedCachePinned(t *testing.T) {
+	for _, policy := range []CacheEviction{LRUEviction, ClockEviction} {
+		cache := newCappedCache(2, policy, nil)
+		require.True(t, cache.add("a", 1, 1), "Entry within the budget must be cached")
+		require.True(t, cache.add("b", 2, 1), "Entry within the budget must be cached")
+
+		_, ok := cache.acquire("a")
+		require.True(t, ok, "Cached entry must be acquired")
+		require.True(t, cache.add("c", 3, 1), "Entry must be cached by evicting an unpinned entry")
+		require.True(t, cache.contains("a"), "Pinned entry must not be evicted")
+		require.False(t, cache.contains("b"), "Unpinned entry must be evicted")
+
+		_, ok = cache.acquire("c")
+		require.True(t, ok, "Cached entry must be acquired")
+		require.False(t, cache.add("d", 4, 1), "Pinned entries must leave no room for the new entry")
+		require.False(t, cache.makeRoom(1), "Pinned entries must leave no room")
+		require.Equal(t, 2, cache.stats().Bytes, "Rejected entry must not be accounted for")
+
+		cache.release("a")
+		require.True(t, cache.add("d", 4, 1), "Released entry must be evicted")
+		require.False(t, cache.contains("a"), "Released entry must be evicted")
+		require.True(t, cache.contains("c"), "Pinned entry must not be evicted")
+	}
+}
+
+func TestCappedCacheUnlimited(t *testing.T) {
+	cache := newCappedCache(0, LRUEviction, nil)
+	for i := 0; i < 100; i++ {
+		require.True(t, cache.add(i, i, 1<<20), "Unlimited cache must cache every entry")
+	}
+	require.Equal(t, 100, cache.stats().Entries, "Unlimited cache must not evict")
+
+	cache.removeIf(func(key interface{}) bool { return key.(int)%2 == 0 })
+	require.Equal(t, CacheStats{Entries: 50, Bytes: 50 << 20}, cache.stats(), "Removed entries must not count as evicted")
+}
+
+func TestCappedCacheConcurrent(t *testing.T) {
+	const (
+		workers = 8
+		ops     = 2000
+		budget  = 64
+	)
+
+	for _, policy := range []CacheEviction{LRUEviction, ClockEviction} {
+		t.Run(fmt.Sprintf("Policy%d", policy), func(t *testing.T) {
+			cache := newCappedCache(budget, policy, nil)
+
+			var wg sync.WaitGroup
+			for w := 0; w < workers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := 0; i < ops; i++ {
+						key := (w*ops + i*7) % (4 * budget)
+						if value, ok := cache.acquire(key); ok {
+							if value.(int) != key {
+								t.Errorf("wrong value %d of key %d", value, key)
+							}
+							cache.release(key)
+						} else {
+							cache.add(key, key, 1)
+						}
+					}
+				}(w)
+			}
+			wg.Wait()
+
+			stats := cache.stats()
+			require.LessOrEqual(t, stats.Bytes, budget, "Cache must stay within its budget")
+			require.Equal(t, stats.Entries, stats.Bytes, "Wrong accounting of the entries")
+			require.EqualValues(t, workers*ops, stats.Hits+stats.Misses, "Every lookup must count as a hit or a miss")
+			require.True(t, stats.Evictions > 0, "Cache under pressure must evict")
+			require.True(t, cache.makeRoom(budget), "No entry must be left pinned")
+		})
+	}
+}
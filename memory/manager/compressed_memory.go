@@ -0,0 +1,250 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"bytes"
+	"compress/flate"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// The block-compressed guest memory file, written by CompressGuestMemory, starts with a header
+// of the magic, the block size and the codec as little-endian uint32 values, and the size of
+// the guest memory as a little-endian uint64 value. The header is followed by the index of the
+// blocks, i.e., the offsets in the file of the compressed blocks followed by the end of the last
+// block as little-endian uint64 values, and by the blocks. Every block but the last one holds
+// the block size of the guest memory, so that the blocks of any range are found in the index.
+const (
+	compressedMagic      = "vhivecm1"
+	compressedHeaderSize = 8 + 4 + 4 + 8
+	// compressedCodecFlate Compresses every block as a raw DEFLATE stream
+	compressedCodecFlate = 1
+	// compressedCacheBlocks Number of the decompressed blocks cached per VM
+	compressedCacheBlocks = 32
+)
+
+// CompressGuestMemory Writes the guest memory file as a block-compressed file that the VMs
+// with the CompressedRead strategy serve their page faults from
+func CompressGuestMemory(guestMemPath, compressedPath string, blockSize int) error {
+	if blockSize <= 0 {
+		return fmt.Errorf("%w: block size %d is not positive", ErrInvalidConfig, blockSize)
+	}
+
+	src, err := os.Open(guestMemPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	fileInfo, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	size := fileInfo.Size()
+	numBlocks := int((size + int64(blockSize) - 1) / int64(blockSize))
+
+	dst, err := os.Create(compressedPath)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	header := make([]byte, compressedHeaderSize+(numBlocks+1)*8)
+	copy(header, compressedMagic)
+	binary.LittleEndian.PutUint32(header[8:], uint32(blockSize))
+	binary.LittleEndian.PutUint32(header[12:], compressedCodecFlate)
+	binary.LittleEndian.PutUint64(header[16:], uint64(size))
+
+	var (
+		out bytes.Buffer
+		buf = make([]byte, blockSize)
+		off = int64(len(header))
+	)
+	zw, err := flate.NewWriter(&out, flate.DefaultCompression)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < numBlocks; i++ {
+		n, err := io.ReadFull(src, buf)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return err
+		}
+
+		out.Reset()
+		zw.Reset(&out)
+		if _, err := zw.Write(buf[:n]); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+
+		if _, err := dst.WriteAt(out.Bytes(), off); err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint64(header[compressedHeaderSize+i*8:], uint64(off))
+		off += int64(out.Len())
+	}
+	binary.LittleEndian.PutUint64(header[compressedHeaderSize+numBlocks*8:], uint64(off))
+
+	if _, err := dst.WriteAt(header, 0); err != nil {
+		return err
+	}
+
+	return dst.Sync()
+}
+
+// compressedMemory Reads the guest memory from a block-compressed file, decompressing
+// the blocks on demand and caching the recently used ones
+type compressedMemory struct {
+	sync.Mutex
+	f         stateFile
+	blockSize int
+	size      int64
+	index     []uint64
+
+	cache        map[int]*list.Element // Indexed by block, the elements hold *compressedBlock
+	lru          *list.List            // the most recently used block first
+	decompressed int                   // number of the blocks decompressed so far
+}
+
+type compressedBlock struct {
+	block int
+	data  []byte
+}
+
+// openCompressedMemory Reads the header and the index of the block-compressed file,
+// which must hold the guest memory of the size
+func openCompressedMemory(f stateFile, size int) (*compressedMemory, error) {
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, compressedHeaderSize)
+	if _, err := f.ReadAt(header, 0); err != nil || string(header[:8]) != compressedMagic {
+		return nil, fmt.Errorf("not a block-compressed guest memory file")
+	}
+	if codec := binary.LittleEndian.Uint32(header[12:]); codec != compressedCodecFlate {
+		return nil, fmt.Errorf("unsupported codec %d", codec)
+	}
+
+	c := &compressedMemory{
+		f:         f,
+		blockSize: int(binary.LittleEndian.Uint32(header[8:])),
+		size:      int64(binary.LittleEndian.Uint64(header[16:])),
+		cache:     make(map[int]*list.Element),
+		lru:       list.New(),
+	}
+	if c.size != int64(size) {
+		return nil, fmt.Errorf("expected %d bytes of guest memory, found %d", size, c.size)
+	}
+	if c.blockSize <= 0 {
+		return nil, fmt.Errorf("block size %d is not positive", c.blockSize)
+	}
+
+	numBlocks := int((c.size + int64(c.blockSize) - 1) / int64(c.blockSize))
+	buf := make([]byte, (numBlocks+1)*8)
+	if _, err := f.ReadAt(buf, compressedHeaderSize); err != nil {
+		return nil, fmt.Errorf("truncated index: %w", err)
+	}
+
+	c.index = make([]uint64, numBlocks+1)
+	for i := range c.index {
+		c.index[i] = binary.LittleEndian.Uint64(buf[i*8:])
+		if i > 0 && c.index[i] < c.index[i-1] {
+			return nil, fmt.Errorf("offset of block %d is out of order", i)
+		}
+	}
+	if c.index[0] != uint64(compressedHeaderSize+len(buf)) || c.index[numBlocks] != uint64(fileInfo.Size()) {
+		return nil, fmt.Errorf("index does not match the file size %d", fileInfo.Size())
+	}
+
+	return c, nil
+}
+
+// ReadAt Reads the guest memory at the offset, decompressing the blocks that are not cached
+func (c *compressedMemory) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > c.size {
+		return 0, io.EOF
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	for n := 0; n < len(p); {
+		block := int((off + int64(n)) / int64(c.blockSize))
+		data, err := c.getBlock(block)
+		if err != nil {
+			return n, err
+		}
+
+		n += copy(p[n:], data[int(off+int64(n))-block*c.blockSize:])
+	}
+
+	return len(p), nil
+}
+
+// getBlock Returns the decompressed block, must be called with the memory locked
+func (c *compressedMemory) getBlock(block int) ([]byte, error) {
+	if elem, ok := c.cache[block]; ok {
+		c.lru.MoveToFront(elem)
+		return elem.Value.(*compressedBlock).data, nil
+	}
+
+	compressed := make([]byte, c.index[block+1]-c.index[block])
+	if _, err := c.f.ReadAt(compressed, int64(c.index[block])); err != nil {
+		return nil, fmt.Errorf("failed to read block %d: %w", block, err)
+	}
+
+	size := int64(c.blockSize)
+	if rest := c.size - int64(block)*size; rest < size {
+		size = rest
+	}
+	data := make([]byte, size)
+	zr := flate.NewReader(bytes.NewReader(compressed))
+	defer zr.Close()
+	if _, err := io.ReadFull(zr, data); err != nil {
+		return nil, fmt.Errorf("block %d is corrupt: %w", block, err)
+	}
+	c.decompressed++
+
+	if c.lru.Len() == compressedCacheBlocks {
+		oldest := c.lru.Remove(c.lru.Back()).(*compressedBlock)
+		delete(c.cache, oldest.block)
+	}
+	c.cache[block] = c.lru.PushFront(&compressedBlock{block: block, data: data})
+
+	return data, nil
+}
+
+// Close Closes the block-compressed file
+func (c *compressedMemory) Close() error {
+	return c.f.Close()
+}
@@ -0,0 +1,159 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// prepareCompressedGuestMemory Overwrites the guest memory file of the VM with pages of random
+// and zero-filled bytes, and compresses it, returns the uncompressed guest memory
+func prepareCompressedGuestMemory(t *testing.T, cfg *SnapshotStateCfg, blockSize int) []byte {
+	pageSize := os.Getpagesize()
+
+	r := rand.New(rand.NewSource(42))
+	guestMem := make([]byte, cfg.GuestMemSize)
+	for page := 0; page < cfg.GuestMemSize/pageSize; page++ {
+		if page%3 != 0 {
+			r.Read(guestMem[page*pageSize : (page+1)*pageSize])
+		}
+	}
+	require.NoError(t, ioutil.WriteFile(cfg.GuestMemPath, guestMem, 0644), "Failed to write guest memory")
+
+	compressedPath := filepath.Join(cfg.BaseDir, "mem_file.cm")
+	require.NoError(t, CompressGuestMemory(cfg.GuestMemPath, compressedPath, blockSize), "Failed to compress")
+	cfg.GuestMemPath = compressedPath
+	cfg.ReadStrategy = CompressedRead
+
+	return guestMem
+}
+
+func TestCompressedGuestMemoryRoundTrip(t *testing.T) {
+	const pages = 40
+
+	pageSize := os.Getpagesize()
+
+	contents := make(map[uint64][]byte)
+	defer stubCopyingInstallRegion(contents)()
+
+	manager := newTestManager(t, MemoryManagerCfg{InstallChunkPages: 3})
+	cfg := prepareSnapshotStateCfg(t, "vm", pages*pageSize)
+	cfg.IsLazyMode = true
+	// the blocks do not end at the page boundaries, and the last block is shorter
+	guestMem := prepareCompressedGuestMemory(t, &cfg, 3*pageSize+pageSize/2)
+	cfg.GuestMemChecksum = guestMemoryChecksum(guestMem)
+	require.NoError(t, manager.RegisterVM(cfg), "Failed to register VM")
+
+	state := manager.instances["vm"]
+	require.NoError(t, state.mapGuestMemory(context.Background()), "Failed to open compressed guest memory")
+	defer func() { _ = state.unmapGuestMemory() }()
+	state.setupStateOnActivate()
+	state.firstPageFaultOnce.Do(func() { state.startAddress = testStartAddress })
+
+	for page := 0; page < pages; page++ {
+		if !state.servedPages.Test(page) {
+			err := state.servePageFault(-1, testStartAddress+uint64(page*pageSize))
+			require.NoError(t, err, "Failed to serve page fault")
+		}
+	}
+
+	served := 0
+	for dst, content := range contents {
+		offset := int(dst - testStartAddress)
+		require.Equal(t, guestMem[offset:offset+len(content)], content, "Wrong contents of the installed pages")
+		served += len(content)
+	}
+	require.Equal(t, len(guestMem), served, "All pages must be installed")
+}
+
+func TestCompressedMemoryCache(t *testing.T) {
+	pageSize := os.Getpagesize()
+
+	cfg := prepareSnapshotStateCfg(t, "vm", 4*compressedCacheBlocks*pageSize)
+	guestMem := prepareCompressedGuestMemory(t, &cfg, 2*pageSize)
+
+	f, err := os.Open(cfg.GuestMemPath)
+	require.NoError(t, err, "Failed to open compressed guest memory")
+	c, err := openCompressedMemory(f, cfg.GuestMemSize)
+	require.NoError(t, err, "Failed to read the index")
+	defer c.Close()
+
+	buf := make([]byte, pageSize)
+	for i := 0; i < 2; i++ {
+		_, err := c.ReadAt(buf, int64(pageSize))
+		require.NoError(t, err, "Failed to read a page")
+		require.Equal(t, guestMem[pageSize:2*pageSize], buf, "Wrong page contents")
+	}
+	require.Equal(t, 1, c.decompressed, "Cached block must not be decompressed again")
+
+	// reading the whole guest memory evicts the first block
+	all := make([]byte, cfg.GuestMemSize)
+	_, err = c.ReadAt(all, 0)
+	require.NoError(t, err, "Failed to read the guest memory")
+	require.Equal(t, guestMem, all, "Wrong guest memory contents")
+	require.Equal(t, 2*compressedCacheBlocks, c.decompressed, "Wrong number of decompressed blocks")
+	require.Len(t, c.cache, compressedCacheBlocks, "Cache must be bounded")
+
+	_, err = c.ReadAt(buf, int64(cfg.GuestMemSize))
+	require.Error(t, err, "Read past the guest memory must fail")
+}
+
+func TestCompressedGuestMemoryCorrupt(t *testing.T) {
+	pageSize := os.Getpagesize()
+
+	cfg := prepareSnapshotStateCfg(t, "vm", 8*pageSize)
+	guestMem := prepareCompressedGuestMemory(t, &cfg, pageSize)
+
+	open := func(size int) error {
+		f, err := os.Open(cfg.GuestMemPath)
+		require.NoError(t, err, "Failed to open compressed guest memory")
+		defer f.Close()
+		_, err = openCompressedMemory(f, size)
+		return err
+	}
+
+	require.Error(t, open(4*pageSize), "Guest memory of a different size must be rejected")
+
+	data, err := ioutil.ReadFile(cfg.GuestMemPath)
+	require.NoError(t, err, "Failed to read compressed guest memory")
+	require.NoError(t, ioutil.WriteFile(cfg.GuestMemPath, data[:len(data)-1], 0644), "Failed to truncate")
+	require.Error(t, open(len(guestMem)), "Truncated file must be rejected")
+
+	require.NoError(t, ioutil.WriteFile(cfg.GuestMemPath, guestMem, 0644), "Failed to write guest memory")
+	require.Error(t, open(len(guestMem)), "Uncompressed file must be rejected")
+
+	require.True(t, errors.Is(CompressGuestMemory(cfg.GuestMemPath, cfg.GuestMemPath+".cm", 0), ErrInvalidConfig),
+		"Non-positive block size must be rejected")
+
+	cfg.IsLazyMode = false
+	err = newTestManager(t, MemoryManagerCfg{}).RegisterVM(cfg)
+	require.True(t, errors.Is(err, ErrInvalidConfig), "Compressed guest memory must be rejected in record mode")
+}
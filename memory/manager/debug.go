@@ -0,0 +1,101 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync/atomic"
+)
+
+// VMState A point-in-time copy of the state of an active VM, see DumpState
+type VMState struct {
+	VMID         string `json:"vmID"`
+	UFFD         int    `json:"uffd"`         // -1 unless the page faults are served over a uffd
+	StartAddress uint64 `json:"startAddress"` // 0 until the first page fault of the VM
+	ServedPages  int    `json:"servedPages"`  // number of pages installed since the activation
+	Paused       bool   `json:"paused"`
+}
+
+// ManagerState A point-in-time copy of the state of the memory manager, see DumpState
+type ManagerState struct {
+	Active   []VMState `json:"active"`   // sorted by vmID
+	Inactive []string  `json:"inactive"` // vmIDs of the registered VMs that are not active, sorted
+}
+
+// DumpState Returns a copy of the state of the registered VMs for debugging, which is
+// taken under the lock of the memory manager and is not updated afterwards
+func (m *MemoryManager) DumpState() ManagerState {
+	m.Lock()
+	defer m.Unlock()
+
+	dump := ManagerState{
+		Active:   make([]VMState, 0, len(m.instances)),
+		Inactive: make([]string, 0, len(m.instances)),
+	}
+
+	for vmID, state := range m.instances {
+		if !state.isActive {
+			dump.Inactive = append(dump.Inactive, vmID)
+			continue
+		}
+
+		dump.Active = append(dump.Active, state.dumpState())
+	}
+
+	sort.Slice(dump.Active, func(i, j int) bool { return dump.Active[i].VMID < dump.Active[j].VMID })
+	sort.Strings(dump.Inactive)
+
+	return dump
+}
+
+func (s *SnapshotState) dumpState() VMState {
+	uffd := -1
+	if s.userFaultFD != nil {
+		uffd = int(s.userFaultFD.Fd())
+	}
+
+	s.pauseMu.Lock()
+	paused := s.paused
+	s.pauseMu.Unlock()
+
+	return VMState{
+		VMID:         s.VMID,
+		UFFD:         uffd,
+		StartAddress: atomic.LoadUint64(&s.startAddress),
+		ServedPages:  int(atomic.LoadInt64(&s.servedPagesNum)),
+		Paused:       paused,
+	}
+}
+
+// DebugHandler Returns an HTTP handler that writes the state of the memory manager,
+// see DumpState, as JSON. It is not registered anywhere by default.
+func (m *MemoryManager) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(m.DumpState()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
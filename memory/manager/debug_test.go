@@ -0,0 +1,81 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpState(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	manager := newTestManager(t, MemoryManagerCfg{})
+	for _, vmID := range []string{"2", "1", "3"} {
+		stateCfg := prepareSnapshotStateCfg(t, vmID, 4*os.Getpagesize())
+		stateCfg.IsLazyMode = true
+		require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+	}
+
+	state, vm := activateTestVM(t, manager, "2")
+	vm.fault(t, testStartAddress)
+	vm.fault(t, testStartAddress+uint64(2*os.Getpagesize()))
+	waitServedPages(t, state, 2)
+	require.NoError(t, manager.PauseVM("2"), "Failed to pause VM")
+
+	dump := manager.DumpState()
+	require.Len(t, dump.Active, 1, "Only VM 2 is active")
+	active := dump.Active[0]
+	require.Equal(t, "2", active.VMID)
+	require.Equal(t, int(state.userFaultFD.Fd()), active.UFFD, "Wrong uffd")
+	require.EqualValues(t, testStartAddress, active.StartAddress, "Wrong start address")
+	require.Equal(t, 2, active.ServedPages, "Wrong number of served pages")
+	require.True(t, active.Paused, "VM must be reported as paused")
+	require.Equal(t, []string{"1", "3"}, dump.Inactive, "Inactive VMs must be listed in order")
+
+	// the dump is a copy
+	dump.Active[0].ServedPages = 0
+	dump.Inactive[0] = "4"
+	require.Equal(t, 2, manager.DumpState().Active[0].ServedPages, "Dump must not alias the manager state")
+	require.Equal(t, []string{"1", "3"}, manager.DumpState().Inactive, "Dump must not alias the manager state")
+
+	rec := httptest.NewRecorder()
+	manager.DebugHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/memory", nil))
+	require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var served ManagerState
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &served), "Failed to decode the dump")
+	require.Equal(t, manager.DumpState(), served, "Handler must serve the dump")
+
+	require.NoError(t, manager.ResumeVM("2"), "Failed to resume VM")
+	require.NoError(t, manager.Deactivate("2"), "Failed to deactivate VM")
+
+	dump = manager.DumpState()
+	require.Empty(t, dump.Active, "No VM is active")
+	require.Equal(t, []string{"1", "2", "3"}, dump.Inactive, "Deactivated VM must be listed as inactive")
+}
@@ -0,0 +1,78 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEagerRestore(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	pageSize := os.Getpagesize()
+	chunkPages := eagerRestoreChunkSize / pageSize
+	pages := 2*chunkPages + 3
+
+	manager := newTestManager(t, MemoryManagerCfg{})
+	cfg := prepareSnapshotStateCfg(t, "vm", pages*pageSize)
+	cfg.IsLazyMode = true
+	cfg.EagerRestore = true
+	require.NoError(t, manager.RegisterVM(cfg), "Failed to register VM")
+
+	state := manager.instances["vm"]
+	state.guestMem = make([]byte, state.GuestMemSize)
+	state.setupStateOnActivate()
+	uffd, fakeVM := newFakeUFFD(t, state)
+	events := []syscall.EpollEvent{{Events: syscall.EPOLLIN, Fd: int32(uffd)}}
+
+	fakeVM.fault(t, testStartAddress)
+	require.NoError(t, state.handleEvents(events), "Failed to handle events")
+
+	require.Equal(t, []installCall{
+		{dst: testStartAddress + uint64(chunkPages*pageSize), len: uint64(chunkPages * pageSize)},
+		{dst: testStartAddress + uint64(2*chunkPages*pageSize), len: uint64(3 * pageSize)},
+		{dst: testStartAddress, len: uint64(chunkPages * pageSize)},
+	}, installs, "Guest memory must be installed in chunks, the faulting one last")
+	require.Equal(t, pages, state.servedPages.Count(), "All pages must be served")
+
+	pagesNum, _, err := manager.WorkingSetSize("vm")
+	require.NoError(t, err, "Failed to get the working set size")
+	require.Equal(t, pages, pagesNum, "All pages must be in the working set")
+
+	_, copied, err := manager.GetInstallStats("vm")
+	require.NoError(t, err, "Failed to get the install stats")
+	require.Equal(t, pages, copied, "All pages must be copied")
+	require.EqualValues(t, 1, state.faultsServed, "Only the first page fault must be served")
+}
+
+func TestEagerRestoreRecordMode(t *testing.T) {
+	manager := newTestManager(t, MemoryManagerCfg{})
+	cfg := prepareSnapshotStateCfg(t, "vm", 4*os.Getpagesize())
+	cfg.EagerRestore = true
+	require.Error(t, manager.RegisterVM(cfg), "Eager restore with record and replay must be rejected")
+}
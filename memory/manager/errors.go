@@ -0,0 +1,115 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrShutdown The memory manager is shut down and does not accept VMs anymore
+	ErrShutdown = errors.New("memory manager is shut down")
+	// ErrInvalidConfig The configuration of the VM or the memory manager is invalid
+	ErrInvalidConfig = errors.New("invalid configuration")
+	// ErrVMNotRegistered The VM is not registered with the memory manager
+	ErrVMNotRegistered = errors.New("VM not registered with the memory manager")
+	// ErrVMAlreadyRegistered The VM is registered with the memory manager already
+	ErrVMAlreadyRegistered = errors.New("VM already registered with the memory manager")
+	// ErrVMAlreadyActive The VM is active already
+	ErrVMAlreadyActive = errors.New("VM already active")
+	// ErrVMNotActive The VM is not active
+	ErrVMNotActive = errors.New("VM not active")
+	// ErrVMStillActive The operation requires the VM to be deactivated first
+	ErrVMStillActive = errors.New("VM still active")
+	// ErrFDNotFound The uffd of the VM has not been received over its socket
+	ErrFDNotFound = errors.New("uffd not received from the VM")
+	// ErrMetricsModeOff The operation requires the metrics mode
+	ErrMetricsModeOff = errors.New("metrics mode is not on")
+	// ErrNotReplayed The VM has not served page faults from a recorded working set
+	ErrNotReplayed = errors.New("VM not replayed from a working set")
+	// ErrUnsupported The kernel does not support the userfaultfd feature that the VM requires
+	ErrUnsupported = errors.New("not supported by the kernel")
+	// ErrNotWriteProtected The operation requires the VM to be in the write-protect mode
+	ErrNotWriteProtected = errors.New("VM not in the write-protect mode")
+	// ErrFaultOutOfRange The page fault address is outside of the guest memory of the VM
+	ErrFaultOutOfRange = errors.New("page fault outside of the guest memory")
+	// ErrVMAlreadyPaused The page faults of the VM are not served already, see PauseVM
+	ErrVMAlreadyPaused = errors.New("VM already paused")
+	// ErrVMNotPaused The page faults of the VM are served, see ResumeVM
+	ErrVMNotPaused = errors.New("VM not paused")
+	// ErrNotProfiled The operation requires the page frequency profiling, see ProfilePageFrequency
+	ErrNotProfiled = errors.New("page frequency profiling is off")
+	// ErrGuestMemRead The guest memory file failed or timed out to be read upon a page fault, e.g., on
+	// a flaky network filesystem. The faulting thread of the VM is not woken up, so it should be terminated.
+	ErrGuestMemRead = errors.New("failed to read the guest memory file")
+	// ErrTooManyActiveVMs The VM cannot be activated as MaxActiveVMs are active already
+	ErrTooManyActiveVMs = errors.New("too many active VMs")
+)
+
+// VMError An error of a VM, either returned by the memory manager, wrapping one of the
+// sentinel errors above, or reported while serving page faults of the VM
+type VMError struct {
+	VMID string
+	Err  error
+}
+
+func (e *VMError) Error() string {
+	return fmt.Sprintf("VM %s: %v", e.VMID, e.Err)
+}
+
+func (e *VMError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigErrors The problems found in the configuration or the state files of a VM by ValidateConfig,
+// or in the configuration of the memory manager by NewMemoryManager, in which case VMID is empty
+type ConfigErrors struct {
+	VMID string
+	Errs []error
+}
+
+func (e *ConfigErrors) Error() string {
+	msgs := make([]string, 0, len(e.Errs))
+	for _, err := range e.Errs {
+		msgs = append(msgs, err.Error())
+	}
+
+	if e.VMID == "" {
+		return fmt.Sprintf("%d configuration problems: %s", len(e.Errs), strings.Join(msgs, "; "))
+	}
+
+	return fmt.Sprintf("VM %s: %d configuration problems: %s", e.VMID, len(e.Errs), strings.Join(msgs, "; "))
+}
+
+// Is Returns true if any of the problems matches the target
+func (e *ConfigErrors) Is(target error) bool {
+	for _, err := range e.Errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,303 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/ftrvxmtrx/fd"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSentinelErrors(t *testing.T) {
+	manager := newTestManager(t, MemoryManagerCfg{})
+
+	stateCfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+	stateCfg.IsLazyMode = true
+	vms := serveFakeUFFDs(t, &stateCfg)
+
+	requireVMError := func(err, target error) {
+		t.Helper()
+
+		require.True(t, errors.Is(err, target), "Wrong sentinel error")
+
+		var vmErr *VMError
+		require.True(t, errors.As(err, &vmErr), "Error must carry the VM")
+		require.Equal(t, "1", vmErr.VMID, "Wrong VM of the error")
+	}
+
+	requireVMError(manager.Activate("1"), ErrVMNotRegistered)
+	requireVMError(manager.Deactivate("1"), ErrVMNotRegistered)
+	requireVMError(manager.DeregisterVM("1"), ErrVMNotRegistered)
+	_, err := manager.FetchState("1")
+	requireVMError(err, ErrVMNotRegistered)
+	_, _, err = manager.GetInstallStats("1")
+	requireVMError(err, ErrVMNotRegistered)
+
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+	requireVMError(manager.RegisterVM(stateCfg), ErrVMAlreadyRegistered)
+
+	_, err = manager.GetUPFLatencyStats("1")
+	requireVMError(err, ErrMetricsModeOff)
+	_, err = manager.DirtyPages("1")
+	requireVMError(err, ErrNotWriteProtected)
+
+	require.NoError(t, manager.Activate("1"), "Failed to activate VM")
+	<-vms
+
+	requireVMError(manager.Activate("1"), ErrVMAlreadyActive)
+	requireVMError(manager.DeregisterVM("1"), ErrVMStillActive)
+	_, err = manager.GetUPFLatencyStats("1")
+	requireVMError(err, ErrVMStillActive)
+
+	require.NoError(t, manager.Deactivate("1"), "Failed to deactivate VM")
+	requireVMError(manager.Deactivate("1"), ErrVMNotActive)
+
+	require.NoError(t, manager.Shutdown(context.Background()), "Failed to shut down")
+	require.True(t, errors.Is(manager.Activate("1"), ErrShutdown), "Activation after shutdown must be rejected")
+	require.True(t, errors.Is(manager.RegisterVM(stateCfg), ErrShutdown), "Registration after shutdown must be rejected")
+}
+
+func TestRegisterVMInvalidConfig(t *testing.T) {
+	manager := newTestManager(t, MemoryManagerCfg{})
+
+	stateCfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+	stateCfg.PageSize = 3 * os.Getpagesize()
+	require.True(t, errors.Is(manager.RegisterVM(stateCfg), ErrInvalidConfig), "Invalid page size must be rejected")
+
+	stateCfg.PageSize = 0
+	stateCfg.GuestMemSize++
+	require.True(t, errors.Is(manager.RegisterVM(stateCfg), ErrInvalidConfig), "Invalid memory size must be rejected")
+}
+
+func TestActivateFDNotFound(t *testing.T) {
+	manager := newTestManager(t, MemoryManagerCfg{})
+
+	stateCfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+	stateCfg.IsLazyMode = true
+	stateCfg.InstanceSockAddr = filepath.Join(stateCfg.BaseDir, "sock")
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+
+	// the VM accepts the connection but closes it without passing the uffd
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: stateCfg.InstanceSockAddr, Net: "unix"})
+	require.NoError(t, err, "Failed to listen on the VM socket")
+	defer l.Close()
+	go func() {
+		if c, err := l.AcceptUnix(); err == nil {
+			c.Close()
+		}
+	}()
+
+	err = manager.Activate("1")
+	require.True(t, errors.Is(err, ErrFDNotFound), "Missing uffd must be reported")
+	require.False(t, manager.instances["1"].isActive, "VM must be left inactive")
+}
+
+// stubCheckUFFD Fails the check of the received uffds with the error until the returned function,
+// which is also called when the test finishes, restores the previous check
+func stubCheckUFFD(t *testing.T, err error) func() {
+	prev := checkUFFDFunc
+	checkUFFDFunc = func(f *os.File) error { return err }
+
+	restore := func() { checkUFFDFunc = prev }
+	t.Cleanup(restore)
+
+	return restore
+}
+
+// stubEpollCreate Fails the creation of epoll instances with the error until the returned function,
+// which is also called when the test finishes, restores the previous one
+func stubEpollCreate(t *testing.T, err error) func() {
+	prev := epollCreateFunc
+	epollCreateFunc = func(flag int) (int, error) { return -1, err }
+
+	restore := func() { epollCreateFunc = prev }
+	t.Cleanup(restore)
+
+	return restore
+}
+
+func TestActivateEpollCreateFailure(t *testing.T) {
+	manager := newTestManager(t, MemoryManagerCfg{})
+
+	stateCfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+	stateCfg.IsLazyMode = true
+	vms := serveFakeUFFDs(t, &stateCfg)
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+
+	restore := stubEpollCreate(t, syscall.EMFILE)
+	err := manager.Activate("1")
+	restore()
+	require.True(t, errors.Is(err, syscall.EMFILE), "Epoll creation failure must be returned")
+	require.False(t, manager.instances["1"].isActive, "VM must be left inactive")
+	<-vms
+
+	// the memory manager keeps serving once the epoll instance can be created again
+	require.NoError(t, manager.Activate("1"), "Failed to activate VM")
+	<-vms
+	require.NoError(t, manager.Deactivate("1"), "Failed to deactivate VM")
+}
+
+func TestActivateFailureRestoresInactiveVM(t *testing.T) {
+	manager := newTestManager(t, MemoryManagerCfg{})
+
+	stateCfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+	stateCfg.IsLazyMode = true
+	vms := serveFakeUFFDs(t, &stateCfg)
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+
+	require.NoError(t, manager.Activate("1"), "Failed to activate VM")
+	<-vms
+	require.NoError(t, manager.Deactivate("1"), "Failed to deactivate VM")
+
+	state := manager.instances["1"]
+	requireRestored := func(step string) {
+		require.False(t, state.isActive, "VM must be left inactive after the "+step+" failure")
+		require.Nil(t, state.guestMem, "Guest memory must be unmapped after the "+step+" failure")
+		require.Nil(t, state.guestMemFile, "Guest memory file must be closed after the "+step+" failure")
+		require.Nil(t, state.userFaultFD, "Uffd must be dropped after the "+step+" failure")
+		require.Equal(t, state, manager.instances["1"], "VM must stay registered after the "+step+" failure")
+		require.NotNil(t, state.inactiveElem, "VM must be back in the inactive list after the "+step+" failure")
+		require.Equal(t, 1, manager.inactive.Len(), "Wrong number of inactive VMs after the "+step+" failure")
+	}
+
+	// mapping the guest memory fails
+	hidden := stateCfg.GuestMemPath + ".hidden"
+	require.NoError(t, os.Rename(stateCfg.GuestMemPath, hidden), "Failed to hide the guest memory file")
+	require.Error(t, manager.Activate("1"), "Mapping failure must be returned")
+	require.NoError(t, os.Rename(hidden, stateCfg.GuestMemPath), "Failed to restore the guest memory file")
+	requireRestored("mapping")
+
+	// receiving the uffd fails
+	restore := stubCheckUFFD(t, syscall.EINVAL)
+	err := manager.Activate("1")
+	restore()
+	require.True(t, errors.Is(err, ErrFDNotFound), "Uffd failure must be returned")
+	<-vms
+	requireRestored("uffd")
+
+	// subscribing to the uffd fails
+	restore = stubEpollCreate(t, syscall.EMFILE)
+	err = manager.Activate("1")
+	restore()
+	require.True(t, errors.Is(err, syscall.EMFILE), "Epoll creation failure must be returned")
+	<-vms
+	requireRestored("epoller")
+
+	require.NoError(t, manager.Activate("1"), "Failed to activate VM")
+	<-vms
+	require.Nil(t, state.inactiveElem, "Active VM must not be in the inactive list")
+	require.NoError(t, manager.Deactivate("1"), "Failed to deactivate VM")
+}
+
+func TestActivateRejectsOtherFDs(t *testing.T) {
+	manager := newTestManager(t, MemoryManagerCfg{})
+
+	stateCfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+	stateCfg.IsLazyMode = true
+	stateCfg.InstanceSockAddr = filepath.Join(stateCfg.BaseDir, "sock")
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+
+	// the VM passes the read end of a pipe instead of its uffd
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: stateCfg.InstanceSockAddr, Net: "unix"})
+	require.NoError(t, err, "Failed to listen on the VM socket")
+	defer l.Close()
+	go func() {
+		c, err := l.AcceptUnix()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		if r, w, err := os.Pipe(); err == nil {
+			_ = fd.Put(c, r)
+			r.Close()
+			w.Close()
+		}
+	}()
+
+	err = manager.Activate("1")
+	require.True(t, errors.Is(err, ErrFDNotFound), "Fd other than a uffd must be rejected")
+	require.Contains(t, err.Error(), "not a userfaultfd")
+	require.False(t, manager.instances["1"].isActive, "VM must be left inactive")
+}
+
+func TestOnServeError(t *testing.T) {
+	pageSize := os.Getpagesize()
+	failedAddress := testStartAddress + uint64(2*pageSize)
+
+	installer, restore := stubInstaller()
+	defer restore()
+	installer.copy = func(fd int, src, dst, mode, len uint64) error {
+		if dst == failedAddress {
+			return syscall.EIO
+		}
+		return nil
+	}
+
+	type serveError struct {
+		vmID   string
+		offset uint64
+		err    error
+	}
+	var serveErrors []serveError
+
+	cfg := prepareSnapshotStateCfg(t, "1", 4*pageSize)
+	cfg.IsLazyMode = true
+	manager := newTestManager(t, MemoryManagerCfg{
+		OnServeError: func(vmID string, offset uint64, err error) {
+			serveErrors = append(serveErrors, serveError{vmID: vmID, offset: offset, err: err})
+		},
+	})
+	require.NoError(t, manager.RegisterVM(cfg), "Failed to register VM")
+
+	state := manager.instances["1"]
+	require.NoError(t, state.mapGuestMemory(context.Background()), "Failed to open guest memory")
+	defer func() { _ = state.unmapGuestMemory() }()
+	state.setupStateOnActivate()
+	state.firstPageFaultOnce.Do(func() { state.startAddress = testStartAddress })
+
+	require.NoError(t, state.servePageFault(-1, testStartAddress), "Failed to serve page fault")
+	require.Empty(t, serveErrors, "Served page fault must not be reported")
+
+	// the fault address points into the page
+	err := state.servePageFault(-1, failedAddress+8)
+	require.True(t, errors.Is(err, syscall.EIO), "Install failure must be returned")
+	require.Len(t, serveErrors, 1, "Install failure must be reported once")
+	require.Equal(t, "1", serveErrors[0].vmID, "Wrong VM of the serve error")
+	require.Equal(t, uint64(2*pageSize), serveErrors[0].offset, "Wrong offset of the serve error")
+	require.True(t, errors.Is(serveErrors[0].err, syscall.EIO), "Wrong serve error")
+
+	count, err := manager.ServeErrors("1")
+	require.NoError(t, err, "Failed to get the serve errors")
+	require.Equal(t, int64(1), count, "Wrong number of serve errors")
+	require.Equal(t, int64(1), state.lifetimeMetrics().ServeErrors, "Serve errors must be in the lifetime metrics")
+
+	_, err = manager.ServeErrors("2")
+	require.True(t, errors.Is(err, ErrVMNotRegistered), "Unknown VM must be reported")
+}
@@ -0,0 +1,85 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"container/list"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// markInactive Moves the deactivated instance to the front of the inactive list and
+// evicts the least recently deactivated instances beyond MaxInactive.
+// Must be called with the manager locked.
+func (m *MemoryManager) markInactive(state *SnapshotState) {
+	if state.inactiveElem != nil {
+		m.inactive.MoveToFront(state.inactiveElem)
+	} else {
+		state.inactiveElem = m.inactive.PushFront(state)
+	}
+
+	if m.MaxInactive <= 0 {
+		return
+	}
+
+	for m.inactive.Len() > m.MaxInactive {
+		m.evict(m.inactive.Back())
+	}
+}
+
+// markActive Removes the instance from the inactive list so that it is never evicted
+// while it is active. Must be called with the manager locked.
+func (m *MemoryManager) markActive(state *SnapshotState) {
+	if state.inactiveElem != nil {
+		m.inactive.Remove(state.inactiveElem)
+		state.inactiveElem = nil
+	}
+}
+
+// evict Deregisters the inactive instance, dropping its record and the working set kept
+// in memory, which is loaded again from the persisted files if the VM is registered again.
+// Must be called with the manager locked.
+func (m *MemoryManager) evict(elem *list.Element) {
+	state := m.inactive.Remove(elem).(*SnapshotState)
+	state.inactiveElem = nil
+
+	log.WithFields(log.Fields{"vmID": state.VMID}).Debug("Evicting inactive VM from the memory manager")
+
+	if state.sharedMem != nil {
+		m.releaseSharedMemory(state.BaseSnapshotID)
+		state.sharedMem = nil
+	}
+	if state.base != nil {
+		m.releaseBaseImage(state.BaseImagePath)
+		state.base = nil
+	}
+
+	state.stopWorkingSetStream()
+	state.workingSet = nil
+	state.trace = state.newTrace()
+	state.isRecordReady = false
+
+	m.recordMetrics(state)
+	state.closeGuestMemFD()
+	delete(m.instances, state.VMID)
+}
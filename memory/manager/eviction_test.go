@@ -0,0 +1,142 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvictInactiveVMs(t *testing.T) {
+	manager := newTestManager(t, MemoryManagerCfg{MaxInactive: 2})
+
+	vms := make(map[string]<-chan *fakeVM)
+	for _, vmID := range []string{"1", "2", "3", "4", "5"} {
+		stateCfg := prepareSnapshotStateCfg(t, vmID, 4*os.Getpagesize())
+		stateCfg.IsLazyMode = true
+		vms[vmID] = serveFakeUFFDs(t, &stateCfg)
+
+		err := manager.RegisterVM(stateCfg)
+		require.NoError(t, err, "Failed to register VM")
+	}
+
+	activate := func(vmID string) {
+		err := manager.Activate(vmID)
+		require.NoError(t, err, "Failed to activate VM")
+		<-vms[vmID]
+	}
+	deactivate := func(vmID string) {
+		err := manager.Deactivate(vmID)
+		require.NoError(t, err, "Failed to deactivate VM")
+	}
+	registered := func(vmIDs ...string) {
+		require.Len(t, manager.instances, len(vmIDs), "Wrong number of registered VMs")
+		for _, vmID := range vmIDs {
+			require.Contains(t, manager.instances, vmID, "Recently deactivated and active VMs must survive")
+		}
+	}
+
+	for _, vmID := range []string{"1", "2", "3", "4", "5"} {
+		activate(vmID)
+	}
+
+	// VMs that have never been deactivated are not eviction candidates
+	registered("1", "2", "3", "4", "5")
+
+	for _, vmID := range []string{"1", "2", "3", "4"} {
+		deactivate(vmID)
+	}
+	registered("3", "4", "5")
+	require.True(t, manager.instances["5"].isActive, "Active VM must not be evicted")
+
+	// reactivating a VM makes it the most recently deactivated one
+	activate("3")
+	deactivate("3")
+	deactivate("5")
+	registered("3", "5")
+
+	err := manager.Activate("1")
+	require.Error(t, err, "Evicted VM must be registered again")
+
+	err = manager.Shutdown(context.Background())
+	require.NoError(t, err, "Failed to shut down")
+}
+
+func TestEvictInactiveVMsDisabled(t *testing.T) {
+	manager := newTestManager(t, MemoryManagerCfg{})
+
+	for _, vmID := range []string{"1", "2", "3"} {
+		stateCfg := prepareSnapshotStateCfg(t, vmID, 4*os.Getpagesize())
+		stateCfg.IsLazyMode = true
+		vms := serveFakeUFFDs(t, &stateCfg)
+
+		err := manager.RegisterVM(stateCfg)
+		require.NoError(t, err, "Failed to register VM")
+		err = manager.Activate(vmID)
+		require.NoError(t, err, "Failed to activate VM")
+		<-vms
+		err = manager.Deactivate(vmID)
+		require.NoError(t, err, "Failed to deactivate VM")
+	}
+
+	require.Len(t, manager.instances, 3, "All inactive VMs must be kept by default")
+	require.Equal(t, 3, manager.inactive.Len(), "Deactivated VMs must be tracked")
+
+	err := manager.DeregisterVM("2")
+	require.NoError(t, err, "Failed to deregister VM")
+	require.Equal(t, 2, manager.inactive.Len(), "Deregistered VM must not be tracked")
+}
+
+func TestEvictVMWithFailedRecord(t *testing.T) {
+	manager := newTestManager(t, MemoryManagerCfg{MaxInactive: 1})
+
+	vms := make(map[string]<-chan *fakeVM)
+	for _, vmID := range []string{"1", "2"} {
+		stateCfg := prepareSnapshotStateCfg(t, vmID, 4*os.Getpagesize())
+		stateCfg.FunctionVersion = "v1"
+		vms[vmID] = serveFakeUFFDs(t, &stateCfg)
+
+		err := manager.RegisterVM(stateCfg)
+		require.NoError(t, err, "Failed to register VM")
+	}
+
+	// the version of the record of the first VM cannot be written over a directory
+	state := manager.instances["1"]
+	require.NoError(t, os.Mkdir(state.getVersionFile(), 0755), "Failed to block the version file")
+
+	require.NoError(t, manager.Activate("1"), "Failed to activate VM")
+	<-vms["1"]
+	require.Error(t, manager.Deactivate("1"), "Failed record must be reported")
+	require.False(t, state.isActive, "VM must be inactive once deactivated")
+	require.False(t, state.isRecordReady, "Failed record must not be replayed")
+	require.Equal(t, 1, manager.inactive.Len(), "VM with the failed record must be an eviction candidate")
+
+	require.NoError(t, manager.Activate("2"), "Failed to activate VM")
+	<-vms["2"]
+	require.NoError(t, manager.Deactivate("2"), "Failed to deactivate VM")
+	require.NotContains(t, manager.instances, "1", "VM with the failed record must be evicted")
+	require.Contains(t, manager.instances, "2", "Recently deactivated VM must survive")
+}
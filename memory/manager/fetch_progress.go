@@ -0,0 +1,83 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"context"
+)
+
+// fetchChunkPages is the number of pages read at once by the fetches that report their progress
+const fetchChunkPages = 512
+
+// fetchProgress Reports the number of the pages fetched so far to the callback of the caller
+// every `every` pages and once all pages are fetched, and aborts the fetch once its context is done
+type fetchProgress struct {
+	ctx      context.Context
+	every    int
+	fn       func(fetched, total int)
+	total    int
+	fetched  int
+	reported int
+}
+
+// newFetchProgress Returns the progress of a fetch of the pages, every is at least one page
+func newFetchProgress(ctx context.Context, every int, fn func(fetched, total int)) *fetchProgress {
+	if every < 1 {
+		every = 1
+	}
+
+	return &fetchProgress{ctx: ctx, every: every, fn: fn}
+}
+
+// start Starts a fetch of the pages, resetting the progress of a previous one
+func (p *fetchProgress) start(total int) {
+	if p == nil {
+		return
+	}
+
+	p.total, p.fetched, p.reported = total, 0, 0
+}
+
+// chunkPages Returns the number of the pages to read at once
+func (p *fetchProgress) chunkPages() int {
+	if p == nil || p.every > fetchChunkPages {
+		return fetchChunkPages
+	}
+
+	return p.every
+}
+
+// add Accounts for the fetched pages, returns an error if the fetch is to be aborted
+func (p *fetchProgress) add(pages int) error {
+	if p == nil {
+		return nil
+	}
+
+	p.fetched += pages
+	if p.fn != nil && (p.fetched-p.reported >= p.every || p.fetched == p.total) && p.fetched > p.reported {
+		p.reported = p.fetched
+		p.fn(p.fetched, p.total)
+	}
+
+	return p.ctx.Err()
+}
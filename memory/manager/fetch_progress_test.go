@@ -0,0 +1,106 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// recordProgress Returns the progress callback that records the reported counts
+func recordProgress(t *testing.T, fetched *[]int) func(int, int) {
+	return func(n, total int) {
+		if len(*fetched) > 0 {
+			require.Greater(t, n, (*fetched)[len(*fetched)-1], "Progress must increase monotonically")
+		}
+		require.LessOrEqual(t, n, total, "Progress must not exceed the total")
+		*fetched = append(*fetched, n)
+	}
+}
+
+func TestFetchStateProgressWorkingSet(t *testing.T) {
+	manager := newTestManager(t, MemoryManagerCfg{})
+
+	pageSize := uint64(os.Getpagesize())
+	stateCfg := prepareSnapshotStateCfg(t, "1", 16*int(pageSize))
+	offsets := make([]uint64, 10)
+	for i := range offsets {
+		offsets[i] = uint64(i) * pageSize
+	}
+	persistRecord(t, stateCfg, offsets)
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+
+	var fetched []int
+	pages, err := manager.FetchStateWithProgress(context.Background(), stateCfg.VMID, 3, recordProgress(t, &fetched))
+	require.NoError(t, err, "Failed to fetch state")
+	require.Equal(t, len(offsets), pages, "Wrong number of prefetched pages")
+	require.Equal(t, []int{3, 6, 9, 10}, fetched, "Progress must be reported every 3 pages and at the end")
+}
+
+func TestFetchStateProgressResidency(t *testing.T) {
+	manager := newTestManager(t, MemoryManagerCfg{})
+
+	pages := 16
+	stateCfg := prepareSnapshotStateCfg(t, "1", pages*os.Getpagesize())
+	stateCfg.IsLazyMode = true
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+
+	resident := newPageBitmap(pages)
+	resident.SetRange(1, 5)
+	resident.SetRange(8, 4)
+	err := ioutil.WriteFile(filepath.Join(stateCfg.BaseDir, "residency"), resident.encode(), 0644)
+	require.NoError(t, err, "Failed to write the residency file")
+
+	var fetched []int
+	n, err := manager.FetchStateWithProgress(context.Background(), stateCfg.VMID, 4, recordProgress(t, &fetched))
+	require.NoError(t, err, "Failed to fetch state")
+	require.Equal(t, 9, n, "Wrong number of resident pages")
+	require.True(t, len(fetched) > 0, "Progress must be reported")
+	require.Equal(t, 9, fetched[len(fetched)-1], "Last progress must report all pages")
+}
+
+func TestFetchStateProgressCancel(t *testing.T) {
+	manager := newTestManager(t, MemoryManagerCfg{})
+
+	pageSize := uint64(os.Getpagesize())
+	stateCfg := prepareSnapshotStateCfg(t, "1", 8*int(pageSize))
+	persistRecord(t, stateCfg, []uint64{0, pageSize, 2 * pageSize, 3 * pageSize})
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	calls := 0
+	_, err := manager.FetchStateWithProgress(ctx, stateCfg.VMID, 1, func(fetched, total int) {
+		calls++
+		cancel()
+	})
+	require.True(t, errors.Is(err, context.Canceled), "Canceled fetch must be aborted")
+	require.Equal(t, 1, calls, "Fetch must stop upon cancellation")
+}
@@ -0,0 +1,157 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	// firecrackerMagicX86, firecrackerMagicAarch64 Magic numbers of the Firecracker snapshot files on x86-64 and aarch64,
+	// whose low 16 bits are the version of the snapshot format
+	firecrackerMagicX86     = 0x0710_1984_8664_0000
+	firecrackerMagicAarch64 = 0x0710_1984_aaaa_0000
+	firecrackerFormatMask   = 0xffff
+	// firecrackerVMInfoVersion First data version of the snapshots that start with the VM info,
+	// i.e., the size of the guest memory in MiB
+	firecrackerVMInfoVersion = 2
+	// maxFirecrackerRegions Bound on the number of the guest memory regions of a snapshot,
+	// so that a corrupt file does not make the parser allocate arbitrary amounts of memory
+	maxFirecrackerRegions = 1024
+	maxInt                = int(^uint(0) >> 1)
+)
+
+// FirecrackerMemoryRegion A region of the guest memory of a Firecracker snapshot, at GuestAddress
+// in the guest-physical address space and backed by the Size bytes at Offset in the guest memory
+// file. Unlike a MemoryRegion, its address is not the one the VMM maps the region at.
+type FirecrackerMemoryRegion struct {
+	GuestAddress uint64
+	Size         int
+	Offset       int
+}
+
+// FirecrackerSnapshot The guest memory layout that a Firecracker snapshot (VMM state) file records
+type FirecrackerSnapshot struct {
+	DataVersion  uint16 // version of the state of the Firecracker that wrote the snapshot
+	GuestMemSize int
+	Regions      []FirecrackerMemoryRegion
+}
+
+// ParseFirecrackerSnapshot Reads the guest memory layout from the start of a Firecracker snapshot file:
+// the magic number, the data version and the parts of the versionized state of the microVM that
+// precede the state of the VM, i.e., the VM info and the regions of the guest memory. The regions
+// must back the guest memory file contiguously, in the order of their offsets.
+func ParseFirecrackerSnapshot(r io.Reader) (*FirecrackerSnapshot, error) {
+	br := bufio.NewReader(r)
+
+	var hdr struct {
+		Magic       uint64
+		DataVersion uint16
+	}
+	if err := binary.Read(br, binary.LittleEndian, &hdr); err != nil {
+		return nil, fmt.Errorf("failed to read the snapshot header: %w", err)
+	}
+	switch hdr.Magic &^ firecrackerFormatMask {
+	case firecrackerMagicX86, firecrackerMagicAarch64:
+	default:
+		return nil, fmt.Errorf("not a Firecracker snapshot: magic number %#x", hdr.Magic)
+	}
+
+	snap := &FirecrackerSnapshot{DataVersion: hdr.DataVersion}
+
+	var memSizeMiB uint64
+	if hdr.DataVersion >= firecrackerVMInfoVersion {
+		if err := binary.Read(br, binary.LittleEndian, &memSizeMiB); err != nil {
+			return nil, fmt.Errorf("failed to read the VM info: %w", err)
+		}
+	}
+
+	var numRegions uint64
+	if err := binary.Read(br, binary.LittleEndian, &numRegions); err != nil {
+		return nil, fmt.Errorf("failed to read the guest memory state: %w", err)
+	}
+	if numRegions == 0 || numRegions > maxFirecrackerRegions {
+		return nil, fmt.Errorf("invalid number of the guest memory regions: %d", numRegions)
+	}
+
+	for i := uint64(0); i < numRegions; i++ {
+		var region struct {
+			BaseAddress, Size, Offset uint64
+		}
+		if err := binary.Read(br, binary.LittleEndian, &region); err != nil {
+			return nil, fmt.Errorf("failed to read guest memory region %d: %w", i, err)
+		}
+		if region.Offset != uint64(snap.GuestMemSize) {
+			return nil, fmt.Errorf("guest memory region %d starts at offset %d instead of %d", i, region.Offset, snap.GuestMemSize)
+		}
+		if region.Size == 0 || region.Size > uint64(maxInt-snap.GuestMemSize) {
+			return nil, fmt.Errorf("invalid size %d of guest memory region %d", region.Size, i)
+		}
+
+		snap.Regions = append(snap.Regions, FirecrackerMemoryRegion{
+			GuestAddress: region.BaseAddress,
+			Size:         int(region.Size),
+			Offset:       int(region.Offset),
+		})
+		snap.GuestMemSize += int(region.Size)
+	}
+
+	if memSizeMiB != 0 && uint64(snap.GuestMemSize) != memSizeMiB<<20 {
+		return nil, fmt.Errorf("guest memory regions cover %d bytes of the %d MiB of the VM", snap.GuestMemSize, memSizeMiB)
+	}
+
+	return snap, nil
+}
+
+// applyFirecrackerState Derives the size of the guest memory of the VM from its Firecracker snapshot
+// file if it is not set, or checks it against the snapshot otherwise
+func (m *MemoryManager) applyFirecrackerState(cfg *SnapshotStateCfg) error {
+	if m.RemoteStore != nil {
+		return fmt.Errorf("%w: the Firecracker snapshot is read upon registration, before the remote store is fetched from",
+			ErrInvalidConfig)
+	}
+
+	f, err := m.StateFS.Open(cfg.VMMStatePath)
+	if err != nil {
+		return fmt.Errorf("%w: VMM state file: %v", ErrInvalidConfig, err)
+	}
+	defer f.Close()
+
+	snap, err := ParseFirecrackerSnapshot(f)
+	if err != nil {
+		return fmt.Errorf("%w: VMM state file %s: %v", ErrInvalidConfig, cfg.VMMStatePath, err)
+	}
+
+	switch {
+	case cfg.GuestMemSize == 0:
+		cfg.GuestMemSize = snap.GuestMemSize
+	case cfg.GuestMemSize != snap.GuestMemSize:
+		return fmt.Errorf("%w: guest memory size %d differs from the %d bytes of the Firecracker snapshot",
+			ErrInvalidConfig, cfg.GuestMemSize, snap.GuestMemSize)
+	}
+
+	return nil
+}
@@ -0,0 +1,133 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// firecrackerSnapshotFixture Firecracker snapshot file of an x86-64 VM with 1 MiB of guest memory
+const firecrackerSnapshotFixture = "testdata/firecracker_vmstate"
+
+// firecrackerSnapshotFile Encodes the start of a Firecracker snapshot file with the given regions,
+// each a {base address, size, offset} triple
+func firecrackerSnapshotFile(magic uint64, dataVersion uint16, memSizeMiB uint64, regions [][3]uint64) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, magic)
+	binary.Write(&buf, binary.LittleEndian, dataVersion)
+	if dataVersion >= firecrackerVMInfoVersion {
+		binary.Write(&buf, binary.LittleEndian, memSizeMiB)
+	}
+	binary.Write(&buf, binary.LittleEndian, uint64(len(regions)))
+	for _, region := range regions {
+		binary.Write(&buf, binary.LittleEndian, region)
+	}
+
+	return buf.Bytes()
+}
+
+func TestParseFirecrackerSnapshotFixture(t *testing.T) {
+	f, err := os.Open(firecrackerSnapshotFixture)
+	require.NoError(t, err, "Failed to open the fixture")
+	defer f.Close()
+
+	snap, err := ParseFirecrackerSnapshot(f)
+	require.NoError(t, err, "Failed to parse the fixture")
+	require.Equal(t, &FirecrackerSnapshot{
+		DataVersion:  3,
+		GuestMemSize: 1 << 20,
+		Regions:      []FirecrackerMemoryRegion{{GuestAddress: 0, Size: 1 << 20, Offset: 0}},
+	}, snap, "Wrong guest memory layout")
+}
+
+func TestParseFirecrackerSnapshot(t *testing.T) {
+	// e.g., an x86-64 VM with more memory than fits below the 32-bit MMIO gap
+	file := firecrackerSnapshotFile(firecrackerMagicX86|1, 4, 4096, [][3]uint64{
+		{0, 3 << 30, 0},
+		{4 << 30, 1 << 30, 3 << 30},
+	})
+	snap, err := ParseFirecrackerSnapshot(bytes.NewReader(file))
+	require.NoError(t, err, "Failed to parse the snapshot")
+	require.Equal(t, 4<<30, snap.GuestMemSize, "Wrong guest memory size")
+	require.Equal(t, []FirecrackerMemoryRegion{
+		{GuestAddress: 0, Size: 3 << 30, Offset: 0},
+		{GuestAddress: 4 << 30, Size: 1 << 30, Offset: 3 << 30},
+	}, snap.Regions, "Wrong regions")
+
+	// the snapshots of the first data version do not record the VM info
+	file = firecrackerSnapshotFile(firecrackerMagicAarch64|1, 1, 0, [][3]uint64{{0x80000000, 64 << 20, 0}})
+	snap, err = ParseFirecrackerSnapshot(bytes.NewReader(file))
+	require.NoError(t, err, "Failed to parse the aarch64 snapshot")
+	require.Equal(t, 64<<20, snap.GuestMemSize, "Wrong guest memory size")
+
+	for name, file := range map[string][]byte{
+		"bad magic":      firecrackerSnapshotFile(0x1234, 3, 1, [][3]uint64{{0, 1 << 20, 0}}),
+		"no regions":     firecrackerSnapshotFile(firecrackerMagicX86|1, 3, 1, nil),
+		"empty region":   firecrackerSnapshotFile(firecrackerMagicX86|1, 3, 1, [][3]uint64{{0, 0, 0}}),
+		"offset gap":     firecrackerSnapshotFile(firecrackerMagicX86|1, 3, 2, [][3]uint64{{0, 1 << 20, 0}, {2 << 20, 1 << 20, 2 << 20}}),
+		"size mismatch":  firecrackerSnapshotFile(firecrackerMagicX86|1, 3, 2, [][3]uint64{{0, 1 << 20, 0}}),
+		"truncated":      firecrackerSnapshotFile(firecrackerMagicX86|1, 3, 1, [][3]uint64{{0, 1 << 20, 0}})[:30],
+		"too many":       firecrackerSnapshotFile(firecrackerMagicX86|1, 3, 1, make([][3]uint64, maxFirecrackerRegions+1)),
+		"not a snapshot": []byte("vmm state"),
+	} {
+		_, err := ParseFirecrackerSnapshot(bytes.NewReader(file))
+		require.Error(t, err, name)
+	}
+}
+
+func TestRegisterVMFirecrackerState(t *testing.T) {
+	fixture, err := ioutil.ReadFile(firecrackerSnapshotFixture)
+	require.NoError(t, err, "Failed to read the fixture")
+
+	manager := newTestManager(t, MemoryManagerCfg{})
+
+	stateCfg := prepareSnapshotStateCfg(t, "1", 1<<20)
+	require.NoError(t, ioutil.WriteFile(stateCfg.VMMStatePath, fixture, 0644), "Failed to write the VMM state file")
+	stateCfg.FirecrackerState = true
+	stateCfg.GuestMemSize = 0
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+	require.Equal(t, 1<<20, manager.instances["1"].GuestMemSize, "Guest memory size must be derived from the snapshot")
+
+	stateCfg.VMID = "2"
+	stateCfg.GuestMemSize = 1 << 20
+	require.NoError(t, manager.ValidateConfig(stateCfg), "Matching guest memory size must be accepted")
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM with a matching guest memory size")
+
+	stateCfg.VMID = "3"
+	stateCfg.GuestMemSize = 2 << 20
+	err = manager.RegisterVM(stateCfg)
+	require.True(t, errors.Is(err, ErrInvalidConfig), "Guest memory size differing from the snapshot must be rejected")
+	require.Error(t, manager.ValidateConfig(stateCfg), "Guest memory size differing from the snapshot must be reported")
+
+	stateCfg = prepareSnapshotStateCfg(t, "4", 1<<20)
+	stateCfg.FirecrackerState = true
+	err = manager.RegisterVM(stateCfg)
+	require.True(t, errors.Is(err, ErrInvalidConfig), "VMM state file that is not a Firecracker snapshot must be rejected")
+}
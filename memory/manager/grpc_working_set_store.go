@@ -0,0 +1,130 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ease-lab/vhive/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// workingSetChunkSize is the maximum size of the contents of a chunk streamed to or from the
+// working set store, well below the default limit of 4 MiB on the size of the gRPC messages
+const workingSetChunkSize = 1 << 20
+
+// grpcWorkingSetStore WorkingSetStore that keeps the working sets in a WorkingSetStore service,
+// see proto/working_set_store.proto
+type grpcWorkingSetStore struct {
+	client proto.WorkingSetStoreClient
+}
+
+// NewGRPCWorkingSetStore Returns the working set store that keeps the working sets in the
+// WorkingSetStore service at the other end of the connection, e.g., for MemoryManagerCfg.WorkingSetStore
+func NewGRPCWorkingSetStore(cc grpc.ClientConnInterface) WorkingSetStore {
+	return &grpcWorkingSetStore{client: proto.NewWorkingSetStoreClient(cc)}
+}
+
+// Upload Streams the files of the record in chunks, the first of which carries the function
+// ID and version
+func (s *grpcWorkingSetStore) Upload(ctx context.Context, functionID, version string, record *WorkingSetRecord) error {
+	stream, err := s.client.Upload(ctx)
+	if err != nil {
+		return err
+	}
+
+	chunk := &proto.WorkingSetChunk{FunctionId: functionID, Version: version}
+	send := func(data []byte, set func(chunk *proto.WorkingSetChunk, data []byte)) error {
+		for len(data) > 0 {
+			n := len(data)
+			if n > workingSetChunkSize {
+				n = workingSetChunkSize
+			}
+			set(chunk, data[:n])
+			if err := stream.Send(chunk); err != nil {
+				return err
+			}
+			chunk = &proto.WorkingSetChunk{}
+			data = data[n:]
+		}
+		return nil
+	}
+
+	if err := send(record.Trace, func(c *proto.WorkingSetChunk, d []byte) { c.Trace = d }); err != nil {
+		return err
+	}
+	if err := send(record.WorkingSet, func(c *proto.WorkingSetChunk, d []byte) { c.WorkingSet = d }); err != nil {
+		return err
+	}
+	if err := send(record.Sequence, func(c *proto.WorkingSetChunk, d []byte) { c.Sequence = d }); err != nil {
+		return err
+	}
+	if chunk.FunctionId != "" {
+		// nothing has been sent for an empty record
+		if err := stream.Send(chunk); err != nil {
+			return err
+		}
+	}
+
+	_, err = stream.CloseAndRecv()
+
+	return err
+}
+
+// Download Concatenates the files of the record from the streamed chunks, returns an error
+// wrapping os.ErrNotExist if the service has no working set of the function version
+func (s *grpcWorkingSetStore) Download(ctx context.Context, functionID, version string) (*WorkingSetRecord, error) {
+	stream, err := s.client.Download(ctx, &proto.DownloadWorkingSetReq{FunctionId: functionID, Version: version})
+	if err != nil {
+		return nil, downloadErr(err)
+	}
+
+	record := new(WorkingSetRecord)
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			return record, nil
+		}
+		if err != nil {
+			return nil, downloadErr(err)
+		}
+
+		record.Trace = append(record.Trace, chunk.Trace...)
+		record.WorkingSet = append(record.WorkingSet, chunk.WorkingSet...)
+		record.Sequence = append(record.Sequence, chunk.Sequence...)
+	}
+}
+
+// downloadErr Returns an error wrapping os.ErrNotExist if the service has no working set
+func downloadErr(err error) error {
+	if status.Code(err) == codes.NotFound {
+		return fmt.Errorf("%w: %v", os.ErrNotExist, err)
+	}
+
+	return err
+}
@@ -0,0 +1,143 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/ease-lab/vhive/proto"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// workingSetStoreServer Keeps the uploaded chunks of the working sets in memory
+type workingSetStoreServer struct {
+	proto.UnimplementedWorkingSetStoreServer
+
+	sync.Mutex
+	chunks map[string][]*proto.WorkingSetChunk
+}
+
+func (s *workingSetStoreServer) Upload(stream proto.WorkingSetStore_UploadServer) error {
+	var (
+		key    string
+		chunks []*proto.WorkingSetChunk
+	)
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if key == "" {
+			key = chunk.FunctionId + "/" + chunk.Version
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	s.Lock()
+	s.chunks[key] = chunks
+	s.Unlock()
+
+	return stream.SendAndClose(&proto.UploadWorkingSetResp{Message: "uploaded"})
+}
+
+func (s *workingSetStoreServer) Download(req *proto.DownloadWorkingSetReq, stream proto.WorkingSetStore_DownloadServer) error {
+	s.Lock()
+	chunks, ok := s.chunks[req.FunctionId+"/"+req.Version]
+	s.Unlock()
+
+	if !ok {
+		return status.Errorf(codes.NotFound, "no working set of %s/%s", req.FunctionId, req.Version)
+	}
+	for _, chunk := range chunks {
+		if err := stream.Send(chunk); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// serveWorkingSetStore Serves the WorkingSetStore service in-process, returns
+// the server and the working set store connected to it
+func serveWorkingSetStore(t *testing.T) (*workingSetStoreServer, WorkingSetStore) {
+	l := bufconn.Listen(1 << 20)
+	srv := &workingSetStoreServer{chunks: make(map[string][]*proto.WorkingSetChunk)}
+
+	s := grpc.NewServer()
+	proto.RegisterWorkingSetStoreServer(s, srv)
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.Dial("bufconn", grpc.WithInsecure(),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return l.Dial() }))
+	require.NoError(t, err, "Failed to dial the working set store")
+	t.Cleanup(func() { conn.Close() })
+
+	return srv, NewGRPCWorkingSetStore(conn)
+}
+
+func TestGRPCWorkingSetStore(t *testing.T) {
+	srv, store := serveWorkingSetStore(t)
+	ctx := context.Background()
+
+	_, err := store.Download(ctx, "helloworld", "v1")
+	require.True(t, errors.Is(err, os.ErrNotExist), "Missing working set must be reported as not existing")
+
+	// the working set spans several chunks
+	record := &WorkingSetRecord{
+		Trace:      []byte("trace"),
+		WorkingSet: bytes.Repeat([]byte("page"), workingSetChunkSize/2+1),
+		Sequence:   []byte("sequence"),
+	}
+	require.NoError(t, store.Upload(ctx, "helloworld", "v1", record), "Failed to upload the working set")
+
+	srv.Lock()
+	chunks := srv.chunks["helloworld/v1"]
+	srv.Unlock()
+	require.Len(t, chunks, 5, "Trace, three chunks of the working set and sequence must be uploaded")
+	for _, chunk := range chunks {
+		require.LessOrEqual(t, len(chunk.Trace)+len(chunk.WorkingSet)+len(chunk.Sequence), workingSetChunkSize,
+			"Chunk exceeds the chunk size")
+	}
+
+	downloaded, err := store.Download(ctx, "helloworld", "v1")
+	require.NoError(t, err, "Failed to download the working set")
+	require.Equal(t, record, downloaded, "Downloaded working set differs from the uploaded one")
+
+	_, err = store.Download(ctx, "helloworld", "v2")
+	require.True(t, errors.Is(err, os.ErrNotExist), "Working set of another version must not be downloaded")
+}
@@ -0,0 +1,76 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreopenedGuestMemFD(t *testing.T) {
+	contents := make(map[uint64][]byte)
+	defer stubCopyingInstallRegion(contents)()
+
+	pageSize := os.Getpagesize()
+	manager := newTestManager(t, MemoryManagerCfg{})
+	cfg := prepareSnapshotStateCfg(t, "1", 4*pageSize)
+	cfg.IsLazyMode = true
+
+	// the VMM has removed the guest memory file it passed the fd of
+	f, err := os.Open(cfg.GuestMemPath)
+	require.NoError(t, err, "Failed to open the guest memory file")
+	require.NoError(t, os.Remove(cfg.GuestMemPath), "Failed to remove the guest memory file")
+	cfg.GuestMemPath = ""
+	cfg.GuestMemFD = f
+
+	require.NoError(t, manager.ValidateConfig(cfg), "Pre-opened guest memory file must be checked")
+	require.NoError(t, manager.RegisterVM(cfg), "Failed to register VM")
+	state := manager.instances["1"]
+
+	// every activation maps the guest memory anew
+	for i := 0; i < 2; i++ {
+		require.NoError(t, state.mapGuestMemory(context.Background()), "Failed to map guest memory")
+		state.setupStateOnActivate()
+		state.firstPageFaultOnce.Do(func() { state.startAddress = testStartAddress })
+
+		address := testStartAddress + uint64(2*pageSize)
+		require.NoError(t, state.servePageFault(-1, address), "Failed to serve page fault")
+		require.Equal(t, bytes.Repeat([]byte{50}, pageSize), contents[address],
+			"Page must be installed from the pre-opened file")
+
+		require.NoError(t, state.unmapGuestMemory(), "Failed to unmap guest memory")
+		state.isActive = false
+	}
+
+	_, err = f.Stat()
+	require.NoError(t, err, "Pre-opened file must be kept open while the VM is registered")
+
+	require.NoError(t, manager.DeregisterVM("1"), "Failed to deregister VM")
+	_, err = f.Stat()
+	require.True(t, errors.Is(err, os.ErrClosed), "Pre-opened file must be closed upon deregistration")
+}
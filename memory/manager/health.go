@@ -0,0 +1,71 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"net/http"
+	"time"
+)
+
+var (
+	// the polling loops poll the uffds at least this often even if there are no page faults,
+	// and are considered stalled if they have not polled them for pollStallTimeout
+	pollHeartbeatInterval = time.Second
+	pollStallTimeout      = 10 * time.Second
+)
+
+// Healthy Returns false if the page faults of an active VM are not served, because its polling loop
+// has stopped serving them or has stalled, e.g., wedged serving a page fault, so that a supervisor
+// can restart the node
+func (m *MemoryManager) Healthy() bool {
+	m.Lock()
+	defer m.Unlock()
+
+	now := time.Now()
+	for _, state := range m.instances {
+		if !state.isActive {
+			continue
+		}
+
+		if !state.backend.isServing(state) {
+			return false
+		}
+		if _, ok := state.backend.(uffdBackend); ok && !state.isPolling(now) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// HealthHandler Returns an HTTP handler, e.g., for /healthz, that responds with 200 if the memory
+// manager is healthy, see Healthy, and with 503 otherwise. It is not registered anywhere by default.
+func (m *MemoryManager) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !m.Healthy() {
+			http.Error(w, "unhealthy", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok\n"))
+	})
+}
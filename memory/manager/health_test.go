@@ -0,0 +1,101 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// waitHealthy Waits until the memory manager reports the health status
+func waitHealthy(t *testing.T, m *MemoryManager, healthy bool) {
+	for i := 0; m.Healthy() != healthy; i++ {
+		require.Less(t, i, 1000, "Memory manager does not report the expected health")
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHealthyStoppedPollingLoop(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	manager := newTestManager(t, MemoryManagerCfg{})
+	stateCfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+	stateCfg.IsLazyMode = true
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+	require.True(t, manager.Healthy(), "Memory manager without active VMs must be healthy")
+
+	state, _ := activateTestVM(t, manager, "1")
+	require.True(t, manager.Healthy(), "Memory manager must be healthy while the page faults are served")
+
+	rec := httptest.NewRecorder()
+	manager.HealthHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	// the polling loop quits while the VM is active
+	state.stopPolling()
+	waitHealthy(t, manager, false)
+
+	rec = httptest.NewRecorder()
+	manager.HealthHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	require.NoError(t, manager.Deactivate("1"), "Failed to deactivate VM")
+	require.True(t, manager.Healthy(), "Memory manager without active VMs must be healthy")
+}
+
+func TestHealthyStalledPollingLoop(t *testing.T) {
+	installer, restore := stubBlockingInstallRegion()
+	defer restore()
+
+	defer func(interval, timeout time.Duration) {
+		pollHeartbeatInterval, pollStallTimeout = interval, timeout
+	}(pollHeartbeatInterval, pollStallTimeout)
+	pollHeartbeatInterval, pollStallTimeout = 5*time.Millisecond, 50*time.Millisecond
+
+	manager := newTestManager(t, MemoryManagerCfg{})
+	stateCfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+	stateCfg.IsLazyMode = true
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+
+	_, vm := activateTestVM(t, manager, "1")
+
+	// the heartbeat of the idle VM keeps it healthy
+	time.Sleep(2 * pollStallTimeout)
+	require.True(t, manager.Healthy(), "Idle polling loop must be healthy")
+
+	// the polling loop is wedged serving the page fault
+	vm.fault(t, testStartAddress)
+	installer.waitStarted(t, 1)
+	waitHealthy(t, manager, false)
+
+	close(installer.release)
+	waitHealthy(t, manager, true)
+
+	require.NoError(t, manager.Deactivate("1"), "Failed to deactivate VM")
+}
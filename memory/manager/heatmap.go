@@ -0,0 +1,127 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"encoding/csv"
+	"os"
+	"sort"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// pageHeatmap Counts the recordings of the VMs of a snapshot that touched each page,
+// indexed by the offset of the page in the guest memory file
+type pageHeatmap map[uint64]int
+
+// snapshotID Returns the snapshot that the heatmap of the instance is accumulated for
+func (s *SnapshotState) snapshotID() string {
+	if s.BaseSnapshotID != "" {
+		return s.BaseSnapshotID
+	}
+
+	return s.VMID
+}
+
+// addToHeatmap Counts the pages of the working set that the instance has just recorded,
+// must be called with the manager locked
+func (m *MemoryManager) addToHeatmap(state *SnapshotState) {
+	id := state.snapshotID()
+
+	heatmap, ok := m.heatmaps[id]
+	if !ok {
+		heatmap = make(pageHeatmap)
+		m.heatmaps[id] = heatmap
+	}
+
+	for _, rec := range state.trace.trace {
+		heatmap[rec.offset]++
+
+		if state.hotPages != nil && heatmap[rec.offset] == state.hotPages.minRecordings {
+			state.hotPages.promote(id, rec.offset)
+		}
+	}
+}
+
+// PageHeatmap Returns the number of the recordings of the snapshot that touched each page,
+// indexed by the offset of the page in the guest memory file. The snapshot is the BaseSnapshotID
+// of its VMs, or the VMID of a VM with no BaseSnapshotID. The pages that no recording touched
+// are missing from the heatmap.
+func (m *MemoryManager) PageHeatmap(snapshotID string) (map[uint64]int, error) {
+	if !m.ProfilePageFrequency {
+		return nil, ErrNotProfiled
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	counts := make(map[uint64]int, len(m.heatmaps[snapshotID]))
+	for offset, n := range m.heatmaps[snapshotID] {
+		counts[offset] = n
+	}
+
+	return counts, nil
+}
+
+// WritePageHeatmap Writes the heatmap of the snapshot, see PageHeatmap, to a csv file
+// with a row of the offset and the number of the recordings per page, sorted by offset
+func (m *MemoryManager) WritePageHeatmap(snapshotID, heatmapOutFilePath string) error {
+	counts, err := m.PageHeatmap(snapshotID)
+	if err != nil {
+		return err
+	}
+
+	offsets := make([]uint64, 0, len(counts))
+	for offset := range counts {
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	csvFile, err := os.Create(heatmapOutFilePath)
+	if err != nil {
+		log.Error("Failed to create csv file for writing the heatmap")
+		return err
+	}
+	defer csvFile.Close()
+
+	writer := csv.NewWriter(csvFile)
+
+	if err := writer.Write([]string{"offset", "count"}); err != nil {
+		return err
+	}
+	for _, offset := range offsets {
+		row := []string{strconv.FormatUint(offset, 10), strconv.Itoa(counts[offset])}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Errorf("Failed to write the heatmap to csv file: %v", err)
+		return err
+	}
+
+	return csvFile.Close()
+}
@@ -0,0 +1,84 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPageHeatmap(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	pageSize := uint64(os.Getpagesize())
+	manager := newTestManager(t, MemoryManagerCfg{ProfilePageFrequency: true})
+
+	// three recordings of the VMs of the same snapshot touch overlapping pages
+	runs := [][]uint64{{0, 1, 2}, {0, 1}, {0, 3}}
+	for i, pages := range runs {
+		vmID := strconv.Itoa(i)
+		stateCfg := prepareSnapshotStateCfg(t, vmID, 4*os.Getpagesize())
+		stateCfg.BaseSnapshotID = "snapshot"
+		vms := serveFakeUFFDs(t, &stateCfg)
+		require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+
+		require.NoError(t, manager.Activate(vmID), "Failed to activate VM")
+		vm := <-vms
+		for _, page := range pages {
+			vm.fault(t, testStartAddress+page*pageSize)
+		}
+		waitServedPages(t, manager.instances[vmID], int64(len(pages)))
+		require.NoError(t, manager.Deactivate(vmID), "Failed to deactivate VM")
+	}
+
+	heatmap, err := manager.PageHeatmap("snapshot")
+	require.NoError(t, err, "Failed to get the heatmap")
+	require.Equal(t, map[uint64]int{0: 3, pageSize: 2, 2 * pageSize: 1, 3 * pageSize: 1}, heatmap,
+		"Heatmap must count the recordings that touched each page")
+
+	heatmap, err = manager.PageHeatmap("unknown")
+	require.NoError(t, err, "Failed to get the heatmap")
+	require.Empty(t, heatmap, "Snapshot with no recordings must have an empty heatmap")
+
+	heatmapPath := filepath.Join(t.TempDir(), "heatmap.csv")
+	require.NoError(t, manager.WritePageHeatmap("snapshot", heatmapPath), "Failed to write the heatmap")
+	buf, err := ioutil.ReadFile(heatmapPath)
+	require.NoError(t, err, "Failed to read the heatmap file")
+	expected := "offset,count\n0,3\n" + strconv.FormatUint(pageSize, 10) + ",2\n" +
+		strconv.FormatUint(2*pageSize, 10) + ",1\n" + strconv.FormatUint(3*pageSize, 10) + ",1\n"
+	require.Equal(t, expected, string(buf), "Heatmap file must list the pages sorted by offset")
+}
+
+func TestPageHeatmapProfilingOff(t *testing.T) {
+	manager := newTestManager(t, MemoryManagerCfg{})
+
+	_, err := manager.PageHeatmap("snapshot")
+	require.True(t, errors.Is(err, ErrNotProfiled), "Heatmap requires the profiling")
+}
@@ -0,0 +1,206 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// hotPageHugePageSize Size of the huge pages that back the hot page pool with HotPagePoolHugePages
+	hotPageHugePageSize = 2 << 20
+	// defaultHotPageMinRecordings Number of the recordings of a snapshot that must touch a page
+	// for it to be admitted to the hot page pool, unless HotPageMinRecordings is set
+	defaultHotPageMinRecordings = 2
+)
+
+// hotPageKey Page of the guest memory of a snapshot
+type hotPageKey struct {
+	snapshotID string
+	offset     uint64
+}
+
+// hotPagePool Pre-faulted anonymous memory holding copies of the hottest pages of the snapshots,
+// shared by their VMs, so that the page faults on them are installed with UFFDIO_COPY without reading
+// the guest memory files. Unlike sharedMemory, which copies every page read by the siblings of a VM,
+// the pool only admits the pages that as many recordings of their snapshot as minRecordings have touched,
+// see PageHeatmap, upon their next page fault. Once the pool is full, the pages are evicted by the
+// eviction policy to admit the new ones, and become admissible again. The slot of a page is pinned
+// while it is installed from, so that it is not reused meanwhile, see lookup.
+type hotPagePool struct {
+	sync.Mutex
+	mem           []byte
+	pageSize      int
+	minRecordings int
+	admissible    map[hotPageKey]struct{} // hot pages that are not in the pool
+	slots         *cappedCache            // slot of each page in the pool
+	free          []int                   // slots that hold no page, the last one is used first
+}
+
+// newHotPagePool Maps the pool of the size rounded down to the pages, backing it with huge pages
+// if requested and available
+func newHotPagePool(size, pageSize int, hugePages bool, minRecordings int, policy CacheEviction) (*hotPagePool, error) {
+	if minRecordings <= 0 {
+		minRecordings = defaultHotPageMinRecordings
+	}
+
+	p := &hotPagePool{
+		pageSize:      pageSize,
+		minRecordings: minRecordings,
+		admissible:    make(map[hotPageKey]struct{}),
+	}
+
+	size -= size % pageSize
+	flags := unix.MAP_PRIVATE | unix.MAP_ANONYMOUS | unix.MAP_POPULATE
+
+	if hugePages {
+		hugeSize := (size + hotPageHugePageSize - 1) / hotPageHugePageSize * hotPageHugePageSize
+		if mem, err := unix.Mmap(-1, 0, hugeSize, unix.PROT_READ|unix.PROT_WRITE, flags|unix.MAP_HUGETLB); err == nil {
+			p.mem = mem[:size]
+		}
+	}
+
+	if p.mem == nil {
+		mem, err := unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, flags)
+		if err != nil {
+			return nil, err
+		}
+		p.mem = mem
+	}
+
+	p.slots = newCappedCache(size, policy, p.evicted)
+	for slot := size/pageSize - 1; slot >= 0; slot-- {
+		p.free = append(p.free, slot)
+	}
+
+	return p, nil
+}
+
+// promote Makes the page of the snapshot admissible to the pool
+func (p *hotPagePool) promote(snapshotID string, offset uint64) {
+	p.Lock()
+	defer p.Unlock()
+
+	key := hotPageKey{snapshotID: snapshotID, offset: offset}
+	if !p.slots.contains(key) {
+		p.admissible[key] = struct{}{}
+	}
+}
+
+// lookup Returns the copy of the page of the snapshot if it is in the pool, pinning its slot
+// until it is released
+func (p *hotPagePool) lookup(snapshotID string, offset uint64) ([]byte, bool) {
+	slot, ok := p.slots.acquire(hotPageKey{snapshotID: snapshotID, offset: offset})
+	if !ok {
+		return nil, false
+	}
+
+	start := slot.(int) * p.pageSize
+	return p.mem[start : start+p.pageSize], true
+}
+
+// release Unpins the slot of the page of the snapshot that has been looked up
+func (p *hotPagePool) release(snapshotID string, offset uint64) {
+	p.slots.release(hotPageKey{snapshotID: snapshotID, offset: offset})
+}
+
+// admit Copies the admissible pages of the run, which starts at the offset, into the free slots
+// of the pool, evicting the pages in the unpinned slots if there are none. Returns the number
+// of the admitted pages.
+func (p *hotPagePool) admit(snapshotID string, offset uint64, run []byte) int {
+	// the slots are freed only by the evictions of the admissions, with the pool locked
+	p.Lock()
+	defer p.Unlock()
+
+	admitted := 0
+	for start := 0; start < len(run); start += p.pageSize {
+		key := hotPageKey{snapshotID: snapshotID, offset: offset + uint64(start)}
+		if _, ok := p.admissible[key]; !ok {
+			continue
+		}
+
+		if len(p.free) == 0 {
+			// the evicted pages free their slots
+			p.slots.makeRoom(p.pageSize)
+		}
+		if len(p.free) == 0 {
+			break
+		}
+		slot := p.free[len(p.free)-1]
+
+		copy(p.mem[slot*p.pageSize:(slot+1)*p.pageSize], run[start:start+p.pageSize])
+		if !p.slots.add(key, slot, p.pageSize) {
+			break
+		}
+		p.free = p.free[:len(p.free)-1]
+		delete(p.admissible, key)
+		admitted++
+	}
+
+	return admitted
+}
+
+// evicted Frees the slot of the evicted page, which becomes admissible again.
+// Called by the evictions of admit, with the pool locked.
+func (p *hotPagePool) evicted(key, slot interface{}) {
+	p.free = append(p.free, slot.(int))
+	p.admissible[key.(hotPageKey)] = struct{}{}
+}
+
+// HotPagePoolStats Returns the counters of the hot page pool, which are zero if there is no pool
+func (m *MemoryManager) HotPagePoolStats() CacheStats {
+	if m.hotPages == nil {
+		return CacheStats{}
+	}
+
+	return m.hotPages.slots.stats()
+}
+
+// hotPage Returns the copy of the page at the offset of the guest memory in the hot page pool,
+// if the instance uses the pool and the page is in it, in which case its slot must be released
+func (s *SnapshotState) hotPage(offset uint64) ([]byte, bool) {
+	if s.hotPages == nil {
+		return nil, false
+	}
+
+	return s.hotPages.lookup(s.snapshotID(), offset)
+}
+
+// close Unmaps the pool, which must no longer be installed from
+func (p *hotPagePool) close() error {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.mem == nil {
+		return nil
+	}
+
+	err := unix.Munmap(p.mem[:cap(p.mem)])
+	p.mem = nil
+	p.slots.removeIf(func(interface{}) bool { return true })
+	p.free = nil
+
+	return err
+}
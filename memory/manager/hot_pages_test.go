@@ -0,0 +1,218 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// registerHotPageVM Registers a lazy VM of the snapshot and maps its guest memory as if it was activated
+func registerHotPageVM(t testing.TB, m *MemoryManager, vmID, snapshotID string, pages int) *SnapshotState {
+	cfg := prepareSnapshotStateCfg(t, vmID, pages*os.Getpagesize())
+	cfg.IsLazyMode = true
+	cfg.BaseSnapshotID = snapshotID
+	require.NoError(t, m.RegisterVM(cfg), "Failed to register VM")
+
+	state := m.instances[vmID]
+	require.NoError(t, state.mapGuestMemory(context.Background()), "Failed to map guest memory")
+	state.setupStateOnActivate()
+	state.firstPageFaultOnce.Do(func() { state.startAddress = testStartAddress })
+
+	return state
+}
+
+func TestHotPagePool(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	pageSize := os.Getpagesize()
+	manager := newTestManager(t, MemoryManagerCfg{HotPagePoolSize: 3 * pageSize})
+	require.NotNil(t, manager.hotPages, "Hot page pool must be mapped")
+
+	// two recordings touch the same pages, which the pool has room for
+	for i := 0; i < 2; i++ {
+		vmID := "record-" + strconv.Itoa(i)
+		stateCfg := prepareSnapshotStateCfg(t, vmID, 4*pageSize)
+		stateCfg.BaseSnapshotID = "snapshot"
+		vms := serveFakeUFFDs(t, &stateCfg)
+		require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+
+		require.NoError(t, manager.Activate(vmID), "Failed to activate VM")
+		vm := <-vms
+		for page := 0; page < 3; page++ {
+			vm.fault(t, testStartAddress+uint64(page*pageSize))
+		}
+		waitServedPages(t, manager.instances[vmID], 3)
+		require.NoError(t, manager.Deactivate(vmID), "Failed to deactivate VM")
+	}
+
+	contents := make(map[uint64][]byte)
+	stubCopyingInstallRegion(contents)
+
+	serve := func(state *SnapshotState) {
+		for page := 0; page < 3; page++ {
+			require.NoError(t, state.servePageFault(-1, testStartAddress+uint64(page*pageSize)), "Failed to serve page fault")
+			content := contents[testStartAddress+uint64(page*pageSize)]
+			require.Len(t, content, pageSize, "Wrong size of the installed page")
+			require.Equal(t, byte(48+page), content[0], "Wrong contents of the installed page")
+		}
+	}
+
+	// the hot pages are admitted upon their next page faults read from the guest memory file
+	first := registerHotPageVM(t, manager, "lazy-0", "snapshot", 4)
+	serve(first)
+	require.Equal(t, int64(3), first.backingReads, "Pages must be read before they are admitted")
+	require.Zero(t, first.hotPageInstalls, "No page must be installed from the empty pool")
+
+	second := registerHotPageVM(t, manager, "lazy-1", "snapshot", 4)
+	serve(second)
+	require.Zero(t, second.backingReads, "Admitted pages must not be read")
+	require.Equal(t, int64(3), second.hotPageInstalls, "Admitted pages must be installed from the pool")
+	require.Equal(t, int64(3), second.lifetimeMetrics().HotPageInstalls, "Hot pages must be in the lifetime metrics")
+	// the page faults of the recordings and of the first lazy VM miss
+	require.Equal(t, CacheStats{Hits: 3, Misses: 9, Entries: 3, Bytes: 3 * pageSize, Budget: 3 * pageSize},
+		manager.HotPagePoolStats(), "Wrong counters of the pool")
+
+	// the pages of the other snapshots are not hot
+	other := registerHotPageVM(t, manager, "other", "other-snapshot", 4)
+	serve(other)
+	require.Zero(t, other.hotPageInstalls, "Pages of the other snapshot must not be installed from the pool")
+
+	for _, state := range []*SnapshotState{first, second, other} {
+		require.NoError(t, state.unmapGuestMemory(), "Failed to unmap guest memory")
+	}
+	require.NoError(t, manager.hotPages.close(), "Failed to unmap the pool")
+	_, ok := manager.hotPages.lookup("snapshot", 0)
+	require.False(t, ok, "Pool must be empty once unmapped")
+}
+
+func TestHotPagePoolMinRecordings(t *testing.T) {
+	pageSize := os.Getpagesize()
+	pool, err := newHotPagePool(2*pageSize+1, pageSize, false, 0, LRUEviction)
+	require.NoError(t, err, "Failed to map the pool")
+	defer pool.close()
+	require.Len(t, pool.mem, 2*pageSize, "Pool must be rounded down to the pages")
+	require.Equal(t, defaultHotPageMinRecordings, pool.minRecordings, "Wrong default admission threshold")
+
+	run := make([]byte, 3*pageSize)
+	require.Zero(t, pool.admit("snapshot", 0, run), "Pages that are not hot must not be admitted")
+
+	for page := 0; page < 3; page++ {
+		pool.promote("snapshot", uint64(page*pageSize))
+	}
+	require.Equal(t, 2, pool.admit("snapshot", 0, run[:2*pageSize]), "Pages must be admitted while the pool has room")
+
+	pool.promote("snapshot", 0)
+	require.Len(t, pool.admissible, 1, "Pooled page must not become admissible again")
+}
+
+func TestHotPagePoolEviction(t *testing.T) {
+	pageSize := os.Getpagesize()
+	pool, err := newHotPagePool(2*pageSize, pageSize, false, 0, LRUEviction)
+	require.NoError(t, err, "Failed to map the pool")
+	defer pool.close()
+
+	run := make([]byte, 3*pageSize)
+	for page := range run {
+		run[page] = byte(page / pageSize)
+	}
+	for page := 0; page < 3; page++ {
+		pool.promote("snapshot", uint64(page*pageSize))
+	}
+	require.Equal(t, 2, pool.admit("snapshot", 0, run[:2*pageSize]), "Pages must be admitted while the pool has room")
+
+	// the least recently used page makes room for the new hot page and becomes admissible again
+	_, ok := pool.lookup("snapshot", uint64(pageSize))
+	require.True(t, ok, "Admitted page must be in the pool")
+	pool.release("snapshot", uint64(pageSize))
+	require.Equal(t, 1, pool.admit("snapshot", uint64(2*pageSize), run[2*pageSize:]), "Full pool must evict a page")
+	_, ok = pool.lookup("snapshot", 0)
+	require.False(t, ok, "Least recently used page must be evicted")
+	require.Contains(t, pool.admissible, hotPageKey{snapshotID: "snapshot", offset: 0}, "Evicted page must be admissible")
+
+	page, ok := pool.lookup("snapshot", uint64(2*pageSize))
+	require.True(t, ok, "New hot page must be admitted")
+	require.Equal(t, byte(2), page[0], "Wrong contents of the pooled page")
+
+	// the pinned pages are not evicted, so their slots are not overwritten while they are installed from
+	page, ok = pool.lookup("snapshot", uint64(pageSize))
+	require.True(t, ok, "Admitted page must be in the pool")
+	require.Zero(t, pool.admit("snapshot", 0, run[:pageSize]), "Pinned pages must not be evicted")
+	require.Equal(t, byte(1), page[0], "Pinned page must not be overwritten")
+	require.Equal(t, byte(2), run[2*pageSize], "Run must not be modified")
+
+	pool.release("snapshot", uint64(pageSize))
+	pool.release("snapshot", uint64(2*pageSize))
+	require.Equal(t, 1, pool.admit("snapshot", 0, run[:pageSize]), "Released page must be evictable")
+	require.EqualValues(t, 2, pool.slots.stats().Evictions, "Wrong number of the evictions")
+}
+
+// BenchmarkHotPagePool Serves the page faults of the VMs of a snapshot on its hot pages with
+// and without the hot page pool, reporting the pages read from the guest memory file per VM
+func BenchmarkHotPagePool(b *testing.B) {
+	const (
+		pages    = 1024
+		hotPages = 128
+	)
+
+	_, restore := stubInstaller()
+	defer restore()
+
+	pageSize := os.Getpagesize()
+
+	for name, poolSize := range map[string]int{"NoPool": 0, "Pool": hotPages * pageSize} {
+		poolSize := poolSize
+		b.Run(name, func(b *testing.B) {
+			manager := newTestManager(b, MemoryManagerCfg{HotPagePoolSize: poolSize})
+			if manager.hotPages != nil {
+				defer manager.hotPages.close()
+				for page := 0; page < hotPages; page++ {
+					manager.hotPages.promote("snapshot", uint64(page*pageSize))
+				}
+			}
+
+			var backingReads int64
+			for n := 0; n < b.N; n++ {
+				b.StopTimer()
+				state := registerHotPageVM(b, manager, strconv.Itoa(n), "snapshot", pages)
+				b.StartTimer()
+
+				for page := 0; page < hotPages; page++ {
+					_ = state.servePageFault(-1, testStartAddress+uint64(page*pageSize))
+				}
+
+				b.StopTimer()
+				backingReads += state.backingReads
+				require.NoError(b, state.unmapGuestMemory(), "Failed to unmap guest memory")
+				b.StartTimer()
+			}
+
+			b.ReportMetric(float64(backingReads)/float64(b.N), "backing-reads/op")
+		})
+	}
+}
@@ -0,0 +1,76 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import "syscall"
+
+// pageInstaller Installs the pages of the page faults into the guest memory registered
+// with the uffd fd, and wakes up the faulting threads. The installs fail with an error
+// wrapping errAlreadyPresent if a page of the region is present already.
+type pageInstaller interface {
+	// Copy Installs the len bytes at dst with a copy of the memory at src, like UFFDIO_COPY
+	Copy(fd int, src, dst, mode, len uint64) error
+	// ZeroPage Installs zero-filled pages in the len bytes at dst, like UFFDIO_ZEROPAGE
+	ZeroPage(fd int, dst, mode, len uint64) error
+	// Continue Maps the pages of the len bytes at dst that are present in the page cache,
+	// like UFFDIO_CONTINUE
+	Continue(fd int, dst, len uint64) error
+	// Wake Wakes up the threads faulting in the len bytes at dst, like UFFDIO_WAKE
+	Wake(fd int, dst uint64, len int) error
+}
+
+// faultReader Reads the messages of the page faults from the uffd fd
+type faultReader interface {
+	// ReadMsg Reads a uffd_msg into msg, returns the number of the bytes read
+	ReadMsg(fd int, msg []byte) (int, error)
+}
+
+// uffdInstaller Installs the pages with the userfaultfd ioctls
+type uffdInstaller struct{}
+
+func (uffdInstaller) Copy(fd int, src, dst, mode, len uint64) error {
+	return installRegion(fd, src, dst, mode, len)
+}
+
+func (uffdInstaller) ZeroPage(fd int, dst, mode, len uint64) error {
+	return zeroRegion(fd, dst, mode, len)
+}
+
+func (uffdInstaller) Continue(fd int, dst, len uint64) error {
+	return continueRegion(fd, dst, len)
+}
+
+func (uffdInstaller) Wake(fd int, dst uint64, len int) error {
+	return wake(fd, dst, len)
+}
+
+// uffdFaultReader Reads the messages from the userfaultfd
+type uffdFaultReader struct{}
+
+func (uffdFaultReader) ReadMsg(fd int, msg []byte) (int, error) {
+	return syscall.Read(fd, msg)
+}
+
+// defaultInstaller Installs the pages of the VMs whose config does not set an installer,
+// replaced in tests to run without a kernel userfaultfd
+var defaultInstaller pageInstaller = uffdInstaller{}
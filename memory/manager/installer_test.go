@@ -0,0 +1,172 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"encoding/binary"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeInstaller Stands in for the userfaultfd ioctls, the hooks that are not set
+// succeed without installing anything
+type fakeInstaller struct {
+	copy     func(fd int, src, dst, mode, len uint64) error
+	zeroPage func(fd int, dst, mode, len uint64) error
+	cont     func(fd int, dst, len uint64) error
+	wake     func(fd int, dst uint64, len int)
+}
+
+func (f *fakeInstaller) Copy(fd int, src, dst, mode, len uint64) error {
+	if f.copy == nil {
+		return nil
+	}
+	return f.copy(fd, src, dst, mode, len)
+}
+
+func (f *fakeInstaller) ZeroPage(fd int, dst, mode, len uint64) error {
+	if f.zeroPage == nil {
+		return nil
+	}
+	return f.zeroPage(fd, dst, mode, len)
+}
+
+func (f *fakeInstaller) Continue(fd int, dst, len uint64) error {
+	if f.cont == nil {
+		return nil
+	}
+	return f.cont(fd, dst, len)
+}
+
+func (f *fakeInstaller) Wake(fd int, dst uint64, len int) error {
+	if f.wake != nil {
+		f.wake(fd, dst, len)
+	}
+	return nil
+}
+
+// stubInstaller Returns the fake installer of the VMs initialized from now on, which is
+// shared by the stubs of a test, and the function that restores the real installer
+func stubInstaller() (*fakeInstaller, func()) {
+	if f, ok := defaultInstaller.(*fakeInstaller); ok {
+		return f, func() {}
+	}
+
+	f := new(fakeInstaller)
+	defaultInstaller = f
+
+	return f, func() { defaultInstaller = uffdInstaller{} }
+}
+
+// fakeFaultReader Returns the queued messages instead of reading them from the uffd
+type fakeFaultReader struct {
+	sync.Mutex
+	msgs [][]byte
+}
+
+func (r *fakeFaultReader) ReadMsg(fd int, msg []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if len(r.msgs) == 0 {
+		return 0, syscall.EAGAIN
+	}
+	n := copy(msg, r.msgs[0])
+	r.msgs = r.msgs[1:]
+
+	return n, nil
+}
+
+func TestInstallerServesPageFaults(t *testing.T) {
+	var (
+		installs []installCall
+		wakes    []uint64
+	)
+	installer := &fakeInstaller{
+		copy: func(fd int, src, dst, mode, len uint64) error {
+			installs = append(installs, installCall{dst: dst, len: len})
+			return nil
+		},
+		wake: func(fd int, dst uint64, len int) { wakes = append(wakes, dst) },
+	}
+
+	pageSize := uint64(os.Getpagesize())
+
+	state := NewSnapshotState(SnapshotStateCfg{
+		VMID:              "test",
+		GuestMemSize:      8 * int(pageSize),
+		installChunkPages: 4,
+		noZeroPage:        true,
+		installer:         installer,
+	})
+	state.guestMem = make([]byte, state.GuestMemSize)
+	state.setupStateOnActivate()
+	state.firstPageFaultOnce.Do(func() { state.startAddress = testStartAddress })
+
+	require.NoError(t, state.servePageFault(-1, testStartAddress+5*pageSize), "Failed to serve page fault")
+	require.NoError(t, state.servePageFault(-1, testStartAddress+pageSize), "Failed to serve page fault")
+	require.Equal(t, []installCall{
+		{dst: testStartAddress + 4*pageSize, len: 4 * pageSize},
+		{dst: testStartAddress, len: 4 * pageSize},
+	}, installs, "Chunks of the faulting pages must be installed")
+	require.EqualValues(t, 8, state.servedPagesNum, "Wrong number of served pages")
+	require.Empty(t, wakes, "Installed pages must not be woken up")
+
+	err := state.servePageFault(-1, testStartAddress+8*pageSize)
+	require.Error(t, err, "Page fault outside of the guest memory must fail")
+	require.Len(t, installs, 2, "Page fault outside of the guest memory must not be installed")
+}
+
+func TestFaultReaderShortMessage(t *testing.T) {
+	reader := &fakeFaultReader{msgs: [][]byte{make([]byte, sizeOfUFFDMsg()-1)}}
+
+	m := newTestManager(t, MemoryManagerCfg{})
+	state := NewSnapshotState(SnapshotStateCfg{VMID: "test", GuestMemSize: os.Getpagesize(), faultReader: reader})
+	state.errCh = m.errCh
+	state.setupStateOnActivate()
+	_, vm := newFakeUFFD(t, state)
+	defer state.stopPolling()
+
+	readyCh := make(chan error)
+	go state.pollUserPageFaults(readyCh)
+	require.NoError(t, <-readyCh, "Failed to register the epoller")
+
+	// the pipe only makes the uffd readable, the message is read from the fake reader
+	msg := make([]byte, sizeOfUFFDMsg())
+	binary.LittleEndian.PutUint64(msg[16:], testStartAddress)
+	_, err := vm.w.Write(msg)
+	require.NoError(t, err, "Failed to write to the fake uffd")
+
+	select {
+	case err := <-m.Errors():
+		require.True(t, strings.Contains(err.Error(), "read uffd_msg"), "Short message must be reported")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Short message is not reported")
+	}
+}
@@ -0,0 +1,74 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ServeLatencyBucketsUs Upper bounds, in microseconds, of the buckets of the histogram of the time
+// to serve a page fault, the last bucket of the histogram counts the slower page faults
+var ServeLatencyBucketsUs = [...]int64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 10000}
+
+// latencyHistogram Counts the page faults per latency bucket, updated atomically
+type latencyHistogram struct {
+	counts [len(ServeLatencyBucketsUs) + 1]int64
+}
+
+// observe Counts the latency in its bucket without allocating
+func (h *latencyHistogram) observe(d time.Duration) {
+	us := d.Microseconds()
+
+	bucket := 0
+	for bucket < len(ServeLatencyBucketsUs) && us > ServeLatencyBucketsUs[bucket] {
+		bucket++
+	}
+
+	atomic.AddInt64(&h.counts[bucket], 1)
+}
+
+// snapshot Returns a copy of the bucket counts
+func (h *latencyHistogram) snapshot() []int64 {
+	counts := make([]int64, len(h.counts))
+	for i := range h.counts {
+		counts[i] = atomic.LoadInt64(&h.counts[i])
+	}
+
+	return counts
+}
+
+// ServeLatencyHistogram Returns the number of the page faults of the VM served within each
+// of the latency buckets of ServeLatencyBucketsUs, followed by the number of the slower ones
+func (m *MemoryManager) ServeLatencyHistogram(vmID string) ([]int64, error) {
+	log.WithFields(log.Fields{"vmID": vmID}).Debug("returning the serve latency histogram")
+
+	state, err := m.getInstance(vmID)
+	if err != nil {
+		return nil, err
+	}
+
+	return state.serveLatency.snapshot(), nil
+}
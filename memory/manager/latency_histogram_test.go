@@ -0,0 +1,85 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyHistogramBuckets(t *testing.T) {
+	var h latencyHistogram
+
+	for _, d := range []time.Duration{
+		0,
+		5 * time.Microsecond,  // the bounds are inclusive
+		6 * time.Microsecond,  // second bucket
+		time.Millisecond,      // bucket of 1000us
+		20 * time.Millisecond, // slower than all buckets
+	} {
+		h.observe(d)
+	}
+
+	counts := h.snapshot()
+	require.Len(t, counts, len(ServeLatencyBucketsUs)+1, "Wrong number of buckets")
+	require.EqualValues(t, 2, counts[0], "Wrong count of the first bucket")
+	require.EqualValues(t, 1, counts[1], "Wrong count of the second bucket")
+	require.EqualValues(t, 1, counts[7], "Wrong count of the 1ms bucket")
+	require.EqualValues(t, 1, counts[len(counts)-1], "Wrong count of the overflow bucket")
+
+	allocs := testing.AllocsPerRun(100, func() { h.observe(42 * time.Microsecond) })
+	require.Zero(t, allocs, "Updating the histogram must not allocate")
+}
+
+func TestServeLatencyHistogram(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	manager := newTestManager(t, MemoryManagerCfg{})
+	stateCfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+	stateCfg.IsLazyMode = true
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+
+	_, err := manager.ServeLatencyHistogram("missing")
+	require.Error(t, err, "Unregistered VM must be reported")
+
+	state := manager.instances["1"]
+	state.guestMem = make([]byte, state.GuestMemSize)
+	state.setupStateOnActivate()
+	for page := 0; page < 3; page++ {
+		err := state.servePageFault(-1, testStartAddress+uint64(page*os.Getpagesize()))
+		require.NoError(t, err, "Failed to serve page fault")
+	}
+
+	counts, err := manager.ServeLatencyHistogram("1")
+	require.NoError(t, err, "Failed to get the histogram")
+
+	var total int64
+	for _, count := range counts {
+		total += count
+	}
+	require.EqualValues(t, 3, total, "Every served page fault must be counted")
+}
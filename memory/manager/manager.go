@@ -23,12 +23,15 @@
 package manager
 
 import (
+	"container/list"
+	"context"
 	"encoding/csv"
-	"errors"
 	"fmt"
 	"os"
+	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ease-lab/vhive/metrics"
@@ -41,75 +44,494 @@ const (
 	serveUniqueMetric = "ServeUnique"
 	installWSMetric   = "InstallWS"
 	fetchStateMetric  = "FetchState"
+
+	errChSize = 100
 )
 
 // MemoryManagerCfg Global config of the manager
 type MemoryManagerCfg struct {
 	MetricsModeOn bool
+	// InstallChunkPages Number of contiguous pages that are installed upon a page fault
+	// in a single UFFDIO_COPY, the default of 0 or 1 installs only the faulting page. Only the
+	// faulting page is recorded in the working set, as are the pages read ahead.
+	InstallChunkPages int
+	// ReadAheadPages Number of pages following the faulting page that are installed
+	// along with it, the pages that have been served already are never reinstalled
+	ReadAheadPages int
+	// AdaptiveReadAhead Adapt the read-ahead of each VM to its access pattern: the number of pages
+	// installed after the faulting page doubles, up to ReadAheadPages or 32 pages if it is unset,
+	// while the page faults are sequential and is halved upon the random ones
+	AdaptiveReadAhead bool
+	// RemoteStore Store that keeps the state files of the VMs, which are fetched
+	// into the local paths of the VM state files, the default of nil uses local files only
+	RemoteStore RemoteStore
+	// SharePages Install the pages of the instances booted from the same snapshot,
+	// i.e., with the same BaseSnapshotID, from a copy of the guest memory shared by them
+	SharePages bool
+	// Tracer Traces fetching the state and serving the page faults of the VMs,
+	// the default of nil disables tracing
+	Tracer Tracer
+	// WorkingSetCompression Compression of the persisted trace files, i.e., the offsets
+	// of the working set pages, the default of NoCompression stores the raw offsets
+	WorkingSetCompression TraceCompression
+	// MaxInactive Maximum number of the deactivated VMs that are kept registered, the least
+	// recently deactivated VMs beyond it are deregistered and must be registered again before
+	// their next activation, the default of 0 keeps all of them registered
+	MaxInactive int
+	// MaxActiveVMs Maximum number of the VMs that are active at the same time, each of them holding
+	// a uffd, an epoller and the guest memory mapping. The activations beyond it fail with
+	// ErrTooManyActiveVMs, the default of 0 sets no limit.
+	MaxActiveVMs int
+	// QueueActivations Queue the activations beyond MaxActiveVMs until another VM is deactivated,
+	// or their context is done, instead of failing them
+	QueueActivations bool
+	// WorkerPoolSize Number of workers that serve the page faults of all VMs,
+	// the default of 0 serves the page faults in the polling loop of each VM
+	WorkerPoolSize int
+	// OnFirstFault Called once per activation of a VM when its first page fault has been served,
+	// i.e., once the restored VM has started executing, with the time the fault was served.
+	// It is called from the goroutine serving the page faults of the VM, so it must not block.
+	OnFirstFault func(vmID string, served time.Time)
+	// OnWorkingSetComplete Called once per activation of a VM when its working set has been served,
+	// i.e., once the VM is fully warm. In replay mode, it is called once as many pages are served as
+	// the recorded working set has, otherwise once the pages prefetched upon the first page fault,
+	// i.e., the resident pages or the whole guest memory with EagerRestore, are installed. It is
+	// called from the goroutine serving the page faults of the VM, so it must not block.
+	OnWorkingSetComplete func(vmID string)
+	// OnServeError Called when a page fault of a VM fails to be served, e.g., the ioctl installing
+	// the page fails, with the offset of the faulting page in the guest memory. The faulting thread
+	// is not woken up and hangs, so the control plane may stop or restart the VM. It is called from
+	// the goroutine serving the page faults of the VM, so it must not block.
+	OnServeError func(vmID string, offset uint64, err error)
+	// Backend Backend that serves the page faults, the default of AutoBackend uses userfaultfd
+	// unless the kernel lacks it, in which case it preloads the guest memory
+	Backend FaultBackend
+	// MetricsSink Sink that the lifetime metrics of the VMs are recorded to when they
+	// are deregistered or evicted, the default of nil drops them
+	MetricsSink MetricsSink
+	// MemoryPressure Signal of the memory pressure of the node, under which the VMs are served
+	// strictly on demand: FetchState fetches no pages and the page faults install only the faulting
+	// page. The default of nil never backs off, see NewPSIPressure.
+	MemoryPressure MemoryPressure
+	// FaultOrderReplay Persist the order of the page faults of the recorded working sets
+	// to the sequence file of each VM, and install the working set pages in that order upon
+	// the first page fault instead of in the order of their offsets
+	FaultOrderReplay bool
+	// StateFS File system that the state files of the VMs are read from, the default of nil
+	// reads them from the local file system, see StateFS
+	StateFS StateFS
+	// ProfilePageFrequency Count, per snapshot, the recordings of its VMs that touched each page
+	// of the guest memory, see PageHeatmap
+	ProfilePageFrequency bool
+	// HotPagePoolSize Size in bytes of the pool of pre-faulted anonymous memory that holds copies of
+	// the hottest pages of the snapshots, which the page faults of the VMs with a BaseSnapshotID are
+	// installed from without reading the guest memory files. The pages that enough recordings of their
+	// snapshot have touched are admitted, see HotPageMinRecordings, evicting the pages by CacheEviction
+	// once the pool is full. The default of 0 disables the pool.
+	HotPagePoolSize int
+	// HotPagePoolHugePages Back the hot page pool with huge pages, falling back to the regular
+	// pages if the node has no free huge pages
+	HotPagePoolHugePages bool
+	// HotPageMinRecordings Number of the recordings of a snapshot that must touch a page for it
+	// to be admitted to the hot page pool, the default of 0 admits the pages touched by two recordings
+	HotPageMinRecordings int
+	// StreamWorkingSet Fetch the working set files in the background, FetchState returns once the
+	// VMM state files are fetched. The page faults of the VMs are served on demand meanwhile, and the
+	// working set pages that have not been served are installed as they are fetched.
+	StreamWorkingSet bool
+	// SharedPagesBudget Size in bytes that the copies of the pages shared by the sibling instances
+	// take up across the snapshots, see SharePages. The pages are evicted by CacheEviction beyond it,
+	// and are read from the guest memory files again. The default of 0 does not bound the copies.
+	SharedPagesBudget int
+	// CacheEviction Policy that the shared pages and the hot page pool evict the pages by,
+	// the default evicts the least recently used pages
+	CacheEviction CacheEviction
+	// WorkingSetStore Central store of the working sets of the functions. The VMs with a FunctionID
+	// upload the working sets they record upon their deactivation, and FetchState downloads the
+	// working set of their function into their local record files, which are used if the store
+	// fails. The default of nil keeps the working sets in the local files only.
+	WorkingSetStore WorkingSetStore
 }
 
 // MemoryManager Serves page faults coming from VMs
 type MemoryManager struct {
 	sync.Mutex
 	MemoryManagerCfg
-	instances map[string]*SnapshotState // Indexed by vmID
+	instances   map[string]*SnapshotState // Indexed by vmID
+	sharedMems  map[string]*sharedMemory  // Indexed by BaseSnapshotID
+	sharedPages *cappedCache              // pages of the shared copies, see SharedPagesBudget
+	baseImages  map[string]*baseImage     // Indexed by BaseImagePath
+	heatmaps    map[string]pageHeatmap    // Indexed by snapshot ID, see PageHeatmap
+	hotPages    *hotPagePool              // nil unless HotPagePoolSize is set
+	inactive    *list.List                // Deactivated instances, the most recently deactivated first
+	errCh       chan error
+	workers     *workerPool
+	isShutdown  bool
+
+	capabilities Capabilities // probed once upon initialization
+	backend      faultBackend // chosen upon initialization, see newFaultBackend
+	sysPageSize  int          // page size of the system, determined upon initialization
+
+	// VMs whose state is being initialized outside of the lock by RegisterVM
+	registering map[string]struct{}
+
+	// slots of MaxActiveVMs held by the active VMs, see acquireActiveSlot
+	activeVMs int
+	slotFreed chan struct{} // closed once a slot is released
 }
 
-// NewMemoryManager Initializes a new memory manager
-func NewMemoryManager(cfg MemoryManagerCfg) *MemoryManager {
+// NewMemoryManager Initializes a new memory manager, returning *ConfigErrors with all the problems
+// of the configuration, each wrapping ErrInvalidConfig, if the configuration is invalid
+func NewMemoryManager(cfg MemoryManagerCfg) (*MemoryManager, error) {
 	log.Debug("Initializing the memory manager")
 
 	m := new(MemoryManager)
 	m.instances = make(map[string]*SnapshotState)
+	m.sharedMems = make(map[string]*sharedMemory)
+	m.sharedPages = newCappedCache(cfg.SharedPagesBudget, cfg.CacheEviction, nil)
+	m.baseImages = make(map[string]*baseImage)
+	m.heatmaps = make(map[string]pageHeatmap)
+	m.registering = make(map[string]struct{})
+	m.inactive = list.New()
+	m.slotFreed = make(chan struct{})
+	m.errCh = make(chan error, errChSize)
 	m.MemoryManagerCfg = cfg
+	if m.MetricsSink == nil {
+		m.MetricsSink = noopMetricsSink{}
+	}
+	if m.StateFS == nil {
+		m.StateFS = OSFS{}
+	}
+	m.capabilities = probeCapabilitiesFunc()
+	m.sysPageSize = os.Getpagesize()
+	m.logCapabilities()
+	m.backend = newFaultBackend(cfg.Backend, m.capabilities)
+
+	if errs := m.checkManagerConfig(); len(errs) > 0 {
+		return nil, &ConfigErrors{Errs: errs}
+	}
+
+	if cfg.WorkerPoolSize > 0 {
+		m.workers = newWorkerPool(cfg.WorkerPoolSize)
+	}
+
+	if cfg.HotPagePoolSize > 0 {
+		pool, err := newHotPagePool(cfg.HotPagePoolSize, m.sysPageSize, cfg.HotPagePoolHugePages, cfg.HotPageMinRecordings,
+			cfg.CacheEviction)
+		if err != nil {
+			log.Errorf("Failed to map the hot page pool, serving the VMs without it: %v", err)
+		} else {
+			m.hotPages = pool
+		}
+	}
+
+	return m, nil
+}
 
-	return m
+// checkManagerConfig Returns the problems of the configuration of the memory manager, which
+// apply to all VMs, in the order they are checked in
+func (m *MemoryManager) checkManagerConfig() []error {
+	var errs []error
+
+	if m.backend == nil {
+		errs = append(errs, fmt.Errorf("%w: unsupported fault backend %q", ErrInvalidConfig, m.Backend))
+	}
+
+	if _, local := m.StateFS.(OSFS); !local && m.RemoteStore != nil {
+		// the files are fetched from the remote store into their local paths
+		errs = append(errs, fmt.Errorf("%w: state files fetched from the remote store are local files, not in the StateFS",
+			ErrInvalidConfig))
+	}
+
+	if !m.WorkingSetCompression.isValid() {
+		errs = append(errs, fmt.Errorf(
+			"%w: unsupported working set compression %q", ErrInvalidConfig, m.WorkingSetCompression))
+	}
+
+	return errs
+}
+
+// Errors Returns the channel where the errors that occur while serving page faults
+// are reported as *VMError, the errors are dropped if the channel is not drained
+func (m *MemoryManager) Errors() <-chan error {
+	return m.errCh
 }
 
 // RegisterVM Registers a VM within the memory manager
 func (m *MemoryManager) RegisterVM(cfg SnapshotStateCfg) error {
-	m.Lock()
-	defer m.Unlock()
+	return m.RegisterVMWithContext(context.Background(), cfg)
+}
 
+// RegisterVMWithContext Registers a VM within the memory manager unless the context is done.
+// The state of the VM is initialized outside of the lock of the memory manager, so that the VMs
+// are registered concurrently.
+func (m *MemoryManager) RegisterVMWithContext(ctx context.Context, cfg SnapshotStateCfg) error {
 	vmID := cfg.VMID
 
 	logger := log.WithFields(log.Fields{"vmID": vmID})
 
 	logger.Debug("Registering the VM with the memory manager")
 
-	if _, ok := m.instances[vmID]; ok {
-		logger.Error("VM already registered with the memory manager")
-		return errors.New("VM already registered with the memory manager")
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	cfg.metricsModeOn = m.MetricsModeOn
-	state := NewSnapshotState(cfg)
+	if err := m.reserve(vmID); err != nil {
+		return err
+	}
+
+	state, err := m.newInstance(cfg)
+
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.registering, vmID)
+
+	if err != nil {
+		return err
+	}
+
+	if m.isShutdown {
+		if state.base != nil {
+			m.releaseBaseImage(state.BaseImagePath)
+		}
+		return ErrShutdown
+	}
+
+	if m.SharePages && cfg.BaseSnapshotID != "" {
+		shared, ok := m.sharedMemoryFor(cfg, state.PageSize)
+		if !ok {
+			return &VMError{VMID: vmID, Err: fmt.Errorf(
+				"%w: guest memory of snapshot %s has a different size or page size", ErrInvalidConfig, cfg.BaseSnapshotID)}
+		}
+		state.sharedMem = shared
+	}
+	if m.hotPages != nil && cfg.BaseSnapshotID != "" && state.PageSize == m.hotPages.pageSize {
+		state.hotPages = m.hotPages
+	}
+	state.errCh = m.errCh
+	if m.workers != nil {
+		state.faultQueue = m.workers.assign()
+	}
 
 	m.instances[vmID] = state
 
 	return nil
 }
 
-// DeregisterVM Deregisters a VM from the memory manager
-func (m *MemoryManager) DeregisterVM(vmID string) error {
+// reserve Reserves the vmID for the VM being registered unless it is registered already
+func (m *MemoryManager) reserve(vmID string) error {
 	m.Lock()
 	defer m.Unlock()
 
+	if m.isShutdown {
+		return ErrShutdown
+	}
+
+	if _, ok := m.instances[vmID]; ok {
+		return &VMError{VMID: vmID, Err: ErrVMAlreadyRegistered}
+	}
+	if _, ok := m.registering[vmID]; ok {
+		return &VMError{VMID: vmID, Err: ErrVMAlreadyRegistered}
+	}
+
+	m.registering[vmID] = struct{}{}
+
+	return nil
+}
+
+// newInstance Validates the configuration of the VM and initializes its state, including
+// the base image it shares, without the manager locked
+func (m *MemoryManager) newInstance(cfg SnapshotStateCfg) (*SnapshotState, error) {
+	vmID := cfg.VMID
+
+	pageSize := cfg.PageSize
+	if pageSize == 0 {
+		pageSize = m.sysPageSize
+	}
+
+	if cfg.FirecrackerState {
+		if err := m.applyFirecrackerState(&cfg); err != nil {
+			return nil, &VMError{VMID: vmID, Err: err}
+		}
+	}
+
+	if errs := m.checkConfig(cfg, pageSize); len(errs) > 0 {
+		return nil, &VMError{VMID: vmID, Err: errs[0]}
+	}
+
+	cfg.metricsModeOn = m.MetricsModeOn
+	cfg.streamWorkingSet = m.StreamWorkingSet
+	cfg.installChunkPages = m.InstallChunkPages
+	cfg.readAheadPages = m.ReadAheadPages
+	cfg.adaptiveReadAhead = m.AdaptiveReadAhead
+	cfg.remoteStore = m.RemoteStore
+	cfg.wsStore = m.WorkingSetStore
+	cfg.tracer = m.Tracer
+	cfg.pressure = m.MemoryPressure
+	cfg.compression = m.WorkingSetCompression
+	cfg.faultOrder = m.FaultOrderReplay
+	// the dirty pages are tracked with the soft-dirty bits if the kernel lacks write-protect faults
+	cfg.softDirty = cfg.WriteProtect && !m.capabilities.WriteProtect
+	// UFFDIO_ZEROPAGE does not support huge pages
+	cfg.noZeroPage = !m.capabilities.ZeroPage || pageSize != m.sysPageSize
+	cfg.PageSize = pageSize
+	cfg.backend = m.backend
+	cfg.onFirstFault = m.OnFirstFault
+	cfg.onWorkingSetComplete = m.OnWorkingSetComplete
+	cfg.onServeError = m.OnServeError
+	cfg.stateFS = m.StateFS
+	state := NewSnapshotState(cfg)
+	if cfg.BaseImagePath != "" {
+		overlay, err := loadOverlayPages(m.StateFS, cfg.OverlayPagesPath, cfg.GuestMemSize/pageSize)
+		if err != nil {
+			return nil, &VMError{VMID: vmID, Err: err}
+		}
+		base, err := m.baseImageFor(cfg.BaseImagePath, cfg.GuestMemSize)
+		if err != nil {
+			return nil, &VMError{VMID: vmID, Err: err}
+		}
+		state.base, state.overlayPages = base, overlay
+	}
+
+	return state, nil
+}
+
+// checkConfig Returns the problems of the configuration of the VM, in the order they are checked in
+func (m *MemoryManager) checkConfig(cfg SnapshotStateCfg, pageSize int) []error {
+	var errs []error
+
+	if pageSize%m.sysPageSize != 0 || pageSize&(pageSize-1) != 0 {
+		errs = append(errs, fmt.Errorf(
+			"%w: page size %d is not a power-of-two multiple of the system page size", ErrInvalidConfig, pageSize))
+	} else if cfg.GuestMemSize%pageSize != 0 {
+		errs = append(errs, fmt.Errorf(
+			"%w: guest memory size %d is not a multiple of the page size %d", ErrInvalidConfig, cfg.GuestMemSize, pageSize))
+	}
+
+	if len(cfg.Regions) > 0 {
+		if err := validateRegions(cfg.Regions, cfg.GuestMemSize, pageSize); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if cfg.GuestPhysBase != 0 {
+		if err := validateGuestPhysBase(cfg, pageSize); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if cfg.EagerRestore && !cfg.IsLazyMode {
+		errs = append(errs, fmt.Errorf(
+			"%w: eager restore is mutually exclusive with record and replay", ErrInvalidConfig))
+	}
+
+	if cfg.MinorFaults && (!cfg.IsLazyMode || cfg.WriteProtect) {
+		errs = append(errs, fmt.Errorf(
+			"%w: minor faults are supported only in lazy mode without write protection", ErrInvalidConfig))
+	}
+
+	if _, local := m.StateFS.(OSFS); !local && m.WorkingSetStore != nil && cfg.FunctionID != "" {
+		// the working sets are downloaded into the local record files
+		errs = append(errs, fmt.Errorf("%w: working sets downloaded from the working set store are local files, not in the StateFS",
+			ErrInvalidConfig))
+	}
+
+	if cfg.BaseImagePath != "" && (!cfg.IsLazyMode || cfg.EagerRestore || (m.SharePages && cfg.BaseSnapshotID != "")) {
+		errs = append(errs, fmt.Errorf(
+			"%w: base image is supported only in lazy mode without eager restore and shared pages", ErrInvalidConfig))
+	}
+
+	if cfg.NUMAPlacement {
+		if m.workers != nil {
+			// the workers serve the page faults of all VMs, regardless of their node
+			errs = append(errs, fmt.Errorf(
+				"%w: NUMA placement is not supported with the worker pool", ErrInvalidConfig))
+		}
+		if cfg.NUMANode < 0 || !numaNodeExists(cfg.NUMANode) {
+			errs = append(errs, fmt.Errorf("%w: NUMA node %d does not exist", ErrInvalidConfig, cfg.NUMANode))
+		}
+	}
+
+	if cfg.FaultRateLimit < 0 {
+		errs = append(errs, fmt.Errorf("%w: fault rate limit %d is negative", ErrInvalidConfig, cfg.FaultRateLimit))
+	}
+
+	if !cfg.ReadStrategy.isValid() {
+		errs = append(errs, fmt.Errorf("%w: unsupported read strategy %q", ErrInvalidConfig, cfg.ReadStrategy))
+	}
+	_, preload := m.backend.(preloadBackend)
+	if cfg.ReadStrategy != MmapRead && (preload || (m.SharePages && cfg.BaseSnapshotID != "")) {
+		// both preloading and sharing the pages read the guest memory through the mapping
+		errs = append(errs, fmt.Errorf(
+			"%w: %s reads are supported only without the preload backend and shared pages",
+			ErrInvalidConfig, cfg.ReadStrategy))
+	}
+	if cfg.FaultReadTimeout < 0 {
+		errs = append(errs, fmt.Errorf("%w: fault read timeout %v is negative", ErrInvalidConfig, cfg.FaultReadTimeout))
+	}
+	if cfg.FaultReadTimeout > 0 && (cfg.ReadStrategy == MmapRead || cfg.ReadStrategy == WindowedRead) {
+		// the mapped pages are read while installing them, which cannot be interrupted
+		errs = append(errs, fmt.Errorf("%w: fault read timeout requires the %s or %s read strategy",
+			ErrInvalidConfig, PreadRead, CompressedRead))
+	}
+	if cfg.WindowSize != 0 && cfg.ReadStrategy != WindowedRead {
+		errs = append(errs, fmt.Errorf("%w: window size requires the %s read strategy", ErrInvalidConfig, WindowedRead))
+	}
+	if cfg.WindowSize < 0 || cfg.WindowSize%m.sysPageSize != 0 {
+		errs = append(errs, fmt.Errorf("%w: window size %d is not a multiple of the system page size %d",
+			ErrInvalidConfig, cfg.WindowSize, m.sysPageSize))
+	}
+	if cfg.ReadStrategy == CompressedRead && !cfg.IsLazyMode {
+		// the working set file is copied from the uncompressed guest memory file
+		errs = append(errs, fmt.Errorf("%w: compressed guest memory is supported only in lazy mode", ErrInvalidConfig))
+	}
+
+	if err := m.checkCapabilities(cfg); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errs
+}
+
+// DeregisterVM Deregisters a VM from the memory manager
+func (m *MemoryManager) DeregisterVM(vmID string) error {
 	logger := log.WithFields(log.Fields{"vmID": vmID})
 
 	logger.Debug("Deregistering VM from the memory manager")
 
-	state, ok := m.instances[vmID]
-	if !ok {
-		logger.Error("VM is not registered with the memory manager")
-		return errors.New("VM is not registered with the memory manager")
+	state, err := m.getInstance(vmID)
+	if err != nil {
+		return err
+	}
+
+	state.opMu.Lock()
+	defer state.opMu.Unlock()
+
+	m.Lock()
+	defer m.Unlock()
+
+	// the VM may have been deregistered or evicted meanwhile
+	if m.instances[vmID] != state {
+		return &VMError{VMID: vmID, Err: ErrVMNotRegistered}
 	}
 
 	if state.isActive {
-		logger.Error("Failed to deactivate, VM still active")
-		return errors.New("Failed to deactivate, VM still active")
+		return &VMError{VMID: vmID, Err: ErrVMStillActive}
+	}
+
+	state.stopWorkingSetStream()
+
+	if state.sharedMem != nil {
+		m.releaseSharedMemory(state.BaseSnapshotID)
+	}
+	if state.base != nil {
+		m.releaseBaseImage(state.BaseImagePath)
 	}
 
+	m.markActive(state)
+	m.recordMetrics(state)
+	state.closeGuestMemFD()
 	delete(m.instances, vmID)
 
 	return nil
@@ -117,84 +539,351 @@ func (m *MemoryManager) DeregisterVM(vmID string) error {
 
 // Activate Creates an epoller to serve page faults for the VM
 func (m *MemoryManager) Activate(vmID string) error {
+	return m.ActivateWithContext(context.Background(), vmID)
+}
+
+// ActivateWithContext Creates an epoller to serve page faults for the VM. Waiting for a slot of
+// MaxActiveVMs, fetching the guest memory file from the remote store and receiving the uffd are
+// aborted once the context is done, in which case the VM is left inactive.
+func (m *MemoryManager) ActivateWithContext(ctx context.Context, vmID string) error {
 	logger := log.WithFields(log.Fields{"vmID": vmID})
 
 	logger.Debug("Activating instance in the memory manager")
 
 	var (
-		ok      bool
-		state   *SnapshotState
-		readyCh chan int = make(chan int)
+		ok    bool
+		state *SnapshotState
 	)
 
 	m.Lock()
 
+	if m.isShutdown {
+		m.Unlock()
+		return ErrShutdown
+	}
+
 	state, ok = m.instances[vmID]
 	if !ok {
-		logger.Error("VM not registered with the memory manager")
-		return errors.New("VM not registered with the memory manager")
+		m.Unlock()
+		return &VMError{VMID: vmID, Err: ErrVMNotRegistered}
 	}
 
 	m.Unlock()
 
+	state.opMu.Lock()
+	defer state.opMu.Unlock()
+
+	return m.activate(ctx, state)
+}
+
+// activate Maps the guest memory of the VM and starts serving its page faults.
+// Must be called with the VM locked, and the manager unlocked.
+func (m *MemoryManager) activate(ctx context.Context, state *SnapshotState) error {
+	vmID := state.VMID
+
+	m.Lock()
+	switch {
+	case m.isShutdown:
+		m.Unlock()
+		return ErrShutdown
+	case m.instances[vmID] != state:
+		// the VM has been deregistered or evicted meanwhile
+		m.Unlock()
+		return &VMError{VMID: vmID, Err: ErrVMNotRegistered}
+	}
+	wasInactive := state.inactiveElem != nil
+	m.markActive(state)
+	m.Unlock()
+
 	if state.isActive {
-		logger.Error("VM already active")
-		return errors.New("VM already active")
+		return &VMError{VMID: vmID, Err: ErrVMAlreadyActive}
 	}
 
-	if err := state.mapGuestMemory(); err != nil {
-		logger.Error("Failed to map guest memory")
-		return err
+	if err := m.acquireActiveSlot(ctx, state); err != nil {
+		m.abortActivation(state, wasInactive)
+		return &VMError{VMID: vmID, Err: err}
+	}
+
+	atomic.StoreInt64(&state.activatedAt, time.Now().UnixNano())
+
+	if err := state.mapGuestMemory(ctx); err != nil {
+		m.abortActivation(state, wasInactive)
+		return &VMError{VMID: vmID, Err: fmt.Errorf("failed to map guest memory: %w", err)}
+	}
+
+	if err := state.backend.activate(ctx, state); err != nil {
+		m.abortActivation(state, wasInactive)
+		return &VMError{VMID: vmID, Err: err}
+	}
+
+	return nil
+}
+
+// abortActivation Undoes a failed activation, unmapping the guest memory and putting the VM
+// back to the inactive list if it was there, so that it can be activated again
+func (m *MemoryManager) abortActivation(state *SnapshotState, wasInactive bool) {
+	if err := state.unmapGuestMemory(); err != nil {
+		log.WithFields(log.Fields{"vmID": state.VMID}).Warnf("Failed to munmap guest memory: %v", err)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.releaseActiveSlot(state)
+
+	if !wasInactive {
+		return
 	}
 
-	if err := state.getUFFD(); err != nil {
-		logger.Error("Failed to get uffd")
+	// the VM may have been deregistered or evicted meanwhile
+	if !m.isShutdown && m.instances[state.VMID] == state {
+		m.markInactive(state)
+	}
+}
+
+// ActivateIdempotent Activates the VM like ActivateWithContext, unless it is active already and
+// its page faults are being served, in which case it succeeds without receiving another uffd.
+// This allows to retry a restore that may have activated the VM. An active VM whose page faults
+// are not served anymore, e.g., because its uffd has failed, must be deactivated first.
+func (m *MemoryManager) ActivateIdempotent(ctx context.Context, vmID string) error {
+	state, err := m.getInstance(vmID)
+	if err != nil {
 		return err
 	}
 
-	state.setupStateOnActivate()
+	state.opMu.Lock()
+	defer state.opMu.Unlock()
 
-	go state.pollUserPageFaults(readyCh)
+	if state.isActive {
+		if state.backend.isServing(state) {
+			log.WithFields(log.Fields{"vmID": vmID}).Debug("VM already active, skipping the activation")
+			return nil
+		}
+		return &VMError{VMID: vmID, Err: fmt.Errorf("%w: page faults are not served anymore", ErrVMAlreadyActive)}
+	}
 
-	<-readyCh
+	return m.activate(ctx, state)
+}
 
-	return nil
+// FetchState Fetches the working set file (or the whole guest memory) and the VMM state file.
+// Returns the number of the working set pages that are installed upon the first page fault,
+// which is zero for instances that have no record yet. For the instances in lazy mode, it fetches
+// and returns the pages served in their previous activation instead. FetchVMMState, FetchWorkingSet
+// and FetchGuestMemory fetch the files separately.
+func (m *MemoryManager) FetchState(vmID string) (int, error) {
+	return m.FetchStateWithContext(context.Background(), vmID)
 }
 
-// FetchState Fetches the working set file (or the whole guest memory) and the VMM state file
-func (m *MemoryManager) FetchState(vmID string) error {
+// FetchStateWithContext Fetches the state files like FetchState, fetching them from the remote
+// store is aborted once the context is done
+func (m *MemoryManager) FetchStateWithContext(ctx context.Context, vmID string) (int, error) {
+	return m.FetchStateWithProgress(ctx, vmID, 0, nil)
+}
+
+// FetchStateWithProgress Fetches the state files like FetchStateWithContext, calling progress with
+// the number of the pages fetched so far and the total number of the pages to fetch every `every`
+// pages and once all of them are fetched. Reading the pages is aborted once the context is done.
+// With StreamWorkingSet, the working set is read in the background until the VM is deactivated
+// regardless of the context, and the progress is reported from the goroutine reading it.
+func (m *MemoryManager) FetchStateWithProgress(ctx context.Context, vmID string, every int,
+	progress func(fetched, total int)) (int, error) {
 	logger := log.WithFields(log.Fields{"vmID": vmID})
 
-	logger.Debug("Activating instance in the memory manager")
+	logger.Debug("Fetching state of the instance in the memory manager")
 
 	var (
-		ok     bool
-		state  *SnapshotState
 		tStart time.Time
-		err    error
+		pages  int
 	)
 
-	m.Lock()
+	state, err := m.getInstance(vmID)
+	if err != nil {
+		return 0, err
+	}
 
-	state, ok = m.instances[vmID]
-	if !ok {
-		logger.Error("VM not registered with the memory manager")
-		return errors.New("VM not registered with the memory manager")
+	ctx, span := state.startSpan(ctx, "memory_manager.FetchState")
+	defer span.End()
+
+	if err := state.fetchRemoteState(ctx); err != nil {
+		return 0, &VMError{VMID: vmID, Err: err}
 	}
 
-	m.Unlock()
+	if !state.isRecordReady && !state.IsLazyMode {
+		if state.usesWorkingSetStore() {
+			state.fetchStoredWorkingSet(ctx)
+		}
+		if err := state.loadRecord(); err != nil {
+			return 0, &VMError{VMID: vmID, Err: err}
+		}
+	}
+
+	fetched := newFetchProgress(ctx, every, progress)
+
+	if state.onDemand() {
+		// prefetching pages under memory pressure risks the OOM killer
+		logger.Debug("Node is under memory pressure, fetching no pages")
+		span.SetAttribute("onDemand", true)
+		return 0, state.fetchVMMState()
+	}
+
+	if state.IsLazyMode && !state.EagerRestore {
+		pages, err = state.fetchResidency(fetched)
+	}
 
 	if state.isRecordReady && !state.IsLazyMode {
 		if state.metricsModeOn {
 			tStart = time.Now()
 		}
-		err = state.fetchState()
-		if state.metricsModeOn {
+		if state.streamWorkingSet {
+			pages, err = state.startWorkingSetStream(every, progress)
+		} else {
+			pages, err = state.fetchState(fetched)
+		}
+		if state.metricsModeOn && state.currentMetric != nil {
 			state.currentMetric.MetricMap[fetchStateMetric] = metrics.ToUS(time.Since(tStart))
 		}
 	}
 
-	return err
+	span.SetAttribute("pages", pages)
+	if err != nil {
+		span.SetAttribute("error", err.Error())
+		return pages, &VMError{VMID: vmID, Err: err}
+	}
+
+	return pages, nil
+}
+
+// FetchVMMState Fetches only the VMM state file of the VM, e.g., to warm up the device
+// and CPU state without touching the guest memory
+func (m *MemoryManager) FetchVMMState(vmID string) error {
+	state, err := m.getInstance(vmID)
+	if err != nil {
+		return err
+	}
+
+	if err := state.fetchRemoteFile(context.Background(), VMMStateFile, state.VMMStatePath); err != nil {
+		return err
+	}
+
+	return state.fetchVMMState()
+}
+
+// FetchWorkingSet Fetches only the working set file of the VM, loading its persisted record
+// first if needed. Returns the number of the working set pages that are installed upon the first
+// page fault, which is zero for instances that have no record yet or are in the lazy mode
+func (m *MemoryManager) FetchWorkingSet(vmID string) (int, error) {
+	state, err := m.getInstance(vmID)
+	if err != nil {
+		return 0, err
+	}
+
+	if state.IsLazyMode {
+		return 0, nil
+	}
+
+	ctx := context.Background()
+	if err := state.fetchRemoteFile(ctx, TraceFile, state.trace.traceFileName); err != nil {
+		return 0, err
+	}
+	if err := state.fetchRemoteFile(ctx, WorkingSetFile, state.WorkingSetPath); err != nil {
+		return 0, err
+	}
+	if state.faultOrder {
+		if err := state.fetchRemoteFile(ctx, SequenceFile, state.getSequenceFile()); err != nil {
+			return 0, err
+		}
+	}
+	if state.FunctionVersion != "" {
+		if err := state.fetchRemoteFile(ctx, VersionFile, state.getVersionFile()); err != nil {
+			return 0, err
+		}
+	}
+
+	if !state.isRecordReady {
+		if state.usesWorkingSetStore() {
+			state.fetchStoredWorkingSet(ctx)
+		}
+		if err := state.loadRecord(); err != nil {
+			return 0, err
+		}
+		if !state.isRecordReady {
+			return 0, nil
+		}
+	}
+
+	return state.fetchWorkingSet(nil)
+}
+
+// FetchGuestMemory Fetches only the guest memory file of the VM into the page cache
+func (m *MemoryManager) FetchGuestMemory(vmID string) error {
+	state, err := m.getInstance(vmID)
+	if err != nil {
+		return err
+	}
+
+	if err := state.fetchRemoteFile(context.Background(), GuestMemFile, state.guestMemFilePath()); err != nil {
+		return err
+	}
+
+	return state.fetchGuestMemory(nil)
+}
+
+// ActiveVMs Returns the sorted IDs of the registered VMs that are active
+func (m *MemoryManager) ActiveVMs() []string {
+	return m.listVMs(true)
+}
+
+// InactiveVMs Returns the sorted IDs of the registered VMs that are not active,
+// including the ones that have never been activated
+func (m *MemoryManager) InactiveVMs() []string {
+	return m.listVMs(false)
+}
+
+func (m *MemoryManager) listVMs(active bool) []string {
+	m.Lock()
+	defer m.Unlock()
+
+	vmIDs := make([]string, 0, len(m.instances))
+	for vmID, state := range m.instances {
+		if state.isActive == active {
+			vmIDs = append(vmIDs, vmID)
+		}
+	}
+	sort.Strings(vmIDs)
+
+	return vmIDs
+}
+
+// getInstance Returns the state of the registered VM
+func (m *MemoryManager) getInstance(vmID string) (*SnapshotState, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	state, ok := m.instances[vmID]
+	if !ok {
+		return nil, &VMError{VMID: vmID, Err: ErrVMNotRegistered}
+	}
+
+	return state, nil
+}
+
+// getStatsInstance Returns the state of the registered VM whose stats can be read,
+// i.e., that is inactive and has the metrics mode on
+func (m *MemoryManager) getStatsInstance(vmID string) (*SnapshotState, error) {
+	state, err := m.getInstance(vmID)
+	if err != nil {
+		return nil, err
+	}
+
+	if state.isActive {
+		return nil, &VMError{VMID: vmID, Err: ErrVMStillActive}
+	}
+
+	if !m.MetricsModeOn || !state.metricsModeOn {
+		return nil, &VMError{VMID: vmID, Err: ErrMetricsModeOff}
+	}
+
+	return state, nil
 }
 
 // Deactivate Removes the epoller which serves page faults for the VM
@@ -203,45 +892,141 @@ func (m *MemoryManager) Deactivate(vmID string) error {
 
 	logger.Debug("Deactivating instance from the memory manager")
 
-	var (
-		state *SnapshotState
-		ok    bool
-	)
+	state, err := m.getInstance(vmID)
+	if err != nil {
+		return err
+	}
+
+	return m.deactivate(context.Background(), state)
+}
+
+// Shutdown Stops serving page faults of all VMs. It waits until the in-flight page faults are
+// served, or the context is done, and deactivates the active VMs. The memory manager does not
+// accept new VMs after the shutdown.
+func (m *MemoryManager) Shutdown(ctx context.Context) error {
+	log.Debug("Shutting down the memory manager")
 
 	m.Lock()
 
-	state, ok = m.instances[vmID]
-	if !ok {
-		logger.Error("VM not registered with the memory manager")
-		return errors.New("VM not registered with the memory manager")
+	if m.isShutdown {
+		m.Unlock()
+		return nil
+	}
+	m.isShutdown = true
+	m.wakeQueuedActivations()
+
+	states := make([]*SnapshotState, 0, len(m.instances))
+	for _, state := range m.instances {
+		if state.isActive {
+			states = append(states, state)
+		}
 	}
+	sort.Slice(states, func(i, j int) bool { return states[i].VMID < states[j].VMID })
 
 	m.Unlock()
 
+	var firstErr error
+	for _, state := range states {
+		if err := m.deactivate(ctx, state); err != nil {
+			log.WithFields(log.Fields{"vmID": state.VMID}).Errorf("Failed to deactivate VM upon shutdown: %v", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	// the polling loops have quit, so nothing is queued to the workers anymore
+	if m.workers != nil {
+		m.workers.stop()
+	}
+
+	if m.hotPages != nil {
+		if err := m.hotPages.close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to unmap the hot page pool: %w", err)
+		}
+	}
+
+	return firstErr
+}
+
+func (m *MemoryManager) deactivate(ctx context.Context, state *SnapshotState) error {
+	state.opMu.Lock()
+	defer state.opMu.Unlock()
+
 	if !state.isEverActivated {
 		return nil
 	}
 
 	if !state.isActive {
-		logger.Error("VM not activated")
-		return errors.New("VM not activated")
+		return &VMError{VMID: state.VMID, Err: ErrVMNotActive}
+	}
+
+	state.stopWorkingSetStream()
+
+	if state.softDirty {
+		// the address space of the VM may be gone after its deactivation
+		state.dirtyMu.Lock()
+		if err := state.collectSoftDirty(); err != nil {
+			log.WithFields(log.Fields{"vmID": state.VMID}).Warnf("Failed to collect the dirty pages: %v", err)
+		}
+		state.dirtyMu.Unlock()
 	}
 
-	state.quitCh <- 0
+	if err := state.backend.deactivate(ctx, state); err != nil {
+		return &VMError{VMID: state.VMID, Err: err}
+	}
 	if err := state.unmapGuestMemory(); err != nil {
-		logger.Error("Failed to munmap guest memory")
-		return err
+		return &VMError{VMID: state.VMID, Err: fmt.Errorf("failed to munmap guest memory: %w", err)}
 	}
 
+	// the uffd and the guest memory of the VM are released already
+	m.Lock()
+	m.releaseActiveSlot(state)
+	m.Unlock()
+
 	state.processMetrics()
 
-	state.userFaultFD.Close()
-	if !state.isRecordReady && !state.IsLazyMode {
-		state.trace.ProcessRecord(state.GuestMemPath, state.WorkingSetPath)
+	if state.IsLazyMode && !state.EagerRestore {
+		// the resident pages are only prefetched in the next activation, which serves them on demand
+		// without the residency file
+		if err := state.persistResidency(); err != nil {
+			log.WithFields(log.Fields{"vmID": state.VMID}).Warnf("Failed to persist the resident pages: %v", err)
+		}
+	}
+
+	state.resetStateOnDeactivate()
+
+	// the VM is inactive from now on, and thus evictable, even if its record fails to be persisted,
+	// in which case it is recorded again in its next activation
+	defer func() {
+		m.Lock()
+		m.markInactive(state)
+		m.Unlock()
+	}()
+
+	recorded := !state.isRecordReady && !state.IsLazyMode
+	if recorded {
+		if err := state.trace.ProcessRecord(state.guestMemFilePath(), state.WorkingSetPath); err != nil {
+			return &VMError{VMID: state.VMID, Err: fmt.Errorf("failed to persist the record: %w", err)}
+		}
+		if err := state.persistVersion(); err != nil {
+			return &VMError{VMID: state.VMID, Err: fmt.Errorf("failed to persist the record version: %w", err)}
+		}
+		if state.usesWorkingSetStore() {
+			// the record is replayed from the local files if it fails to be uploaded
+			if err := state.uploadWorkingSet(ctx); err != nil {
+				log.WithFields(log.Fields{"vmID": state.VMID}).Warnf("Failed to upload the record: %v", err)
+			}
+		}
 	}
 
 	state.isRecordReady = true
-	state.isActive = false
+
+	if recorded && (m.ProfilePageFrequency || m.hotPages != nil) {
+		m.Lock()
+		m.addToHeatmap(state)
+		m.Unlock()
+	}
 
 	return nil
 }
@@ -257,24 +1042,9 @@ func (m *MemoryManager) DumpUPFPageStats(vmID, functionName, metricsOutFilePath
 
 	logger.Debug("Dumping stats about number of page faults")
 
-	m.Lock()
-
-	state, ok := m.instances[vmID]
-	if !ok {
-		logger.Error("VM not registered with the memory manager")
-		return errors.New("VM not registered with the memory manager")
-	}
-
-	m.Unlock()
-
-	if state.isActive {
-		logger.Error("Cannot get stats while VM is active")
-		return errors.New("Cannot get stats while VM is active")
-	}
-
-	if !m.MetricsModeOn || !state.metricsModeOn {
-		logger.Error("Metrics mode is not on")
-		return errors.New("Metrics mode is not on")
+	state, err := m.getStatsInstance(vmID)
+	if err != nil {
+		return err
 	}
 
 	if state.IsLazyMode {
@@ -292,57 +1062,122 @@ func (m *MemoryManager) DumpUPFLatencyStats(vmID, functionName, latencyOutFilePa
 
 	logger.Debug("Dumping stats about latency of UPFs")
 
-	m.Lock()
+	state, err := m.getStatsInstance(vmID)
+	if err != nil {
+		return err
+	}
 
-	state, ok := m.instances[vmID]
-	if !ok {
-		logger.Error("VM not registered with the memory manager")
-		return errors.New("VM not registered with the memory manager")
+	return metrics.PrintMeanStd(latencyOutFilePath, functionName, state.latencyMetrics...)
+
+}
+
+// GetUPFLatencyStats Returns the gathered metrics for the VM
+func (m *MemoryManager) GetUPFLatencyStats(vmID string) ([]*metrics.Metric, error) {
+	logger := log.WithFields(log.Fields{"vmID": vmID})
+
+	logger.Debug("returning stats about latency of UPFs")
+
+	state, err := m.getStatsInstance(vmID)
+	if err != nil {
+		return nil, err
 	}
 
-	m.Unlock()
+	return state.latencyMetrics, nil
+}
 
-	if state.isActive {
-		logger.Error("Cannot get stats while VM is active")
-		return errors.New("Cannot get stats while VM is active")
+// GetInstallStats Returns the number of pages installed for the VM with UFFDIO_ZEROPAGE,
+// because they are zero-filled in the guest memory file, and with UFFDIO_COPY
+func (m *MemoryManager) GetInstallStats(vmID string) (zeroPages, copiedPages int, err error) {
+	logger := log.WithFields(log.Fields{"vmID": vmID})
+
+	logger.Debug("returning stats about installed pages")
+
+	state, err := m.getInstance(vmID)
+	if err != nil {
+		return 0, 0, err
 	}
 
-	if !m.MetricsModeOn || !state.metricsModeOn {
-		logger.Error("Metrics mode is not on")
-		return errors.New("Metrics mode is not on")
+	return int(atomic.LoadInt64(&state.zeroInstalls)), int(atomic.LoadInt64(&state.copyInstalls)), nil
+}
+
+// ServeErrors Returns the number of the page faults of the VM that failed to be served
+// during its lifetime
+func (m *MemoryManager) ServeErrors(vmID string) (int64, error) {
+	state, err := m.getInstance(vmID)
+	if err != nil {
+		return 0, err
 	}
 
-	return metrics.PrintMeanStd(latencyOutFilePath, functionName, state.latencyMetrics...)
+	return atomic.LoadInt64(&state.serveErrors), nil
+}
+
+// DirtyPages Returns the sorted offsets of the pages that the VM in the write-protect mode
+// has written since its activation
+// If the kernel lacks write-protect faults, the pages are tracked with their soft-dirty bits,
+// and the pages installed after the first page fault are reported as written as well.
+func (m *MemoryManager) DirtyPages(vmID string) ([]uint64, error) {
+	logger := log.WithFields(log.Fields{"vmID": vmID})
+
+	logger.Debug("returning the dirty pages")
+
+	state, err := m.getInstance(vmID)
+	if err != nil {
+		return nil, err
+	}
 
+	if !state.WriteProtect {
+		return nil, &VMError{VMID: vmID, Err: ErrNotWriteProtected}
+	}
+
+	if state.softDirty {
+		if err := state.syncSoftDirty(); err != nil {
+			return nil, &VMError{VMID: vmID, Err: err}
+		}
+	}
+
+	return state.dirtyOffsets(), nil
 }
 
-// GetUPFLatencyStats Returns the gathered metrics for the VM
-func (m *MemoryManager) GetUPFLatencyStats(vmID string) ([]*metrics.Metric, error) {
+// ReplayCoverage Returns the fraction of the pages installed for the VM that were prefetched with
+// its working set, rather than installed on demand, since it was activated in replay mode.
+// A low coverage signals that the working set of the VM needs to be recorded again.
+func (m *MemoryManager) ReplayCoverage(vmID string) (float64, error) {
 	logger := log.WithFields(log.Fields{"vmID": vmID})
 
-	logger.Debug("returning stats about latency of UPFs")
+	logger.Debug("returning the replay coverage")
 
-	m.Lock()
+	state, err := m.getInstance(vmID)
+	if err != nil {
+		return 0, err
+	}
 
-	state, ok := m.instances[vmID]
-	if !ok {
-		logger.Error("VM not registered with the memory manager")
-		return nil, errors.New("VM not registered with the memory manager")
+	prefetched := atomic.LoadInt64(&state.prefetchedPages)
+	missed := atomic.LoadInt64(&state.missedFaultPages)
+	if prefetched+missed == 0 {
+		return 0, &VMError{VMID: vmID, Err: ErrNotReplayed}
 	}
 
-	m.Unlock()
+	return float64(prefetched) / float64(prefetched+missed), nil
+}
 
-	if state.isActive {
-		logger.Error("Cannot get stats while VM is active")
-		return nil, errors.New("Cannot get stats while VM is active")
+// WorkingSetSize Returns the size of the working set of the VM, which is the number of
+// the pages served since its activation if it is active, or the recorded working set otherwise
+func (m *MemoryManager) WorkingSetSize(vmID string) (pages int, bytes int, err error) {
+	logger := log.WithFields(log.Fields{"vmID": vmID})
+
+	logger.Debug("returning the working set size")
+
+	state, err := m.getInstance(vmID)
+	if err != nil {
+		return 0, 0, err
 	}
 
-	if !m.MetricsModeOn || !state.metricsModeOn {
-		logger.Error("Metrics mode is not on")
-		return nil, errors.New("Metrics mode is not on")
+	pages, err = state.workingSetPages()
+	if err != nil {
+		return 0, 0, &VMError{VMID: vmID, Err: err}
 	}
 
-	return state.latencyMetrics, nil
+	return pages, pages * state.PageSize, nil
 }
 
 func getLazyHeaderStats(state *SnapshotState, functionName string) ([]string, []string) {
@@ -24,15 +24,1532 @@
 package manager
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
 
 	"io/ioutil"
 
+	"github.com/ftrvxmtrx/fd"
 	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
 
 	"errors"
 )
 
+func TestFetchStateColdVM(t *testing.T) {
+	manager := newTestManager(t, MemoryManagerCfg{})
+
+	stateCfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+
+	err := manager.RegisterVM(stateCfg)
+	require.NoError(t, err, "Failed to register VM")
+
+	pages, err := manager.FetchState(stateCfg.VMID)
+	require.NoError(t, err, "Fetching state of a cold VM must not fail")
+	require.Equal(t, 0, pages, "Cold VM must not prefetch any pages")
+}
+
+func TestFetchStatePersistedRecord(t *testing.T) {
+	manager := newTestManager(t, MemoryManagerCfg{})
+
+	stateCfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+	offsets := []uint64{0, uint64(os.Getpagesize()), uint64(3 * os.Getpagesize())}
+	persistRecord(t, stateCfg, offsets)
+
+	err := manager.RegisterVM(stateCfg)
+	require.NoError(t, err, "Failed to register VM")
+
+	pages, err := manager.FetchState(stateCfg.VMID)
+	require.NoError(t, err, "Failed to fetch state")
+	require.Equal(t, len(offsets), pages, "Wrong number of prefetched pages")
+}
+
+func TestFetchStateCorruptWorkingSet(t *testing.T) {
+	manager := newTestManager(t, MemoryManagerCfg{})
+
+	stateCfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+	persistRecord(t, stateCfg, []uint64{0, uint64(os.Getpagesize())})
+
+	// drop the last page of the working set
+	err := os.Truncate(stateCfg.WorkingSetPath, int64(os.Getpagesize()))
+	require.NoError(t, err, "Failed to truncate the working set file")
+
+	err = manager.RegisterVM(stateCfg)
+	require.NoError(t, err, "Failed to register VM")
+
+	_, err = manager.FetchState(stateCfg.VMID)
+	require.Error(t, err, "Corrupt working set file must be reported")
+}
+
+func TestMapGuestMemoryTruncatedFile(t *testing.T) {
+	stateCfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+
+	err := os.Truncate(stateCfg.GuestMemPath, int64(3*os.Getpagesize()))
+	require.NoError(t, err, "Failed to truncate the guest memory file")
+
+	state := NewSnapshotState(stateCfg)
+	err = state.mapGuestMemory(context.Background())
+	require.Error(t, err, "Truncated guest memory file must be reported")
+	require.Contains(t, err.Error(), "truncated")
+}
+
+func TestMapGuestMemoryChecksum(t *testing.T) {
+	stateCfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+
+	checksum, err := GuestMemoryChecksum(stateCfg.GuestMemPath)
+	require.NoError(t, err, "Failed to compute the guest memory checksum")
+
+	stateCfg.GuestMemChecksum = checksum
+	state := NewSnapshotState(stateCfg)
+	err = state.mapGuestMemory(context.Background())
+	require.NoError(t, err, "Guest memory with a matching checksum must be mapped")
+	require.NoError(t, state.unmapGuestMemory(), "Failed to unmap guest memory")
+
+	// corrupt the first page
+	f, err := os.OpenFile(stateCfg.GuestMemPath, os.O_WRONLY, 0644)
+	require.NoError(t, err, "Failed to open the guest memory file")
+	_, err = f.WriteAt([]byte{0}, 0)
+	require.NoError(t, err, "Failed to corrupt the guest memory file")
+	f.Close()
+
+	err = state.mapGuestMemory(context.Background())
+	require.Error(t, err, "Checksum mismatch must be reported")
+	require.Contains(t, err.Error(), "checksum")
+}
+
+func TestServePageFaultInstallChunks(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	pageSize := uint64(os.Getpagesize())
+
+	// sequential access to 8 pages with 1-page installs
+	state := newTestSnapshotState(8, 1)
+	for page := uint64(0); page < 8; page++ {
+		err := state.servePageFault(-1, testStartAddress+page*pageSize)
+		require.NoError(t, err, "Failed to serve page fault")
+	}
+	require.Len(t, installs, 8, "Every page must be installed separately")
+
+	// the same access pattern with 4-page chunks
+	installs = nil
+	state = newTestSnapshotState(8, 4)
+	for page := uint64(0); page < 8; page++ {
+		if state.servedPages.Test(int(page)) {
+			continue // would not fault
+		}
+		err := state.servePageFault(-1, testStartAddress+page*pageSize)
+		require.NoError(t, err, "Failed to serve page fault")
+	}
+	require.Len(t, installs, 2, "Chunks must be installed in a single call")
+	require.Equal(t, 8, state.servedPages.Count(), "All pages must be served")
+}
+
+func TestServePageFaultInstallChunkClamping(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	pageSize := uint64(os.Getpagesize())
+
+	// 6 pages of guest memory, the second chunk is cut by the end of the guest memory
+	state := newTestSnapshotState(6, 4)
+
+	err := state.servePageFault(-1, testStartAddress+5*pageSize)
+	require.NoError(t, err, "Failed to serve page fault")
+	require.Equal(t, installCall{dst: testStartAddress + 4*pageSize, len: 2 * pageSize}, installs[0])
+
+	// page 1 is already served, so the run must stop right before it
+	state.servedPages.Set(1)
+	err = state.servePageFault(-1, testStartAddress+3*pageSize)
+	require.NoError(t, err, "Failed to serve page fault")
+	require.Equal(t, installCall{dst: testStartAddress + 2*pageSize, len: 2 * pageSize}, installs[1])
+}
+
+func TestServePageFaultOutOfRange(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	pageSize := uint64(os.Getpagesize())
+	state := newTestSnapshotState(4, 1)
+
+	for _, address := range []uint64{
+		testStartAddress - pageSize,   // below the start
+		testStartAddress + 4*pageSize, // past the end
+		testStartAddress + 1<<40,      // far past the end
+	} {
+		err := state.servePageFault(-1, address)
+		require.True(t, errors.Is(err, ErrFaultOutOfRange), "Fault outside of the guest memory must be rejected")
+	}
+	require.Empty(t, installs, "No pages must be installed for faults outside of the guest memory")
+
+	// the start address is set by the first page fault, which has been consumed
+	state.startAddress = 0
+	err := state.servePageFault(-1, testStartAddress)
+	require.True(t, errors.Is(err, ErrFaultOutOfRange), "Fault before the start address is known must be rejected")
+	require.Empty(t, installs, "No pages must be installed before the start address is known")
+}
+
+func TestOnFirstFault(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	var (
+		mu    sync.Mutex
+		calls []string
+	)
+	manager := newTestManager(t, MemoryManagerCfg{
+		WorkerPoolSize: 2,
+		OnFirstFault: func(vmID string, served time.Time) {
+			mu.Lock()
+			defer mu.Unlock()
+			require.False(t, served.IsZero(), "Served time must be set")
+			calls = append(calls, vmID)
+		},
+	})
+	stateCfg := prepareSnapshotStateCfg(t, "1", 8*os.Getpagesize())
+	stateCfg.IsLazyMode = true
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+
+	for activation := 1; activation <= 2; activation++ {
+		state, vm := activateTestVM(t, manager, "1")
+
+		var wg sync.WaitGroup
+		for page := 0; page < 8; page++ {
+			wg.Add(1)
+			go func(page int) {
+				defer wg.Done()
+				vm.fault(t, testStartAddress+uint64(page*os.Getpagesize()))
+			}(page)
+		}
+		wg.Wait()
+		waitServedPages(t, state, 8)
+
+		require.NoError(t, manager.Deactivate("1"), "Failed to deactivate VM")
+
+		mu.Lock()
+		require.Equal(t, activation, len(calls), "Callback must be called once per activation")
+		require.Equal(t, "1", calls[activation-1], "Wrong VM ID")
+		mu.Unlock()
+	}
+}
+
+func TestOnWorkingSetComplete(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	var calls []string
+	manager := newTestManager(t, MemoryManagerCfg{
+		OnWorkingSetComplete: func(vmID string) { calls = append(calls, vmID) },
+	})
+
+	pageSize := uint64(os.Getpagesize())
+	stateCfg := prepareSnapshotStateCfg(t, "1", 8*os.Getpagesize())
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+
+	// the VM has no working set in its first activation, which records it
+	state := manager.instances["1"]
+	require.NoError(t, state.mapGuestMemory(context.Background()), "Failed to map guest memory")
+	state.setupStateOnActivate()
+	state.firstPageFaultOnce.Do(func() { state.startAddress = testStartAddress })
+	for _, page := range []uint64{0, 1, 2} {
+		require.NoError(t, state.servePageFault(-1, testStartAddress+page*pageSize), "Failed to serve page fault")
+	}
+	require.Empty(t, calls, "Callback must not be called without a working set")
+	require.NoError(t, state.unmapGuestMemory(), "Failed to unmap guest memory")
+
+	persistRecord(t, stateCfg, []uint64{0, pageSize, 2 * pageSize})
+	manager = newTestManager(t, MemoryManagerCfg{
+		OnWorkingSetComplete: func(vmID string) { calls = append(calls, vmID) },
+	})
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+
+	state = manager.instances[stateCfg.VMID]
+	require.NoError(t, state.mapGuestMemory(context.Background()), "Failed to map guest memory")
+	defer state.unmapGuestMemory()
+
+	for activation := 1; activation <= 2; activation++ {
+		_, err := manager.FetchState(stateCfg.VMID)
+		require.NoError(t, err, "Failed to fetch state")
+		state.setupStateOnActivate()
+
+		// the first page fault installs the working set, the later ones are served on demand
+		for _, page := range []uint64{1, 4, 5} {
+			require.NoError(t, state.servePageFault(-1, testStartAddress+page*pageSize), "Failed to serve page fault")
+		}
+		require.Equal(t, activation, len(calls), "Callback must be called once per activation")
+		require.Equal(t, "1", calls[activation-1], "Wrong VM ID")
+
+		state.resetStateOnDeactivate()
+	}
+}
+
+func TestServePageFaultReadAhead(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	pageSize := uint64(os.Getpagesize())
+
+	state := newTestSnapshotState(8, 1)
+	state.readAheadPages = 3
+
+	err := state.servePageFault(-1, testStartAddress)
+	require.NoError(t, err, "Failed to serve page fault")
+	require.Equal(t, []installCall{{dst: testStartAddress, len: 4 * pageSize}}, installs,
+		"Read-ahead pages must be installed along with the faulting page")
+
+	// pages 1-3 are served, so accessing them would not fault
+	require.Equal(t, 4, state.servedPages.Count(), "Read-ahead pages must be marked as served")
+
+	// the read-ahead stops at the already served page 7
+	state.servedPages.Set(7)
+	err = state.servePageFault(-1, testStartAddress+5*pageSize)
+	require.NoError(t, err, "Failed to serve page fault")
+	require.Equal(t, installCall{dst: testStartAddress + 5*pageSize, len: 2 * pageSize}, installs[1])
+	require.Equal(t, 7, state.servedPages.Count(), "Page 4 must not be read ahead")
+}
+
+func TestServePageFaultTraceLogging(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	defer log.SetLevel(log.GetLevel())
+
+	pageSize := uint64(os.Getpagesize())
+
+	state := newTestSnapshotState(8, 1)
+	state.readAheadPages = 1
+
+	log.SetLevel(log.DebugLevel)
+	err := state.servePageFault(-1, testStartAddress)
+	require.NoError(t, err, "Failed to serve page fault")
+	require.Empty(t, buf.String(), "Page faults must not be logged below the trace level")
+
+	log.SetLevel(log.TraceLevel)
+	err = state.servePageFault(-1, testStartAddress+2*pageSize)
+	require.NoError(t, err, "Failed to serve page fault")
+	for _, field := range []string{"address", "offset", "readAheadPages", "installUs"} {
+		require.Contains(t, buf.String(), field, "Page fault must be logged with the field")
+	}
+
+	buf.Reset()
+	installer, _ := stubInstaller()
+	installer.copy = func(fd int, src, dst, mode, len uint64) error {
+		return os.NewSyscallError("ioctl", syscall.EINVAL)
+	}
+	err = state.servePageFault(-1, testStartAddress+4*pageSize)
+	require.True(t, errors.Is(err, syscall.EINVAL), "Errno of the ioctl must be preserved")
+	require.Contains(t, buf.String(), "errno", "Failed install must be logged with the errno")
+}
+
+func TestServePageFaultRecordsFaultingPage(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	pageSize := uint64(os.Getpagesize())
+	state := newTestSnapshotState(8, 4)
+
+	require.NoError(t, state.servePageFault(-1, testStartAddress+2*pageSize), "Failed to serve page fault")
+	require.Equal(t, []installCall{{dst: testStartAddress, len: 4 * pageSize}}, installs, "The chunk must be installed at once")
+	require.Equal(t, []Record{{offset: 2 * pageSize}}, state.trace.trace, "Only the faulting page must be recorded")
+}
+
+func TestServePageFaultMissingFromWorkingSet(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	defer log.SetLevel(log.GetLevel())
+	log.SetLevel(log.DebugLevel)
+
+	// the pages of a replayed VM that are faulted on outside of its working set
+	state := newTestSnapshotState(8, 4)
+	state.isRecordReady = true
+
+	address := testStartAddress + 2*uint64(os.Getpagesize())
+	require.NoError(t, state.servePageFault(-1, address), "Failed to serve page fault")
+	require.Len(t, installs, 1)
+	require.EqualValues(t, 4*os.Getpagesize(), installs[0].len, "The run of pages must be installed at once")
+
+	require.Equal(t, 1, strings.Count(buf.String(), "missing from the working set"), "The fault must be logged once")
+	require.Contains(t, buf.String(), fmt.Sprintf("0x%x", address), "The fault must be logged with its address")
+}
+
+func TestServePageFaultAlreadyPresent(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	// the pages stay present once installed, as in the guest memory
+	present := make(map[uint64]bool)
+	installer, _ := stubInstaller()
+	installer.copy = func(fd int, src, dst, mode, len uint64) error {
+		if present[dst] {
+			return installErr(os.NewSyscallError("ioctl", syscall.EEXIST))
+		}
+		present[dst] = true
+		return nil
+	}
+	var wakes []uint64
+	installer.wake = func(fd int, dst uint64, len int) { wakes = append(wakes, dst) }
+
+	state := newTestSnapshotState(4, 1)
+
+	// e.g., the page is faulted on again before the first fault has been served
+	for i := 0; i < 2; i++ {
+		err := state.servePageFault(-1, testStartAddress)
+		require.NoError(t, err, "Installing a page that is present already must not fail")
+	}
+
+	require.EqualValues(t, 1, state.copyInstalls, "Page must be counted as installed once")
+	require.EqualValues(t, 1, state.alreadyPresent, "Second install must be counted as already present")
+	require.EqualValues(t, 2, state.faultsServed, "Both page faults must be served")
+	require.Equal(t, []uint64{testStartAddress}, wakes, "Faulting thread must be woken up")
+
+	err := installErr(os.NewSyscallError("ioctl", syscall.EINVAL))
+	require.False(t, errors.Is(err, errAlreadyPresent), "Only EEXIST means the page is present")
+}
+
+func TestInstallRegionShortCopy(t *testing.T) {
+	defer func() { uffdCopyFunc = uffdCopy }()
+
+	const (
+		src = uint64(0x20000000)
+		dst = uint64(testStartAddress)
+	)
+	pageSize := uint64(os.Getpagesize())
+
+	// the copies are interrupted after the first page of the region
+	var calls []installCall
+	uffdCopyFunc = func(fd int, s, d, mode, len uint64) (int64, error) {
+		require.Equal(t, s-src, d-dst, "Source and destination must advance together")
+		calls = append(calls, installCall{dst: d, len: len})
+		if len > pageSize {
+			return int64(pageSize), os.NewSyscallError("ioctl", syscall.EAGAIN)
+		}
+		return int64(len), nil
+	}
+
+	require.NoError(t, installRegion(-1, src, dst, 0, 3*pageSize), "Short copies must be retried")
+	require.Equal(t, []installCall{
+		{dst: dst, len: 3 * pageSize},
+		{dst: dst + pageSize, len: 2 * pageSize},
+		{dst: dst + 2*pageSize, len: pageSize},
+	}, calls, "Remainder of the region must be copied again")
+
+	// a failure without progress is not retried
+	uffdCopyFunc = func(fd int, s, d, mode, len uint64) (int64, error) {
+		return -int64(syscall.ENOMEM), os.NewSyscallError("ioctl", syscall.ENOMEM)
+	}
+	err := installRegion(-1, src, dst, 0, 3*pageSize)
+	require.True(t, errors.Is(err, syscall.ENOMEM), "Failed copy must be reported")
+
+	// the page after the copied one is present already
+	uffdCopyFunc = func(fd int, s, d, mode, len uint64) (int64, error) {
+		if d == dst {
+			return int64(pageSize), os.NewSyscallError("ioctl", syscall.EAGAIN)
+		}
+		return -int64(syscall.EEXIST), os.NewSyscallError("ioctl", syscall.EEXIST)
+	}
+	err = installRegion(-1, src, dst, 0, 2*pageSize)
+	require.True(t, errors.Is(err, errAlreadyPresent), "Present page must be reported after a short copy")
+}
+
+func TestServePageFaultHugePages(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	const hugePageSize = 2 << 20
+
+	state := NewSnapshotState(SnapshotStateCfg{
+		VMID:         "test",
+		GuestMemSize: 4 * hugePageSize,
+		PageSize:     hugePageSize,
+	})
+	state.guestMem = make([]byte, state.GuestMemSize)
+	for i := range state.guestMem {
+		state.guestMem[i] = byte(1 + i/hugePageSize)
+	}
+	state.setupStateOnActivate()
+	state.firstPageFaultOnce.Do(func() { state.startAddress = testStartAddress })
+
+	// the fault address in the middle of the second huge page is masked to its start
+	err := state.servePageFault(-1, testStartAddress+hugePageSize+12345)
+	require.NoError(t, err, "Failed to serve page fault")
+	require.Equal(t, []installCall{{dst: testStartAddress + hugePageSize, len: hugePageSize}}, installs,
+		"Whole huge page must be installed")
+	require.True(t, state.servedPages.Test(1), "Huge page must be marked as served")
+	require.Equal(t, []Record{{offset: hugePageSize}}, state.trace.trace, "Wrong offset recorded")
+
+	manager := newTestManager(t, MemoryManagerCfg{})
+	err = manager.RegisterVM(SnapshotStateCfg{VMID: "1", GuestMemSize: 3 * os.Getpagesize(), PageSize: hugePageSize})
+	require.Error(t, err, "Guest memory size that is not a multiple of the page size must be rejected")
+	err = manager.RegisterVM(SnapshotStateCfg{VMID: "1", GuestMemSize: 3 * hugePageSize, PageSize: 3 * os.Getpagesize()})
+	require.Error(t, err, "Page size that is not a power of two must be rejected")
+}
+
+func TestRegisterVMSystemPageSize(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	// e.g., arm64 kernels with 16KB pages
+	const sysPageSize = 16 << 10
+
+	manager := newTestManager(t, MemoryManagerCfg{})
+	manager.sysPageSize = sysPageSize
+
+	stateCfg := prepareSnapshotStateCfg(t, "1", 4*sysPageSize)
+	stateCfg.IsLazyMode = true
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+
+	state := manager.instances["1"]
+	require.Equal(t, sysPageSize, state.PageSize, "Page size must default to the system page size")
+	require.Equal(t, !manager.capabilities.ZeroPage, state.noZeroPage, "Zero pages must be installed with the system page size")
+
+	state.guestMem = make([]byte, state.GuestMemSize)
+	for i := range state.guestMem {
+		state.guestMem[i] = byte(1 + i/sysPageSize)
+	}
+	state.setupStateOnActivate()
+	state.firstPageFaultOnce.Do(func() { state.startAddress = testStartAddress })
+
+	// the fault address within the third page is masked to the start of the 16KB page
+	err := state.servePageFault(-1, testStartAddress+2*sysPageSize+3*4096+123)
+	require.NoError(t, err, "Failed to serve page fault")
+	require.Equal(t, []installCall{{dst: testStartAddress + 2*sysPageSize, len: sysPageSize}}, installs,
+		"Whole 16KB page must be installed")
+	require.True(t, state.servedPages.Test(2), "Wrong page marked as served")
+
+	stateCfg = prepareSnapshotStateCfg(t, "2", 4*sysPageSize)
+	stateCfg.PageSize = 4096
+	err = manager.RegisterVM(stateCfg)
+	require.True(t, errors.Is(err, ErrInvalidConfig), "Page size below the system page size must be rejected")
+}
+
+func TestHandleEventsSkipsUnknownFd(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	state := newTestSnapshotState(4, 1)
+	uffd, fakeVM := newFakeUFFD(t, state)
+
+	fakeVM.fault(t, testStartAddress+uint64(os.Getpagesize()))
+
+	events := []syscall.EpollEvent{
+		{Events: syscall.EPOLLIN, Fd: int32(uffd + 1000)}, // bogus fd
+		{Events: syscall.EPOLLIN, Fd: int32(uffd)},
+	}
+
+	err := state.handleEvents(events)
+	require.NoError(t, err, "Events from unknown fds must not stop the polling loop")
+	require.Len(t, installs, 1, "The page fault after the bogus event must be served")
+}
+
+func TestHandleEventsServesOnlyReturnedEvents(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	state := newTestSnapshotState(4, 1)
+	uffd, fakeVM := newFakeUFFD(t, state)
+
+	for page := uint64(0); page < 4; page++ {
+		fakeVM.fault(t, testStartAddress+page*uint64(os.Getpagesize()))
+	}
+
+	// the tail of the buffer is left populated as if by a previous epoll_wait
+	var events [4]syscall.EpollEvent
+	for i := range events {
+		events[i] = syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(uffd)}
+	}
+	nevents := 2
+
+	err := state.handleEvents(events[:nevents])
+	require.NoError(t, err, "Failed to handle events")
+	require.Len(t, installs, nevents, "Stale events must not be served")
+}
+
+func TestPollingLoopDrainsQueuedFaults(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	const numFaults = 16
+
+	manager := newTestManager(t, MemoryManagerCfg{})
+	stateCfg := prepareSnapshotStateCfg(t, "1", numFaults*os.Getpagesize())
+	stateCfg.IsLazyMode = true
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+
+	// the page faults are queued before the polling loop starts, as by activateTestVM
+	state := manager.instances[stateCfg.VMID]
+	require.NoError(t, state.mapGuestMemory(context.Background()), "Failed to map guest memory")
+	state.setupStateOnActivate()
+	state.firstPageFaultOnce.Do(func() { state.startAddress = testStartAddress })
+	_, vm := newFakeUFFD(t, state)
+	for page := 0; page < numFaults; page++ {
+		vm.fault(t, testStartAddress+uint64(page*os.Getpagesize()))
+	}
+
+	readyCh := make(chan error)
+	go state.pollUserPageFaults(readyCh)
+	require.NoError(t, <-readyCh, "Failed to register the epoller")
+
+	// every wakeup returns a single event and reads a single page fault
+	waitServedPages(t, state, numFaults)
+	require.Len(t, installs, numFaults, "All the queued page faults must be served")
+
+	require.NoError(t, manager.Deactivate(stateCfg.VMID), "Failed to deactivate VM")
+}
+
+func TestHandleEventsRemovedPages(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	pageSize := uint64(os.Getpagesize())
+
+	state := newTestSnapshotState(4, 1)
+	uffd, fakeVM := newFakeUFFD(t, state)
+	events := []syscall.EpollEvent{{Events: syscall.EPOLLIN, Fd: int32(uffd)}}
+
+	for page := uint64(0); page < 4; page++ {
+		err := state.servePageFault(-1, testStartAddress+page*pageSize)
+		require.NoError(t, err, "Failed to serve page fault")
+	}
+
+	// the guest drops pages 1 and 2
+	fakeVM.remove(t, uffdRemove(), testStartAddress+pageSize, testStartAddress+3*pageSize)
+	err := state.handleEvents(events)
+	require.NoError(t, err, "Remove event must not stop the polling loop")
+	require.Len(t, installs, 4, "Remove event must not be served as a page fault")
+	require.False(t, state.servedPages.Test(1), "Removed page must not be marked as served")
+	require.False(t, state.servedPages.Test(2), "Removed page must not be marked as served")
+	require.Equal(t, 2, state.servedPages.Count(), "Only the removed pages must be unmarked")
+
+	// the removed page is served again upon the next access
+	fakeVM.fault(t, testStartAddress+pageSize)
+	err = state.handleEvents(events)
+	require.NoError(t, err, "Failed to handle events")
+	require.Equal(t, installCall{dst: testStartAddress + pageSize, len: pageSize}, installs[4])
+
+	// the unmapped range is clamped at the end of the guest memory
+	fakeVM.remove(t, uffdUnmap(), testStartAddress+3*pageSize, testStartAddress+16*pageSize)
+	err = state.handleEvents(events)
+	require.NoError(t, err, "Unmap event must not stop the polling loop")
+	require.False(t, state.servedPages.Test(3), "Unmapped page must not be marked as served")
+	require.Equal(t, 2, state.servedPages.Count(), "Only the unmapped pages must be unmarked")
+}
+
+func TestServePageFaultZeroPages(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	pageSize := os.Getpagesize()
+
+	state := newTestSnapshotState(4, 1)
+	copy(state.guestMem[pageSize:2*pageSize], zeroPage)
+
+	for page := 0; page < 2; page++ {
+		err := state.servePageFault(-1, testStartAddress+uint64(page*pageSize))
+		require.NoError(t, err, "Failed to serve page fault")
+	}
+
+	require.False(t, installs[0].zero, "Page with data must be copied")
+	require.True(t, installs[1].zero, "Zero-filled page must be installed with UFFDIO_ZEROPAGE")
+	require.EqualValues(t, 1, state.zeroInstalls, "Wrong number of zero page installs")
+	require.EqualValues(t, 1, state.copyInstalls, "Wrong number of copy installs")
+	require.True(t, state.zeroCheckedPages.Test(1), "Zero check must be cached")
+}
+
+func TestDeactivatePersistsWorkingSet(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	manager := newTestManager(t, MemoryManagerCfg{})
+
+	pageSize := uint64(os.Getpagesize())
+	stateCfg := prepareSnapshotStateCfg(t, "1", 8*os.Getpagesize())
+
+	err := manager.RegisterVM(stateCfg)
+	require.NoError(t, err, "Failed to register VM")
+
+	state, _ := activateTestVM(t, manager, stateCfg.VMID)
+	for _, page := range []uint64{5, 1, 6, 3} {
+		err := state.servePageFault(-1, testStartAddress+page*pageSize)
+		require.NoError(t, err, "Failed to serve page fault")
+	}
+
+	err = manager.Deactivate(stateCfg.VMID)
+	require.NoError(t, err, "Failed to deactivate VM")
+
+	buf, err := ioutil.ReadFile(filepath.Join(stateCfg.BaseDir, "trace"))
+	require.NoError(t, err, "Failed to read the trace file")
+	require.Len(t, buf, 4*traceRecordSize, "Wrong size of the trace file")
+
+	offsets := make([]uint64, 0)
+	for i := 0; i < len(buf); i += traceRecordSize {
+		offsets = append(offsets, binary.LittleEndian.Uint64(buf[i:]))
+	}
+	require.Equal(t, []uint64{1 * pageSize, 3 * pageSize, 5 * pageSize, 6 * pageSize}, offsets,
+		"Trace file must contain the faulted offsets in the ascending order")
+
+	// the persisted record must be loadable upon the next restore
+	pages, err := manager.FetchState(stateCfg.VMID)
+	require.NoError(t, err, "Failed to fetch state")
+	require.Equal(t, 4, pages, "Wrong number of prefetched pages")
+}
+
+func TestReplayCoverage(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	manager := newTestManager(t, MemoryManagerCfg{})
+
+	pageSize := uint64(os.Getpagesize())
+	stateCfg := prepareSnapshotStateCfg(t, "1", 8*os.Getpagesize())
+	persistRecord(t, stateCfg, []uint64{0, pageSize, 2 * pageSize})
+
+	err := manager.RegisterVM(stateCfg)
+	require.NoError(t, err, "Failed to register VM")
+
+	_, err = manager.ReplayCoverage(stateCfg.VMID)
+	require.True(t, errors.Is(err, ErrNotReplayed), "Coverage of a VM that has not been replayed must be reported")
+
+	pages, err := manager.FetchState(stateCfg.VMID)
+	require.NoError(t, err, "Failed to fetch state")
+	require.Equal(t, 3, pages, "Wrong number of prefetched pages")
+
+	state := manager.instances[stateCfg.VMID]
+	require.NoError(t, state.mapGuestMemory(context.Background()), "Failed to map guest memory")
+	defer state.unmapGuestMemory()
+	state.setupStateOnActivate()
+
+	// the first page fault installs the working set, the pages 4-6 are missing from it
+	for _, page := range []uint64{0, 4, 5, 6} {
+		err := state.servePageFault(-1, testStartAddress+page*pageSize)
+		require.NoError(t, err, "Failed to serve page fault")
+	}
+
+	coverage, err := manager.ReplayCoverage(stateCfg.VMID)
+	require.NoError(t, err, "Failed to get the replay coverage")
+	require.Equal(t, 0.5, coverage, "Half of the installed pages must be prefetched")
+}
+
+func TestReplayInstallErrors(t *testing.T) {
+	installer, restore := stubInstaller()
+	defer restore()
+
+	pageSize := uint64(os.Getpagesize())
+
+	for _, tc := range []struct {
+		name    string
+		copyErr error
+	}{
+		{"present pages", errAlreadyPresent},
+		{"failed ioctl", syscall.EIO},
+	} {
+		var woken []uint64
+		installer.copy = func(fd int, src, dst, mode, len uint64) error {
+			if dst == testStartAddress {
+				return tc.copyErr
+			}
+			return nil
+		}
+		installer.wake = func(fd int, dst uint64, len int) { woken = append(woken, dst) }
+
+		manager := newTestManager(t, MemoryManagerCfg{})
+		stateCfg := prepareSnapshotStateCfg(t, "1", 8*os.Getpagesize())
+		persistRecord(t, stateCfg, []uint64{0, 2 * pageSize, 3 * pageSize})
+		require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+
+		_, err := manager.FetchState(stateCfg.VMID)
+		require.NoError(t, err, "Failed to fetch state")
+
+		state := manager.instances[stateCfg.VMID]
+		require.NoError(t, state.mapGuestMemory(context.Background()), "Failed to map guest memory")
+		state.setupStateOnActivate()
+
+		// the first page fault installs the working set
+		err = state.servePageFault(-1, testStartAddress)
+		if tc.copyErr == errAlreadyPresent {
+			require.NoError(t, err, "Working set pages that are present already must be skipped")
+			require.EqualValues(t, 3, state.servedPagesNum, "All the working set pages must be served")
+			require.EqualValues(t, 1, state.alreadyPresent, "Wrong number of the present pages")
+			require.Equal(t, []uint64{testStartAddress}, woken, "Faulting thread must be woken up")
+		} else {
+			require.True(t, errors.Is(err, syscall.EIO), "Failure to install the working set must be returned")
+			require.Empty(t, woken, "Faulting thread must not be woken up")
+		}
+
+		require.NoError(t, state.unmapGuestMemory(), "Failed to unmap guest memory")
+	}
+}
+
+// BenchmarkRecordReplay Compares restoring a synthetic snapshot on demand, in lazy mode, with
+// replaying its recorded working set. Every operation touches the working set pages in a random
+// order, faulting only on the pages that are not installed yet, so ns/op is the wall-clock time
+// until the working set is served. The pages are installed by the fake installer.
+func BenchmarkRecordReplay(b *testing.B) {
+	const (
+		pages           = 1024
+		workingSetPages = 256
+	)
+
+	_, restore := stubInstaller()
+	defer restore()
+
+	pageSize := os.Getpagesize()
+	workingSet := make([]uint64, workingSetPages)
+	for i := range workingSet {
+		workingSet[i] = uint64(i * pages / workingSetPages * pageSize)
+	}
+	accesses := rand.New(rand.NewSource(1)).Perm(workingSetPages)
+
+	for name, lazy := range map[string]bool{"Cold": true, "Replay": false} {
+		lazy := lazy
+		b.Run(name, func(b *testing.B) {
+			stateCfg := prepareSnapshotStateCfg(b, "1", pages*pageSize)
+			stateCfg.IsLazyMode = lazy
+			persistRecord(b, stateCfg, workingSet)
+
+			var faults, prefetched, served int64
+			for n := 0; n < b.N; n++ {
+				b.StopTimer()
+				manager := newTestManager(b, MemoryManagerCfg{})
+				require.NoError(b, manager.RegisterVM(stateCfg), "Failed to register VM")
+				_, err := manager.FetchState("1")
+				require.NoError(b, err, "Failed to fetch state")
+
+				state := manager.instances["1"]
+				require.NoError(b, state.mapGuestMemory(context.Background()), "Failed to map guest memory")
+				state.setupStateOnActivate()
+				b.StartTimer()
+
+				for _, i := range accesses {
+					page := int(workingSet[i]) / pageSize
+					if state.servedPages.Test(page) {
+						continue
+					}
+					_ = state.servePageFault(-1, testStartAddress+workingSet[i])
+				}
+
+				b.StopTimer()
+				faults += state.faultsServed
+				prefetched += state.prefetchedPages
+				served += state.servedPagesNum
+				require.NoError(b, state.unmapGuestMemory(), "Failed to unmap guest memory")
+				b.StartTimer()
+			}
+
+			b.ReportMetric(float64(faults)/float64(b.N), "faults/op")
+			b.ReportMetric(float64(prefetched)/float64(served), "prefetch-coverage")
+		})
+	}
+}
+
+// blockingInstaller Stubs the installation of the pages, which blocks until released
+type blockingInstaller struct {
+	started, completed int64
+	release            chan struct{}
+}
+
+func stubBlockingInstallRegion() (*blockingInstaller, func()) {
+	b := &blockingInstaller{release: make(chan struct{})}
+
+	installer, restore := stubInstaller()
+	installer.copy = func(fd int, src, dst, mode, len uint64) error {
+		atomic.AddInt64(&b.started, 1)
+		<-b.release
+		atomic.AddInt64(&b.completed, 1)
+		return nil
+	}
+
+	return b, restore
+}
+
+// activateTestVMs Registers and activates the VMs, and faults all their pages
+func activateTestVMs(t *testing.T, manager *MemoryManager, vmIDs []string, pages int) {
+	for _, vmID := range vmIDs {
+		stateCfg := prepareSnapshotStateCfg(t, vmID, pages*os.Getpagesize())
+		stateCfg.IsLazyMode = true
+
+		err := manager.RegisterVM(stateCfg)
+		require.NoError(t, err, "Failed to register VM")
+
+		_, vm := activateTestVM(t, manager, vmID)
+		for page := 0; page < pages; page++ {
+			vm.fault(t, testStartAddress+uint64(page*os.Getpagesize()))
+		}
+	}
+}
+
+// waitStarted Waits until the number of started installations reaches n
+func (b *blockingInstaller) waitStarted(t *testing.T, n int64) {
+	for i := 0; atomic.LoadInt64(&b.started) < n; i++ {
+		require.Less(t, i, 1000, "Page faults are not served")
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestShutdownDrainsInflightFaults(t *testing.T) {
+	installer, restore := stubBlockingInstallRegion()
+	defer restore()
+
+	manager := newTestManager(t, MemoryManagerCfg{WorkerPoolSize: 2})
+	vmIDs := []string{"1", "2", "3"}
+	activateTestVMs(t, manager, vmIDs, 4)
+
+	// both workers are busy serving page faults
+	installer.waitStarted(t, 2)
+
+	shutdownDone := make(chan error)
+	go func() { shutdownDone <- manager.Shutdown(context.Background()) }()
+
+	select {
+	case <-shutdownDone:
+		t.Fatal("Shutdown must wait for the in-flight page faults")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(installer.release)
+	require.NoError(t, <-shutdownDone, "Failed to shut down")
+	require.Equal(t, atomic.LoadInt64(&installer.started), atomic.LoadInt64(&installer.completed),
+		"All started installations must be complete upon shutdown")
+
+	for _, vmID := range vmIDs {
+		require.False(t, manager.instances[vmID].isActive, "VM must be deactivated upon shutdown")
+	}
+
+	err := manager.RegisterVM(SnapshotStateCfg{VMID: "4"})
+	require.Error(t, err, "Memory manager must not accept VMs after the shutdown")
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	installer, restore := stubBlockingInstallRegion()
+	defer restore()
+
+	manager := newTestManager(t, MemoryManagerCfg{WorkerPoolSize: 1})
+	activateTestVMs(t, manager, []string{"1"}, 4)
+
+	installer.waitStarted(t, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := manager.Shutdown(ctx)
+	require.True(t, errors.Is(err, context.DeadlineExceeded), "Shutdown must stop waiting at the deadline")
+
+	// let the worker finish before the stub is restored
+	close(installer.release)
+	err = manager.instances["1"].waitInflightFaults(context.Background())
+	require.NoError(t, err, "Failed to wait for the in-flight page faults")
+}
+
+func TestActivateDeactivateRoundTrip(t *testing.T) {
+	installer, restore := stubBlockingInstallRegion()
+	defer restore()
+	close(installer.release)
+
+	manager := newTestManager(t, MemoryManagerCfg{})
+
+	stateCfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+	stateCfg.IsLazyMode = true
+	vms := serveFakeUFFDs(t, &stateCfg)
+
+	err := manager.RegisterVM(stateCfg)
+	require.NoError(t, err, "Failed to register VM")
+
+	for round := int64(1); round <= 2; round++ {
+		err := manager.Activate(stateCfg.VMID)
+		require.NoError(t, err, "Failed to activate VM")
+
+		vm := <-vms
+		vm.fault(t, testStartAddress)
+		vm.fault(t, testStartAddress+uint64(os.Getpagesize()))
+		installer.waitStarted(t, 2*round)
+
+		err = manager.Deactivate(stateCfg.VMID)
+		require.NoError(t, err, "Failed to deactivate VM")
+		require.Equal(t, 2*round, atomic.LoadInt64(&installer.completed), "Page faults must be served in every activation")
+	}
+}
+
+func TestDeactivateOneOfSeveralVMs(t *testing.T) {
+	installer, restore := stubBlockingInstallRegion()
+	defer restore()
+	close(installer.release)
+
+	manager := newTestManager(t, MemoryManagerCfg{})
+
+	vms := make(map[string]*fakeVM)
+	for _, vmID := range []string{"1", "2", "3"} {
+		stateCfg := prepareSnapshotStateCfg(t, vmID, 4*os.Getpagesize())
+		stateCfg.IsLazyMode = true
+		vmCh := serveFakeUFFDs(t, &stateCfg)
+
+		err := manager.RegisterVM(stateCfg)
+		require.NoError(t, err, "Failed to register VM")
+		err = manager.Activate(vmID)
+		require.NoError(t, err, "Failed to activate VM")
+
+		vms[vmID] = <-vmCh
+		vms[vmID].fault(t, testStartAddress)
+	}
+	installer.waitStarted(t, 3)
+
+	err := manager.Deactivate("2")
+	require.NoError(t, err, "Failed to deactivate VM")
+
+	state := manager.instances["2"]
+	require.False(t, state.isActive, "VM must be deactivated")
+	require.Zero(t, state.startAddress, "Start address must be reset upon deactivation")
+	require.Zero(t, state.servedPages.Count(), "Served pages must be reset upon deactivation")
+
+	for _, vmID := range []string{"1", "3"} {
+		require.True(t, manager.instances[vmID].isActive, "Other VMs must remain active")
+		vms[vmID].fault(t, testStartAddress+uint64(os.Getpagesize()))
+	}
+	installer.waitStarted(t, 5)
+
+	err = manager.Shutdown(context.Background())
+	require.NoError(t, err, "Failed to shut down")
+}
+
+// BenchmarkConcurrentVMFaults Measures the aggregate page fault throughput of VMs faulting
+// concurrently, each VM is polled by its own epoll instance in its own goroutine
+func BenchmarkConcurrentVMFaults(b *testing.B) {
+	const pages = 64
+
+	var served int64
+	installer, restore := stubInstaller()
+	defer restore()
+	installer.copy = func(fd int, src, dst, mode, len uint64) error {
+		atomic.AddInt64(&served, 1)
+		return nil
+	}
+
+	for _, numVMs := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("VMs%d", numVMs), func(b *testing.B) {
+			manager := newTestManager(b, MemoryManagerCfg{})
+
+			vms := make([]*fakeVM, numVMs)
+			for i := range vms {
+				vmID := strconv.Itoa(i)
+				stateCfg := prepareSnapshotStateCfg(b, vmID, pages*os.Getpagesize())
+				stateCfg.IsLazyMode = true
+				require.NoError(b, manager.RegisterVM(stateCfg), "Failed to register VM")
+
+				_, vms[i] = activateTestVM(b, manager, vmID)
+			}
+
+			msgs := make([][]byte, pages)
+			for page := range msgs {
+				msgs[page] = make([]byte, sizeOfUFFDMsg())
+				msgs[page][0] = uffdPageFault()
+				binary.LittleEndian.PutUint64(msgs[page][16:], testStartAddress+uint64(page*os.Getpagesize()))
+			}
+
+			atomic.StoreInt64(&served, 0)
+			b.ResetTimer()
+
+			var wg sync.WaitGroup
+			for i, vm := range vms {
+				faults := b.N / numVMs
+				if i == 0 {
+					faults += b.N % numVMs
+				}
+
+				wg.Add(1)
+				go func(vm *fakeVM, faults int) {
+					defer wg.Done()
+					for n := 0; n < faults; n++ {
+						_, _ = vm.w.Write(msgs[n%pages])
+					}
+				}(vm, faults)
+			}
+			wg.Wait()
+
+			for atomic.LoadInt64(&served) < int64(b.N) {
+				time.Sleep(10 * time.Microsecond)
+			}
+			b.StopTimer()
+
+			require.NoError(b, manager.Shutdown(context.Background()), "Failed to shut down")
+		})
+	}
+}
+
+func TestWorkingSetSize(t *testing.T) {
+	installer, restore := stubBlockingInstallRegion()
+	defer restore()
+	close(installer.release)
+
+	manager := newTestManager(t, MemoryManagerCfg{})
+
+	_, _, err := manager.WorkingSetSize("1")
+	require.Error(t, err, "Unknown VM must be reported")
+
+	stateCfg := prepareSnapshotStateCfg(t, "1", 8*os.Getpagesize())
+	vms := serveFakeUFFDs(t, &stateCfg)
+
+	err = manager.RegisterVM(stateCfg)
+	require.NoError(t, err, "Failed to register VM")
+	err = manager.Activate(stateCfg.VMID)
+	require.NoError(t, err, "Failed to activate VM")
+
+	vm := <-vms
+	for _, page := range []int{0, 2, 5} {
+		vm.fault(t, testStartAddress+uint64(page*os.Getpagesize()))
+	}
+
+	// the live count of the served pages
+	for i := 0; ; i++ {
+		pages, _, err := manager.WorkingSetSize(stateCfg.VMID)
+		require.NoError(t, err, "Failed to get the working set size")
+		if pages == 3 {
+			break
+		}
+		require.Less(t, i, 1000, "Page faults are not served")
+		time.Sleep(time.Millisecond)
+	}
+
+	err = manager.Deactivate(stateCfg.VMID)
+	require.NoError(t, err, "Failed to deactivate VM")
+
+	// the recorded working set
+	pages, bytes, err := manager.WorkingSetSize(stateCfg.VMID)
+	require.NoError(t, err, "Failed to get the working set size")
+	require.Equal(t, 3, pages, "Wrong number of recorded pages")
+	require.Equal(t, 3*os.Getpagesize(), bytes, "Wrong size of the recorded working set")
+
+	// the working set persisted by another memory manager
+	manager = newTestManager(t, MemoryManagerCfg{})
+	err = manager.RegisterVM(stateCfg)
+	require.NoError(t, err, "Failed to register VM")
+
+	pages, _, err = manager.WorkingSetSize(stateCfg.VMID)
+	require.NoError(t, err, "Failed to get the working set size")
+	require.Equal(t, 3, pages, "Wrong number of persisted pages")
+}
+
+func TestActivateWithContextTimeout(t *testing.T) {
+	manager := newTestManager(t, MemoryManagerCfg{})
+
+	stateCfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+	stateCfg.IsLazyMode = true
+	stateCfg.InstanceSockAddr = filepath.Join(stateCfg.BaseDir, "sock")
+
+	// the VM accepts the connection but never sends the uffd
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: stateCfg.InstanceSockAddr, Net: "unix"})
+	require.NoError(t, err, "Failed to listen on the VM socket")
+	defer l.Close()
+
+	err = manager.RegisterVM(stateCfg)
+	require.NoError(t, err, "Failed to register VM")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err = manager.ActivateWithContext(ctx, stateCfg.VMID)
+	require.True(t, errors.Is(err, context.DeadlineExceeded), "Activation must be aborted at the deadline")
+
+	state := manager.instances[stateCfg.VMID]
+	require.False(t, state.isActive, "VM must not be left active")
+	require.Nil(t, state.guestMem, "Guest memory must be unmapped")
+
+	err = manager.RegisterVMWithContext(ctx, SnapshotStateCfg{VMID: "2"})
+	require.Error(t, err, "Registration with a done context must fail")
+	require.NotContains(t, manager.instances, "2", "VM must not be registered")
+}
+
+func TestActivateIdempotent(t *testing.T) {
+	manager := newTestManager(t, MemoryManagerCfg{})
+
+	stateCfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+	stateCfg.IsLazyMode = true
+	vms := serveFakeUFFDs(t, &stateCfg)
+
+	err := manager.RegisterVM(stateCfg)
+	require.NoError(t, err, "Failed to register VM")
+
+	err = manager.ActivateIdempotent(context.Background(), stateCfg.VMID)
+	require.NoError(t, err, "Failed to activate VM")
+	vm := <-vms
+
+	// the retried activation keeps the uffd of the first one
+	err = manager.ActivateIdempotent(context.Background(), stateCfg.VMID)
+	require.NoError(t, err, "Repeated activation of a serving VM must succeed")
+	select {
+	case <-vms:
+		t.Fatal("Repeated activation must not receive another uffd")
+	default:
+	}
+	require.True(t, errors.Is(manager.Activate(stateCfg.VMID), ErrVMAlreadyActive),
+		"Non-idempotent activation must still be rejected")
+
+	// the uffd fails, so the page faults of the VM are not served anymore
+	vm.w.Close()
+	require.Error(t, <-manager.Errors(), "Failure of the uffd must be reported")
+
+	err = manager.ActivateIdempotent(context.Background(), stateCfg.VMID)
+	require.True(t, errors.Is(err, ErrVMAlreadyActive), "Activation of a failed VM must be rejected")
+
+	err = manager.Deactivate(stateCfg.VMID)
+	require.NoError(t, err, "Failed to deactivate VM")
+
+	err = manager.ActivateIdempotent(context.Background(), stateCfg.VMID)
+	require.NoError(t, err, "Failed to activate VM again")
+	<-vms
+
+	require.NoError(t, manager.Shutdown(context.Background()), "Failed to shut down")
+}
+
+func TestRegisterVMsConcurrently(t *testing.T) {
+	const numVMs = 100
+
+	manager := newTestManager(t, MemoryManagerCfg{SharePages: true})
+
+	cfgs := make([]SnapshotStateCfg, numVMs)
+	for i := range cfgs {
+		cfgs[i] = prepareSnapshotStateCfg(t, strconv.Itoa(i), 4*os.Getpagesize())
+		cfgs[i].IsLazyMode = true
+		cfgs[i].BaseSnapshotID = strconv.Itoa(i % 10)
+	}
+
+	// every VM is registered twice at the same time
+	var (
+		wg                   sync.WaitGroup
+		registered, rejected int64
+	)
+	for _, cfg := range append(cfgs, cfgs...) {
+		wg.Add(1)
+		go func(cfg SnapshotStateCfg) {
+			defer wg.Done()
+
+			err := manager.RegisterVM(cfg)
+			switch {
+			case err == nil:
+				atomic.AddInt64(&registered, 1)
+			case errors.Is(err, ErrVMAlreadyRegistered):
+				atomic.AddInt64(&rejected, 1)
+			}
+		}(cfg)
+	}
+	wg.Wait()
+
+	require.EqualValues(t, numVMs, registered, "Every VM must be registered once")
+	require.EqualValues(t, numVMs, rejected, "Duplicate registrations must be rejected")
+	require.Len(t, manager.instances, numVMs, "Wrong number of registered VMs")
+	require.Empty(t, manager.registering, "No VM must be left reserved")
+	require.Len(t, manager.sharedMems, 10, "VMs of the same snapshot must share the guest memory")
+	for _, shared := range manager.sharedMems {
+		require.Equal(t, numVMs/10, shared.refs, "Every VM must hold a reference to the shared guest memory")
+	}
+
+	for _, cfg := range cfgs {
+		wg.Add(1)
+		go func(vmID string) {
+			defer wg.Done()
+			_ = manager.DeregisterVM(vmID)
+		}(cfg.VMID)
+	}
+	wg.Wait()
+
+	require.Empty(t, manager.instances, "All VMs must be deregistered")
+	require.Empty(t, manager.sharedMems, "Shared guest memory must be released")
+}
+
+func TestActivateConcurrently(t *testing.T) {
+	manager := newTestManager(t, MemoryManagerCfg{})
+
+	stateCfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+	stateCfg.IsLazyMode = true
+	vms := serveFakeUFFDs(t, &stateCfg)
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- manager.Activate("1") }()
+	}
+	<-vms
+
+	var activated, rejected int
+	for i := 0; i < 2; i++ {
+		err := <-errs
+		switch {
+		case err == nil:
+			activated++
+		case errors.Is(err, ErrVMAlreadyActive):
+			rejected++
+		default:
+			require.NoError(t, err, "Unexpected activation error")
+		}
+	}
+	require.Equal(t, 1, activated, "VM must be activated once")
+	require.Equal(t, 1, rejected, "Concurrent activation must be rejected")
+
+	require.NoError(t, manager.Deactivate("1"), "Failed to deactivate VM")
+}
+
+func TestListVMs(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	manager := newTestManager(t, MemoryManagerCfg{})
+	require.Empty(t, manager.ActiveVMs(), "No VM is registered")
+	require.Empty(t, manager.InactiveVMs(), "No VM is registered")
+
+	for _, vmID := range []string{"3", "1", "2"} {
+		stateCfg := prepareSnapshotStateCfg(t, vmID, 4*os.Getpagesize())
+		stateCfg.IsLazyMode = true
+		require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+	}
+
+	activateTestVM(t, manager, "2")
+	activateTestVM(t, manager, "3")
+	require.NoError(t, manager.Deactivate("3"), "Failed to deactivate VM")
+
+	require.Equal(t, []string{"2"}, manager.ActiveVMs(), "Wrong active VMs")
+	inactive := manager.InactiveVMs()
+	require.Equal(t, []string{"1", "3"}, inactive, "Wrong inactive VMs, including the never activated ones")
+
+	inactive[0] = "4"
+	require.Equal(t, []string{"1", "3"}, manager.InactiveVMs(), "Returned VMs must be a copy")
+
+	require.NoError(t, manager.Deactivate("2"), "Failed to deactivate VM")
+	require.Empty(t, manager.ActiveVMs(), "No VM is active")
+	require.Equal(t, []string{"1", "2", "3"}, manager.InactiveVMs(), "Wrong inactive VMs")
+}
+
+func TestLoadRecordCorruptTrace(t *testing.T) {
+	pageSize := uint64(os.Getpagesize())
+
+	for name, offsets := range map[string][]uint64{
+		"unaligned":    {pageSize + 1},
+		"out of order": {2 * pageSize, pageSize},
+	} {
+		offsets := offsets
+		t.Run(name, func(t *testing.T) {
+			stateCfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+
+			buf := make([]byte, traceRecordSize*len(offsets))
+			for i, offset := range offsets {
+				binary.LittleEndian.PutUint64(buf[i*traceRecordSize:], offset)
+			}
+			err := ioutil.WriteFile(filepath.Join(stateCfg.BaseDir, "trace"), buf, 0644)
+			require.NoError(t, err, "Failed to write the trace file")
+
+			state := NewSnapshotState(stateCfg)
+			require.Error(t, state.loadRecord(), "Corrupt trace must be reported")
+		})
+	}
+
+	stateCfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+	err := ioutil.WriteFile(filepath.Join(stateCfg.BaseDir, "trace"), []byte{1, 2, 3}, 0644)
+	require.NoError(t, err, "Failed to write the trace file")
+
+	state := NewSnapshotState(stateCfg)
+	require.Error(t, state.loadRecord(), "Truncated trace must be reported")
+}
+
+const testStartAddress = uint64(0x10000000)
+
+type installCall struct {
+	dst, len uint64
+	zero     bool
+}
+
+// stubInstallRegion Records the installed regions instead of issuing UFFDIO_COPY or UFFDIO_ZEROPAGE,
+// returns the function that restores the real implementation
+func stubInstallRegion(installs *[]installCall) func() {
+	installer, restore := stubInstaller()
+	installer.copy = func(fd int, src, dst, mode, len uint64) error {
+		*installs = append(*installs, installCall{dst: dst, len: len})
+		return nil
+	}
+	installer.zeroPage = func(fd int, dst, mode, len uint64) error {
+		*installs = append(*installs, installCall{dst: dst, len: len, zero: true})
+		return nil
+	}
+
+	return restore
+}
+
+// fakeVM Writes uffd messages to the pipe that stands in for a uffd
+type fakeVM struct {
+	w *os.File
+}
+
+// newFakeUFFD Sets the read end of a pipe as the uffd of the state, returns its fd
+// and the fake VM that feeds the uffd messages into the pipe
+func newFakeUFFD(t testing.TB, s *SnapshotState) (int, *fakeVM) {
+	r, w, err := os.Pipe()
+	require.NoError(t, err, "Failed to create a pipe")
+
+	t.Cleanup(func() {
+		r.Close()
+		w.Close()
+	})
+
+	s.userFaultFD = r
+
+	return int(r.Fd()), &fakeVM{w: w}
+}
+
+// fault Writes a page fault uffd message for the address
+func (v *fakeVM) fault(t testing.TB, address uint64) {
+	v.event(t, uffdPageFault(), address)
+}
+
+// event Writes a uffd message with the event type and the address
+func (v *fakeVM) event(t testing.TB, event uint8, address uint64) {
+	msg := make([]byte, sizeOfUFFDMsg())
+	msg[0] = event
+	binary.LittleEndian.PutUint64(msg[16:], address)
+
+	_, err := v.w.Write(msg)
+	require.NoError(t, err, "Failed to write uffd message")
+}
+
+// remove Writes a uffd message with the remove or unmap event type for the range [start, end)
+func (v *fakeVM) remove(t *testing.T, event uint8, start, end uint64) {
+	msg := make([]byte, sizeOfUFFDMsg())
+	msg[0] = event
+	binary.LittleEndian.PutUint64(msg[8:], start)
+	binary.LittleEndian.PutUint64(msg[16:], end)
+
+	_, err := v.w.Write(msg)
+	require.NoError(t, err, "Failed to write uffd message")
+}
+
+// serveFakeUFFDs Sets the socket of the VM to the one where the returned fake VMs
+// pass the uffd to the memory manager, a new fake VM is returned upon every activation
+func serveFakeUFFDs(t *testing.T, cfg *SnapshotStateCfg) <-chan *fakeVM {
+	cfg.InstanceSockAddr = filepath.Join(cfg.BaseDir, "sock")
+
+	checkUFFDFunc = func(f *os.File) error { return nil }
+	t.Cleanup(func() { checkUFFDFunc = checkUFFD })
+
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: cfg.InstanceSockAddr, Net: "unix"})
+	require.NoError(t, err, "Failed to listen on the VM socket")
+	t.Cleanup(func() { l.Close() })
+
+	vms := make(chan *fakeVM, 1)
+	go func() {
+		for {
+			c, err := l.AcceptUnix()
+			if err != nil {
+				return
+			}
+
+			r, w, err := os.Pipe()
+			if err == nil {
+				err = fd.Put(c, r)
+				r.Close()
+			}
+			c.Close()
+			if err != nil {
+				return
+			}
+
+			t.Cleanup(func() { w.Close() })
+			vms <- &fakeVM{w: w}
+		}
+	}()
+
+	return vms
+}
+
+// newTestSnapshotState Creates an activated snapshot state with an in-memory guest memory
+// whose first page is mapped at testStartAddress
+func newTestSnapshotState(pages, installChunkPages int) *SnapshotState {
+	s := NewSnapshotState(SnapshotStateCfg{
+		VMID:              "test",
+		GuestMemSize:      pages * os.Getpagesize(),
+		installChunkPages: installChunkPages,
+	})
+	s.guestMem = make([]byte, s.GuestMemSize)
+	for i := range s.guestMem {
+		s.guestMem[i] = byte(48 + i/os.Getpagesize())
+	}
+	s.setupStateOnActivate()
+	s.firstPageFaultOnce.Do(func() { s.startAddress = testStartAddress })
+
+	return s
+}
+
+// newTestManager Creates a memory manager with the valid configuration
+func newTestManager(t testing.TB, cfg MemoryManagerCfg) *MemoryManager {
+	manager, err := NewMemoryManager(cfg)
+	require.NoError(t, err, "Failed to create the memory manager")
+
+	return manager
+}
+
+// prepareSnapshotStateCfg Creates the guest memory and VMM state files of a VM in a temporary directory
+func prepareSnapshotStateCfg(t testing.TB, vmID string, guestMemSize int) SnapshotStateCfg {
+	baseDir := t.TempDir()
+
+	cfg := SnapshotStateCfg{
+		VMID:           vmID,
+		BaseDir:        baseDir,
+		GuestMemPath:   filepath.Join(baseDir, "mem_file"),
+		VMMStatePath:   filepath.Join(baseDir, "snap_file"),
+		WorkingSetPath: filepath.Join(baseDir, "ws_file"),
+		GuestMemSize:   guestMemSize,
+	}
+
+	prepareGuestMemoryFile(cfg.GuestMemPath, guestMemSize)
+
+	err := ioutil.WriteFile(cfg.VMMStatePath, []byte("vmm state"), 0644)
+	require.NoError(t, err, "Failed to write the VMM state file")
+
+	return cfg
+}
+
+// persistRecord Persists the trace and the working set files as if the VM had been recorded
+func persistRecord(t testing.TB, cfg SnapshotStateCfg, offsets []uint64) {
+	trace := initTrace(filepath.Join(cfg.BaseDir, "trace"), os.Getpagesize())
+	for _, offset := range offsets {
+		trace.AppendRecord(Record{offset: offset})
+	}
+
+	err := trace.ProcessRecord(cfg.GuestMemPath, cfg.WorkingSetPath)
+	require.NoError(t, err, "Failed to persist the record")
+}
+
+// activateTestVM Activates a registered VM with a fake uffd instead of the one of a real VM
+func activateTestVM(t testing.TB, m *MemoryManager, vmID string) (*SnapshotState, *fakeVM) {
+	state := m.instances[vmID]
+
+	err := state.mapGuestMemory(context.Background())
+	require.NoError(t, err, "Failed to map guest memory")
+
+	state.setupStateOnActivate()
+	state.firstPageFaultOnce.Do(func() { state.startAddress = testStartAddress })
+	_, vm := newFakeUFFD(t, state)
+
+	readyCh := make(chan error)
+	go state.pollUserPageFaults(readyCh)
+	require.NoError(t, <-readyCh, "Failed to register the epoller")
+
+	return state, vm
+}
+
 /*
 func TestSingleClient(t *testing.T) {
 	log.SetFormatter(&log.TextFormatter{
@@ -64,7 +1581,7 @@ func TestSingleClient(t *testing.T) {
 	uffdFile := os.NewFile(uintptr(uffd), uffdFileName)
 
 	managerCfg := MemoryManagerCfg{}
-	manager := NewMemoryManager(managerCfg)
+	manager := newTestManager(t, managerCfg)
 
 	stateCfg := SnapshotStateCfg{
 		VMID:         vmID,
@@ -125,7 +1642,7 @@ func TestParallelClients(t *testing.T) {
 	}
 
 	managerCfg := MemoryManagerCfg{}
-	manager := NewMemoryManager(managerCfg)
+	manager := newTestManager(t, managerCfg)
 
 	var wg sync.WaitGroup
 
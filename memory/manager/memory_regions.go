@@ -0,0 +1,130 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// MemoryRegion A contiguous region of the guest memory, mapped at BaseAddress in the address
+// space of the VMM and backed by the Size bytes at Offset in the guest memory file
+type MemoryRegion struct {
+	BaseAddress uint64
+	Size        int
+	Offset      int
+}
+
+// validateRegions Checks that the regions are page-aligned and back the guest memory file
+// contiguously, in the order of their offsets
+func validateRegions(regions []MemoryRegion, guestMemSize, pageSize int) error {
+	offset := 0
+	for i, r := range regions {
+		switch {
+		case r.Offset != offset:
+			return fmt.Errorf("%w: region %d starts at offset %d instead of %d", ErrInvalidConfig, i, r.Offset, offset)
+		case r.Size <= 0 || r.Size%pageSize != 0:
+			return fmt.Errorf("%w: size %d of region %d is not a positive multiple of the page size",
+				ErrInvalidConfig, r.Size, i)
+		case r.BaseAddress == 0 || r.BaseAddress%uint64(pageSize) != 0:
+			return fmt.Errorf("%w: base address 0x%x of region %d is not page-aligned", ErrInvalidConfig, r.BaseAddress, i)
+		}
+		offset += r.Size
+	}
+
+	if offset != guestMemSize {
+		return fmt.Errorf("%w: regions cover %d bytes of the %d bytes of guest memory", ErrInvalidConfig, offset, guestMemSize)
+	}
+
+	return nil
+}
+
+// validateGuestPhysBase Checks that the configured address of the guest memory is page-aligned
+// and that the guest memory fits in the address space from there
+func validateGuestPhysBase(cfg SnapshotStateCfg, pageSize int) error {
+	switch {
+	case len(cfg.Regions) > 0:
+		return fmt.Errorf("%w: guest memory base is mutually exclusive with the regions", ErrInvalidConfig)
+	case cfg.GuestPhysBase%uint64(pageSize) != 0:
+		return fmt.Errorf("%w: guest memory base 0x%x is not page-aligned", ErrInvalidConfig, cfg.GuestPhysBase)
+	case cfg.GuestPhysBase+uint64(cfg.GuestMemSize) < cfg.GuestPhysBase:
+		return fmt.Errorf("%w: guest memory of %d bytes at 0x%x overflows the address space",
+			ErrInvalidConfig, cfg.GuestMemSize, cfg.GuestPhysBase)
+	}
+
+	return nil
+}
+
+// guestRegions Returns the regions of the guest memory, which is a single region starting
+// at the start address unless the regions are configured, or nil if the start address is unknown
+func (s *SnapshotState) guestRegions() []MemoryRegion {
+	if len(s.Regions) > 0 {
+		return s.Regions
+	}
+
+	start := atomic.LoadUint64(&s.startAddress)
+	if start == 0 {
+		return nil
+	}
+
+	return []MemoryRegion{{BaseAddress: start, Size: s.GuestMemSize}}
+}
+
+// regionOf Returns the region that backs the page of the guest memory file
+func (s *SnapshotState) regionOf(page int) MemoryRegion {
+	offset := page * s.PageSize
+	for _, r := range s.Regions {
+		if offset >= r.Offset && offset < r.Offset+r.Size {
+			return r
+		}
+	}
+
+	return MemoryRegion{BaseAddress: s.startAddress, Size: s.GuestMemSize}
+}
+
+// regionPages Returns the first page and the end page of the region that backs the page
+func (s *SnapshotState) regionPages(page int) (int, int) {
+	r := s.regionOf(page)
+	return r.Offset / s.PageSize, (r.Offset + r.Size) / s.PageSize
+}
+
+// pageAddress Returns the address of the page of the guest memory file in the address space of the VMM
+func (s *SnapshotState) pageAddress(page int) uint64 {
+	r := s.regionOf(page)
+	return r.BaseAddress + uint64(page*s.PageSize-r.Offset)
+}
+
+// clipToRegion Clips the run of pages to the region that backs the page, as the regions
+// are not contiguous in the address space of the VMM
+func (s *SnapshotState) clipToRegion(page, first, num int) (int, int) {
+	regionFirst, regionEnd := s.regionPages(page)
+	if first < regionFirst {
+		num -= regionFirst - first
+		first = regionFirst
+	}
+	if first+num > regionEnd {
+		num = regionEnd - first
+	}
+
+	return first, num
+}
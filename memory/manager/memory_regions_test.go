@@ -0,0 +1,128 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryRegionsServePageFaults(t *testing.T) {
+	contents := make(map[uint64][]byte)
+	defer stubCopyingInstallRegion(contents)()
+
+	pageSize := os.Getpagesize()
+	secondAddress := testStartAddress + uint64(64*pageSize)
+
+	state := newTestSnapshotState(8, 8)
+	state.Regions = []MemoryRegion{
+		{BaseAddress: testStartAddress, Size: 4 * pageSize},
+		{BaseAddress: secondAddress, Size: 4 * pageSize, Offset: 4 * pageSize},
+	}
+
+	require.NoError(t, state.servePageFault(-1, secondAddress+uint64(pageSize)), "Failed to serve page fault")
+	require.Len(t, contents, 1, "Install run must not span several regions")
+	require.Equal(t, bytes.Repeat([]byte{52}, pageSize), contents[secondAddress][:pageSize],
+		"Region must be backed by its offset in the guest memory file")
+	require.Len(t, contents[secondAddress], 4*pageSize, "Install run must be clipped to the region")
+
+	require.NoError(t, state.servePageFault(-1, testStartAddress+uint64(2*pageSize)), "Failed to serve page fault")
+	require.Len(t, contents, 2, "Fault in the first region must be installed")
+	require.Equal(t, bytes.Repeat([]byte{48}, pageSize), contents[testStartAddress][:pageSize],
+		"First region must be backed by the start of the guest memory file")
+	require.EqualValues(t, 8, state.servedPagesNum, "Wrong number of served pages")
+
+	err := state.servePageFault(-1, testStartAddress+uint64(4*pageSize))
+	require.True(t, errors.Is(err, ErrFaultOutOfRange), "Fault between the regions must be out of range")
+}
+
+func TestRegisterVMInvalidRegions(t *testing.T) {
+	pageSize := os.Getpagesize()
+
+	for name, regions := range map[string][]MemoryRegion{
+		"gap":       {{BaseAddress: testStartAddress, Size: pageSize}, {BaseAddress: 2 * testStartAddress, Size: pageSize, Offset: 2 * pageSize}},
+		"unaligned": {{BaseAddress: testStartAddress + 1, Size: 2 * pageSize}},
+		"short":     {{BaseAddress: testStartAddress, Size: pageSize}},
+	} {
+		m := newTestManager(t, MemoryManagerCfg{})
+		cfg := prepareSnapshotStateCfg(t, "test", 2*pageSize)
+		cfg.IsLazyMode = true
+		cfg.Regions = regions
+
+		err := m.RegisterVM(cfg)
+		require.True(t, errors.Is(err, ErrInvalidConfig), "Invalid regions must be rejected: "+name)
+	}
+}
+
+func TestGuestPhysBase(t *testing.T) {
+	contents := make(map[uint64][]byte)
+	defer stubCopyingInstallRegion(contents)()
+
+	pageSize := os.Getpagesize()
+
+	// the VM first touches its third page, which the first fault would take for the base
+	state := newTestSnapshotState(8, 1)
+	state.GuestPhysBase = testStartAddress
+	state.firstPageFaultOnce, state.startAddress = new(sync.Once), 0
+	thirdPage := testStartAddress + uint64(2*pageSize)
+
+	require.NoError(t, state.servePageFault(-1, thirdPage), "Failed to serve page fault")
+	require.Equal(t, testStartAddress, state.startAddress, "Start address must be the configured base")
+	require.Equal(t, bytes.Repeat([]byte{50}, pageSize), contents[thirdPage][:pageSize],
+		"Fault must be backed by its offset from the configured base")
+
+	require.NoError(t, state.servePageFault(-1, testStartAddress), "Failed to serve page fault")
+	require.Equal(t, bytes.Repeat([]byte{48}, pageSize), contents[testStartAddress][:pageSize],
+		"Fault at the base must be backed by the start of the guest memory file")
+
+	err := state.servePageFault(-1, testStartAddress-uint64(pageSize))
+	require.True(t, errors.Is(err, ErrFaultOutOfRange), "Fault below the base must be out of range")
+	err = state.servePageFault(-1, testStartAddress+uint64(8*pageSize))
+	require.True(t, errors.Is(err, ErrFaultOutOfRange), "Fault past the guest memory must be out of range")
+}
+
+func TestRegisterVMInvalidGuestPhysBase(t *testing.T) {
+	pageSize := os.Getpagesize()
+
+	for name, setup := range map[string]func(cfg *SnapshotStateCfg){
+		"unaligned": func(cfg *SnapshotStateCfg) { cfg.GuestPhysBase = testStartAddress + 1 },
+		"overflow":  func(cfg *SnapshotStateCfg) { cfg.GuestPhysBase = ^uint64(0) &^ uint64(pageSize-1) },
+		"regions": func(cfg *SnapshotStateCfg) {
+			cfg.GuestPhysBase = testStartAddress
+			cfg.Regions = []MemoryRegion{{BaseAddress: testStartAddress, Size: 2 * pageSize}}
+		},
+	} {
+		m := newTestManager(t, MemoryManagerCfg{})
+		cfg := prepareSnapshotStateCfg(t, "test", 2*pageSize)
+		cfg.IsLazyMode = true
+		setup(&cfg)
+
+		err := m.RegisterVM(cfg)
+		require.True(t, errors.Is(err, ErrInvalidConfig), "Invalid guest memory base must be rejected: "+name)
+	}
+}
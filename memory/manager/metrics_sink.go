@@ -0,0 +1,130 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SnapshotMetrics The lifetime counters of a VM, which are recorded to the MetricsSink
+// when the VM is deregistered or evicted
+type SnapshotMetrics struct {
+	FaultsServed       int64         `json:"faultsServed"`
+	ServeTime          time.Duration `json:"serveTimeNs"`
+	ZeroInstalls       int64         `json:"zeroInstalls"`       // pages installed with UFFDIO_ZEROPAGE
+	CopyInstalls       int64         `json:"copyInstalls"`       // pages installed with UFFDIO_COPY on demand
+	MinorFaults        int64         `json:"minorFaults"`        // pages mapped with UFFDIO_CONTINUE
+	AlreadyPresent     int64         `json:"alreadyPresent"`     // pages found present upon installation
+	WorkingSetInstalls int64         `json:"workingSetInstalls"` // working set pages installed in replay mode
+	WorkingSetMisses   int64         `json:"workingSetMisses"`   // pages installed on demand in replay mode
+	BackingReads       int64         `json:"backingReads"`       // pages read from the guest memory file
+	ServeErrors        int64         `json:"serveErrors"`        // page faults that failed to be served
+	HotPageInstalls    int64         `json:"hotPageInstalls"`    // pages installed from the hot page pool
+	// ServeLatencyHistogram Number of the page faults per bucket of ServeLatencyBucketsUs,
+	// followed by the number of the slower ones
+	ServeLatencyHistogram []int64 `json:"serveLatencyHistogram"`
+}
+
+// MetricsSink Persists the lifetime metrics of the VMs, e.g., to keep the history of the
+// functions across their short-lived instances. Record is called with the memory manager
+// locked, once per VM that is deregistered or evicted.
+type MetricsSink interface {
+	Record(vmID string, metrics SnapshotMetrics) error
+}
+
+// noopMetricsSink MetricsSink used when no sink is configured
+type noopMetricsSink struct{}
+
+func (noopMetricsSink) Record(vmID string, metrics SnapshotMetrics) error { return nil }
+
+// FileMetricsSink MetricsSink that appends the metrics of each VM to a file as a line of JSON
+type FileMetricsSink struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// fileMetricsRecord A line of the file of a FileMetricsSink
+type fileMetricsRecord struct {
+	VMID     string    `json:"vmID"`
+	Recorded time.Time `json:"recorded"`
+	SnapshotMetrics
+}
+
+// NewFileMetricsSink Opens the file that the metrics are appended to, creating it if needed
+func NewFileMetricsSink(path string) (*FileMetricsSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileMetricsSink{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Record Appends the metrics of the VM to the file
+func (s *FileMetricsSink) Record(vmID string, metrics SnapshotMetrics) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.enc.Encode(fileMetricsRecord{VMID: vmID, Recorded: time.Now(), SnapshotMetrics: metrics})
+}
+
+// Close Closes the file
+func (s *FileMetricsSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.f.Close()
+}
+
+// lifetimeMetrics Returns a copy of the lifetime counters of the VM
+func (s *SnapshotState) lifetimeMetrics() SnapshotMetrics {
+	return SnapshotMetrics{
+		FaultsServed:          atomic.LoadInt64(&s.faultsServed),
+		ServeTime:             time.Duration(atomic.LoadInt64(&s.serveTimeNs)),
+		ZeroInstalls:          atomic.LoadInt64(&s.zeroInstalls),
+		CopyInstalls:          atomic.LoadInt64(&s.copyInstalls),
+		MinorFaults:           atomic.LoadInt64(&s.minorFaults),
+		AlreadyPresent:        atomic.LoadInt64(&s.alreadyPresent),
+		WorkingSetInstalls:    atomic.LoadInt64(&s.workingSetInstalls),
+		WorkingSetMisses:      atomic.LoadInt64(&s.workingSetMisses),
+		BackingReads:          atomic.LoadInt64(&s.backingReads),
+		ServeErrors:           atomic.LoadInt64(&s.serveErrors),
+		HotPageInstalls:       atomic.LoadInt64(&s.hotPageInstalls),
+		ServeLatencyHistogram: s.serveLatency.snapshot(),
+	}
+}
+
+// recordMetrics Records the lifetime metrics of the VM that is being removed from the memory manager,
+// a failure is only logged as the VM is removed anyway. Must be called with the manager locked.
+func (m *MemoryManager) recordMetrics(state *SnapshotState) {
+	if err := m.MetricsSink.Record(state.VMID, state.lifetimeMetrics()); err != nil {
+		log.WithFields(log.Fields{"vmID": state.VMID}).Warnf("Failed to record the metrics of the VM: %v", err)
+	}
+}
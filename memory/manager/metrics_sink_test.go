@@ -0,0 +1,128 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMetricsSink Records the metrics of the VMs in memory
+type fakeMetricsSink struct {
+	mu      sync.Mutex
+	vmIDs   []string
+	metrics []SnapshotMetrics
+}
+
+func (s *fakeMetricsSink) Record(vmID string, metrics SnapshotMetrics) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.vmIDs = append(s.vmIDs, vmID)
+	s.metrics = append(s.metrics, metrics)
+
+	return nil
+}
+
+func TestMetricsSinkOnDeregister(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	sink := new(fakeMetricsSink)
+	manager := newTestManager(t, MemoryManagerCfg{MetricsSink: sink})
+
+	stateCfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+	stateCfg.IsLazyMode = true
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+
+	state, vm := activateTestVM(t, manager, "1")
+	vm.fault(t, testStartAddress)
+	vm.fault(t, testStartAddress+uint64(os.Getpagesize()))
+	waitServedPages(t, state, 2)
+	require.NoError(t, manager.Deactivate("1"), "Failed to deactivate VM")
+	require.Empty(t, sink.vmIDs, "Metrics must not be recorded before the VM is removed")
+
+	require.NoError(t, manager.DeregisterVM("1"), "Failed to deregister VM")
+	err := manager.DeregisterVM("1")
+	require.True(t, errors.Is(err, ErrVMNotRegistered), "VM must be deregistered once")
+
+	require.Equal(t, []string{"1"}, sink.vmIDs, "Metrics must be recorded once per removal")
+	require.EqualValues(t, 2, sink.metrics[0].FaultsServed, "Wrong number of served page faults")
+	require.EqualValues(t, 2, sink.metrics[0].CopyInstalls, "Wrong number of installed pages")
+	require.Len(t, sink.metrics[0].ServeLatencyHistogram, len(ServeLatencyBucketsUs)+1)
+}
+
+func TestMetricsSinkOnEviction(t *testing.T) {
+	sink := new(fakeMetricsSink)
+	manager := newTestManager(t, MemoryManagerCfg{MetricsSink: sink, MaxInactive: 1})
+
+	for _, vmID := range []string{"1", "2"} {
+		stateCfg := prepareSnapshotStateCfg(t, vmID, 4*os.Getpagesize())
+		stateCfg.IsLazyMode = true
+		vms := serveFakeUFFDs(t, &stateCfg)
+		require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+
+		require.NoError(t, manager.Activate(vmID), "Failed to activate VM")
+		<-vms
+		require.NoError(t, manager.Deactivate(vmID), "Failed to deactivate VM")
+	}
+
+	require.Equal(t, []string{"1"}, sink.vmIDs, "Metrics of the evicted VM must be recorded")
+}
+
+func TestFileMetricsSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.jsonl")
+
+	sink, err := NewFileMetricsSink(path)
+	require.NoError(t, err, "Failed to create the sink")
+	require.NoError(t, sink.Record("1", SnapshotMetrics{FaultsServed: 3}), "Failed to record metrics")
+	require.NoError(t, sink.Record("2", SnapshotMetrics{FaultsServed: 5}), "Failed to record metrics")
+	require.NoError(t, sink.Close(), "Failed to close the sink")
+
+	f, err := os.Open(path)
+	require.NoError(t, err, "Failed to open the metrics file")
+	defer f.Close()
+
+	var records []fileMetricsRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec fileMetricsRecord
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &rec), "Every line must be a JSON object")
+		records = append(records, rec)
+	}
+	require.NoError(t, scanner.Err())
+
+	require.Len(t, records, 2, "Every record must be a line")
+	require.Equal(t, "1", records[0].VMID)
+	require.EqualValues(t, 3, records[0].FaultsServed)
+	require.Equal(t, "2", records[1].VMID)
+	require.EqualValues(t, 5, records[1].FaultsServed)
+	require.False(t, records[1].Recorded.IsZero(), "Records must be timestamped")
+}
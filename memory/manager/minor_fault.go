@@ -0,0 +1,61 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// serveMinorFault Maps the page that is present in the page cache of the guest memory,
+// which is backed by shmem or hugetlbfs, without copying it, and wakes up the faulting thread
+func (s *SnapshotState) serveMinorFault(fd int, address uint64) error {
+	tServe := time.Now()
+
+	address &^= uint64(s.PageSize - 1)
+	offset, err := s.faultOffset(address)
+	if err != nil {
+		return fmt.Errorf("minor fault: %w", err)
+	}
+
+	err = s.installer.Continue(fd, address, uint64(s.PageSize))
+	switch {
+	case errors.Is(err, errAlreadyPresent):
+		// the ioctl does not wake up the faulting thread if it fails
+		if err := s.installer.Wake(fd, address, s.PageSize); err != nil {
+			return s.serveFailed(offset, fmt.Errorf("minor fault: wake: %w", err))
+		}
+		atomic.AddInt64(&s.alreadyPresent, 1)
+	case err != nil:
+		return s.serveFailed(offset, fmt.Errorf("minor fault: %w", err))
+	default:
+		atomic.AddInt64(&s.minorFaults, 1)
+	}
+
+	atomic.AddInt64(&s.servedPagesNum, int64(s.servedPages.SetRange(int(offset)/s.PageSize, 1)))
+	s.countServedFault(tServe)
+
+	return nil
+}
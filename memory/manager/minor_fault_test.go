@@ -0,0 +1,137 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type continueCall struct {
+	start, len uint64
+}
+
+// stubMinorFaults Records the minor fault registrations and the ranges mapped with UFFDIO_CONTINUE
+// instead of issuing the ioctls, returns the function that restores the real implementation
+func stubMinorFaults(registrations, calls *[]continueCall) func() {
+	registerMinorFaultsFunc = func(fd int, start, len uint64) error {
+		*registrations = append(*registrations, continueCall{start: start, len: len})
+		return nil
+	}
+	installer, restore := stubInstaller()
+	installer.cont = func(fd int, start, len uint64) error {
+		*calls = append(*calls, continueCall{start: start, len: len})
+		return nil
+	}
+
+	return func() {
+		registerMinorFaultsFunc = registerMinorFaults
+		restore()
+	}
+}
+
+// minorFault Writes a minor page fault uffd message for the address
+func (v *fakeVM) minorFault(t *testing.T, address uint64) {
+	msg := make([]byte, sizeOfUFFDMsg())
+	msg[0] = uffdPageFault()
+	binary.LittleEndian.PutUint64(msg[8:], uffdPageFaultFlagMinor())
+	binary.LittleEndian.PutUint64(msg[16:], address)
+
+	_, err := v.w.Write(msg)
+	require.NoError(t, err, "Failed to write uffd message")
+}
+
+func TestServeMinorFaults(t *testing.T) {
+	var (
+		installs             []installCall
+		registrations, conts []continueCall
+	)
+	defer stubInstallRegion(&installs)()
+	defer stubMinorFaults(&registrations, &conts)()
+	defer stubCapabilities(Capabilities{ZeroPage: true, MinorFaults: true})()
+
+	pageSize := uint64(os.Getpagesize())
+
+	manager := newTestManager(t, MemoryManagerCfg{})
+	cfg := prepareSnapshotStateCfg(t, "vm", 4*int(pageSize))
+	cfg.IsLazyMode = true
+	cfg.MinorFaults = true
+	require.NoError(t, manager.RegisterVM(cfg), "Failed to register VM")
+
+	state := manager.instances["vm"]
+	state.guestMem = make([]byte, state.GuestMemSize)
+	state.setupStateOnActivate()
+	uffd, fakeVM := newFakeUFFD(t, state)
+	events := []syscall.EpollEvent{{Events: syscall.EPOLLIN, Fd: int32(uffd)}}
+
+	// the first page fault is on a missing page, which is copied
+	fakeVM.fault(t, testStartAddress)
+	require.NoError(t, state.handleEvents(events), "Failed to handle events")
+	require.Equal(t, []continueCall{{start: testStartAddress, len: 4 * pageSize}}, registrations,
+		"Guest memory must be registered for minor faults once")
+	require.Len(t, installs, 1, "Missing page must be installed")
+
+	// pages 2 and 3 are in the page cache
+	for _, page := range []uint64{2, 3} {
+		fakeVM.minorFault(t, testStartAddress+page*pageSize+8)
+		require.NoError(t, state.handleEvents(events), "Failed to handle events")
+	}
+	require.Len(t, installs, 1, "Minor faults must not copy pages")
+	require.Equal(t, []continueCall{
+		{start: testStartAddress + 2*pageSize, len: pageSize},
+		{start: testStartAddress + 3*pageSize, len: pageSize},
+	}, conts, "Faulting pages must be mapped with UFFDIO_CONTINUE")
+	require.EqualValues(t, 2, state.minorFaults, "Wrong number of minor faults")
+	require.EqualValues(t, 3, state.faultsServed, "Wrong number of served page faults")
+	require.Equal(t, 3, state.servedPages.Count(), "Mapped pages must be marked as served")
+	require.Len(t, registrations, 1, "Guest memory must be registered for minor faults once")
+}
+
+func TestRegisterVMMinorFaults(t *testing.T) {
+	defer stubCapabilities(Capabilities{ZeroPage: true, WriteProtect: true})()
+
+	manager := newTestManager(t, MemoryManagerCfg{})
+	cfg := prepareSnapshotStateCfg(t, "vm", 4*os.Getpagesize())
+	cfg.IsLazyMode = true
+	cfg.MinorFaults = true
+
+	err := manager.RegisterVM(cfg)
+	require.True(t, errors.Is(err, ErrUnsupported), "Minor faults must be rejected without the kernel support")
+
+	manager.capabilities.MinorFaults = true
+	cfg.WriteProtect = true
+	err = manager.RegisterVM(cfg)
+	require.True(t, errors.Is(err, ErrInvalidConfig), "Minor faults must be rejected with write protection")
+
+	cfg.WriteProtect, cfg.IsLazyMode = false, false
+	err = manager.RegisterVM(cfg)
+	require.True(t, errors.Is(err, ErrInvalidConfig), "Minor faults must be rejected in record and replay")
+
+	cfg.IsLazyMode = true
+	require.NoError(t, manager.RegisterVM(cfg), "Failed to register VM")
+}
@@ -0,0 +1,93 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// mpolBind is MPOL_BIND of linux/mempolicy.h, which allocates the pages on the nodes of the mask only
+const mpolBind = 2
+
+var (
+	// mbindFunc and setMempolicyFunc bind the guest memory mapping and the thread that installs
+	// the pages to a NUMA node, stubbed out in the tests
+	mbindFunc        = mbind
+	setMempolicyFunc = setMempolicy
+)
+
+// nodeMask Returns the mask of the NUMA node and its maxnode argument of the mempolicy syscalls,
+// which count one bit more than the mask holds
+func nodeMask(node int) ([]uint64, uintptr) {
+	mask := make([]uint64, node/64+1)
+	mask[node/64] = 1 << (node % 64)
+
+	return mask, uintptr(len(mask)*64 + 1)
+}
+
+// mbind Binds the mapping to the NUMA node
+func mbind(mem []byte, node int) error {
+	mask, maxNode := nodeMask(node)
+	_, _, errno := syscall.Syscall6(syscall.SYS_MBIND, uintptr(unsafe.Pointer(&mem[0])), uintptr(len(mem)),
+		mpolBind, uintptr(unsafe.Pointer(&mask[0])), maxNode, 0)
+	if errno != 0 {
+		return fmt.Errorf("mbind: %w", errno)
+	}
+
+	return nil
+}
+
+// setMempolicy Binds the allocations of the calling thread to the NUMA node
+func setMempolicy(node int) error {
+	mask, maxNode := nodeMask(node)
+	_, _, errno := syscall.Syscall(syscall.SYS_SET_MEMPOLICY, mpolBind, uintptr(unsafe.Pointer(&mask[0])), maxNode)
+	if errno != 0 {
+		return fmt.Errorf("set_mempolicy: %w", errno)
+	}
+
+	return nil
+}
+
+// numaNodeExists Returns true if the NUMA node is present on the host
+func numaNodeExists(node int) bool {
+	_, err := os.Stat(fmt.Sprintf("/sys/devices/system/node/node%d", node))
+	return err == nil
+}
+
+// bindToNUMANode Locks the calling goroutine to its thread and binds the allocations of the thread
+// to the NUMA node of the VM. The pages installed with UFFDIO_COPY are allocated by the thread that
+// installs them, so they land on the node of the VM. The thread is not unlocked, so that it exits
+// along with the goroutine instead of serving other goroutines with the mempolicy of the VM.
+func (s *SnapshotState) bindToNUMANode() error {
+	runtime.LockOSThread()
+
+	if err := setMempolicyFunc(s.NUMANode); err != nil {
+		return fmt.Errorf("failed to bind the page fault handler to NUMA node %d: %w", s.NUMANode, err)
+	}
+
+	return nil
+}
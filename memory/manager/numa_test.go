@@ -0,0 +1,119 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNUMAPlacement(t *testing.T) {
+	bound := make(chan int, 1)
+	var mbound []int
+	mbindFunc = func(mem []byte, node int) error {
+		mbound = append(mbound, node, len(mem))
+		return nil
+	}
+	setMempolicyFunc = func(node int) error {
+		bound <- node
+		return nil
+	}
+	defer func() { mbindFunc, setMempolicyFunc = mbind, setMempolicy }()
+
+	manager := newTestManager(t, MemoryManagerCfg{})
+	stateCfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+	stateCfg.IsLazyMode = true
+	stateCfg.NUMAPlacement = true
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+
+	state, _ := activateTestVM(t, manager, "1")
+	defer state.stopPolling()
+
+	require.Equal(t, []int{0, 4 * os.Getpagesize()}, mbound, "Guest memory must be bound to the node")
+	require.Equal(t, 0, <-bound, "Page fault handler must be bound to the node")
+
+	var out bytes.Buffer
+	require.NoError(t, manager.WriteMetrics(&out), "Failed to write the metrics")
+	require.Contains(t, out.String(), `vhive_memory_manager_numa_node{vmID="1"} 0`)
+}
+
+func TestNUMAPlacementInvalidConfig(t *testing.T) {
+	for name, managerCfg := range map[string]MemoryManagerCfg{
+		"missing node": {},
+		"worker pool":  {WorkerPoolSize: 2},
+	} {
+		manager := newTestManager(t, managerCfg)
+		stateCfg := prepareSnapshotStateCfg(t, "1", os.Getpagesize())
+		stateCfg.IsLazyMode = true
+		stateCfg.NUMAPlacement = true
+		if name == "missing node" {
+			stateCfg.NUMANode = 1 << 20
+		}
+
+		err := manager.RegisterVM(stateCfg)
+		require.True(t, errors.Is(err, ErrInvalidConfig), "NUMA placement must be rejected: "+name)
+	}
+}
+
+func TestSetMempolicy(t *testing.T) {
+	if !numaNodeExists(0) {
+		t.Skip("NUMA is not supported on the host")
+	}
+
+	errCh := make(chan error)
+	go func() {
+		runtime.LockOSThread()
+		// the thread exits along with the goroutine instead of keeping the mempolicy
+
+		if err := setMempolicy(0); err != nil {
+			errCh <- err
+			return
+		}
+
+		var mode int
+		mask, maxNode := nodeMask(0)
+		_, _, errno := syscall.Syscall6(syscall.SYS_GET_MEMPOLICY, uintptr(unsafe.Pointer(&mode)),
+			uintptr(unsafe.Pointer(&mask[0])), maxNode, 0, 0, 0)
+		switch {
+		case errno != 0:
+			errCh <- errno
+		case mode != mpolBind || mask[0] != 1:
+			errCh <- errors.New("mempolicy is not applied")
+		default:
+			errCh <- nil
+		}
+	}()
+
+	err := <-errCh
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.ENOSYS) {
+		t.Skip("set_mempolicy is not permitted on the host")
+	}
+	require.NoError(t, err, "Failed to bind the thread to NUMA node 0")
+}
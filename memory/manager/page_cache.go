@@ -0,0 +1,113 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+// sharedMemory Copy of the guest memory of a snapshot that is shared by the instances
+// booted from it. The pages of a snapshot never change, so a page that has been read
+// from the guest memory file of one instance is installed into its siblings from the copy.
+// The copied pages are cached in the cache of the pages shared across the snapshots, whose
+// budget bounds the memory of all copies, see SharedPagesBudget.
+type sharedMemory struct {
+	pages    *cappedCache // contents of the copied pages, by sharedPageKey
+	size     int
+	pageSize int
+	refs     int // number of the registered instances that use the copy
+}
+
+// sharedPageKey Page of a shared copy of the guest memory
+type sharedPageKey struct {
+	mem  *sharedMemory
+	page int
+}
+
+func newSharedMemory(size, pageSize int, pages *cappedCache) *sharedMemory {
+	m := new(sharedMemory)
+	m.pages = pages
+	m.size = size
+	m.pageSize = pageSize
+
+	return m
+}
+
+// fill Returns the contents of the pages [firstPage, firstPage+numPages), copying the pages that
+// are not in the shared copy from the guest memory into it, along with the number of the pages read
+// from the guest memory. The contents are copied into a new buffer, so that the cached pages may be
+// evicted while they are installed.
+func (m *sharedMemory) fill(guestMem []byte, firstPage, numPages int) ([]byte, int) {
+	run := make([]byte, numPages*m.pageSize)
+
+	read := 0
+	for i := 0; i < numPages; i++ {
+		key := sharedPageKey{mem: m, page: firstPage + i}
+		dst := run[i*m.pageSize : (i+1)*m.pageSize]
+
+		if page, ok := m.pages.get(key); ok {
+			copy(dst, page.([]byte))
+			continue
+		}
+
+		start := key.page * m.pageSize
+		copy(dst, guestMem[start:start+m.pageSize])
+		m.pages.add(key, append([]byte(nil), dst...), m.pageSize)
+		read++
+	}
+
+	return run, read
+}
+
+// sharedMemoryFor Returns the shared copy of the guest memory of the snapshot,
+// creating it for the first instance. Must be called with the manager locked.
+func (m *MemoryManager) sharedMemoryFor(cfg SnapshotStateCfg, pageSize int) (*sharedMemory, bool) {
+	shared, ok := m.sharedMems[cfg.BaseSnapshotID]
+	if !ok {
+		shared = newSharedMemory(cfg.GuestMemSize, pageSize, m.sharedPages)
+		m.sharedMems[cfg.BaseSnapshotID] = shared
+	} else if shared.size != cfg.GuestMemSize || shared.pageSize != pageSize {
+		return nil, false
+	}
+
+	shared.refs++
+
+	return shared, true
+}
+
+// releaseSharedMemory Drops the shared copy of the guest memory of the snapshot once
+// no instance uses it. Must be called with the manager locked.
+func (m *MemoryManager) releaseSharedMemory(snapshotID string) {
+	shared, ok := m.sharedMems[snapshotID]
+	if !ok {
+		return
+	}
+
+	shared.refs--
+	if shared.refs == 0 {
+		delete(m.sharedMems, snapshotID)
+		shared.pages.removeIf(func(key interface{}) bool { return key.(sharedPageKey).mem == shared })
+	}
+}
+
+// SharedPagesStats Returns the counters of the cache of the pages shared by the sibling instances
+// across the snapshots, see SharePages
+func (m *MemoryManager) SharedPagesStats() CacheStats {
+	return m.sharedPages.stats()
+}
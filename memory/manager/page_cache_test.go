@@ -0,0 +1,154 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSharedMemory(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	pageSize := uint64(os.Getpagesize())
+	shared := newSharedMemory(4*os.Getpagesize(), os.Getpagesize(), newCappedCache(0, LRUEviction, nil))
+
+	siblings := []*SnapshotState{newTestSnapshotState(4, 1), newTestSnapshotState(4, 1)}
+	for _, state := range siblings {
+		state.sharedMem = shared
+
+		for page := uint64(0); page < 4; page++ {
+			err := state.servePageFault(-1, testStartAddress+page*pageSize)
+			require.NoError(t, err, "Failed to serve page fault")
+		}
+	}
+
+	require.EqualValues(t, 4, siblings[0].backingReads, "First instance must read the pages from its guest memory")
+	require.EqualValues(t, 0, siblings[1].backingReads, "Sibling must install the pages from the shared copy")
+	for page := 0; page < 4; page++ {
+		copied, ok := shared.pages.get(sharedPageKey{mem: shared, page: page})
+		require.True(t, ok, "Page must be in the shared copy")
+		require.Equal(t, siblings[0].guestMem[page*int(pageSize):(page+1)*int(pageSize)], copied,
+			"Shared copy must match the guest memory")
+	}
+	require.Len(t, installs, 8, "Pages of all instances must be installed")
+}
+
+func TestRegisterVMSharedMemory(t *testing.T) {
+	manager := newTestManager(t, MemoryManagerCfg{SharePages: true})
+
+	size := 4 * os.Getpagesize()
+	for _, vmID := range []string{"1", "2"} {
+		err := manager.RegisterVM(SnapshotStateCfg{VMID: vmID, GuestMemSize: size, BaseSnapshotID: "base"})
+		require.NoError(t, err, "Failed to register VM")
+	}
+	require.True(t, manager.instances["1"].sharedMem == manager.instances["2"].sharedMem,
+		"Instances of the same snapshot must share the guest memory copy")
+
+	err := manager.RegisterVM(SnapshotStateCfg{VMID: "3", GuestMemSize: 2 * size, BaseSnapshotID: "base"})
+	require.Error(t, err, "Instance with a different guest memory size must be rejected")
+
+	for _, vmID := range []string{"1", "2"} {
+		require.NoError(t, manager.DeregisterVM(vmID), "Failed to deregister VM")
+	}
+	require.Empty(t, manager.sharedMems, "Shared copy must be dropped with the last instance")
+}
+
+func TestSharedPagesBudget(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	pageSize := os.Getpagesize()
+	manager := newTestManager(t, MemoryManagerCfg{SharePages: true, SharedPagesBudget: 2 * pageSize})
+
+	siblings := []*SnapshotState{newTestSnapshotState(4, 1), newTestSnapshotState(4, 1)}
+	for i, state := range siblings {
+		manager.Lock()
+		shared, ok := manager.sharedMemoryFor(SnapshotStateCfg{GuestMemSize: state.GuestMemSize, BaseSnapshotID: "base"}, pageSize)
+		manager.Unlock()
+		require.True(t, ok, "Failed to share the guest memory")
+		state.sharedMem = shared
+
+		for page := 0; page < 4; page++ {
+			err := state.servePageFault(-1, testStartAddress+uint64(page*pageSize))
+			require.NoError(t, err, "Failed to serve page fault")
+		}
+		require.Len(t, installs, 4*(i+1), "Pages must be installed")
+	}
+
+	// the copies of the first two pages are evicted to make room for the last two
+	require.EqualValues(t, 4, siblings[0].backingReads, "First instance must read the pages from its guest memory")
+	require.EqualValues(t, 4, siblings[1].backingReads, "Evicted pages must be read from the guest memory again")
+	stats := manager.SharedPagesStats()
+	require.Equal(t, 2*pageSize, stats.Bytes, "Shared pages must stay within the budget")
+	require.EqualValues(t, 6, stats.Evictions, "Wrong number of the evictions")
+	require.EqualValues(t, 8, stats.Misses, "Wrong number of the misses")
+
+	manager.Lock()
+	manager.releaseSharedMemory("base")
+	manager.releaseSharedMemory("base")
+	manager.Unlock()
+	require.Zero(t, manager.SharedPagesStats().Entries, "Pages of the dropped copy must be dropped")
+}
+
+func BenchmarkSharedMemory(b *testing.B) {
+	const (
+		numSiblings = 16
+		numPages    = 256
+	)
+
+	_, restore := stubInstaller()
+	defer restore()
+
+	for _, share := range []bool{false, true} {
+		b.Run(fmt.Sprintf("Shared%v", share), func(b *testing.B) {
+			var backingReads int64
+
+			for n := 0; n < b.N; n++ {
+				b.StopTimer()
+				shared := newSharedMemory(numPages*os.Getpagesize(), os.Getpagesize(), newCappedCache(0, LRUEviction, nil))
+				siblings := make([]*SnapshotState, numSiblings)
+				for i := range siblings {
+					siblings[i] = newTestSnapshotState(numPages, 1)
+					if share {
+						siblings[i].sharedMem = shared
+					}
+				}
+				b.StartTimer()
+
+				for _, state := range siblings {
+					for page := 0; page < numPages; page++ {
+						_ = state.servePageFault(-1, testStartAddress+uint64(page*os.Getpagesize()))
+					}
+					backingReads += state.backingReads
+				}
+			}
+
+			b.ReportMetric(float64(backingReads)/float64(b.N), "backing-reads/op")
+		})
+	}
+}
@@ -0,0 +1,163 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"context"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PauseVM Stops installing pages for the active VM, e.g., while its state is copied during
+// a migration, without tearing down its guest memory mapping or its uffd. The page faults
+// being served are served before PauseVM returns, and the ones that arrive meanwhile are
+// deferred until ResumeVM.
+func (m *MemoryManager) PauseVM(vmID string) error {
+	logger := log.WithFields(log.Fields{"vmID": vmID})
+
+	logger.Debug("Pausing the page faults of the VM")
+
+	state, err := m.getInstance(vmID)
+	if err != nil {
+		return err
+	}
+
+	if !state.isActive {
+		return &VMError{VMID: vmID, Err: ErrVMNotActive}
+	}
+
+	state.pauseMu.Lock()
+	if state.paused {
+		state.pauseMu.Unlock()
+		return &VMError{VMID: vmID, Err: ErrVMAlreadyPaused}
+	}
+	state.paused = true
+	state.pauseMu.Unlock()
+
+	// the polling loop queues no more page faults to the worker once the VM is paused
+	state.inflightFaults.Wait()
+
+	return nil
+}
+
+// QuiesceVM Pauses the active VM like PauseVM, e.g., before taking a delta snapshot of it, and waits
+// until the page faults being served are served or the context is done. The VM is left paused in
+// either case and must be resumed with ResumeVM. If the VM is paused already, e.g., by a QuiesceVM
+// whose context was done, it only waits for the page faults being served. No pages of the VM are
+// installed after QuiesceVM returns nil until the VM is resumed.
+func (m *MemoryManager) QuiesceVM(ctx context.Context, vmID string) error {
+	logger := log.WithFields(log.Fields{"vmID": vmID})
+
+	logger.Debug("Quiescing the page faults of the VM")
+
+	state, err := m.getInstance(vmID)
+	if err != nil {
+		return err
+	}
+
+	if !state.isActive {
+		return &VMError{VMID: vmID, Err: ErrVMNotActive}
+	}
+
+	// the page fault served by the polling loop, if any, is served once the lock is taken
+	state.pauseMu.Lock()
+	state.paused = true
+	if state.quiesced == nil {
+		// the waiter is shared with the retries and ResumeVM, the page faults are queued
+		// to the worker again only once it has returned
+		quiesced := make(chan struct{})
+		go func() {
+			state.inflightFaults.Wait()
+			close(quiesced)
+		}()
+		state.quiesced = quiesced
+	}
+	quiesced := state.quiesced
+	state.pauseMu.Unlock()
+
+	select {
+	case <-quiesced:
+		return nil
+	case <-ctx.Done():
+		return &VMError{VMID: vmID, Err: fmt.Errorf("failed to wait for the in-flight page faults: %w", ctx.Err())}
+	}
+}
+
+// ResumeVM Serves the page faults deferred while the VM was paused, in the order of their
+// arrival, and resumes serving the page faults of the VM. If the VM was quiesced, the page faults
+// being served at that time are served first.
+func (m *MemoryManager) ResumeVM(vmID string) error {
+	logger := log.WithFields(log.Fields{"vmID": vmID})
+
+	logger.Debug("Resuming the page faults of the VM")
+
+	state, err := m.getInstance(vmID)
+	if err != nil {
+		return err
+	}
+
+	if !state.isActive {
+		return &VMError{VMID: vmID, Err: ErrVMNotActive}
+	}
+
+	state.pauseMu.Lock()
+	defer state.pauseMu.Unlock()
+
+	if !state.paused {
+		return &VMError{VMID: vmID, Err: ErrVMNotPaused}
+	}
+
+	if state.quiesced != nil {
+		<-state.quiesced
+		state.quiesced = nil
+	}
+
+	state.paused = false
+	deferred := state.deferred
+	state.deferred = nil
+
+	logger.Debugf("Serving %d deferred page faults", len(deferred))
+
+	// the polling loop waits for the deferred page faults to be dispatched before the new ones
+	for _, req := range deferred {
+		if err := state.dispatch(req); err != nil {
+			state.reportError(fmt.Errorf("failed to serve page fault at 0x%x: %w", req.address, err))
+		}
+	}
+
+	return nil
+}
+
+// dispatchUnlessPaused Dispatches the request, or defers it if the VM is paused
+func (s *SnapshotState) dispatchUnlessPaused(req faultRequest) error {
+	s.pauseMu.Lock()
+	defer s.pauseMu.Unlock()
+
+	if s.paused {
+		s.deferred = append(s.deferred, req)
+		return nil
+	}
+
+	return s.dispatch(req)
+}
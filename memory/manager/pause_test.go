@@ -0,0 +1,138 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// waitDeferred Waits until the number of the deferred page faults of the paused VM reaches n
+func waitDeferred(t *testing.T, state *SnapshotState, n int) {
+	for i := 0; ; i++ {
+		state.pauseMu.Lock()
+		deferred := len(state.deferred)
+		state.pauseMu.Unlock()
+
+		if deferred >= n {
+			return
+		}
+		require.Less(t, i, 1000, "Page faults are not deferred")
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPauseResumeVM(t *testing.T) {
+	for _, workers := range []int{0, 2} {
+		t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+			var installs []installCall
+			defer stubInstallRegion(&installs)()
+
+			manager := newTestManager(t, MemoryManagerCfg{WorkerPoolSize: workers})
+			stateCfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+			stateCfg.IsLazyMode = true
+			require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+
+			err := manager.PauseVM("1")
+			require.True(t, errors.Is(err, ErrVMNotActive), "Inactive VM must not be paused")
+
+			state, vm := activateTestVM(t, manager, "1")
+
+			require.NoError(t, manager.PauseVM("1"), "Failed to pause VM")
+			err = manager.PauseVM("1")
+			require.True(t, errors.Is(err, ErrVMAlreadyPaused), "Paused VM must not be paused again")
+
+			vm.fault(t, testStartAddress)
+			vm.fault(t, testStartAddress+uint64(2*os.Getpagesize()))
+			waitDeferred(t, state, 2)
+			require.Empty(t, installs, "No pages must be installed while the VM is paused")
+
+			require.NoError(t, manager.ResumeVM("1"), "Failed to resume VM")
+			err = manager.ResumeVM("1")
+			require.True(t, errors.Is(err, ErrVMNotPaused), "Served VM must not be resumed")
+
+			// waits until the page faults are served
+			require.NoError(t, manager.Deactivate("1"), "Failed to deactivate VM")
+
+			require.Equal(t, []installCall{
+				{dst: testStartAddress, len: uint64(os.Getpagesize())},
+				{dst: testStartAddress + uint64(2*os.Getpagesize()), len: uint64(os.Getpagesize())},
+			}, installs, "Deferred page faults must be served in order upon resume")
+		})
+	}
+}
+
+func TestQuiesceVM(t *testing.T) {
+	installer, restore := stubBlockingInstallRegion()
+	defer restore()
+
+	manager := newTestManager(t, MemoryManagerCfg{WorkerPoolSize: 2})
+	stateCfg := prepareSnapshotStateCfg(t, "1", 8*os.Getpagesize())
+	stateCfg.IsLazyMode = true
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+
+	err := manager.QuiesceVM(context.Background(), "1")
+	require.True(t, errors.Is(err, ErrVMNotActive), "Inactive VM must not be quiesced")
+
+	state, vm := activateTestVM(t, manager, "1")
+	for page := 0; page < 4; page++ {
+		vm.fault(t, testStartAddress+uint64(page*os.Getpagesize()))
+	}
+	installer.waitStarted(t, 1)
+
+	// the installs in flight block the quiescing until they complete
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	err = manager.QuiesceVM(ctx, "1")
+	cancel()
+	require.True(t, errors.Is(err, context.DeadlineExceeded), "Quiescing must time out")
+
+	state.pauseMu.Lock()
+	require.True(t, state.paused, "VM must be left paused")
+	state.pauseMu.Unlock()
+
+	// the page faults arriving meanwhile are deferred
+	for page := 4; page < 8; page++ {
+		vm.fault(t, testStartAddress+uint64(page*os.Getpagesize()))
+	}
+
+	close(installer.release)
+	require.NoError(t, manager.QuiesceVM(context.Background(), "1"), "Failed to quiesce VM")
+
+	started := atomic.LoadInt64(&installer.started)
+	require.Equal(t, started, atomic.LoadInt64(&installer.completed), "Installs must complete before quiescing returns")
+
+	waitDeferred(t, state, 8-int(started))
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, started, atomic.LoadInt64(&installer.started), "No pages must be installed once the VM is quiesced")
+
+	require.NoError(t, manager.ResumeVM("1"), "Failed to resume VM")
+	waitServedPages(t, state, 8)
+	require.NoError(t, manager.Deactivate("1"), "Failed to deactivate VM")
+}
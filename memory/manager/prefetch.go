@@ -0,0 +1,146 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PrefetchPages Installs the pages of the active VM at the offsets of the guest memory file right away,
+// e.g., upon the hints of an agent in the guest about the pages it is about to touch, so that they do
+// not fault. The pages that have been served already are skipped, and in the record mode the installed
+// pages are recorded in the working set like the served ones. Returns the number of the installed pages,
+// none before the first page fault of the VM, which sets up the guest memory.
+func (m *MemoryManager) PrefetchPages(vmID string, offsets []uint64) (int, error) {
+	logger := log.WithFields(log.Fields{"vmID": vmID})
+
+	logger.Debug("Prefetching the pages of the VM")
+
+	state, err := m.getInstance(vmID)
+	if err != nil {
+		return 0, err
+	}
+
+	state.opMu.Lock()
+	defer state.opMu.Unlock()
+
+	if !state.isActive || state.userFaultFD == nil {
+		return 0, &VMError{VMID: vmID, Err: ErrVMNotActive}
+	}
+
+	for _, offset := range offsets {
+		if offset%uint64(state.PageSize) != 0 || offset >= uint64(state.GuestMemSize) {
+			return 0, &VMError{VMID: vmID, Err: fmt.Errorf(
+				"%w: offset %#x is not a page of the guest memory", ErrInvalidConfig, offset)}
+		}
+	}
+
+	n, err := state.prefetchPages(int(state.userFaultFD.Fd()), offsets)
+	if err != nil {
+		return n, &VMError{VMID: vmID, Err: err}
+	}
+
+	logger.Debugf("Prefetched %d pages", n)
+
+	return n, nil
+}
+
+// prefetchPages Installs the pages at the offsets that have not been served yet,
+// returns the number of the installed pages
+func (s *SnapshotState) prefetchPages(fd int, offsets []uint64) (int, error) {
+	if s.startAddress == 0 {
+		// the guest memory is set up upon the first page fault
+		return 0, nil
+	}
+
+	// no page fault is served meanwhile, see PauseVM
+	s.pauseMu.Lock()
+	defer s.pauseMu.Unlock()
+	s.inflightFaults.Wait()
+
+	pages := newPageBitmap(s.servedPages.Len())
+	for _, offset := range offsets {
+		if page := int(offset) / s.PageSize; !s.servedPages.Test(page) {
+			pages.Set(page)
+		}
+	}
+
+	mode := uint64(0)
+	if s.usesUFFDWriteProtect() {
+		mode |= uffdCopyModeWP()
+	}
+
+	var (
+		installed int
+		err       error
+	)
+	pages.runs(func(first, num int) bool {
+		for page := first; page < first+num; {
+			mem, _, n := s.clipToSource(page, page, first+num-page)
+			_, n = s.clipToRegion(page, page, n)
+
+			var run []byte
+			if s.sharedMem != nil {
+				var read int
+				run, read = s.sharedMem.fill(s.guestMem, page, n)
+				atomic.AddInt64(&s.backingReads, int64(read))
+			} else {
+				atomic.AddInt64(&s.backingReads, int64(n))
+				if run, err = s.readPages(mem, page, n); err != nil {
+					return false
+				}
+			}
+
+			src := uint64(uintptr(unsafe.Pointer(&run[0])))
+			err = s.installer.Copy(fd, src, s.pageAddress(page), mode, uint64(n*s.PageSize))
+			switch {
+			case errors.Is(err, errAlreadyPresent):
+				// pages of the run are present already
+				atomic.AddInt64(&s.alreadyPresent, int64(n))
+				err = nil
+			case err != nil:
+				return false
+			default:
+				atomic.AddInt64(&s.copyInstalls, int64(n))
+				installed += n
+			}
+
+			if !s.isRecordReady {
+				for p := page; p < page+n; p++ {
+					s.trace.AppendRecord(Record{offset: uint64(p * s.PageSize)})
+				}
+			}
+			atomic.AddInt64(&s.servedPagesNum, int64(s.servedPages.SetRange(page, n)))
+			page += n
+		}
+
+		return true
+	})
+
+	return installed, err
+}
@@ -0,0 +1,87 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"errors"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefetchPages(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	pageSize := uint64(os.Getpagesize())
+	manager := newTestManager(t, MemoryManagerCfg{})
+
+	stateCfg := prepareSnapshotStateCfg(t, "1", 8*os.Getpagesize())
+	stateCfg.IsLazyMode = true
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+
+	_, err := manager.PrefetchPages("1", []uint64{0})
+	require.True(t, errors.Is(err, ErrVMNotActive), "Pages of an inactive VM must not be prefetched")
+
+	state, vm := activateTestVM(t, manager, "1")
+	vm.fault(t, testStartAddress)
+	waitServedPages(t, state, 1)
+
+	_, err = manager.PrefetchPages("1", []uint64{pageSize + 1})
+	require.True(t, errors.Is(err, ErrInvalidConfig), "Unaligned offset must be rejected")
+	_, err = manager.PrefetchPages("1", []uint64{8 * pageSize})
+	require.True(t, errors.Is(err, ErrInvalidConfig), "Offset past the guest memory must be rejected")
+
+	// the first page has been served already
+	n, err := manager.PrefetchPages("1", []uint64{0, 3 * pageSize, 2 * pageSize, 6 * pageSize})
+	require.NoError(t, err, "Failed to prefetch pages")
+	require.Equal(t, 3, n, "Wrong number of prefetched pages")
+	require.Equal(t, []installCall{
+		{dst: testStartAddress, len: pageSize},
+		{dst: testStartAddress + 2*pageSize, len: 2 * pageSize},
+		{dst: testStartAddress + 6*pageSize, len: pageSize},
+	}, installs, "Prefetched pages must be installed in runs")
+	require.EqualValues(t, 4, atomic.LoadInt64(&state.servedPagesNum), "Prefetched pages must be marked as served")
+
+	n, err = manager.PrefetchPages("1", []uint64{2 * pageSize, 3 * pageSize})
+	require.NoError(t, err, "Failed to prefetch pages")
+	require.Zero(t, n, "Served pages must not be prefetched again")
+
+	// the prefetched pages never fault, and the page faults around them do not install them again
+	for _, page := range []uint64{1, 4, 5, 7} {
+		vm.fault(t, testStartAddress+page*pageSize)
+	}
+	waitServedPages(t, state, 8)
+	require.Len(t, installs, 7, "Every page must be installed once")
+	for _, install := range installs[3:] {
+		require.Equal(t, pageSize, install.len, "Page faults must install only the faulting pages")
+	}
+	for i := 0; atomic.LoadInt64(&state.faultsServed) < 5; i++ {
+		require.Less(t, i, 1000, "Page faults are not counted")
+		time.Sleep(time.Millisecond)
+	}
+	require.EqualValues(t, 5, atomic.LoadInt64(&state.faultsServed), "Prefetched pages must not fault")
+}
@@ -0,0 +1,112 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MemoryPressure Reports whether the node is under memory pressure, see MemoryManagerCfg.MemoryPressure
+type MemoryPressure interface {
+	UnderPressure() bool
+}
+
+// psiRefreshInterval is how long the memory pressure read from the PSI file is reused for
+const psiRefreshInterval = time.Second
+
+// psiPressure Reports memory pressure when the share of the time some tasks of the node were stalled
+// on memory over the last 10 seconds, the "some avg10" value of the PSI file, exceeds the threshold
+type psiPressure struct {
+	sync.Mutex
+	path      string
+	threshold float64
+	readAt    time.Time
+	pressure  bool
+}
+
+// NewPSIPressure Returns the memory pressure signal of the pressure stall information of the kernel,
+// which reports memory pressure when tasks were stalled on memory for more than threshold percent
+// of the last 10 seconds
+func NewPSIPressure(threshold float64) MemoryPressure {
+	return &psiPressure{path: "/proc/pressure/memory", threshold: threshold}
+}
+
+// UnderPressure Returns true if the node is under memory pressure, the PSI file is read
+// at most once per psiRefreshInterval. The node is assumed not to be under pressure
+// if the PSI file cannot be read.
+func (p *psiPressure) UnderPressure() bool {
+	p.Lock()
+	defer p.Unlock()
+
+	if now := time.Now(); now.Sub(p.readAt) >= psiRefreshInterval {
+		p.readAt = now
+		avg10, err := readPSIAvg10(p.path)
+		if err != nil {
+			log.Debugf("Failed to read the memory pressure: %v", err)
+		}
+		p.pressure = err == nil && avg10 > p.threshold
+	}
+
+	return p.pressure
+}
+
+// readPSIAvg10 Returns the avg10 value of the "some" line of the PSI file
+func readPSIAvg10(path string) (float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "some" {
+			continue
+		}
+		for _, field := range fields[1:] {
+			if value := strings.TrimPrefix(field, "avg10="); value != field {
+				return strconv.ParseFloat(value, 64)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	return 0, fmt.Errorf("no some avg10 value in %s", path)
+}
+
+// onDemand Returns true if the VM is to be served strictly on demand, without prefetching
+// or read-ahead, as the node is under memory pressure
+func (s *SnapshotState) onDemand() bool {
+	return s.pressure != nil && s.pressure.UnderPressure()
+}
@@ -0,0 +1,112 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakePressure Reports the memory pressure set by the test
+type fakePressure struct {
+	pressure int32
+}
+
+func (p *fakePressure) UnderPressure() bool {
+	return atomic.LoadInt32(&p.pressure) == 1
+}
+
+func (p *fakePressure) set(pressure bool) {
+	if pressure {
+		atomic.StoreInt32(&p.pressure, 1)
+	} else {
+		atomic.StoreInt32(&p.pressure, 0)
+	}
+}
+
+func TestMemoryPressureFetchState(t *testing.T) {
+	pressure := new(fakePressure)
+	manager := newTestManager(t, MemoryManagerCfg{MemoryPressure: pressure})
+
+	pageSize := uint64(os.Getpagesize())
+	stateCfg := prepareSnapshotStateCfg(t, "1", 4*int(pageSize))
+	persistRecord(t, stateCfg, []uint64{0, 2 * pageSize})
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+
+	pressure.set(true)
+	pages, err := manager.FetchState("1")
+	require.NoError(t, err, "Failed to fetch state")
+	require.Zero(t, pages, "No pages must be prefetched under memory pressure")
+	require.Nil(t, manager.instances["1"].workingSet, "Working set must not be fetched under memory pressure")
+
+	var out bytes.Buffer
+	require.NoError(t, manager.WriteMetrics(&out), "Failed to write the metrics")
+	require.Contains(t, out.String(), "vhive_memory_manager_on_demand_mode 1")
+
+	pressure.set(false)
+	pages, err = manager.FetchState("1")
+	require.NoError(t, err, "Failed to fetch state")
+	require.Equal(t, 2, pages, "Working set must be prefetched without memory pressure")
+
+	out.Reset()
+	require.NoError(t, manager.WriteMetrics(&out), "Failed to write the metrics")
+	require.Contains(t, out.String(), "vhive_memory_manager_on_demand_mode 0")
+}
+
+func TestMemoryPressureReadAhead(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	pressure := new(fakePressure)
+	pageSize := uint64(os.Getpagesize())
+
+	state := newTestSnapshotState(8, 4)
+	state.pressure = pressure
+
+	pressure.set(true)
+	require.NoError(t, state.servePageFault(-1, testStartAddress+pageSize), "Failed to serve page fault")
+	require.Equal(t, []installCall{{dst: testStartAddress + pageSize, len: pageSize}}, installs,
+		"Only the faulting page must be installed under memory pressure")
+
+	pressure.set(false)
+	require.NoError(t, state.servePageFault(-1, testStartAddress+5*pageSize), "Failed to serve page fault")
+	require.Equal(t, installCall{dst: testStartAddress + 4*pageSize, len: 4 * pageSize}, installs[1],
+		"Chunk of the faulting page must be installed without memory pressure")
+}
+
+func TestPSIPressure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "memory")
+	psi := "some avg10=12.50 avg60=3.00 avg300=1.00 total=123\nfull avg10=1.00 avg60=0.00 avg300=0.00 total=12\n"
+	require.NoError(t, ioutil.WriteFile(path, []byte(psi), 0644), "Failed to write the PSI file")
+
+	require.True(t, (&psiPressure{path: path, threshold: 10}).UnderPressure(), "Stalls above the threshold are pressure")
+	require.False(t, (&psiPressure{path: path, threshold: 20}).UnderPressure(), "Stalls below the threshold are no pressure")
+	require.False(t, (&psiPressure{path: path + ".missing", threshold: 0}).UnderPressure(),
+		"Unreadable PSI file must not report pressure")
+}
@@ -0,0 +1,188 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const metricsNamespace = "vhive_memory_manager"
+
+// vmStats A point-in-time copy of the counters of a VM
+type vmStats struct {
+	vmID               string
+	faultsServed       int64
+	pagesInstalled     int64
+	serveTime          time.Duration
+	workingSetInstalls int64
+	workingSetMisses   int64
+	alreadyPresent     int64
+	numaNode           int // -1 unless the VM is placed on a NUMA node
+	readAheadWindow    int // -1 unless the read-ahead is adaptive
+}
+
+func (s *SnapshotState) getStats() vmStats {
+	numaNode := -1
+	if s.NUMAPlacement {
+		numaNode = s.NUMANode
+	}
+	readAheadWindow := -1
+	if s.readAhead != nil {
+		readAheadWindow = s.readAhead.current()
+	}
+
+	return vmStats{
+		vmID:         s.VMID,
+		faultsServed: atomic.LoadInt64(&s.faultsServed),
+		pagesInstalled: atomic.LoadInt64(&s.zeroInstalls) + atomic.LoadInt64(&s.copyInstalls) +
+			atomic.LoadInt64(&s.workingSetInstalls) + atomic.LoadInt64(&s.minorFaults),
+		serveTime:          time.Duration(atomic.LoadInt64(&s.serveTimeNs)),
+		workingSetInstalls: atomic.LoadInt64(&s.workingSetInstalls),
+		workingSetMisses:   atomic.LoadInt64(&s.workingSetMisses),
+		alreadyPresent:     atomic.LoadInt64(&s.alreadyPresent),
+		numaNode:           numaNode,
+		readAheadWindow:    readAheadWindow,
+	}
+}
+
+// collectStats Returns the counters of all registered VMs sorted by vmID
+func (m *MemoryManager) collectStats() []vmStats {
+	m.Lock()
+	stats := make([]vmStats, 0, len(m.instances))
+	for _, state := range m.instances {
+		stats = append(stats, state.getStats())
+	}
+	m.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].vmID < stats[j].vmID })
+
+	return stats
+}
+
+// MetricsHandler Returns an HTTP handler that exports the metrics of the registered VMs
+// in the Prometheus text exposition format. All metrics carry the vmID label:
+//
+//	vhive_memory_manager_page_faults_served_total           counter
+//	vhive_memory_manager_pages_installed_total              counter
+//	vhive_memory_manager_pages_already_present_total        counter
+//	vhive_memory_manager_working_set_hit_ratio              gauge, replay mode only
+//	vhive_memory_manager_page_fault_serve_latency_seconds   gauge, average
+//	vhive_memory_manager_numa_node                          gauge, VMs placed on a NUMA node only
+//	vhive_memory_manager_read_ahead_window_pages            gauge, adaptive read-ahead only
+//
+// along with vhive_memory_manager_on_demand_mode, a gauge without labels that is 1 while the node
+// is under memory pressure, if MemoryManagerCfg.MemoryPressure is set.
+func (m *MemoryManager) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := m.WriteMetrics(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// WriteMetrics Writes the metrics of the registered VMs in the Prometheus text exposition format
+func (m *MemoryManager) WriteMetrics(w io.Writer) error {
+	stats := m.collectStats()
+
+	families := []struct {
+		name, help, kind string
+		value            func(vmStats) (float64, bool)
+	}{
+		{
+			"page_faults_served_total", "Number of page faults served.", "counter",
+			func(s vmStats) (float64, bool) { return float64(s.faultsServed), true },
+		},
+		{
+			"pages_installed_total", "Number of guest memory pages installed.", "counter",
+			func(s vmStats) (float64, bool) { return float64(s.pagesInstalled), true },
+		},
+		{
+			"pages_already_present_total", "Number of pages found present already upon installation.", "counter",
+			func(s vmStats) (float64, bool) { return float64(s.alreadyPresent), true },
+		},
+		{
+			"working_set_hit_ratio", "Fraction of pages installed from the working set in replay mode.", "gauge",
+			func(s vmStats) (float64, bool) {
+				total := s.workingSetInstalls + s.workingSetMisses
+				if total == 0 {
+					return 0, false
+				}
+				return float64(s.workingSetInstalls) / float64(total), true
+			},
+		},
+		{
+			"page_fault_serve_latency_seconds", "Average time to serve a page fault.", "gauge",
+			func(s vmStats) (float64, bool) {
+				if s.faultsServed == 0 {
+					return 0, false
+				}
+				return s.serveTime.Seconds() / float64(s.faultsServed), true
+			},
+		},
+		{
+			"numa_node", "NUMA node the pages of the VM are placed on.", "gauge",
+			func(s vmStats) (float64, bool) { return float64(s.numaNode), s.numaNode >= 0 },
+		},
+		{
+			"read_ahead_window_pages", "Current window of the adaptive read-ahead in pages.", "gauge",
+			func(s vmStats) (float64, bool) { return float64(s.readAheadWindow), s.readAheadWindow >= 0 },
+		},
+	}
+
+	for _, f := range families {
+		name := metricsNamespace + "_" + f.name
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, f.help, name, f.kind); err != nil {
+			return err
+		}
+
+		for _, s := range stats {
+			value, ok := f.value(s)
+			if !ok {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "%s{vmID=%q} %g\n", name, s.vmID, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	if m.MemoryPressure != nil {
+		onDemand := 0
+		if m.MemoryPressure.UnderPressure() {
+			onDemand = 1
+		}
+		name := metricsNamespace + "_on_demand_mode"
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name,
+			"Whether the VMs are served on demand only as the node is under memory pressure.", name, name, onDemand); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	manager := newTestManager(t, MemoryManagerCfg{})
+
+	for _, vmID := range []string{"1", "2"} {
+		state := newTestSnapshotState(4, 1)
+		state.VMID = vmID
+		manager.instances[vmID] = state
+	}
+
+	for page := uint64(0); page < 3; page++ {
+		err := manager.instances["1"].servePageFault(-1, testStartAddress+page*uint64(os.Getpagesize()))
+		require.NoError(t, err, "Failed to serve page fault")
+	}
+
+	var buf bytes.Buffer
+	err := manager.WriteMetrics(&buf)
+	require.NoError(t, err, "Failed to write metrics")
+
+	out := buf.String()
+	require.Contains(t, out, "# TYPE vhive_memory_manager_page_faults_served_total counter")
+	require.Contains(t, out, `vhive_memory_manager_page_faults_served_total{vmID="1"} 3`)
+	require.Contains(t, out, `vhive_memory_manager_page_faults_served_total{vmID="2"} 0`)
+	require.Contains(t, out, `vhive_memory_manager_pages_installed_total{vmID="1"} 3`)
+	require.Contains(t, out, `vhive_memory_manager_page_fault_serve_latency_seconds{vmID="1"}`)
+	require.NotContains(t, out, `vhive_memory_manager_working_set_hit_ratio{vmID="1"}`,
+		"Hit ratio is only exported in replay mode")
+}
@@ -0,0 +1,75 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter Token bucket that limits the rate of the pages installed upon the page faults
+// of a VM. The pages beyond the rate are delayed rather than dropped: every install takes its
+// tokens right away, going into debt if needed, and waits until the debt is paid off.
+type rateLimiter struct {
+	sync.Mutex
+	rate   float64 // tokens, i.e., pages, per second
+	burst  float64 // tokens accumulated while idle, a tenth of a second worth of pages
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(pagesPerSec int) *rateLimiter {
+	l := new(rateLimiter)
+	l.rate = float64(pagesPerSec)
+	l.burst = l.rate / 10
+	if l.burst < 1 {
+		l.burst = 1
+	}
+	l.tokens = l.burst
+	l.last = time.Now()
+
+	return l
+}
+
+// wait Blocks until the pages can be installed at the rate, returns how long it blocked
+func (l *rateLimiter) wait(pages int) time.Duration {
+	l.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(pages)
+	tokens := l.tokens
+	l.Unlock()
+
+	if tokens >= 0 {
+		return 0
+	}
+
+	delay := time.Duration(-tokens / l.rate * float64(time.Second))
+	time.Sleep(delay)
+
+	return delay
+}
@@ -0,0 +1,96 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiterBurst(t *testing.T) {
+	l := newRateLimiter(100)
+
+	require.Zero(t, l.wait(10), "Burst must not be delayed")
+	delay := l.wait(5)
+	require.Greater(t, int64(delay), int64(40*time.Millisecond), "Pages beyond the burst must be delayed")
+	require.Less(t, int64(delay), int64(60*time.Millisecond), "Pages must be delayed by their tokens only")
+}
+
+func TestFaultRateLimit(t *testing.T) {
+	const (
+		pages = 150
+		limit = 500
+	)
+
+	var (
+		mu       sync.Mutex
+		installs []time.Time
+	)
+	installer, restore := stubInstaller()
+	defer restore()
+	installer.copy = func(fd int, src, dst, mode, len uint64) error {
+		mu.Lock()
+		installs = append(installs, time.Now())
+		mu.Unlock()
+		return nil
+	}
+
+	manager := newTestManager(t, MemoryManagerCfg{})
+	cfg := prepareSnapshotStateCfg(t, "vm", pages*os.Getpagesize())
+	cfg.IsLazyMode = true
+	cfg.FaultRateLimit = limit
+	require.NoError(t, manager.RegisterVM(cfg), "Failed to register VM")
+
+	state, vm := activateTestVM(t, manager, "vm")
+	defer state.stopPolling()
+
+	// the guest scans its memory as fast as the faults are fed
+	tStart := time.Now()
+	for page := 0; page < pages; page++ {
+		vm.fault(t, testStartAddress+uint64(page*os.Getpagesize()))
+	}
+	waitServedPages(t, state, pages)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, installs, pages, "Throttled page faults must not be dropped")
+
+	burst := limit / 10
+	elapsed := installs[pages-1].Sub(tStart)
+	require.GreaterOrEqual(t, elapsed.Seconds(), float64(pages-burst)/limit,
+		"Install rate must stay under the limit")
+}
+
+func TestFaultRateLimitValidation(t *testing.T) {
+	cfg := prepareSnapshotStateCfg(t, "vm", os.Getpagesize())
+	cfg.IsLazyMode = true
+	cfg.FaultRateLimit = -1
+
+	err := newTestManager(t, MemoryManagerCfg{}).RegisterVM(cfg)
+	require.True(t, errors.Is(err, ErrInvalidConfig), "Negative rate limit must be rejected")
+}
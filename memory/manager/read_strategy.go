@@ -0,0 +1,122 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ReadStrategy How the pages are read from the guest memory file
+type ReadStrategy string
+
+const (
+	// MmapRead Maps the whole guest memory file upon activation and installs the pages
+	// from the mapping
+	MmapRead ReadStrategy = ""
+	// PreadRead Reads the pages of every install from the guest memory file with pread,
+	// which avoids mapping the file at the cost of a copy per install
+	PreadRead ReadStrategy = "pread"
+	// CompressedRead Decompresses the pages of every install from the guest memory file,
+	// which is written by CompressGuestMemory, in lazy mode only
+	CompressedRead ReadStrategy = "compressed"
+	// WindowedRead Maps the guest memory file in windows of WindowSize bytes upon the page faults
+	// and installs the pages from them, which bounds the virtual memory reserved for large guests
+	WindowedRead ReadStrategy = "windowed"
+)
+
+func (r ReadStrategy) isValid() bool {
+	return r == MmapRead || r == PreadRead || r == CompressedRead || r == WindowedRead
+}
+
+// guestMemReader Reads the guest memory without mapping it
+type guestMemReader interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// readPages Returns the contents of the pages [first, first+num) of the memory returned
+// by clipToSource, which are read or decompressed from the guest memory file if it is not mapped
+func (s *SnapshotState) readPages(mem []byte, first, num int) ([]byte, error) {
+	start, end := first*s.PageSize, (first+num)*s.PageSize
+	if mem != nil || s.guestMemFile == nil {
+		return mem[start:end], nil
+	}
+
+	buf := make([]byte, end-start)
+	if err := s.readGuestMemFile(buf, int64(start)); err != nil {
+		logger := log.WithFields(log.Fields{"vmID": s.VMID})
+		var errno syscall.Errno
+		if errors.As(err, &errno) {
+			logger = logger.WithField("errno", int(errno))
+		}
+		logger.Errorf("Failed to read pages %d-%d of the guest memory file: %v", first, first+num-1, err)
+
+		return nil, fmt.Errorf("%w: pages %d-%d: %v", ErrGuestMemRead, first, first+num-1, err)
+	}
+
+	return buf, nil
+}
+
+// readGuestMemFile Reads the guest memory file into buf, giving up after FaultReadTimeout if it is set.
+// The read that timed out is left running, so buf must not be reused.
+func (s *SnapshotState) readGuestMemFile(buf []byte, off int64) error {
+	if s.FaultReadTimeout <= 0 {
+		_, err := s.guestMemFile.ReadAt(buf, off)
+		return err
+	}
+
+	f := s.guestMemFile
+	done := make(chan error, 1)
+	go func() {
+		_, err := f.ReadAt(buf, off)
+		done <- err
+	}()
+
+	timer := time.NewTimer(s.FaultReadTimeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("timed out after %v", s.FaultReadTimeout)
+	}
+}
+
+// guestMemoryFileChecksum Returns the checksum of the guest memory read without mapping it
+func guestMemoryFileChecksum(f io.ReaderAt, size int) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, int64(size))); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,233 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/require"
+)
+
+// stubCopyingInstallRegion Records the contents of the installed regions by the destination
+// address, returns the function that restores the real implementation
+func stubCopyingInstallRegion(contents map[uint64][]byte) func() {
+	installer, restore := stubInstaller()
+	installer.copy = func(fd int, src, dst, mode, len uint64) error {
+		mem := (*[1 << 30]byte)(*(*unsafe.Pointer)(unsafe.Pointer(&src)))
+		contents[dst] = append([]byte(nil), mem[:len]...)
+		return nil
+	}
+	installer.zeroPage = func(fd int, dst, mode, len uint64) error {
+		contents[dst] = make([]byte, len)
+		return nil
+	}
+
+	return restore
+}
+
+// registerReadStrategyVM Registers a VM that reads the guest memory with the strategy
+// and maps its guest memory as if it was activated
+func registerReadStrategyVM(t testing.TB, m *MemoryManager, vmID string, pages int, strategy ReadStrategy) *SnapshotState {
+	cfg := prepareSnapshotStateCfg(t, vmID, pages*os.Getpagesize())
+	cfg.IsLazyMode = true
+	cfg.ReadStrategy = strategy
+	require.NoError(t, m.RegisterVM(cfg), "Failed to register VM")
+
+	state := m.instances[vmID]
+	require.NoError(t, state.mapGuestMemory(context.Background()), "Failed to map guest memory")
+	state.setupStateOnActivate()
+	state.firstPageFaultOnce.Do(func() { state.startAddress = testStartAddress })
+
+	return state
+}
+
+func TestReadStrategiesInstallSameContents(t *testing.T) {
+	const pages = 16
+
+	pageSize := os.Getpagesize()
+	manager := newTestManager(t, MemoryManagerCfg{InstallChunkPages: 4})
+
+	contents := make(map[ReadStrategy]map[uint64][]byte)
+	for _, strategy := range []ReadStrategy{MmapRead, PreadRead} {
+		contents[strategy] = make(map[uint64][]byte)
+		restore := stubCopyingInstallRegion(contents[strategy])
+
+		state := registerReadStrategyVM(t, manager, "vm-"+string(strategy), pages, strategy)
+		if strategy == PreadRead {
+			require.Nil(t, state.guestMem, "Guest memory must not be mapped")
+			require.NotNil(t, state.guestMemFile, "Guest memory file must be open")
+		}
+
+		for _, page := range []int{5, 0, 13, 9, 2} {
+			err := state.servePageFault(-1, testStartAddress+uint64(page*pageSize))
+			require.NoError(t, err, "Failed to serve page fault")
+		}
+		require.EqualValues(t, 4*4, state.servedPagesNum, "Wrong number of served pages")
+
+		require.NoError(t, state.unmapGuestMemory(), "Failed to unmap guest memory")
+		require.Nil(t, state.guestMemFile, "Guest memory file must be closed")
+		restore()
+	}
+
+	require.Equal(t, contents[MmapRead], contents[PreadRead], "Read strategies must install the same contents")
+	for dst, content := range contents[PreadRead] {
+		page := int(dst-testStartAddress) / pageSize
+		for i := 0; i < len(content); i += pageSize {
+			require.Equal(t, byte(48+page+i/pageSize), content[i], "Wrong contents of the installed page")
+		}
+	}
+}
+
+func TestReadStrategyChecksum(t *testing.T) {
+	const pages = 4
+
+	manager := newTestManager(t, MemoryManagerCfg{})
+
+	cfg := prepareSnapshotStateCfg(t, "vm", pages*os.Getpagesize())
+	cfg.IsLazyMode = true
+	cfg.ReadStrategy = PreadRead
+	checksum, err := GuestMemoryChecksum(cfg.GuestMemPath)
+	require.NoError(t, err, "Failed to compute the checksum")
+
+	cfg.GuestMemChecksum = checksum
+	require.NoError(t, manager.RegisterVM(cfg), "Failed to register VM")
+	require.NoError(t, manager.instances["vm"].mapGuestMemory(context.Background()), "Checksum must match")
+	require.NoError(t, manager.instances["vm"].unmapGuestMemory(), "Failed to unmap guest memory")
+
+	cfg.VMID, cfg.GuestMemChecksum = "corrupt", "00"
+	require.NoError(t, manager.RegisterVM(cfg), "Failed to register VM")
+	err = manager.instances["corrupt"].mapGuestMemory(context.Background())
+	require.Error(t, err, "Checksum must not match")
+	require.Contains(t, err.Error(), "is corrupt")
+	require.Nil(t, manager.instances["corrupt"].guestMemFile, "Guest memory file must be closed")
+}
+
+func TestReadStrategyValidation(t *testing.T) {
+	cfg := prepareSnapshotStateCfg(t, "vm", os.Getpagesize())
+	cfg.IsLazyMode = true
+
+	cfg.ReadStrategy = "direct"
+	err := newTestManager(t, MemoryManagerCfg{}).RegisterVM(cfg)
+	require.True(t, errors.Is(err, ErrInvalidConfig), "Unknown read strategy must be rejected")
+
+	cfg.ReadStrategy = PreadRead
+	err = newTestManager(t, MemoryManagerCfg{Backend: PreloadBackend}).RegisterVM(cfg)
+	require.True(t, errors.Is(err, ErrInvalidConfig), "Preloading must be rejected")
+
+	cfg.BaseSnapshotID = "snap"
+	err = newTestManager(t, MemoryManagerCfg{SharePages: true}).RegisterVM(cfg)
+	require.True(t, errors.Is(err, ErrInvalidConfig), "Shared pages must be rejected")
+}
+
+func BenchmarkReadStrategies(b *testing.B) {
+	const pages = 256
+
+	_, restore := stubInstaller()
+	defer restore()
+
+	for name, strategy := range map[string]ReadStrategy{"mmap": MmapRead, "pread": PreadRead} {
+		strategy := strategy
+		b.Run(name, func(b *testing.B) {
+			manager := newTestManager(b, MemoryManagerCfg{})
+			state := registerReadStrategyVM(b, manager, "vm", pages, strategy)
+			defer func() { _ = state.unmapGuestMemory() }()
+
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				b.StopTimer()
+				state.servedPages = newPageBitmap(pages)
+				b.StartTimer()
+
+				for page := 0; page < pages; page++ {
+					_ = state.servePageFault(-1, testStartAddress+uint64(page*os.Getpagesize()))
+				}
+			}
+		})
+	}
+}
+
+// flakyReader Stands in for a guest memory file on a network filesystem that stalls or fails
+type flakyReader struct {
+	delay time.Duration
+	err   error
+}
+
+func (r flakyReader) ReadAt(p []byte, off int64) (int, error) {
+	time.Sleep(r.delay)
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	return len(p), nil
+}
+
+func (r flakyReader) Close() error {
+	return nil
+}
+
+func TestFaultReadErrors(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	eio := &os.PathError{Op: "read", Path: "mem_file", Err: syscall.EIO}
+	for name, reader := range map[string]flakyReader{
+		"stall": {delay: time.Minute},
+		"eio":   {err: eio},
+	} {
+		state := newTestSnapshotState(4, 1)
+		state.guestMem = nil
+		state.guestMemFile = reader
+		state.FaultReadTimeout = 10 * time.Millisecond
+
+		tStart := time.Now()
+		err := state.servePageFault(-1, testStartAddress)
+		require.True(t, errors.Is(err, ErrGuestMemRead), "Read failure must be reported: "+name)
+		require.Less(t, int64(time.Since(tStart)), int64(time.Second), "Read must not block the fault: "+name)
+		require.Empty(t, installs, "No page must be installed: "+name)
+		require.Zero(t, state.servedPagesNum, "No page must be served: "+name)
+
+		if reader.err != nil {
+			require.True(t, strings.Contains(err.Error(), syscall.EIO.Error()), "Errno must be reported")
+		}
+	}
+}
+
+func TestRegisterVMFaultReadTimeout(t *testing.T) {
+	manager := newTestManager(t, MemoryManagerCfg{})
+
+	cfg := prepareSnapshotStateCfg(t, "vm", 4*os.Getpagesize())
+	cfg.IsLazyMode = true
+	cfg.FaultReadTimeout = time.Second
+	err := manager.RegisterVM(cfg)
+	require.True(t, errors.Is(err, ErrInvalidConfig), "Reads of the mapped guest memory cannot time out")
+
+	cfg.ReadStrategy = PreadRead
+	require.NoError(t, manager.RegisterVM(cfg), "Failed to register VM")
+}
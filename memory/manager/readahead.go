@@ -0,0 +1,87 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"sync/atomic"
+)
+
+// defaultMaxReadAheadPages is the maximum window of the adaptive read-ahead if ReadAheadPages is unset
+const defaultMaxReadAheadPages = 32
+
+// adaptiveReadAhead Sizes the read-ahead of the page faults of a VM like the readahead of Linux does:
+// the window doubles, up to the maximum, upon every page fault on the page right past the run
+// installed upon the previous page fault, and is halved upon every other page fault
+type adaptiveReadAhead struct {
+	max      int
+	window   int64 // in pages, set atomically since it is exported in the metrics
+	nextPage int   // page right past the run installed upon the previous page fault
+}
+
+func newAdaptiveReadAhead(max int) *adaptiveReadAhead {
+	if max <= 0 {
+		max = defaultMaxReadAheadPages
+	}
+
+	r := &adaptiveReadAhead{max: max}
+	r.reset()
+
+	return r
+}
+
+// reset Shrinks the window to no read-ahead, e.g., upon the activation of the VM
+func (r *adaptiveReadAhead) reset() {
+	atomic.StoreInt64(&r.window, 0)
+	r.nextPage = -1
+}
+
+// next Returns the read-ahead window for the page fault on the page
+func (r *adaptiveReadAhead) next(page int) int {
+	window := int(atomic.LoadInt64(&r.window))
+
+	if page == r.nextPage {
+		window *= 2
+		if window == 0 {
+			window = 1
+		}
+		if window > r.max {
+			window = r.max
+		}
+	} else {
+		window /= 2
+	}
+
+	atomic.StoreInt64(&r.window, int64(window))
+
+	return window
+}
+
+// installed Records the end of the run that is installed upon the page fault
+func (r *adaptiveReadAhead) installed(end int) {
+	r.nextPage = end
+}
+
+// current Returns the current window in pages
+func (r *adaptiveReadAhead) current() int {
+	return int(atomic.LoadInt64(&r.window))
+}
@@ -0,0 +1,92 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// serveReadAheadFaults Serves the page faults on the pages in turn, returns the read-ahead
+// window used by every fault and the number of the pages installed upon it
+func serveReadAheadFaults(t *testing.T, state *SnapshotState, installs *[]installCall,
+	pages []int) (windows, installed []int) {
+	for _, page := range pages {
+		n := len(*installs)
+		err := state.servePageFault(-1, testStartAddress+uint64(page*os.Getpagesize()))
+		require.NoError(t, err, "Failed to serve page fault")
+		require.Len(t, *installs, n+1, "Every page fault must install a run")
+
+		windows = append(windows, state.readAhead.current())
+		installed = append(installed, int((*installs)[n].len)/os.Getpagesize())
+	}
+
+	return windows, installed
+}
+
+func TestAdaptiveReadAheadSequential(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	state := newTestSnapshotState(128, 1)
+	state.readAhead = newAdaptiveReadAhead(16)
+
+	// every page fault lands right past the pages installed upon the previous one
+	windows, installed := serveReadAheadFaults(t, state, &installs, []int{0, 1, 3, 6, 11, 20, 37, 54})
+	require.Equal(t, []int{0, 1, 2, 4, 8, 16, 16, 16}, windows, "Window must double up to the maximum")
+	require.Equal(t, []int{1, 2, 3, 5, 9, 17, 17, 17}, installed, "Window pages must be installed past the fault")
+}
+
+func TestAdaptiveReadAheadRandom(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	state := newTestSnapshotState(128, 1)
+	state.readAhead = newAdaptiveReadAhead(16)
+
+	windows, _ := serveReadAheadFaults(t, state, &installs, []int{40, 3, 97, 25, 64, 10, 120, 77})
+	for _, window := range windows {
+		require.Zero(t, window, "Window must stay small upon random access")
+	}
+
+	// a random page fault shrinks the window grown by a sequential stream
+	windows, _ = serveReadAheadFaults(t, state, &installs, []int{78, 80, 83, 88, 50, 30})
+	require.Equal(t, []int{1, 2, 4, 8, 4, 2}, windows, "Window must be halved upon random access")
+}
+
+func TestAdaptiveReadAheadMetrics(t *testing.T) {
+	manager := newTestManager(t, MemoryManagerCfg{AdaptiveReadAhead: true})
+	cfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+	cfg.IsLazyMode = true
+	require.NoError(t, manager.RegisterVM(cfg), "Failed to register VM")
+	require.Equal(t, defaultMaxReadAheadPages, manager.instances["1"].readAhead.max, "Wrong default maximum window")
+
+	var out bytes.Buffer
+	require.NoError(t, manager.WriteMetrics(&out), "Failed to write the metrics")
+	require.True(t, strings.Contains(out.String(), `vhive_memory_manager_read_ahead_window_pages{vmID="1"} 0`),
+		"Window must be exported")
+}
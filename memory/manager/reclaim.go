@@ -0,0 +1,211 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// maxIovecs is UIO_MAXIOV, the maximum number of the ranges advised by a process_madvise call
+const maxIovecs = 1024
+
+// dropPagesFunc drops the pages of the VM, stubbed out in the tests
+var dropPagesFunc = dropPages
+
+// remoteIovec A range of the address space of another process, laid out as struct iovec
+type remoteIovec struct {
+	base, len uint64
+}
+
+// peerPid Returns the pid of the process at the other end of the socket, 0 if it is unknown
+func peerPid(c *net.UnixConn) int {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return 0
+	}
+
+	var cred *syscall.Ucred
+	if err := raw.Control(func(fd uintptr) {
+		cred, _ = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil || cred == nil {
+		return 0
+	}
+
+	return int(cred.Pid)
+}
+
+// dropPages Drops the ranges of the address space of the process with MADV_DONTNEED,
+// after which its accesses to them fault as the accesses to missing pages
+func dropPages(pid int, iovs []remoteIovec) error {
+	pidfd, _, errno := syscall.Syscall(unix.SYS_PIDFD_OPEN, uintptr(pid), 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("pidfd_open: %w", errno)
+	}
+	defer syscall.Close(int(pidfd))
+
+	for len(iovs) > 0 {
+		n := len(iovs)
+		if n > maxIovecs {
+			n = maxIovecs
+		}
+
+		var size uint64
+		for _, iov := range iovs[:n] {
+			size += iov.len
+		}
+
+		advised, _, errno := syscall.Syscall6(unix.SYS_PROCESS_MADVISE, pidfd, uintptr(unsafe.Pointer(&iovs[0])),
+			uintptr(n), syscall.MADV_DONTNEED, 0, 0)
+		if errno != 0 {
+			return fmt.Errorf("process_madvise: %w", errno)
+		}
+		if uint64(advised) != size {
+			return fmt.Errorf("process_madvise: advised %d of %d bytes", advised, size)
+		}
+
+		iovs = iovs[n:]
+	}
+
+	return nil
+}
+
+// ReclaimPages Drops the installed pages of the active VM at the offsets of the guest memory file, or all
+// of its installed pages if offsets is nil, so that the kernel can reclaim them. The dropped pages
+// fault and are served again upon their next access. The VM must be in the write-protect mode,
+// since the pages written by the guest are kept: dropping them would lose the writes.
+// Returns the number of the dropped pages, or ErrUnsupported if the kernel does not accept
+// MADV_DONTNEED from process_madvise for the pages of the VM.
+func (m *MemoryManager) ReclaimPages(vmID string, offsets []uint64) (int, error) {
+	logger := log.WithFields(log.Fields{"vmID": vmID})
+
+	logger.Debug("Reclaiming the installed pages of the VM")
+
+	state, err := m.getInstance(vmID)
+	if err != nil {
+		return 0, err
+	}
+
+	state.opMu.Lock()
+	defer state.opMu.Unlock()
+
+	if !state.isActive {
+		return 0, &VMError{VMID: vmID, Err: ErrVMNotActive}
+	}
+	if !state.WriteProtect {
+		return 0, &VMError{VMID: vmID, Err: ErrNotWriteProtected}
+	}
+
+	for _, offset := range offsets {
+		if offset%uint64(state.PageSize) != 0 || offset >= uint64(state.GuestMemSize) {
+			return 0, &VMError{VMID: vmID, Err: fmt.Errorf(
+				"%w: offset %#x is not a page of the guest memory", ErrInvalidConfig, offset)}
+		}
+	}
+
+	n, err := state.reclaimPages(offsets)
+	if err != nil {
+		return 0, &VMError{VMID: vmID, Err: err}
+	}
+
+	logger.Debugf("Reclaimed %d pages", n)
+
+	return n, nil
+}
+
+// reclaimPages Drops the installed pages at the offsets, or all of them if offsets is nil,
+// except for the dirty ones, and marks them as not served
+func (s *SnapshotState) reclaimPages(offsets []uint64) (int, error) {
+	if s.startAddress == 0 {
+		// no page has been installed yet
+		return 0, nil
+	}
+	if s.vmPid == 0 {
+		return 0, fmt.Errorf("%w: the pid of the VM is unknown", ErrUnsupported)
+	}
+
+	// no page fault is served meanwhile, see PauseVM
+	s.pauseMu.Lock()
+	defer s.pauseMu.Unlock()
+	s.inflightFaults.Wait()
+
+	s.dirtyMu.Lock()
+	defer s.dirtyMu.Unlock()
+
+	if s.softDirty {
+		if err := s.collectSoftDirty(); err != nil {
+			return 0, err
+		}
+	}
+
+	pages := newPageBitmap(s.servedPages.Len())
+	if offsets == nil {
+		pages.SetRange(0, pages.Len())
+	}
+	for _, offset := range offsets {
+		pages.Set(int(offset) / s.PageSize)
+	}
+	for page := 0; page < pages.Len(); page++ {
+		if !s.servedPages.Test(page) || s.dirtyPages.Test(page) {
+			pages.Clear(page)
+		}
+	}
+
+	// a run of the pages may span several guest memory regions
+	var iovs []remoteIovec
+	pages.runs(func(first, num int) bool {
+		for page := first; page < first+num; {
+			_, n := s.clipToRegion(page, page, first+num-page)
+			iovs = append(iovs, remoteIovec{base: s.pageAddress(page), len: uint64(n * s.PageSize)})
+			page += n
+		}
+		return true
+	})
+	if len(iovs) == 0 {
+		return 0, nil
+	}
+
+	if err := dropPagesFunc(s.vmPid, iovs); err != nil {
+		if errors.Is(err, syscall.EINVAL) {
+			// the kernel may not accept MADV_DONTNEED for the pages of other processes
+			return 0, fmt.Errorf("%w: %v", ErrUnsupported, err)
+		}
+		return 0, fmt.Errorf("failed to drop the pages: %w", err)
+	}
+
+	var dropped int
+	pages.runs(func(first, num int) bool {
+		dropped += s.servedPages.ClearRange(first, num)
+		return true
+	})
+	atomic.AddInt64(&s.servedPagesNum, -int64(dropped))
+
+	return dropped, nil
+}
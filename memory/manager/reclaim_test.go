@@ -0,0 +1,129 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/require"
+)
+
+// waitDirtyPages Waits until the number of the dirty pages of the VM reaches n
+func waitDirtyPages(t *testing.T, state *SnapshotState, n int) {
+	for i := 0; len(state.dirtyOffsets()) < n; i++ {
+		require.Less(t, i, 1000, "Write-protect faults are not served")
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReclaimPages(t *testing.T) {
+	var (
+		installs              []installCall
+		registrations, unprot []writeProtectCall
+		dropped               []remoteIovec
+		pids                  []int
+	)
+	defer stubInstallRegion(&installs)()
+	defer stubWriteProtect(&registrations, &unprot)()
+	defer stubCapabilities(Capabilities{ZeroPage: true, WriteProtect: true})()
+	dropPagesFunc = func(pid int, iovs []remoteIovec) error {
+		pids = append(pids, pid)
+		dropped = append(dropped, iovs...)
+		return nil
+	}
+	defer func() { dropPagesFunc = dropPages }()
+
+	pageSize := uint64(os.Getpagesize())
+	manager := newTestManager(t, MemoryManagerCfg{})
+	stateCfg := prepareSnapshotStateCfg(t, "1", 8*os.Getpagesize())
+	stateCfg.IsLazyMode = true
+	stateCfg.WriteProtect = true
+	vms := serveFakeUFFDs(t, &stateCfg)
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+
+	_, err := manager.ReclaimPages("1", nil)
+	require.True(t, errors.Is(err, ErrVMNotActive), "Pages of an inactive VM must not be reclaimed")
+
+	require.NoError(t, manager.Activate("1"), "Failed to activate VM")
+	vm := <-vms
+	state := manager.instances["1"]
+
+	for _, page := range []uint64{0, 1, 2, 5} {
+		vm.fault(t, testStartAddress+page*pageSize)
+	}
+	waitServedPages(t, state, 4)
+	// the guest writes page 1, which must be kept
+	vm.writeFault(t, testStartAddress+pageSize)
+	waitDirtyPages(t, state, 1)
+
+	_, err = manager.ReclaimPages("1", []uint64{8 * pageSize})
+	require.True(t, errors.Is(err, ErrInvalidConfig), "Offset outside of the guest memory must be rejected")
+
+	n, err := manager.ReclaimPages("1", nil)
+	require.NoError(t, err, "Failed to reclaim pages")
+	require.Equal(t, 3, n, "Clean installed pages must be reclaimed")
+	require.Equal(t, []int{os.Getpid()}, pids, "Pages must be dropped from the process that sent the uffd")
+	require.Equal(t, []remoteIovec{
+		{base: testStartAddress, len: pageSize},
+		{base: testStartAddress + 2*pageSize, len: pageSize},
+		{base: testStartAddress + 5*pageSize, len: pageSize},
+	}, dropped, "Wrong pages dropped")
+	require.EqualValues(t, 1, state.servedPagesNum, "Reclaimed pages must not be served anymore")
+
+	n, err = manager.ReclaimPages("1", []uint64{5 * pageSize})
+	require.NoError(t, err, "Failed to reclaim pages")
+	require.Zero(t, n, "Reclaimed page must not be reclaimed again")
+
+	// the reclaimed page faults again and is served again
+	installed := len(installs)
+	vm.fault(t, testStartAddress+2*pageSize)
+	waitServedPages(t, state, 2)
+	require.Equal(t, []installCall{{dst: testStartAddress + 2*pageSize, len: pageSize}}, installs[installed:],
+		"Reclaimed page must be installed again upon its fault")
+
+	require.NoError(t, manager.Deactivate("1"), "Failed to deactivate VM")
+}
+
+func TestDropPages(t *testing.T) {
+	pageSize := os.Getpagesize()
+	mem, err := syscall.Mmap(-1, 0, 2*pageSize, syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS)
+	require.NoError(t, err, "Failed to map memory")
+	defer syscall.Munmap(mem)
+
+	mem[0], mem[pageSize] = 1, 1
+	base := uint64(uintptr(unsafe.Pointer(&mem[0])))
+
+	err = dropPages(os.Getpid(), []remoteIovec{{base: base, len: uint64(pageSize)}})
+	if errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOSYS) || errors.Is(err, syscall.EPERM) {
+		t.Skip("process_madvise with MADV_DONTNEED is not supported on the host")
+	}
+	require.NoError(t, err, "Failed to drop the page")
+	require.Zero(t, mem[0], "Dropped page must be zero-filled upon its next access")
+	require.EqualValues(t, 1, mem[pageSize], "Other pages must be kept")
+}
@@ -0,0 +1,71 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func (s *SnapshotState) getVersionFile() string {
+	return filepath.Join(s.BaseDir, "version")
+}
+
+// persistVersion Stores the FunctionVersion of the instance along with its record
+func (s *SnapshotState) persistVersion() error {
+	if s.FunctionVersion == "" {
+		if err := os.Remove(s.getVersionFile()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	return ioutil.WriteFile(s.getVersionFile(), []byte(s.FunctionVersion), 0644)
+}
+
+// recordVersionMatches Returns true if the persisted record was recorded by the FunctionVersion of
+// the instance. The records are not checked if the instance has no FunctionVersion, and the
+// records persisted with no version do not match any version.
+func (s *SnapshotState) recordVersionMatches() (bool, error) {
+	if s.FunctionVersion == "" {
+		return true, nil
+	}
+
+	version, err := ioutil.ReadFile(s.getVersionFile())
+	if os.IsNotExist(err) {
+		version = nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if string(version) != s.FunctionVersion {
+		log.WithFields(log.Fields{"vmID": s.VMID, "version": s.FunctionVersion}).Infof(
+			"Ignoring the record of version %q, the instance is cold", version)
+		return false, nil
+	}
+
+	return true, nil
+}
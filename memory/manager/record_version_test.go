@@ -0,0 +1,78 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFunctionVersionMismatchSkipsRecord(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	pageSize := uint64(os.Getpagesize())
+	stateCfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+	persistRecord(t, stateCfg, []uint64{0, 2 * pageSize})
+	versionPath := filepath.Join(stateCfg.BaseDir, "version")
+	require.NoError(t, ioutil.WriteFile(versionPath, []byte("v1"), 0644), "Failed to write the version file")
+
+	// the record of another version is not prefetched
+	stateCfg.FunctionVersion = "v2"
+	vms := serveFakeUFFDs(t, &stateCfg)
+	manager := newTestManager(t, MemoryManagerCfg{})
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+
+	pages, err := manager.FetchState("1")
+	require.NoError(t, err, "Failed to fetch state")
+	require.Zero(t, pages, "Record of another version must be skipped")
+	pages, _, err = manager.WorkingSetSize("1")
+	require.NoError(t, err, "Failed to get the working set size")
+	require.Zero(t, pages, "Record of another version must not count")
+
+	// the VM records its working set anew, tagged with its version
+	require.NoError(t, manager.Activate("1"), "Failed to activate VM")
+	vm := <-vms
+	vm.fault(t, testStartAddress+pageSize)
+	waitServedPages(t, manager.instances["1"], 1)
+	require.NoError(t, manager.Deactivate("1"), "Failed to deactivate VM")
+
+	version, err := ioutil.ReadFile(versionPath)
+	require.NoError(t, err, "Failed to read the version file")
+	require.Equal(t, "v2", string(version), "Record must be tagged with the version of the VM")
+
+	for version, expected := range map[string]int{"v2": 1, "v3": 0, "": 1} {
+		cfg := stateCfg
+		cfg.FunctionVersion = version
+		manager := newTestManager(t, MemoryManagerCfg{})
+		require.NoError(t, manager.RegisterVM(cfg), "Failed to register VM")
+
+		pages, err := manager.FetchState("1")
+		require.NoError(t, err, "Failed to fetch state")
+		require.Equal(t, expected, pages, "Wrong number of prefetched pages of version "+version)
+	}
+}
@@ -0,0 +1,345 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// StateFileKind Kind of a file of the VM state kept in a remote store
+type StateFileKind string
+
+const (
+	// GuestMemFile Guest memory file of the snapshot
+	GuestMemFile StateFileKind = "mem_file"
+	// VMMStateFile VMM state file of the snapshot
+	VMMStateFile StateFileKind = "snap_file"
+	// WorkingSetFile Contents of the working set pages
+	WorkingSetFile StateFileKind = "working_set_pages"
+	// TraceFile Offsets of the working set pages
+	TraceFile StateFileKind = "trace"
+	// SequenceFile Offsets of the working set pages in the order of the page faults
+	SequenceFile StateFileKind = "sequence"
+	// VersionFile Function version that the working set was recorded by
+	VersionFile StateFileKind = "version"
+)
+
+// RemoteStore Stores the state files of VMs, e.g., in an object store of
+// a disaggregated deployment. Fetch must return an error that wraps
+// os.ErrNotExist if the store has no such file.
+type RemoteStore interface {
+	Fetch(vmID string, kind StateFileKind) (io.ReadCloser, error)
+}
+
+// NewRemoteStore Returns the store for the URL, which is either
+// an s3://bucket/prefix URL or a path in the local filesystem.
+// The S3 credentials, region, and endpoint are taken from the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN, AWS_REGION, and AWS_ENDPOINT_URL environment variables.
+func NewRemoteStore(rawURL string) (RemoteStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "s3":
+		return NewS3Store(S3StoreCfg{
+			Endpoint:     os.Getenv("AWS_ENDPOINT_URL"),
+			Region:       os.Getenv("AWS_REGION"),
+			Bucket:       u.Host,
+			Prefix:       strings.Trim(u.Path, "/"),
+			AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		})
+	case "file":
+		return NewLocalStore(u.Path), nil
+	case "":
+		return NewLocalStore(rawURL), nil
+	default:
+		return nil, fmt.Errorf("unsupported remote store scheme %q", u.Scheme)
+	}
+}
+
+// LocalStore Keeps the state files of each VM in a directory named after the VM
+type LocalStore struct {
+	baseDir string
+}
+
+// NewLocalStore Returns the store with the base directory
+func NewLocalStore(baseDir string) *LocalStore {
+	return &LocalStore{baseDir: baseDir}
+}
+
+// Fetch Opens the file of the VM
+func (l *LocalStore) Fetch(vmID string, kind StateFileKind) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(l.baseDir, vmID, string(kind)))
+}
+
+// S3StoreCfg Config of an S3-compatible object store
+type S3StoreCfg struct {
+	Endpoint     string // e.g., http://minio:9000, defaults to AWS S3 in the region
+	Region       string // defaults to us-east-1
+	Bucket       string
+	Prefix       string // prefix of the object keys
+	AccessKey    string
+	SecretKey    string
+	SessionToken string // token of temporary credentials, e.g., of an assumed role
+}
+
+// S3Store Keeps the state files of each VM as objects <prefix>/<vmID>/<kind>
+// of a bucket of an S3-compatible object store
+type S3Store struct {
+	S3StoreCfg
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// NewS3Store Returns the store of the bucket
+func NewS3Store(cfg S3StoreCfg) (*S3Store, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("no bucket is specified for the S3 store")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", cfg.Region)
+	}
+
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint: %w", err)
+	}
+
+	return &S3Store{S3StoreCfg: cfg, endpoint: endpoint, client: http.DefaultClient}, nil
+}
+
+// Fetch Streams the object of the VM file from the bucket
+func (s *S3Store) Fetch(vmID string, kind StateFileKind) (io.ReadCloser, error) {
+	key := path.Join(s.Prefix, vmID, string(kind))
+
+	// path-style addressing is supported by all S3-compatible stores, the endpoint
+	// may be served under a path, e.g., by a reverse proxy
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.Bucket + "/" + key
+	u.RawPath = ""
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, unsignedPayload, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, fmt.Errorf("object %s: %w", key, os.ErrNotExist)
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to get object %s: %s", key, resp.Status)
+	}
+}
+
+// unsignedPayload Payload hash of the requests whose payload is not signed
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// sign Signs the request with the AWS Signature Version 4, given the hex-encoded SHA-256
+// hash of its payload or unsignedPayload. The query of the request must be canonical,
+// i.e., its parameters sorted and encoded.
+func (s *S3Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	const algorithm = "AWS4-HMAC-SHA256"
+
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	scope := strings.Join([]string{date, s.Region, "s3", "aws4_request"}, "/")
+
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	req.Header.Set("x-amz-date", amzDate)
+
+	// the canonical headers are sorted by their names
+	headers := []string{
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+	}
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	if s.SessionToken != "" {
+		req.Header.Set("x-amz-security-token", s.SessionToken)
+		headers = append(headers, "x-amz-security-token:"+s.SessionToken)
+		signedHeaders += ";x-amz-security-token"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncodePath(req.URL.Path),
+		req.URL.RawQuery,
+		strings.Join(headers, "\n"),
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{algorithm, amzDate, scope, hex.EncodeToString(hash[:])}, "\n")
+
+	key := []byte("AWS4" + s.SecretKey)
+	for _, part := range []string{date, s.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		algorithm, s.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// uriEncodePath Encodes each segment of the path as required by the AWS Signature Version 4
+func uriEncodePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+// contextReader Fails the reads once the context is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return c.r.Read(p)
+}
+
+// fetchRemoteFile Streams the file of the VM from the remote store into the local path,
+// unless it has been cached already. A file that the store does not have is skipped.
+func (s *SnapshotState) fetchRemoteFile(ctx context.Context, kind StateFileKind, localPath string) error {
+	if s.remoteStore == nil {
+		return nil
+	}
+
+	if _, err := os.Stat(localPath); err == nil {
+		return nil
+	}
+
+	logger := log.WithFields(log.Fields{"vmID": s.VMID})
+
+	r, err := s.remoteStore.Fetch(s.VMID, kind)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			logger.Debugf("No %s in the remote store", kind)
+			return nil
+		}
+		return fmt.Errorf("failed to fetch %s from the remote store: %w", kind, err)
+	}
+	defer r.Close()
+
+	if err := os.MkdirAll(filepath.Dir(localPath), 0777); err != nil {
+		return err
+	}
+
+	// the file is renamed once complete, so that a partially fetched file is never cached
+	f, err := ioutil.TempFile(filepath.Dir(localPath), filepath.Base(localPath)+".fetch")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := io.Copy(f, &contextReader{ctx: ctx, r: r}); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to fetch %s from the remote store: %w", kind, err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), localPath)
+}
+
+// fetchRemoteState Caches the files of the VM state that are kept in the remote store
+func (s *SnapshotState) fetchRemoteState(ctx context.Context) error {
+	files := map[StateFileKind]string{
+		VMMStateFile: s.VMMStatePath,
+		GuestMemFile: s.guestMemFilePath(),
+	}
+	if !s.IsLazyMode {
+		files[TraceFile] = s.trace.traceFileName
+		files[WorkingSetFile] = s.WorkingSetPath
+		if s.faultOrder {
+			files[SequenceFile] = s.getSequenceFile()
+		}
+		if s.FunctionVersion != "" {
+			files[VersionFile] = s.getVersionFile()
+		}
+	}
+
+	for kind, localPath := range files {
+		if err := s.fetchRemoteFile(ctx, kind, localPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,176 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"unsafe"
+)
+
+// residencyReadSize is the size of the reads of the resident pages from the guest memory file
+const residencyReadSize = 1 << 20
+
+// getResidencyFile Returns the path of the file of the pages served in the previous activation
+// of the instance in lazy mode. Unlike the working set of the record, it reflects the pages the
+// VM had resident at run time, including the ones fetched on demand and excluding the removed ones.
+func (s *SnapshotState) getResidencyFile() string {
+	return filepath.Join(s.BaseDir, "residency")
+}
+
+// persistResidency Saves the pages served since the activation upon deactivation
+func (s *SnapshotState) persistResidency() error {
+	return ioutil.WriteFile(s.getResidencyFile(), s.servedPages.encode(), 0644)
+}
+
+// fetchResidency Loads the pages served in the previous activation, if any, which are installed
+// upon the first page fault, and reads them from the guest memory file into the page cache.
+// Returns the number of the loaded pages. Reports the progress if set.
+func (s *SnapshotState) fetchResidency(progress *fetchProgress) (int, error) {
+	path := s.getResidencyFile()
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	resident, err := decodePageBitmap(data, s.GuestMemSize/s.PageSize)
+	if err != nil {
+		return 0, fmt.Errorf("residency file %s is corrupt: %w", path, err)
+	}
+
+	// the pages that are not in the overlay are read from the base image, if any,
+	// and the pages of compressed guest memory are only decompressed upon installation
+	var guestMemFile, baseFile stateFile
+	if s.hasOverlayFile() && s.ReadStrategy != CompressedRead {
+		if guestMemFile, err = openStateFile(s.guestMemFS(), s.guestMemFilePath()); err != nil {
+			return 0, err
+		}
+		defer guestMemFile.Close()
+	}
+	if s.base != nil {
+		if baseFile, err = openStateFile(s.stateFS, s.BaseImagePath); err != nil {
+			return 0, err
+		}
+		defer baseFile.Close()
+	}
+
+	progress.start(resident.Count())
+	chunk := progress.chunkPages()
+
+	buf := make([]byte, residencyReadSize)
+	resident.runs(func(first, num int) bool {
+		for page := first; page < first+num && err == nil; {
+			f, n := guestMemFile, first+num-page
+			if n > chunk {
+				n = chunk
+			}
+			if s.base != nil {
+				inOverlay := s.overlayPages.Test(page)
+				n = 1
+				for page+n < first+num && n < chunk && s.overlayPages.Test(page+n) == inOverlay {
+					n++
+				}
+				if !inOverlay {
+					f = baseFile
+				}
+			}
+			if f != nil {
+				err = readPages(f, buf, int64(page*s.PageSize), n*s.PageSize)
+			}
+			if err == nil {
+				err = progress.add(n)
+			}
+			page += n
+		}
+		return err == nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch the resident pages: %w", err)
+	}
+
+	s.residentPages = resident
+
+	return resident.Count(), nil
+}
+
+// readPages Reads the bytes [off, off+n) of the file in reads of up to the size of the buffer
+func readPages(f io.ReaderAt, buf []byte, off int64, n int) error {
+	for end := off + int64(n); off < end; off += int64(len(buf)) {
+		size := len(buf)
+		if end-off < int64(size) {
+			size = int(end - off)
+		}
+		if _, err := f.ReadAt(buf[:size], off); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// installResidentPages Installs the pages served in the previous activation without waking up
+// the faulting thread
+func (s *SnapshotState) installResidentPages(fd int) (int, error) {
+	var (
+		installed int
+		err       error
+	)
+
+	mode := uffdCopyModeDontWake()
+	if s.usesUFFDWriteProtect() {
+		mode |= uffdCopyModeWP()
+	}
+
+	s.residentPages.runs(func(first, num int) bool {
+		for page := first; page < first+num; {
+			mem, _, n := s.clipToSource(page, page, first+num-page)
+			_, n = s.clipToRegion(page, page, n)
+			var run []byte
+			if run, err = s.readPages(mem, page, n); err != nil {
+				return false
+			}
+
+			src := uint64(uintptr(unsafe.Pointer(&run[0])))
+			dst := s.pageAddress(page)
+			if err = s.installer.Copy(fd, src, dst, mode, uint64(n*s.PageSize)); err != nil {
+				return false
+			}
+
+			pages := s.servedPages.SetRange(page, n)
+			atomic.AddInt64(&s.servedPagesNum, int64(pages))
+			installed += pages
+			page += n
+		}
+
+		return true
+	})
+
+	return installed, err
+}
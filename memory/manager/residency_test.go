@@ -0,0 +1,147 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// waitServedPages Waits until the number of the pages served since the activation reaches n
+func waitServedPages(t *testing.T, state *SnapshotState, n int64) {
+	for i := 0; atomic.LoadInt64(&state.servedPagesNum) < n; i++ {
+		require.Less(t, i, 1000, "Page faults are not served")
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestResidencyAcrossActivations(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	pageSize := uint64(os.Getpagesize())
+	manager := newTestManager(t, MemoryManagerCfg{})
+	stateCfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+	stateCfg.IsLazyMode = true
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+
+	pages, err := manager.FetchState("1")
+	require.NoError(t, err, "Failed to fetch the state of the cold VM")
+	require.Zero(t, pages, "Cold VM must have no resident pages")
+
+	state, vm := activateTestVM(t, manager, "1")
+	vm.fault(t, testStartAddress)
+	vm.fault(t, testStartAddress+2*pageSize)
+	waitServedPages(t, state, 2)
+	require.NoError(t, manager.Deactivate("1"), "Failed to deactivate VM")
+
+	pages, err = manager.FetchState("1")
+	require.NoError(t, err, "Failed to fetch the resident pages")
+	require.Equal(t, 2, pages, "Pages served in the previous activation must be fetched")
+
+	// the first page fault of the activation sets the start address and installs the resident pages
+	installs = installs[:0]
+	require.NoError(t, state.mapGuestMemory(context.Background()), "Failed to map guest memory")
+	state.setupStateOnActivate()
+	_, vm = newFakeUFFD(t, state)
+	readyCh := make(chan error)
+	go state.pollUserPageFaults(readyCh)
+	require.NoError(t, <-readyCh, "Failed to register the epoller")
+
+	vm.fault(t, testStartAddress)
+	vm.fault(t, testStartAddress+3*pageSize)
+	waitServedPages(t, state, 3)
+	require.NoError(t, manager.Deactivate("1"), "Failed to deactivate VM")
+
+	require.Equal(t, []installCall{
+		{dst: testStartAddress, len: pageSize},
+		{dst: testStartAddress + 2*pageSize, len: pageSize},
+		{dst: testStartAddress + 3*pageSize, len: pageSize},
+	}, installs, "Resident pages must be prefetched upon the first page fault")
+
+	pages, err = manager.FetchState("1")
+	require.NoError(t, err, "Failed to fetch the resident pages")
+	require.Equal(t, 3, pages, "Pages served on demand must be resident in the next activation")
+}
+
+func TestResidencyPersistFailure(t *testing.T) {
+	manager := newTestManager(t, MemoryManagerCfg{})
+	stateCfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+	stateCfg.IsLazyMode = true
+	vms := serveFakeUFFDs(t, &stateCfg)
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+
+	// the residency file cannot be written over a directory
+	state := manager.instances["1"]
+	require.NoError(t, os.Mkdir(state.getResidencyFile(), 0755), "Failed to block the residency file")
+
+	require.NoError(t, manager.Activate("1"), "Failed to activate VM")
+	<-vms
+	require.NoError(t, manager.Deactivate("1"), "Lost residency file must not fail the deactivation")
+	require.False(t, state.isActive, "VM must be inactive once deactivated")
+	require.True(t, errors.Is(manager.Deactivate("1"), ErrVMNotActive), "Deactivated VM must not be torn down again")
+
+	require.NoError(t, manager.Activate("1"), "Failed to reactivate VM")
+	<-vms
+	require.NoError(t, manager.Deactivate("1"), "Failed to deactivate the reactivated VM")
+}
+
+func TestResidencyCorruptFile(t *testing.T) {
+	manager := newTestManager(t, MemoryManagerCfg{})
+	stateCfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+	stateCfg.IsLazyMode = true
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+
+	err := ioutil.WriteFile(manager.instances["1"].getResidencyFile(), []byte("corrupt"), 0644)
+	require.NoError(t, err, "Failed to write the residency file")
+
+	_, err = manager.FetchState("1")
+	require.Error(t, err, "Corrupt residency file must be rejected")
+}
+
+func TestPageBitmapEncode(t *testing.T) {
+	b := newPageBitmap(130)
+	b.SetRange(3, 2)
+	b.Set(129)
+
+	decoded, err := decodePageBitmap(b.encode(), 130)
+	require.NoError(t, err, "Failed to decode the bitmap")
+	require.Equal(t, b, decoded, "Decoded bitmap must match the encoded one")
+
+	_, err = decodePageBitmap(b.encode(), 200)
+	require.Error(t, err, "Bitmap of a different size must be rejected")
+
+	var runs [][2]int
+	decoded.runs(func(first, num int) bool {
+		runs = append(runs, [2]int{first, num})
+		return true
+	})
+	require.Equal(t, [][2]int{{3, 2}, {129, 1}}, runs, "Wrong runs of pages")
+}
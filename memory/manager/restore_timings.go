@@ -0,0 +1,56 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RestoreTimings Returns how long after its latest activation the first page fault of the VM
+// arrived, and how long after it the pages prefetched upon the first page fault, i.e., the recorded
+// working set in replay mode, were installed. Either duration is zero until the event happens,
+// the latter remains zero if nothing is prefetched.
+func (m *MemoryManager) RestoreTimings(vmID string) (firstFault, workingSet time.Duration, err error) {
+	log.WithFields(log.Fields{"vmID": vmID}).Debug("returning the restore timings")
+
+	state, err := m.getInstance(vmID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	activatedAt := atomic.LoadInt64(&state.activatedAt)
+	firstFaultAt := atomic.LoadInt64(&state.firstFaultAt)
+	prefetchedAt := atomic.LoadInt64(&state.prefetchedAt)
+
+	if activatedAt != 0 && firstFaultAt != 0 {
+		firstFault = time.Duration(firstFaultAt - activatedAt)
+	}
+	if firstFaultAt != 0 && prefetchedAt != 0 {
+		workingSet = time.Duration(prefetchedAt - firstFaultAt)
+	}
+
+	return firstFault, workingSet, nil
+}
@@ -0,0 +1,76 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestoreTimings(t *testing.T) {
+	installer, restore := stubInstaller()
+	defer restore()
+	installer.copy = func(fd int, src, dst, mode, len uint64) error {
+		time.Sleep(time.Millisecond)
+		return nil
+	}
+
+	manager := newTestManager(t, MemoryManagerCfg{})
+
+	pageSize := uint64(os.Getpagesize())
+	stateCfg := prepareSnapshotStateCfg(t, "1", 8*os.Getpagesize())
+	persistRecord(t, stateCfg, []uint64{0, pageSize, 4 * pageSize})
+	vms := serveFakeUFFDs(t, &stateCfg)
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+
+	_, err := manager.FetchState("1")
+	require.NoError(t, err, "Failed to fetch state")
+
+	require.NoError(t, manager.Activate("1"), "Failed to activate VM")
+	vm := <-vms
+
+	firstFault, workingSet, err := manager.RestoreTimings("1")
+	require.NoError(t, err, "Failed to get the restore timings")
+	require.Zero(t, firstFault, "First page fault has not arrived yet")
+	require.Zero(t, workingSet, "Working set has not been installed yet")
+
+	time.Sleep(5 * time.Millisecond)
+	vm.fault(t, testStartAddress)
+	// the working set is installed upon the first page fault
+	for i := 0; workingSet == 0; i++ {
+		require.Less(t, i, 1000, "Working set is not installed")
+		time.Sleep(time.Millisecond)
+
+		firstFault, workingSet, err = manager.RestoreTimings("1")
+		require.NoError(t, err, "Failed to get the restore timings")
+	}
+	require.EqualValues(t, 3, atomic.LoadInt64(&manager.instances["1"].servedPagesNum), "Working set must be installed")
+	require.GreaterOrEqual(t, int64(firstFault), int64(5*time.Millisecond), "First page fault must follow the activation")
+	require.GreaterOrEqual(t, int64(workingSet), int64(2*time.Millisecond), "Working set must be installed after the first fault")
+
+	require.NoError(t, manager.Deactivate("1"), "Failed to deactivate VM")
+}
@@ -28,16 +28,23 @@ package manager
 import "C"
 
 import (
+	"bytes"
+	"container/list"
 	"context"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -56,12 +63,79 @@ type SnapshotStateCfg struct {
 
 	VMMStatePath, GuestMemPath, WorkingSetPath string
 
+	// pre-opened guest memory file, e.g., passed by the VMM, that is used instead of GuestMemPath.
+	// The manager owns the file once the VM is registered and closes it upon its deregistration.
+	GuestMemFD *os.File
+
 	InstanceSockAddr string
 	BaseDir          string // base directory for the instance
 	MetricsPath      string // path to csv file where the metrics should be stored
 	IsLazyMode       bool
+	WriteProtect     bool // track the pages written by the guest, see DirtyPages and Capabilities.SoftDirty
+	EagerRestore     bool // install the whole guest memory upon the first page fault
+	MinorFaults      bool // map the pages in the page cache of shmem or hugetlbfs with UFFDIO_CONTINUE
 	GuestMemSize     int
+	Priority         int    // page faults of the VMs with a higher priority are served first, see WorkerPoolSize
+	PageSize         int    // size of the guest memory pages, defaults to the system page size
+	GuestMemChecksum string // hex-encoded SHA-256 of the guest memory file, checked if set
+	BaseSnapshotID   string // groups the instances booted from the same snapshot
+	FunctionVersion  string // version or hash of the function code, the records of other versions are ignored
+	FunctionID       string // function whose working set is kept in the WorkingSetStore, if set
+	BaseImagePath    string // read-only guest memory image shared by the instances, lazy mode only
+	OverlayPagesPath string // encoded bitmap of the pages of GuestMemPath that override the base image
 	metricsModeOn    bool
+	streamWorkingSet bool // fetch the working set in the background while the page faults are served
+
+	// VMMStatePath is a Firecracker snapshot file, which GuestMemSize is derived from if it is 0,
+	// or checked against otherwise, see ParseFirecrackerSnapshot. Not supported with a remote store.
+	FirecrackerState bool
+
+	ReadStrategy   ReadStrategy // how the pages are read from the guest memory file, mapped by default
+	FaultRateLimit int          // pages per second installed upon the page faults, unlimited if 0
+
+	// gives up reading the guest memory file for a page fault after the timeout, e.g., if it is on a
+	// network filesystem, unlimited if 0. Requires a ReadStrategy that does not map the file.
+	FaultReadTimeout time.Duration
+
+	// size in bytes of the windows of the guest memory file mapped by the WindowedRead strategy,
+	// a multiple of the system page size, defaults to defaultWindowSize
+	WindowSize int
+
+	// regions of the guest memory in the order of their offsets in the guest memory file,
+	// a single region starting at GuestPhysBase, or at the address of the first page fault, if empty
+	Regions []MemoryRegion
+	// address of the guest memory, i.e., of the start of the guest memory file, in the address space
+	// of the VMM. The page faults are translated to the offsets in the guest memory file against it
+	// instead of against the address of the first page fault, which is the start of the guest memory
+	// only if the VM first touches its first page, e.g., not for a snapshot restored at a different
+	// base than it was recorded at. Mutually exclusive with Regions, unset if 0.
+	GuestPhysBase uint64
+
+	// place the pages installed upon the page faults, and the private pages of the guest memory
+	// mapping, on NUMANode. The page faults of the VM are served by a thread bound to the node.
+	NUMAPlacement bool
+	NUMANode      int
+
+	installChunkPages int         // number of contiguous pages installed upon a page fault
+	readAheadPages    int         // number of pages installed after the faulting page
+	adaptiveReadAhead bool        // grow the read-ahead up to readAheadPages while the faults are sequential
+	remoteStore       RemoteStore // store of the state files, local files are used if nil
+	stateFS           StateFS     // file system of the state files, the local one if nil
+	tracer            Tracer      // tracer of the page faults, tracing is disabled if nil
+	compression       TraceCompression
+	noZeroPage        bool // install the zero-filled pages with UFFDIO_COPY as well
+	faultOrder        bool // record the order of the page faults and install the working set in it
+	softDirty         bool // track the pages written by the guest with the soft-dirty bits, see WriteProtect
+
+	backend      faultBackend                        // serves the page faults, uffdBackend if nil
+	installer    pageInstaller                       // installs the pages, defaultInstaller if nil
+	faultReader  faultReader                         // reads the page faults, uffdFaultReader if nil
+	onFirstFault func(vmID string, served time.Time) // called upon the first served page fault, if set
+	pressure     MemoryPressure                      // memory pressure of the node, never under pressure if nil
+	wsStore      WorkingSetStore                     // central store of the working sets of the functions, if set
+
+	onWorkingSetComplete func(vmID string)                           // called once the working set is served, if set
+	onServeError         func(vmID string, offset uint64, err error) // called upon a page fault failing to be served, if set
 }
 
 // SnapshotState Stores the state of the snapshot
@@ -69,22 +143,109 @@ type SnapshotStateCfg struct {
 type SnapshotState struct {
 	SnapshotStateCfg
 	firstPageFaultOnce *sync.Once // to initialize the start virtual address and replay
+	firstServedOnce    *sync.Once // to call onFirstFault once per activation
+	workingSetOnce     *sync.Once // to call onWorkingSetComplete once per activation
 	startAddress       uint64
 	userFaultFD        *os.File
+	vmPid              int // pid of the process that sent the uffd, 0 if unknown
 	trace              *Trace
 	epfd               int
-	quitCh             chan int
+	wakeFds            [2]int          // pipe to wake up the polling loop upon quitting
+	quitCh             chan struct{}   // closed to make the polling loop quit
+	loopDone           chan struct{}   // closed once the polling loop has quit
+	loopFailed         int32           // set atomically once the polling loop has stopped serving
+	heartbeat          int64           // time of the last iteration of the polling loop in ns, set atomically
+	errCh              chan<- error    // to report errors to the memory manager
+	traceCtx           context.Context // parent of the spans of the page faults
+
+	faultQueue     *workerQueue   // queue of the worker that serves the VM, if any
+	inflightFaults sync.WaitGroup // page faults queued to the worker
+
+	// held while dispatching a request, which is deferred until the VM is resumed if it is paused
+	pauseMu  sync.Mutex
+	paused   bool
+	deferred []faultRequest
+	// closed once the page faults being served when the VM was quiesced are served, see QuiesceVM
+	quiesced chan struct{}
+
+	// serializes the activation, deactivation and deregistration of the instance,
+	// which are slow and therefore not done with the manager locked
+	opMu sync.Mutex
 
 	// to indicate whether the instance has even been activated. this is to
 	// get around cases where offload is called for the first time
 	isEverActivated bool
 	// for sanity checking on deactivate/activate
 	isActive bool
+	// whether the instance holds one of the slots of MaxActiveVMs
+	holdsActiveSlot bool
 
 	isRecordReady bool
 
 	guestMem   []byte
 	workingSet []byte
+	wsStream   *workingSetStream // working set fetched in the background, nil unless being streamed
+
+	guestMemFile guestMemReader // read instead of mapping guestMem unless the strategy is MmapRead
+
+	// pages served in the previous activation in lazy mode, installed upon the first page fault
+	residentPages *pageBitmap
+
+	// times of the latest activation, of its first page fault, and of the installation of
+	// the pages prefetched upon the first page fault in ns, set atomically, see RestoreTimings
+	activatedAt, firstFaultAt, prefetchedAt int64
+
+	// delays the page faults beyond FaultRateLimit, nil if unlimited
+	rateLimiter *rateLimiter
+
+	// sizes the read-ahead of the page faults, nil unless it is adaptive
+	readAhead *adaptiveReadAhead
+
+	sharedMem *sharedMemory // copy of the guest memory shared with the sibling instances, if any
+	hotPages  *hotPagePool  // pool of the hot pages of the snapshots, if any
+
+	// base image shared with the instances of the snapshot family, if any,
+	// and the pages that are installed from the guest memory file instead
+	base         *baseImage
+	overlayPages *pageBitmap
+
+	// element of the instance in the inactive list of the manager, nil unless it is deactivated
+	inactiveElem *list.Element
+
+	// pages written by the guest since the instance was activated in the write-protect mode
+	dirtyMu    sync.Mutex
+	dirtyPages *pageBitmap
+
+	// pages installed since the instance was activated, and their number updated atomically
+	servedPages    *pageBitmap
+	servedPagesNum int64
+	// pages of the guest memory file that have been checked for being zero-filled,
+	// and the ones found to be zero-filled, kept across activations
+	zeroCheckedPages *pageBitmap
+	zeroPages        *pageBitmap
+
+	// number of pages installed with UFFDIO_ZEROPAGE and with UFFDIO_COPY
+	zeroInstalls int64
+	copyInstalls int64
+
+	// lifetime counters of the VM, updated atomically
+	faultsServed       int64 // number of page faults served
+	serveTimeNs        int64 // total time spent serving page faults
+	workingSetInstalls int64 // number of working set pages installed in replay mode
+	workingSetMisses   int64 // number of pages installed on demand in replay mode
+	backingReads       int64 // number of pages read from the guest memory file to be installed
+	minorFaults        int64 // number of minor faults served with UFFDIO_CONTINUE
+	alreadyPresent     int64 // number of pages found present upon installation, e.g., in a race with another fault
+	serveErrors        int64 // number of page faults that failed to be served
+	hotPageInstalls    int64 // number of pages installed from the hot page pool
+
+	// distribution of the time spent serving page faults
+	serveLatency latencyHistogram
+
+	// pages installed from the prefetched working set and on demand since the instance
+	// was activated in replay mode, updated atomically
+	prefetchedPages  int64
+	missedFaultPages int64
 
 	// Stats
 	totalPFServed  []float64
@@ -101,8 +262,32 @@ type SnapshotState struct {
 func NewSnapshotState(cfg SnapshotStateCfg) *SnapshotState {
 	s := new(SnapshotState)
 	s.SnapshotStateCfg = cfg
+	s.traceCtx = context.Background()
+	if s.backend == nil {
+		s.backend = uffdBackend{}
+	}
+	if s.installer == nil {
+		s.installer = defaultInstaller
+	}
+	if s.faultReader == nil {
+		s.faultReader = uffdFaultReader{}
+	}
+	if s.stateFS == nil {
+		s.stateFS = OSFS{}
+	}
+	if s.FaultRateLimit > 0 {
+		s.rateLimiter = newRateLimiter(s.FaultRateLimit)
+	}
+	if s.adaptiveReadAhead {
+		s.readAhead = newAdaptiveReadAhead(s.readAheadPages)
+	}
+	if s.PageSize == 0 {
+		s.PageSize = os.Getpagesize()
+	}
 
-	s.trace = initTrace(s.getTraceFile())
+	s.trace = s.newTrace()
+	s.zeroCheckedPages = newPageBitmap(s.GuestMemSize / s.PageSize)
+	s.zeroPages = newPageBitmap(s.GuestMemSize / s.PageSize)
 	if s.metricsModeOn {
 		s.totalPFServed = make([]float64, 0)
 		s.uniquePFServed = make([]float64, 0)
@@ -117,7 +302,40 @@ func (s *SnapshotState) setupStateOnActivate() {
 	s.isActive = true
 	s.isEverActivated = true
 	s.firstPageFaultOnce = new(sync.Once)
-	s.quitCh = make(chan int)
+	s.firstServedOnce = new(sync.Once)
+	s.workingSetOnce = new(sync.Once)
+	s.quitCh = make(chan struct{})
+	s.loopDone = make(chan struct{})
+	atomic.StoreInt32(&s.loopFailed, 0)
+	atomic.StoreInt64(&s.heartbeat, time.Now().UnixNano())
+	atomic.StoreInt64(&s.firstFaultAt, 0)
+	atomic.StoreInt64(&s.prefetchedAt, 0)
+	s.pauseMu.Lock()
+	if s.quiesced != nil {
+		// the page faults of the previous activation have been served upon its deactivation
+		<-s.quiesced
+	}
+	s.paused, s.deferred, s.quiesced = false, nil, nil
+	s.pauseMu.Unlock()
+	atomic.StoreInt64(&s.prefetchedPages, 0)
+	atomic.StoreInt64(&s.missedFaultPages, 0)
+	s.wakeFds = [2]int{-1, -1}
+
+	if s.servedPages == nil {
+		s.servedPages = newPageBitmap(s.GuestMemSize / s.PageSize)
+	} else {
+		s.servedPages.Reset()
+	}
+	atomic.StoreInt64(&s.servedPagesNum, 0)
+	if s.readAhead != nil {
+		s.readAhead.reset()
+	}
+
+	if s.WriteProtect {
+		s.dirtyMu.Lock()
+		s.dirtyPages = newPageBitmap(s.GuestMemSize / s.PageSize)
+		s.dirtyMu.Unlock()
+	}
 
 	if s.metricsModeOn {
 		s.uniqueNum = 0
@@ -126,17 +344,57 @@ func (s *SnapshotState) setupStateOnActivate() {
 	}
 }
 
-func (s *SnapshotState) getUFFD() error {
+// resetStateOnDeactivate Drops the state of the guest memory mapping, which is rebuilt
+// from the first page fault upon the next activation
+func (s *SnapshotState) resetStateOnDeactivate() {
+	s.isActive = false
+	s.workingSet = nil
+	s.residentPages = nil
+	atomic.StoreUint64(&s.startAddress, 0)
+	s.firstPageFaultOnce = new(sync.Once)
+	s.servedPages.Reset()
+	atomic.StoreInt64(&s.servedPagesNum, 0)
+}
+
+// workingSetPages Returns the number of the pages the VM has touched since it was activated
+// or, if it is inactive, the number of the pages in its persisted record
+func (s *SnapshotState) workingSetPages() (int, error) {
+	if s.isActive {
+		return int(atomic.LoadInt64(&s.servedPagesNum)), nil
+	}
+
+	if s.isRecordReady {
+		return s.trace.Len(), nil
+	}
+
+	if _, err := os.Stat(s.trace.traceFileName); os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	if ok, err := s.recordVersionMatches(); err != nil || !ok {
+		return 0, err
+	}
+
+	// the number of records of a compressed trace is known only once it is decoded
+	trace := initTrace(s.trace.traceFileName, s.PageSize)
+	if err := trace.readTrace(); err != nil {
+		return 0, err
+	}
+
+	return trace.Len(), nil
+}
+
+func (s *SnapshotState) getUFFD(ctx context.Context) error {
 	var d net.Dialer
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	dialCtx, cancel := context.WithTimeout(ctx, 1*time.Second)
 	defer cancel()
 
 	for {
-		c, err := d.DialContext(ctx, "unix", s.InstanceSockAddr)
+		c, err := d.DialContext(dialCtx, "unix", s.InstanceSockAddr)
 		if err != nil {
-			if ctx.Err() != nil {
-				log.Error("Failed to dial within the context timeout")
-				return err
+			if dialCtx.Err() != nil {
+				return fmt.Errorf("failed to dial the VM socket: %w", err)
 			}
 			time.Sleep(1 * time.Millisecond)
 			continue
@@ -144,20 +402,54 @@ func (s *SnapshotState) getUFFD() error {
 
 		defer c.Close()
 
+		// unblock receiving the uffd once the context is done
+		received := make(chan struct{})
+		defer close(received)
+		go func() {
+			select {
+			case <-ctx.Done():
+				c.Close()
+			case <-received:
+			}
+		}()
+
 		sendfdConn := c.(*net.UnixConn)
 
 		fs, err := fd.Get(sendfdConn, 1, []string{"a file"})
 		if err != nil {
-			log.Error("Failed to receive the uffd")
-			return err
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("%w: %v", ErrFDNotFound, err)
+		}
+		if len(fs) == 0 {
+			return ErrFDNotFound
+		}
+		if err := checkUFFDFunc(fs[0]); err != nil {
+			fs[0].Close()
+			return fmt.Errorf("%w: %v", ErrFDNotFound, err)
 		}
 
 		s.userFaultFD = fs[0]
+		s.vmPid = peerPid(sendfdConn)
 
 		return nil
 	}
 }
 
+// checkUFFD Returns an error unless the file is a userfaultfd, which is an anonymous inode
+func checkUFFD(f *os.File) error {
+	link, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", f.Fd()))
+	if err != nil {
+		return err
+	}
+	if link != "anon_inode:[userfaultfd]" {
+		return fmt.Errorf("received fd is %s, not a userfaultfd", link)
+	}
+
+	return nil
+}
+
 func (s *SnapshotState) processMetrics() {
 	if s.metricsModeOn && s.isRecordReady {
 		s.uniquePFServed = append(s.uniquePFServed, float64(s.uniqueNum))
@@ -178,27 +470,175 @@ func (s *SnapshotState) getTraceFile() string {
 	return filepath.Join(s.BaseDir, "trace")
 }
 
-func (s *SnapshotState) mapGuestMemory() error {
-	fd, err := os.OpenFile(s.GuestMemPath, os.O_RDONLY, 0444)
+// guestMemFilePath Returns the path the guest memory file is opened at. GuestMemFD is reopened
+// through procfs, which never races with the VMM removing the file, and gives every opener
+// its own file offset
+func (cfg *SnapshotStateCfg) guestMemFilePath() string {
+	if cfg.GuestMemFD != nil {
+		return fmt.Sprintf("/proc/self/fd/%d", cfg.GuestMemFD.Fd())
+	}
+
+	return cfg.GuestMemPath
+}
+
+// closeGuestMemFD Closes the pre-opened guest memory file, if any, upon the deregistration
+func (s *SnapshotState) closeGuestMemFD() {
+	if s.GuestMemFD == nil {
+		return
+	}
+
+	if err := s.GuestMemFD.Close(); err != nil {
+		log.WithFields(log.Fields{"vmID": s.VMID}).Warnf("Failed to close the guest memory fd: %v", err)
+	}
+}
+
+func (s *SnapshotState) getSequenceFile() string {
+	return filepath.Join(s.BaseDir, "sequence")
+}
+
+// newTrace Returns an empty trace persisted to the trace file of the instance
+func (s *SnapshotState) newTrace() *Trace {
+	trace := initTrace(s.getTraceFile(), s.PageSize)
+	trace.compression = s.compression
+	trace.guestMemFS = s.guestMemFS()
+	if s.faultOrder {
+		trace.sequenceFileName = s.getSequenceFile()
+	}
+
+	return trace
+}
+
+func (s *SnapshotState) mapGuestMemory(ctx context.Context) error {
+	if !s.hasOverlayFile() {
+		return nil
+	}
+
+	if err := s.fetchRemoteFile(ctx, GuestMemFile, s.guestMemFilePath()); err != nil {
+		log.Errorf("Failed to fetch guest memory file: %v", err)
+		return err
+	}
+
+	fd, err := openStateFile(s.guestMemFS(), s.guestMemFilePath())
 	if err != nil {
 		log.Errorf("Failed to open guest memory file: %v", err)
 		return err
 	}
+	defer func() {
+		if s.guestMemFile == nil {
+			fd.Close()
+		}
+	}()
+
+	if s.ReadStrategy == CompressedRead {
+		compressed, err := openCompressedMemory(fd, s.GuestMemSize)
+		if err != nil {
+			return fmt.Errorf("guest memory file %s is corrupt: %w", s.GuestMemPath, err)
+		}
+
+		return s.openGuestMemory(compressed)
+	}
+
+	// accessing the mapping past the end of the file raises SIGBUS
+	fileInfo, err := fd.Stat()
+	if err != nil {
+		log.Errorf("Failed to stat guest memory file: %v", err)
+		return err
+	}
+	if fileInfo.Size() < int64(s.GuestMemSize) {
+		return fmt.Errorf("guest memory file %s is truncated: expected %d bytes, found %d",
+			s.GuestMemPath, s.GuestMemSize, fileInfo.Size())
+	}
+
+	if s.ReadStrategy == PreadRead {
+		return s.openGuestMemory(fd)
+	}
+
+	mapped, ok := fd.(mappableFile)
+	if !ok {
+		return fmt.Errorf("%w: guest memory file %s has no file descriptor to be mapped, it must be read with the %s strategy",
+			ErrInvalidConfig, s.GuestMemPath, PreadRead)
+	}
+
+	if s.ReadStrategy == WindowedRead {
+		return s.openGuestMemory(newWindowedMapping(mapped, s.GuestMemSize, s.windowSize()))
+	}
 
-	s.guestMem, err = unix.Mmap(int(fd.Fd()), 0, s.GuestMemSize, unix.PROT_READ, unix.MAP_PRIVATE)
+	s.guestMem, err = unix.Mmap(int(mapped.Fd()), 0, s.GuestMemSize, unix.PROT_READ, unix.MAP_PRIVATE)
 	if err != nil {
 		log.Errorf("Failed to mmap guest memory file: %v", err)
 		return err
 	}
 
+	if s.NUMAPlacement {
+		if err := mbindFunc(s.guestMem, s.NUMANode); err != nil {
+			_ = s.unmapGuestMemory()
+			return fmt.Errorf("failed to bind the guest memory to NUMA node %d: %w", s.NUMANode, err)
+		}
+	}
+
+	if s.GuestMemChecksum != "" {
+		if checksum := guestMemoryChecksum(s.guestMem); checksum != s.GuestMemChecksum {
+			_ = s.unmapGuestMemory()
+			return fmt.Errorf("guest memory file %s is corrupt: expected checksum %s, found %s",
+				s.GuestMemPath, s.GuestMemChecksum, checksum)
+		}
+	}
+
+	return nil
+}
+
+// openGuestMemory Reads the guest memory with the reader instead of mapping it,
+// once its checksum, if set, is verified
+func (s *SnapshotState) openGuestMemory(r guestMemReader) error {
+	if s.GuestMemChecksum != "" {
+		checksum, err := guestMemoryFileChecksum(r, s.GuestMemSize)
+		if err != nil {
+			log.Errorf("Failed to read guest memory file: %v", err)
+			return err
+		}
+		if checksum != s.GuestMemChecksum {
+			return fmt.Errorf("guest memory file %s is corrupt: expected checksum %s, found %s",
+				s.GuestMemPath, s.GuestMemChecksum, checksum)
+		}
+	}
+
+	s.guestMemFile = r
+
 	return nil
 }
 
+// GuestMemoryChecksum Returns the checksum of the guest memory file
+// to be set in SnapshotStateCfg when the snapshot is created
+func GuestMemoryChecksum(guestMemPath string) (string, error) {
+	guestMem, err := ioutil.ReadFile(guestMemPath)
+	if err != nil {
+		return "", err
+	}
+
+	return guestMemoryChecksum(guestMem), nil
+}
+
+func guestMemoryChecksum(guestMem []byte) string {
+	sum := sha256.Sum256(guestMem)
+	return hex.EncodeToString(sum[:])
+}
+
 func (s *SnapshotState) unmapGuestMemory() error {
+	if s.guestMemFile != nil {
+		err := s.guestMemFile.Close()
+		s.guestMemFile = nil
+		return err
+	}
+
+	if s.guestMem == nil {
+		return nil
+	}
+
 	if err := unix.Munmap(s.guestMem); err != nil {
 		log.Errorf("Failed to munmap guest memory file: %v", err)
 		return err
 	}
+	s.guestMem = nil
 
 	return nil
 }
@@ -239,181 +679,712 @@ func AlignedBlock(blockSize int) []byte {
 	return block
 }
 
-// fetchState Fetches the working set file (or the whole guest memory) and the VMM state file
-func (s *SnapshotState) fetchState() error {
-	if _, err := ioutil.ReadFile(s.VMMStatePath); err != nil {
+// loadRecord Restores the record of a previous run of the instance from the
+// trace file persisted in the base directory, if there is one
+func (s *SnapshotState) loadRecord() error {
+	if _, err := os.Stat(s.trace.traceFileName); err != nil {
+		if os.IsNotExist(err) {
+			log.Debug("No persisted trace found, the instance is cold")
+			return nil
+		}
+		log.Errorf("Failed to stat the trace file: %v", err)
+		return err
+	}
+
+	if ok, err := s.recordVersionMatches(); err != nil || !ok {
+		return err
+	}
+
+	if err := s.trace.readTrace(); err != nil {
+		return fmt.Errorf("trace file %s is corrupt: %w", s.trace.traceFileName, err)
+	}
+
+	if s.trace.sequenceFileName != "" {
+		// the pages are installed in the order of the offsets without a valid sequence
+		if err := s.trace.readSequence(); err != nil {
+			log.WithFields(log.Fields{"vmID": s.VMID}).Warnf(
+				"Ignoring sequence file %s: %v", s.trace.sequenceFileName, err)
+		}
+	}
+
+	s.trace.buildRegions()
+	s.isRecordReady = true
+
+	return nil
+}
+
+// fetchState Fetches the working set file (or the whole guest memory, if there is no working
+// set file) and the VMM state file. Returns the number of the working set pages that are
+// installed upon the first page fault
+func (s *SnapshotState) fetchState(progress *fetchProgress) (int, error) {
+	if err := s.fetchVMMState(); err != nil {
+		return 0, err
+	}
+
+	pages, err := s.fetchWorkingSet(progress)
+	if err != nil || s.workingSet != nil {
+		return pages, err
+	}
+
+	return 0, s.fetchGuestMemory(progress)
+}
+
+// fetchVMMState Reads the VMM state file into the page cache
+func (s *SnapshotState) fetchVMMState() error {
+	if _, err := readStateFile(s.stateFS, s.VMMStatePath); err != nil {
 		log.Errorf("Failed to fetch VMM state: %v\n", err)
 		return err
 	}
 
-	size := len(s.trace.trace) * os.Getpagesize()
+	return nil
+}
 
-	// O_DIRECT allows to fully leverage disk bandwidth by bypassing the OS page cache
-	f, err := os.OpenFile(s.WorkingSetPath, os.O_RDONLY|syscall.O_DIRECT, 0600)
+// fetchGuestMemory Reads the whole guest memory file into the page cache, reporting the progress if set
+func (s *SnapshotState) fetchGuestMemory(progress *fetchProgress) error {
+	f, err := s.guestMemFS().Open(s.guestMemFilePath())
 	if err != nil {
-		log.Errorf("Failed to open the working set file for direct-io: %v\n", err)
+		log.Errorf("Failed to open the guest memory file: %v\n", err)
 		return err
 	}
+	defer f.Close()
+
+	progress.start(s.GuestMemSize / s.PageSize)
+	buf := make([]byte, progress.chunkPages()*s.PageSize)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			if err := progress.add(n / s.PageSize); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			log.Errorf("Failed to fetch the guest memory: %v\n", err)
+			return err
+		}
+	}
 
-	s.workingSet = AlignedBlock(size) // direct io requires aligned buffer
+	log.Debug("Fetched the entire guest memory")
 
-	if n, err := f.Read(s.workingSet); n != size || err != nil {
-		log.Errorf("Reading working set file failed: %v\n", err)
-		return err
+	return nil
+}
+
+// fetchWorkingSet Reads the working set file of the loaded record into memory, returns the number
+// of the working set pages, which is zero if there is no working set file. Reports the progress if set
+func (s *SnapshotState) fetchWorkingSet(progress *fetchProgress) (int, error) {
+	f, err := s.openWorkingSet()
+	if err != nil || f == nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	workingSet := AlignedBlock(len(s.trace.trace) * s.PageSize) // direct io requires aligned buffer
+	if err := s.readWorkingSet(f, workingSet, progress, nil); err != nil {
+		return 0, err
 	}
 
+	s.workingSet = workingSet
+
 	log.Debug("Fetched the entire working set")
-	if err := f.Close(); err != nil {
-		log.Errorf("Failed to close the working set file: %v\n", err)
-		return err
+
+	return len(s.trace.trace), nil
+}
+
+// openWorkingSet Opens the working set file of the loaded record after checking its size,
+// returns a nil file if there is no working set file
+func (s *SnapshotState) openWorkingSet() (fs.File, error) {
+	pages := len(s.trace.trace)
+	size := pages * s.PageSize
+
+	fileInfo, err := s.stateFS.Stat(s.WorkingSetPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			log.Debug("No working set file found, serving all page faults on demand")
+			return nil, nil
+		}
+		log.Errorf("Failed to stat the working set file: %v\n", err)
+		return nil, err
+	}
+
+	if fileInfo.Size() != int64(size) {
+		return nil, fmt.Errorf("working set file %s is corrupt: expected %d bytes for %d pages, found %d bytes",
+			s.WorkingSetPath, size, pages, fileInfo.Size())
+	}
+
+	f, err := s.openWorkingSetFile()
+	if err != nil {
+		log.Errorf("Failed to open the working set file for direct-io: %v\n", err)
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// readWorkingSet Reads the opened working set file into workingSet in chunks, reporting the progress
+// if set. Calls onChunk, if set, with the number of the pages read so far after every chunk, and
+// aborts the read if it returns an error.
+func (s *SnapshotState) readWorkingSet(f fs.File, workingSet []byte, progress *fetchProgress,
+	onChunk func(fetched int) error) error {
+	size := len(workingSet)
+
+	progress.start(size / s.PageSize)
+	chunk := progress.chunkPages() * s.PageSize
+	for off := 0; off < size; off += chunk {
+		end := off + chunk
+		if end > size {
+			end = size
+		}
+
+		if n, err := f.Read(workingSet[off:end]); n != end-off || err != nil {
+			log.Errorf("Reading working set file failed: %v\n", err)
+			return fmt.Errorf("short read of the working set file %s: read %d of %d bytes: %v",
+				s.WorkingSetPath, off+n, size, err)
+		}
+
+		if err := progress.add((end - off) / s.PageSize); err != nil {
+			return err
+		}
+
+		if onChunk != nil {
+			if err := onChunk(end / s.PageSize); err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
 }
 
-func (s *SnapshotState) pollUserPageFaults(readyCh chan int) {
+// openWorkingSetFile Opens the working set file, bypassing the page cache if it is a local file
+func (s *SnapshotState) openWorkingSetFile() (fs.File, error) {
+	if _, ok := s.stateFS.(OSFS); !ok {
+		return s.stateFS.Open(s.WorkingSetPath)
+	}
+
+	// O_DIRECT allows to fully leverage disk bandwidth by bypassing the OS page cache
+	f, err := os.OpenFile(s.WorkingSetPath, os.O_RDONLY|syscall.O_DIRECT, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// pollUserPageFaults Serves the page faults of the instance until it is deactivated. Every instance
+// polls its uffd with its own epoll instance in its own goroutine, so the page faults of different
+// VMs are never funneled through a single epoll_wait and are served in parallel across the CPUs.
+// The epoll instance holds only the uffd and the wake pipe, and epoll_wait returns at most one
+// event per fd, so a larger event buffer would not save wakeups: a uffd_msg is read per event
+// and the level-triggered uffd wakes the next epoll_wait right away while more faults are queued.
+func (s *SnapshotState) pollUserPageFaults(readyCh chan error) {
 	logger := log.WithFields(log.Fields{"vmID": s.VMID})
 
 	var events [1]syscall.EpollEvent
 
+	defer close(s.loopDone)
+
 	if err := s.registerEpoller(); err != nil {
-		logger.Fatalf("register_epoller: %v", err)
+		readyCh <- err
+		return
 	}
 
 	logger.Debug("Starting polling loop")
 
-	defer syscall.Close(s.epfd)
+	defer s.closeEpoller()
+
+	if s.NUMAPlacement {
+		if err := s.bindToNUMANode(); err != nil {
+			readyCh <- err
+			return
+		}
+	}
 
-	readyCh <- 0
+	readyCh <- nil
 
 	for {
+		atomic.StoreInt64(&s.heartbeat, time.Now().UnixNano())
+
 		select {
 		case <-s.quitCh:
 			logger.Debug("Handler received a signal to quit")
 			return
 		default:
-			nevents, err := syscall.EpollWait(s.epfd, events[:], -1)
+			// wakes up periodically to update the heartbeat of an idle VM
+			nevents, err := syscall.EpollWait(s.epfd, events[:], int(pollHeartbeatInterval/time.Millisecond))
 			if err != nil {
-				logger.Fatalf("epoll_wait: %v", err)
-				break
+				if errors.Is(err, syscall.EINTR) {
+					continue
+				}
+				err = fmt.Errorf("epoll_wait: %w", err)
+			} else {
+				err = s.handleEvents(events[:nevents])
 			}
 
-			if nevents < 1 {
-				panic("Wrong number of events")
+			if err != nil {
+				// the uffd cannot be served anymore, wait for the deactivation
+				atomic.StoreInt32(&s.loopFailed, 1)
+				logger.Errorf("Stopped serving page faults: %v", err)
+				s.reportError(err)
+				<-s.quitCh
+				return
 			}
+		}
+	}
+}
 
-			for i := 0; i < nevents; i++ {
-				event := events[i]
+// handleEvents Serves the page faults signalled by the epoll events. Errors serving
+// individual page faults are reported, an error is returned only if the uffd cannot be read
+func (s *SnapshotState) handleEvents(events []syscall.EpollEvent) error {
+	logger := log.WithFields(log.Fields{"vmID": s.VMID})
 
-				fd := int(event.Fd)
+	for _, event := range events {
+		fd := int(event.Fd)
 
-				stateFd := int(s.userFaultFD.Fd())
+		if fd == s.wakeFds[0] {
+			// the polling loop is about to quit
+			continue
+		}
 
-				if fd != stateFd && stateFd != -1 {
-					logger.Fatalf("Received event from unknown fd")
-				}
+		stateFd := int(s.userFaultFD.Fd())
 
-				goMsg := make([]byte, sizeOfUFFDMsg())
+		if fd != stateFd && stateFd != -1 {
+			logger.Warnf("Received event from unknown fd %d, skipping", fd)
+			continue
+		}
 
-				if nread, err := syscall.Read(fd, goMsg); err != nil || nread != len(goMsg) {
-					if !errors.Is(err, syscall.EBADF) {
-						log.Fatalf("Read uffd_msg failed: %v", err)
-					}
-					break
-				}
+		goMsg := make([]byte, sizeOfUFFDMsg())
 
-				if event := uint8(goMsg[0]); event != uffdPageFault() {
-					log.Fatal("Received wrong event type")
-				}
+		nread, err := s.faultReader.ReadMsg(fd, goMsg)
+		switch {
+		case errors.Is(err, syscall.EAGAIN), errors.Is(err, syscall.EINTR):
+			continue
+		case errors.Is(err, syscall.EBADF):
+			// the uffd has been closed upon deactivation
+			return nil
+		case err != nil:
+			return fmt.Errorf("read uffd_msg: %w", err)
+		case nread != len(goMsg):
+			return fmt.Errorf("read uffd_msg: read %d of %d bytes", nread, len(goMsg))
+		}
 
-				address := binary.LittleEndian.Uint64(goMsg[16:])
+		switch event := uint8(goMsg[0]); event {
+		case uffdPageFault():
+			address, _, kind := parsePageFault(goMsg)
 
-				if err := s.servePageFault(fd, address); err != nil {
-					log.Fatalf("Failed to serve page fault")
-				}
+			if err := s.dispatchUnlessPaused(faultRequest{state: s, kind: kind, fd: fd, address: address}); err != nil {
+				logger.Errorf("Failed to serve page fault at 0x%x: %v", address, err)
+				s.reportError(fmt.Errorf("failed to serve page fault at 0x%x: %w", address, err))
 			}
+		case uffdRemove(), uffdUnmap():
+			// the guest has dropped the pages (e.g., with MADV_DONTNEED),
+			// they fault again upon the next access
+			start := binary.LittleEndian.Uint64(goMsg[8:])
+			end := binary.LittleEndian.Uint64(goMsg[16:])
+
+			_ = s.dispatchUnlessPaused(faultRequest{state: s, kind: removal, address: start, end: end})
+		default:
+			logger.Warnf("Received unexpected event type %d, skipping", event)
 		}
 	}
+
+	return nil
+}
+
+// parsePageFault Returns the address and the flags of the page fault in the uffd_msg, along with
+// the kind of the fault that the flags indicate. The write flag is set upon a write both to a missing
+// page, which is a missing fault, and to a write-protected page, which has the write-protect flag set.
+func parsePageFault(msg []byte) (address, flags uint64, kind faultKind) {
+	flags = binary.LittleEndian.Uint64(msg[8:])
+	address = binary.LittleEndian.Uint64(msg[16:])
+
+	switch {
+	case flags&uffdPageFaultFlagWP() != 0:
+		kind = writeProtectFault
+	case flags&uffdPageFaultFlagMinor() != 0:
+		kind = minorFault
+	default:
+		kind = missingFault
+	}
+
+	return address, flags, kind
+}
+
+// reportError Surfaces an error to the memory manager without blocking the polling loop
+func (s *SnapshotState) reportError(err error) {
+	if s.errCh == nil {
+		return
+	}
+
+	select {
+	case s.errCh <- &VMError{VMID: s.VMID, Err: err}:
+	default:
+		log.WithFields(log.Fields{"vmID": s.VMID}).Warn("Memory manager error channel is full, dropping the error")
+	}
+}
+
+// serveFailed Counts the page fault at the offset that failed to be served and calls onServeError,
+// returning the error. The faulting thread is not woken up, so it hangs on the page.
+func (s *SnapshotState) serveFailed(offset uint64, err error) error {
+	atomic.AddInt64(&s.serveErrors, 1)
+
+	if s.onServeError != nil {
+		s.onServeError(s.VMID, offset, err)
+	}
+
+	return err
 }
 
 func (s *SnapshotState) registerEpoller() error {
 	logger := log.WithFields(log.Fields{"vmID": s.VMID})
 
 	var (
-		err   error
-		event syscall.EpollEvent
-		fdInt int
+		err     error
+		wakeFds [2]int
 	)
 
-	fdInt = int(s.userFaultFD.Fd())
-
-	event.Events = syscall.EPOLLIN
-	event.Fd = int32(fdInt)
-
-	s.epfd, err = syscall.EpollCreate1(0)
+	s.epfd, err = epollCreateFunc(0)
 	if err != nil {
 		logger.Errorf("Failed to create epoller %v", err)
 		return err
 	}
 
-	if err := syscall.EpollCtl(
-		s.epfd,
-		syscall.EPOLL_CTL_ADD,
-		fdInt,
-		&event,
-	); err != nil {
-		logger.Errorf("Failed to subscribe VM %v", err)
+	if err := syscall.Pipe2(wakeFds[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		logger.Errorf("Failed to create wake up pipe %v", err)
+		syscall.Close(s.epfd)
 		return err
 	}
 
+	for _, fdInt := range []int{int(s.userFaultFD.Fd()), wakeFds[0]} {
+		event := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fdInt)}
+
+		if err := syscall.EpollCtl(
+			s.epfd,
+			syscall.EPOLL_CTL_ADD,
+			fdInt,
+			&event,
+		); err != nil {
+			logger.Errorf("Failed to subscribe VM %v", err)
+			syscall.Close(wakeFds[0])
+			syscall.Close(wakeFds[1])
+			syscall.Close(s.epfd)
+			return err
+		}
+	}
+
+	s.wakeFds = wakeFds
+
 	return nil
 }
 
-func (s *SnapshotState) servePageFault(fd int, address uint64) error {
+// closeEpoller Closes the epoller and the wake up pipe once the polling loop has quit
+func (s *SnapshotState) closeEpoller() {
+	syscall.Close(s.epfd)
+	syscall.Close(s.wakeFds[0])
+	syscall.Close(s.wakeFds[1])
+}
+
+// isServing Returns true if the polling loop of the active instance serves its page faults
+func (s *SnapshotState) isServing() bool {
+	if s.userFaultFD == nil || atomic.LoadInt32(&s.loopFailed) != 0 {
+		return false
+	}
+
+	select {
+	case <-s.loopDone:
+		return false
+	default:
+		return true
+	}
+}
+
+// isPolling Returns true if the polling loop has polled the uffd within pollStallTimeout
+func (s *SnapshotState) isPolling(now time.Time) bool {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&s.heartbeat))) < pollStallTimeout
+}
+
+// stopPolling Makes the polling loop quit and waits until it does.
+// The page faults that the loop has queued to a worker may still be in flight.
+func (s *SnapshotState) stopPolling() {
+	select {
+	case <-s.quitCh:
+		// already stopped
+	default:
+		// the pipe is closed by the polling loop only after quitCh is closed
+		if s.wakeFds[1] != -1 {
+			_, _ = syscall.Write(s.wakeFds[1], []byte{0})
+		}
+		close(s.quitCh)
+	}
+
+	<-s.loopDone
+}
+
+// waitInflightFaults Waits until the page faults queued to a worker are served or the context is done
+func (s *SnapshotState) waitInflightFaults(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.inflightFaults.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *SnapshotState) servePageFault(fd int, address uint64) error {
 	var (
 		tStart              time.Time
 		workingSetInstalled bool
+		eagerErr            error
+		eagerRestored       bool
+		wpErr               error
+		softDirtyErr        error
+		minorErr            error
+		residentInstalled   int
+		residentErr         error
+		workingSetErr       error
+		streamedInstalled   int
+		streamErr           error
 	)
 
+	tServe := time.Now()
+
+	_, span := s.startSpan(s.traceCtx, "memory_manager.ServePageFault")
+	defer span.End()
+
+	// the fault address may point anywhere within the page
+	address &^= uint64(s.PageSize - 1)
+
+	logger := s.faultLogger(address)
+
 	s.firstPageFaultOnce.Do(
 		func() {
-			s.startAddress = address
+			atomic.StoreInt64(&s.firstFaultAt, tServe.UnixNano())
 
-			if s.isRecordReady && !s.IsLazyMode {
+			if s.softDirty {
+				// the pages installed upon the first page fault have not been written by the guest,
+				// while the pages installed later are dirty as far as the soft-dirty bits tell
+				defer func() { softDirtyErr = s.resetSoftDirty() }()
+			}
+
+			// read concurrently by DumpState
+			switch {
+			case len(s.Regions) > 0:
+				atomic.StoreUint64(&s.startAddress, s.Regions[0].BaseAddress)
+			case s.GuestPhysBase != 0:
+				atomic.StoreUint64(&s.startAddress, s.GuestPhysBase)
+			default:
+				atomic.StoreUint64(&s.startAddress, address)
+			}
+
+			for _, r := range s.guestRegions() {
+				if s.usesUFFDWriteProtect() && wpErr == nil {
+					// the pages are write-protected upon installation
+					wpErr = registerWriteProtectFunc(fd, r.BaseAddress, uint64(r.Size))
+				}
+
+				if s.MinorFaults && minorErr == nil {
+					// the pages present in the page cache fault as minor faults from now on
+					minorErr = registerMinorFaultsFunc(fd, r.BaseAddress, uint64(r.Size))
+				}
+			}
+
+			if s.EagerRestore {
+				eagerErr = s.installGuestMemory(fd)
+				eagerRestored = eagerErr == nil
+				return
+			}
+
+			if s.isRecordReady && !s.IsLazyMode && s.workingSet != nil {
 				if s.metricsModeOn {
 					tStart = time.Now()
 				}
-				s.installWorkingSetPages(fd)
+				workingSetErr = s.installWorkingSetPages(fd)
 				if s.metricsModeOn {
 					s.currentMetric.MetricMap[installWSMetric] = metrics.ToUS(time.Since(tStart))
 				}
 
-				workingSetInstalled = true
+				workingSetInstalled = workingSetErr == nil
+			}
+
+			if s.wsStream != nil && s.workingSet == nil {
+				// the rest of the working set is installed as it is fetched
+				s.wsStream.fd = fd
+				streamedInstalled, streamErr = s.installStreamedPages(s.wsStream)
+			}
+
+			if s.residentPages != nil {
+				residentInstalled, residentErr = s.installResidentPages(fd)
 			}
 		})
 
-	if workingSetInstalled {
+	if eagerRestored || workingSetInstalled || (residentInstalled > 0 && residentErr == nil) {
+		atomic.StoreInt64(&s.prefetchedAt, time.Now().UnixNano())
+	}
+
+	if wpErr != nil {
+		return fmt.Errorf("failed to register for write-protect faults: %w", wpErr)
+	}
+
+	if softDirtyErr != nil {
+		return fmt.Errorf("failed to clear the soft-dirty bits: %w", softDirtyErr)
+	}
+
+	if minorErr != nil {
+		return fmt.Errorf("failed to register for minor faults: %w", minorErr)
+	}
+
+	if eagerErr != nil {
+		span.SetAttribute("error", eagerErr.Error())
+		return fmt.Errorf("failed to restore the guest memory eagerly: %w", eagerErr)
+	}
+
+	if eagerRestored {
+		span.SetAttribute("eager", true)
+		if logger != nil {
+			logger.Trace("Served page fault by restoring the guest memory eagerly")
+		}
+		s.countServedFault(tServe)
 		return nil
 	}
 
-	offset := address - s.startAddress
+	if workingSetErr != nil {
+		span.SetAttribute("error", workingSetErr.Error())
+		return fmt.Errorf("failed to install the working set: %w", workingSetErr)
+	}
 
-	src := uint64(uintptr(unsafe.Pointer(&s.guestMem[offset])))
-	dst := uint64(int64(address) & ^(int64(os.Getpagesize()) - 1))
-	mode := uint64(0)
+	if residentErr != nil {
+		span.SetAttribute("error", residentErr.Error())
+		return fmt.Errorf("failed to install the resident pages: %w", residentErr)
+	}
+
+	if streamErr != nil {
+		span.SetAttribute("error", streamErr.Error())
+		return fmt.Errorf("failed to install the streamed working set: %w", streamErr)
+	}
+
+	offset, err := s.faultOffset(address)
+	if err != nil {
+		span.SetAttribute("error", err.Error())
+		return err
+	}
 
-	rec := Record{
-		offset: offset,
+	faultPage := int(offset) / s.PageSize
+
+	if residentInstalled > 0 {
+		atomic.AddInt64(&s.prefetchedPages, int64(residentInstalled))
+		if s.servedPages.Test(faultPage) {
+			span.SetAttribute("offset", offset)
+			span.SetAttribute("resident", true)
+			if logger != nil {
+				logger.WithField("offset", offset).Trace("Served page fault from the resident pages")
+			}
+			if err := s.installer.Wake(fd, address, s.PageSize); err != nil {
+				return s.serveFailed(offset, fmt.Errorf("wake: %w", err))
+			}
+			s.countServedFault(tServe)
+			return nil
+		}
 	}
 
-	if !s.isRecordReady {
-		s.trace.AppendRecord(rec)
+	if streamedInstalled > 0 && s.servedPages.Test(faultPage) {
+		span.SetAttribute("offset", offset)
+		span.SetAttribute("streamed", true)
+		if logger != nil {
+			logger.WithField("offset", offset).Trace("Served page fault from the streamed working set")
+		}
+		if err := s.installer.Wake(fd, address, s.PageSize); err != nil {
+			return s.serveFailed(offset, fmt.Errorf("wake: %w", err))
+		}
+		s.countServedFault(tServe)
+		return nil
+	}
+
+	if workingSetInstalled {
+		span.SetAttribute("offset", offset)
+		span.SetAttribute("workingSet", true)
+		if logger != nil {
+			logger.WithField("offset", offset).Trace("Served page fault by installing the working set")
+		}
+		atomic.AddInt64(&s.workingSetInstalls, int64(len(s.trace.trace)))
+		atomic.AddInt64(&s.prefetchedPages, int64(len(s.trace.trace)))
+		s.countServedFault(tServe)
+		return nil
+	}
+
+	firstPage, numPages := faultPage, 1
+
+	run, hot := s.hotPage(offset)
+	if hot {
+		// the hot page is installed alone, without reading ahead from the guest memory file
+		defer s.hotPages.release(s.snapshotID(), offset)
+		span.SetAttribute("hotPage", true)
+		atomic.AddInt64(&s.hotPageInstalls, 1)
 	} else {
-		log.Debug("Serving a page that is missing from the working set")
+		firstPage, numPages = s.getInstallRun(faultPage)
+		firstPage, numPages = s.clipToRegion(faultPage, firstPage, numPages)
+
+		var mem []byte
+		mem, firstPage, numPages = s.clipToSource(faultPage, firstPage, numPages)
+		if s.readAhead != nil {
+			s.readAhead.installed(firstPage + numPages)
+		}
+
+		if s.rateLimiter != nil {
+			// blocks the polling loop or the worker serving the VM along with the faulting thread
+			if delay := s.rateLimiter.wait(numPages); delay > 0 {
+				span.SetAttribute("throttledUs", delay.Microseconds())
+			}
+		}
+
+		if s.sharedMem != nil {
+			var read int
+			run, read = s.sharedMem.fill(s.guestMem, firstPage, numPages)
+			atomic.AddInt64(&s.backingReads, int64(read))
+		} else {
+			atomic.AddInt64(&s.backingReads, int64(numPages))
+			if run, err = s.readPages(mem, firstPage, numPages); err != nil {
+				span.SetAttribute("error", err.Error())
+				return s.serveFailed(offset, err)
+			}
+		}
+
+		if s.hotPages != nil {
+			s.hotPages.admit(s.snapshotID(), uint64(firstPage*s.PageSize), run)
+		}
 	}
 
-	if s.metricsModeOn {
-		if s.isRecordReady {
+	src := uint64(uintptr(unsafe.Pointer(&run[0])))
+	dst := s.pageAddress(firstPage)
+	regionLen := uint64(numPages * s.PageSize)
+	mode := uint64(0)
+	if s.usesUFFDWriteProtect() {
+		mode |= uint64(C.const_UFFDIO_COPY_MODE_WP)
+	}
+
+	if s.isRecordReady && log.IsLevelEnabled(log.DebugLevel) {
+		log.WithFields(log.Fields{"vmID": s.VMID, "address": fmt.Sprintf("0x%x", address), "pages": numPages}).Debug(
+			"Serving pages that are missing from the working set")
+	}
+
+	for page := firstPage; page < firstPage+numPages; page++ {
+		rec := Record{
+			offset: uint64(page * s.PageSize),
+		}
+
+		// only the faulting page is known to be touched by the guest, the pages installed along
+		// with it are served on demand upon replay if the guest touches them
+		if !s.isRecordReady && page == faultPage {
+			s.trace.AppendRecord(rec)
+		}
+
+		if s.metricsModeOn && s.isRecordReady {
 			if s.IsLazyMode {
 				if !s.trace.containsRecord(rec) {
 					s.uniqueNum++
@@ -422,24 +1393,276 @@ func (s *SnapshotState) servePageFault(fd int, address uint64) error {
 			} else {
 				s.uniqueNum++
 			}
-
 		}
+	}
+
+	// UFFDIO_ZEROPAGE cannot write-protect the pages it installs
+	isZero := !s.usesUFFDWriteProtect() && !s.noZeroPage && s.isZeroRun(run, firstPage, numPages)
 
+	if s.metricsModeOn || s.tracer != nil || logger != nil {
 		tStart = time.Now()
 	}
 
-	err := installRegion(fd, src, dst, mode, 1)
+	if isZero {
+		err = s.installer.ZeroPage(fd, dst, mode, regionLen)
+	} else {
+		err = s.installer.Copy(fd, src, dst, mode, regionLen)
+	}
 
 	if s.metricsModeOn {
 		s.currentMetric.MetricMap[serveUniqueMetric] += metrics.ToUS(time.Since(tStart))
 	}
 
-	return err
+	if s.tracer != nil {
+		span.SetAttribute("offset", offset)
+		span.SetAttribute("pages", numPages)
+		span.SetAttribute("zeroPage", isZero)
+		span.SetAttribute("installLatencyUs", time.Since(tStart).Microseconds())
+	}
+
+	if logger != nil {
+		traceInstall(logger.WithFields(log.Fields{
+			"offset":         offset,
+			"pages":          numPages,
+			"readAheadPages": firstPage + numPages - 1 - faultPage,
+			"zeroPage":       isZero,
+			"installUs":      time.Since(tStart).Microseconds(),
+		}), err)
+	}
+
+	present := errors.Is(err, errAlreadyPresent)
+	if err != nil && !present {
+		span.SetAttribute("error", err.Error())
+		return s.serveFailed(offset, err)
+	}
+
+	atomic.AddInt64(&s.servedPagesNum, int64(s.servedPages.SetRange(firstPage, numPages)))
+	switch {
+	case present:
+		// the ioctl does not wake up the faulting thread if it fails
+		if err := s.installer.Wake(fd, dst, int(regionLen)); err != nil {
+			return s.serveFailed(offset, fmt.Errorf("wake: %w", err))
+		}
+		atomic.AddInt64(&s.alreadyPresent, int64(numPages))
+	case isZero:
+		atomic.AddInt64(&s.zeroInstalls, int64(numPages))
+	default:
+		atomic.AddInt64(&s.copyInstalls, int64(numPages))
+	}
+	if s.isRecordReady && !s.IsLazyMode {
+		atomic.AddInt64(&s.workingSetMisses, int64(numPages))
+		atomic.AddInt64(&s.missedFaultPages, int64(numPages))
+	}
+	s.countServedFault(tServe)
+
+	return nil
+}
+
+// faultLogger Returns the logger of the page fault at the address, or nil unless
+// the trace level is enabled, so that the page faults are not logged by default
+func (s *SnapshotState) faultLogger(address uint64) *log.Entry {
+	if !log.IsLevelEnabled(log.TraceLevel) {
+		return nil
+	}
+
+	return log.WithFields(log.Fields{"vmID": s.VMID, "address": fmt.Sprintf("0x%x", address)})
+}
+
+// traceInstall Logs the installation of the pages of a page fault, along with
+// the errno of the ioctl if it failed
+func traceInstall(logger *log.Entry, err error) {
+	switch {
+	case err == nil:
+		logger.Trace("Served page fault")
+		return
+	case errors.Is(err, errAlreadyPresent):
+		logger.Trace("Served page fault, the pages are present already")
+		return
+	}
+
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		logger = logger.WithField("errno", int(errno))
+	}
+	logger.WithError(err).Trace("Failed to install the pages of the page fault")
+}
+
+// faultOffset Returns the offset of the fault address within the guest memory file, or an error
+// if the address is outside of the guest memory regions or the start address of the guest memory is unknown
+func (s *SnapshotState) faultOffset(address uint64) (uint64, error) {
+	if len(s.Regions) == 0 {
+		start := s.GuestPhysBase
+		if start == 0 {
+			start = s.startAddress
+		}
+		if start == 0 {
+			return 0, fmt.Errorf("%w: fault at 0x%x before the start address is known", ErrFaultOutOfRange, address)
+		}
+
+		end := start + uint64(s.GuestMemSize)
+		if address < start || address >= end {
+			return 0, fmt.Errorf("%w: fault at 0x%x outside of [0x%x, 0x%x)", ErrFaultOutOfRange, address, start, end)
+		}
+
+		return address - start, nil
+	}
+
+	for _, r := range s.Regions {
+		if address >= r.BaseAddress && address < r.BaseAddress+uint64(r.Size) {
+			return uint64(r.Offset) + address - r.BaseAddress, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: fault at 0x%x outside of the %d guest memory regions", ErrFaultOutOfRange, address, len(s.Regions))
+}
+
+func (s *SnapshotState) countServedFault(tServe time.Time) {
+	latency := time.Since(tServe)
+
+	atomic.AddInt64(&s.faultsServed, 1)
+	atomic.AddInt64(&s.serveTimeNs, int64(latency))
+	s.serveLatency.observe(latency)
+
+	if s.onFirstFault != nil {
+		s.firstServedOnce.Do(func() { s.onFirstFault(s.VMID, tServe.Add(latency)) })
+	}
+
+	if s.onWorkingSetComplete != nil && s.isWorkingSetServed() {
+		s.workingSetOnce.Do(func() { s.onWorkingSetComplete(s.VMID) })
+	}
+}
+
+// isWorkingSetServed Returns true once as many pages are served as the recorded working set has
+// in replay mode, or once the pages prefetched upon the first page fault are installed otherwise
+func (s *SnapshotState) isWorkingSetServed() bool {
+	if s.isRecordReady && !s.IsLazyMode && s.workingSet != nil {
+		return atomic.LoadInt64(&s.servedPagesNum) >= int64(s.trace.Len())
+	}
+
+	return atomic.LoadInt64(&s.prefetchedAt) != 0
+}
+
+// isZeroRun Returns true if all pages of the run, whose contents are in run, are zero-filled
+// in the guest memory. The result of the check is cached per page as the guest memory file
+// does not change.
+func (s *SnapshotState) isZeroRun(run []byte, firstPage, numPages int) bool {
+	pageSize := s.PageSize
+
+	for page := firstPage; page < firstPage+numPages; page++ {
+		if !s.zeroCheckedPages.Test(page) {
+			offset := (page - firstPage) * pageSize
+			if isZeroFilled(run[offset : offset+pageSize]) {
+				s.zeroPages.Set(page)
+			}
+			s.zeroCheckedPages.Set(page)
+		}
+
+		if !s.zeroPages.Test(page) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isZeroFilled Returns true if all bytes of the buffer are zero
+func isZeroFilled(buf []byte) bool {
+	for len(buf) > 0 {
+		n := len(buf)
+		if n > len(zeroPage) {
+			n = len(zeroPage)
+		}
+		if !bytes.Equal(buf[:n], zeroPage[:n]) {
+			return false
+		}
+		buf = buf[n:]
+	}
+
+	return true
+}
+
+// removePages Marks the pages in the range [start, end) of guest addresses as not served
+func (s *SnapshotState) removePages(start, end uint64) {
+	if s.startAddress == 0 {
+		// no page has been served yet
+		return
+	}
+
+	pageSize := uint64(s.PageSize)
+
+	for _, r := range s.guestRegions() {
+		from, to := start, end
+		regionEnd := r.BaseAddress + uint64(r.Size)
+
+		if from < r.BaseAddress {
+			from = r.BaseAddress
+		}
+		if to > regionEnd {
+			to = regionEnd
+		}
+		if from >= to {
+			continue
+		}
+
+		first := (r.Offset + int(from-r.BaseAddress)) / s.PageSize
+		last := (r.Offset + int(to-r.BaseAddress+pageSize-1)) / s.PageSize
+
+		atomic.AddInt64(&s.servedPagesNum, -int64(s.servedPages.ClearRange(first, last-first)))
+	}
 }
 
-func (s *SnapshotState) installWorkingSetPages(fd int) {
+// getInstallRun Returns the run of contiguous pages to install upon a fault on the page.
+// The run is contained in the chunk of installChunkPages pages that includes the faulting page,
+// extended by readAheadPages pages, or the adaptive read-ahead window, past the faulting page,
+// and is clamped at the end of the guest memory and at the pages that have been served already.
+// Only the faulting page is installed while the node is under memory pressure.
+func (s *SnapshotState) getInstallRun(page int) (int, int) {
+	chunk, readAhead := s.installChunkPages, s.readAheadPages
+	if s.readAhead != nil {
+		readAhead = s.readAhead.next(page)
+	}
+	if s.onDemand() {
+		chunk, readAhead = 1, 0
+	}
+	if chunk < 1 {
+		chunk = 1
+	}
+
+	chunkStart := page - page%chunk
+	chunkEnd := chunkStart + chunk
+	if readAheadEnd := page + 1 + readAhead; readAheadEnd > chunkEnd {
+		chunkEnd = readAheadEnd
+	}
+	if chunkEnd > s.servedPages.Len() {
+		chunkEnd = s.servedPages.Len()
+	}
+
+	first, last := page, page
+	for first > chunkStart && !s.servedPages.Test(first-1) {
+		first--
+	}
+	for last+1 < chunkEnd && !s.servedPages.Test(last+1) {
+		last++
+	}
+
+	return first, last - first + 1
+}
+
+func (s *SnapshotState) installWorkingSetPages(fd int) error {
 	log.Debug("Installing the working set pages")
 
+	mode := uint64(C.const_UFFDIO_COPY_MODE_DONTWAKE)
+	if s.usesUFFDWriteProtect() {
+		mode |= uint64(C.const_UFFDIO_COPY_MODE_WP)
+	}
+
+	if s.trace.sequence != nil {
+		if err := s.installWorkingSetSequence(fd, mode); err != nil {
+			return err
+		}
+		return s.installer.Wake(fd, s.startAddress, s.PageSize)
+	}
+
 	// build a list of sorted regions
 	keys := make([]uint64, 0)
 	for k := range s.trace.regions {
@@ -453,33 +1676,266 @@ func (s *SnapshotState) installWorkingSetPages(fd int) {
 
 	for _, offset := range keys {
 		regLength := s.trace.regions[offset]
-		regAddress := s.startAddress + offset
-		mode := uint64(C.const_UFFDIO_COPY_MODE_DONTWAKE)
+		if err := s.installWorkingSetRun(fd, mode, int(offset)/s.PageSize, regLength, srcOffset); err != nil {
+			return err
+		}
+		srcOffset += uint64(regLength * s.PageSize)
+	}
+
+	return s.installer.Wake(fd, s.startAddress, s.PageSize)
+}
+
+// installWorkingSetSequence Installs the working set pages in the order of the recorded
+// page faults, coalescing the pages that are contiguous both in the sequence and in memory
+func (s *SnapshotState) installWorkingSetSequence(fd int, mode uint64) error {
+	// the working set file stores the pages in the order of their offsets,
+	// i.e., in the order of the records sorted by buildRegions
+	index := make(map[uint64]int, len(s.trace.trace))
+	for i, rec := range s.trace.trace {
+		index[rec.offset] = i
+	}
+
+	seq := s.trace.sequence
+	for i := 0; i < len(seq); {
+		n := 1
+		for i+n < len(seq) && seq[i+n] == seq[i+n-1]+uint64(s.PageSize) {
+			n++
+		}
+
+		srcOffset := uint64(index[seq[i]] * s.PageSize)
+		if err := s.installWorkingSetRun(fd, mode, int(seq[i])/s.PageSize, n, srcOffset); err != nil {
+			return err
+		}
+		i += n
+	}
+
+	return nil
+}
+
+// installWorkingSetRun Installs num contiguous pages starting at page from srcOffset of
+// the working set, a run may span several guest memory regions. The pages installed already,
+// e.g., by PrefetchPages, are skipped.
+func (s *SnapshotState) installWorkingSetRun(fd int, mode uint64, first, num int, srcOffset uint64) error {
+	for page := first; page < first+num; {
+		_, n := s.clipToRegion(page, page, first+num-page)
 		src := uint64(uintptr(unsafe.Pointer(&s.workingSet[srcOffset])))
-		dst := regAddress
+		dst := s.pageAddress(page)
+
+		err := s.installer.Copy(fd, src, dst, mode, uint64(n*s.PageSize))
+		switch {
+		case errors.Is(err, errAlreadyPresent):
+			atomic.AddInt64(&s.alreadyPresent, int64(n))
+		case err != nil:
+			return fmt.Errorf("failed to install %d pages at offset %#x: %w", n, page*s.PageSize, err)
+		}
+		atomic.AddInt64(&s.servedPagesNum, int64(s.servedPages.SetRange(page, n)))
+
+		srcOffset += uint64(n * s.PageSize)
+		page += n
+	}
+
+	return nil
+}
+
+// eagerRestoreChunkSize is the size of the UFFDIO_COPY calls that install the whole guest memory
+const eagerRestoreChunkSize = 2 << 20
+
+// installGuestMemory Installs all pages of the guest memory in large chunks, after which the VM
+// does not fault anymore. The first chunk, which contains the faulting page, is installed last,
+// waking up the faulting thread once the whole guest memory is in place.
+func (s *SnapshotState) installGuestMemory(fd int) error {
+	log.Debug("Installing the whole guest memory")
+
+	chunk := eagerRestoreChunkSize
+	if chunk < s.PageSize {
+		chunk = s.PageSize
+	}
+
+	wpMode := uint64(0)
+	if s.usesUFFDWriteProtect() {
+		wpMode = uint64(C.const_UFFDIO_COPY_MODE_WP)
+	}
+
+	// the chunks do not span several guest memory regions
+	chunkLen := func(offset int) int {
+		_, regionEnd := s.regionPages(offset / s.PageSize)
+		if end := regionEnd * s.PageSize; offset+chunk > end {
+			return end - offset
+		}
+		return chunk
+	}
+
+	install := func(offset int, mode uint64) error {
+		n := chunkLen(offset)
+
+		run, err := s.readPages(s.guestMem, offset/s.PageSize, n/s.PageSize)
+		if err != nil {
+			return err
+		}
+
+		src := uint64(uintptr(unsafe.Pointer(&run[0])))
+		if err := s.installer.Copy(fd, src, s.pageAddress(offset/s.PageSize), mode|wpMode, uint64(n)); err != nil {
+			return err
+		}
+
+		pages := s.servedPages.SetRange(offset/s.PageSize, n/s.PageSize)
+		atomic.AddInt64(&s.servedPagesNum, int64(pages))
+		atomic.AddInt64(&s.copyInstalls, int64(pages))
+		atomic.AddInt64(&s.backingReads, int64(pages))
+
+		return nil
+	}
 
-		if err := installRegion(fd, src, dst, mode, uint64(regLength)); err != nil {
-			log.Fatalf("install_region: %v", err)
+	for offset := chunkLen(0); offset < s.GuestMemSize; offset += chunkLen(offset) {
+		if err := install(offset, uint64(C.const_UFFDIO_COPY_MODE_DONTWAKE)); err != nil {
+			return err
 		}
+	}
+
+	return install(0, 0)
+}
 
-		srcOffset += uint64(regLength) * 4096
+var (
+	// registerWriteProtectFunc and writeProtectFunc register the guest memory for
+	// write-protect faults and (un)protect pages, replaced in tests as well
+	registerWriteProtectFunc = registerWriteProtect
+	writeProtectFunc         = writeProtect
+
+	// issues a single UFFDIO_COPY, replaced in tests to simulate short copies
+	uffdCopyFunc = uffdCopy
+
+	// registers the guest memory for minor faults, replaced in tests as well
+	registerMinorFaultsFunc = registerMinorFaults
+
+	// checks that the fd received from the VM is a uffd, replaced in tests that pass pipes instead
+	checkUFFDFunc = checkUFFD
+
+	// creates the epoll instance of the polling loop, replaced in tests to inject failures
+	epollCreateFunc = syscall.EpollCreate1
+
+	zeroPage = make([]byte, os.Getpagesize())
+
+	// returned when installing a region if a page of it is present already
+	errAlreadyPresent = errors.New("page already present")
+)
+
+// installErr Returns errAlreadyPresent if the ioctl installing a region failed with EEXIST,
+// which is benign as the page has been installed already, e.g., by a concurrent page fault
+func installErr(err error) error {
+	if errors.Is(err, unix.EEXIST) {
+		return fmt.Errorf("%w: %v", errAlreadyPresent, err)
 	}
 
-	wake(fd, s.startAddress, os.Getpagesize())
+	return err
 }
 
+// installRegion Installs the region with UFFDIO_COPY. The ioctl copies only a part of the region
+// if it is interrupted, e.g., by a signal, in which case the remainder of the region is copied again.
 func installRegion(fd int, src, dst, mode, len uint64) error {
+	for {
+		copied, err := uffdCopyFunc(fd, src, dst, mode, len)
+		if copied > 0 && uint64(copied) < len {
+			src += uint64(copied)
+			dst += uint64(copied)
+			len -= uint64(copied)
+			continue
+		}
+
+		if err != nil {
+			return installErr(err)
+		}
+
+		return nil
+	}
+}
+
+// uffdCopy Issues UFFDIO_COPY, returns the number of the bytes copied, or a negative errno
+func uffdCopy(fd int, src, dst, mode, len uint64) (int64, error) {
 	cUC := C.struct_uffdio_copy{
 		mode: C.ulonglong(mode),
 		copy: 0,
 		src:  C.ulonglong(src),
 		dst:  C.ulonglong(dst),
-		len:  C.ulonglong(uint64(os.Getpagesize()) * len),
+		len:  C.ulonglong(len),
 	}
 
 	err := ioctl(uintptr(fd), int(C.const_UFFDIO_COPY), unsafe.Pointer(&cUC))
+
+	return int64(cUC.copy), err
+}
+
+func zeroRegion(fd int, dst, mode, len uint64) error {
+	cUZ := C.struct_uffdio_zeropage{
+		_range: C.struct_uffdio_range{
+			start: C.ulonglong(dst),
+			len:   C.ulonglong(len),
+		},
+		mode:     C.ulonglong(mode),
+		zeropage: 0,
+	}
+
+	err := ioctl(uintptr(fd), int(C.const_UFFDIO_ZEROPAGE), unsafe.Pointer(&cUZ))
 	if err != nil {
-		return err
+		return installErr(err)
+	}
+
+	return nil
+}
+
+func registerWriteProtect(fd int, start, len uint64) error {
+	cUR := C.struct_uffdio_register{
+		_range: C.struct_uffdio_range{
+			start: C.ulonglong(start),
+			len:   C.ulonglong(len),
+		},
+		mode: C.ulonglong(C.const_UFFDIO_REGISTER_MODE_MISSING | C.const_UFFDIO_REGISTER_MODE_WP),
+	}
+
+	return ioctl(uintptr(fd), int(C.const_UFFDIO_REGISTER), unsafe.Pointer(&cUR))
+}
+
+func writeProtect(fd int, start, len uint64, protect bool) error {
+	mode := uint64(0)
+	if protect {
+		mode = uint64(C.const_UFFDIO_WRITEPROTECT_MODE_WP)
+	}
+
+	cUW := C.struct_uffdio_writeprotect{
+		_range: C.struct_uffdio_range{
+			start: C.ulonglong(start),
+			len:   C.ulonglong(len),
+		},
+		mode: C.ulonglong(mode),
+	}
+
+	return ioctl(uintptr(fd), int(C.const_UFFDIO_WRITEPROTECT), unsafe.Pointer(&cUW))
+}
+
+func registerMinorFaults(fd int, start, len uint64) error {
+	cUR := C.struct_uffdio_register{
+		_range: C.struct_uffdio_range{
+			start: C.ulonglong(start),
+			len:   C.ulonglong(len),
+		},
+		mode: C.ulonglong(C.const_UFFDIO_REGISTER_MODE_MISSING | C.const_UFFDIO_REGISTER_MODE_MINOR),
+	}
+
+	return ioctl(uintptr(fd), int(C.const_UFFDIO_REGISTER), unsafe.Pointer(&cUR))
+}
+
+func continueRegion(fd int, start, len uint64) error {
+	cUC := C.struct_uffdio_continue{
+		_range: C.struct_uffdio_range{
+			start: C.ulonglong(start),
+			len:   C.ulonglong(len),
+		},
+		mode:   0,
+		mapped: 0,
+	}
+
+	err := ioctl(uintptr(fd), int(C.const_UFFDIO_CONTINUE), unsafe.Pointer(&cUC))
+	if err != nil {
+		return installErr(err)
 	}
 
 	return nil
@@ -496,22 +1952,19 @@ func ioctl(fd uintptr, request int, argp unsafe.Pointer) error {
 		uintptr(argp),
 	)
 	if errno != 0 {
-		return os.NewSyscallError("ioctl", fmt.Errorf("%d", int(errno)))
+		return os.NewSyscallError("ioctl", errno)
 	}
 
 	return nil
 }
 
-func wake(fd int, startAddress uint64, len int) {
+func wake(fd int, startAddress uint64, len int) error {
 	cUR := C.struct_uffdio_range{
 		start: C.ulonglong(startAddress),
 		len:   C.ulonglong(len),
 	}
 
-	err := ioctl(uintptr(fd), int(C.const_UFFDIO_WAKE), unsafe.Pointer(&cUR))
-	if err != nil {
-		log.Fatalf("ioctl failed: %v", err)
-	}
+	return ioctl(uintptr(fd), int(C.const_UFFDIO_WAKE), unsafe.Pointer(&cUR))
 }
 
 //nolint:deadcode,unused
@@ -526,3 +1979,31 @@ func sizeOfUFFDMsg() int {
 func uffdPageFault() uint8 {
 	return uint8(C.const_UFFD_EVENT_PAGEFAULT)
 }
+
+func uffdCopyModeDontWake() uint64 {
+	return uint64(C.const_UFFDIO_COPY_MODE_DONTWAKE)
+}
+
+func uffdCopyModeWP() uint64 {
+	return uint64(C.const_UFFDIO_COPY_MODE_WP)
+}
+
+func uffdPageFaultFlagWP() uint64 {
+	return uint64(C.const_UFFD_PAGEFAULT_FLAG_WP)
+}
+
+func uffdPageFaultFlagWrite() uint64 {
+	return uint64(C.const_UFFD_PAGEFAULT_FLAG_WRITE)
+}
+
+func uffdPageFaultFlagMinor() uint64 {
+	return uint64(C.const_UFFD_PAGEFAULT_FLAG_MINOR)
+}
+
+func uffdRemove() uint8 {
+	return uint8(C.const_UFFD_EVENT_REMOVE)
+}
+
+func uffdUnmap() uint8 {
+	return uint8(C.const_UFFD_EVENT_UNMAP)
+}
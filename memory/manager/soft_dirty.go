@@ -0,0 +1,185 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// pagemapSoftDirty is the soft-dirty bit of the /proc/pid/pagemap entries
+	pagemapSoftDirty = 1 << 55
+	// pagemapEntrySize is the size of the pagemap entry of a system page
+	pagemapEntrySize = 8
+	// maxPagemapRead is the maximum number of the pagemap entries read at once
+	maxPagemapRead = 64 * 1024
+)
+
+var (
+	// clearSoftDirtyFunc and softDirtyPagesFunc clear and read the soft-dirty bits of a process,
+	// replaced in tests
+	clearSoftDirtyFunc = clearSoftDirty
+	softDirtyPagesFunc = softDirtyPages
+)
+
+// clearSoftDirty Clears the soft-dirty bits of all the pages of the process, after which
+// the kernel sets the bits of the pages that the process writes
+func clearSoftDirty(pid int) error {
+	f, err := os.OpenFile("/proc/"+strconv.Itoa(pid)+"/clear_refs", os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// 4 clears the soft-dirty bits, see Documentation/admin-guide/mm/soft-dirty.rst
+	if _, err := f.Write([]byte("4")); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// softDirtyPages Returns the bitmap of the system pages of the range of the address space
+// of the process whose soft-dirty bits are set
+func softDirtyPages(pid int, start, len uint64) (*pageBitmap, error) {
+	f, err := os.Open("/proc/" + strconv.Itoa(pid) + "/pagemap")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sysPageSize := uint64(os.Getpagesize())
+	numPages := int(len / sysPageSize)
+	dirty := newPageBitmap(numPages)
+	buf := make([]byte, maxPagemapRead*pagemapEntrySize)
+
+	for page := 0; page < numPages; {
+		n := numPages - page
+		if n > maxPagemapRead {
+			n = maxPagemapRead
+		}
+
+		off := int64((start/sysPageSize + uint64(page)) * pagemapEntrySize)
+		if _, err := f.ReadAt(buf[:n*pagemapEntrySize], off); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, fmt.Errorf("failed to read the pagemap: %w", err)
+		}
+
+		for i := 0; i < n; i++ {
+			if binary.LittleEndian.Uint64(buf[i*pagemapEntrySize:])&pagemapSoftDirty != 0 {
+				dirty.Set(page + i)
+			}
+		}
+		page += n
+	}
+
+	return dirty, nil
+}
+
+// probeSoftDirty Returns true if the kernel tracks the soft-dirty bits, i.e., sets the bit of
+// a page that the process has just written
+func probeSoftDirty() bool {
+	sysPageSize := os.Getpagesize()
+
+	mem, err := syscall.Mmap(-1, 0, sysPageSize, syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS)
+	if err != nil {
+		return false
+	}
+	defer syscall.Munmap(mem)
+
+	mem[0] = 1
+
+	dirty, err := softDirtyPages(os.Getpid(), uint64(uintptr(unsafe.Pointer(&mem[0]))), uint64(sysPageSize))
+	if err != nil {
+		log.Debugf("Failed to probe the soft-dirty bits: %v", err)
+		return false
+	}
+
+	return dirty.Test(0)
+}
+
+// resetSoftDirty Clears the soft-dirty bits of the VM, the pages it writes from now on are dirty
+func (s *SnapshotState) resetSoftDirty() error {
+	if s.vmPid == 0 {
+		return fmt.Errorf("%w: the pid of the VM is unknown", ErrUnsupported)
+	}
+
+	return clearSoftDirtyFunc(s.vmPid)
+}
+
+// collectSoftDirty Marks the pages whose soft-dirty bits are set in the address space
+// of the VM as dirty. The caller must hold dirtyMu.
+func (s *SnapshotState) collectSoftDirty() error {
+	regions := s.guestRegions()
+	if len(regions) == 0 {
+		// no page has been installed nor written yet
+		return nil
+	}
+	if s.vmPid == 0 {
+		return fmt.Errorf("%w: the pid of the VM is unknown", ErrUnsupported)
+	}
+
+	sysPageSize := os.Getpagesize()
+	for _, r := range regions {
+		dirty, err := softDirtyPagesFunc(s.vmPid, r.BaseAddress, uint64(r.Size))
+		if err != nil {
+			return fmt.Errorf("failed to read the soft-dirty bits: %w", err)
+		}
+
+		// a guest page may span several system pages, e.g., a huge page
+		for page := 0; page < dirty.Len(); page++ {
+			if dirty.Test(page) {
+				s.dirtyPages.Set((r.Offset + page*sysPageSize) / s.PageSize)
+			}
+		}
+	}
+
+	return nil
+}
+
+// syncSoftDirty Collects the soft-dirty bits of the VM into its dirty pages if it is active,
+// they are collected upon its deactivation otherwise
+func (s *SnapshotState) syncSoftDirty() error {
+	s.opMu.Lock()
+	defer s.opMu.Unlock()
+
+	if !s.isActive {
+		return nil
+	}
+
+	s.dirtyMu.Lock()
+	defer s.dirtyMu.Unlock()
+
+	return s.collectSoftDirty()
+}
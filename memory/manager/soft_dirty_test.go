@@ -0,0 +1,150 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build linux
+// +build linux
+
+package manager
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSoftDirtyPages(t *testing.T) {
+	if !probeSoftDirty() {
+		t.Skip("The kernel does not track the soft-dirty bits")
+	}
+
+	pageSize := os.Getpagesize()
+	mem, err := syscall.Mmap(-1, 0, 4*pageSize, syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS)
+	require.NoError(t, err, "Failed to map memory")
+	defer syscall.Munmap(mem)
+
+	for page := 0; page < 4; page++ {
+		mem[page*pageSize] = 1
+	}
+
+	err = clearSoftDirty(os.Getpid())
+	require.NoError(t, err, "Failed to clear the soft-dirty bits")
+
+	mem[1*pageSize+8] = 2
+	mem[3*pageSize] = 2
+
+	dirty, err := softDirtyPages(os.Getpid(), uint64(uintptr(unsafe.Pointer(&mem[0]))), uint64(4*pageSize))
+	require.NoError(t, err, "Failed to read the soft-dirty bits")
+	require.Equal(t, 4, dirty.Len(), "Wrong number of the pages")
+	for page := 0; page < 4; page++ {
+		require.Equal(t, page == 1 || page == 3, dirty.Test(page), "Only the written pages must be soft-dirty")
+	}
+}
+
+// stubSoftDirty Reports the pages of the bitmap as soft-dirty and counts the clears of the bits
+// instead of accessing the procfs, returns the function that restores the real implementation
+func stubSoftDirty(dirty *pageBitmap, clears *int) func() {
+	clearSoftDirtyFunc = func(pid int) error {
+		*clears++
+		return nil
+	}
+	softDirtyPagesFunc = func(pid int, start, len uint64) (*pageBitmap, error) {
+		return dirty, nil
+	}
+
+	return func() {
+		clearSoftDirtyFunc = clearSoftDirty
+		softDirtyPagesFunc = softDirtyPages
+	}
+}
+
+func TestSoftDirtyFallback(t *testing.T) {
+	var (
+		installs      []installCall
+		registrations []writeProtectCall
+		unprot        []writeProtectCall
+		modes         []uint64
+		clears        int
+	)
+	pageSize := uint64(os.Getpagesize())
+	dirty := newPageBitmap(8)
+
+	defer stubInstallRegion(&installs)()
+	defer stubWriteProtect(&registrations, &unprot)()
+	defer stubSoftDirty(dirty, &clears)()
+	defer stubCapabilities(Capabilities{ZeroPage: true, SoftDirty: true})()
+
+	installer, _ := stubInstaller()
+	installer.copy = func(fd int, src, dst, mode, len uint64) error {
+		installs = append(installs, installCall{dst: dst, len: len})
+		modes = append(modes, mode)
+		return nil
+	}
+
+	manager := newTestManager(t, MemoryManagerCfg{})
+	cfg := prepareSnapshotStateCfg(t, "vm", 8*int(pageSize))
+	cfg.WriteProtect = true
+	cfg.IsLazyMode = true
+	require.NoError(t, manager.RegisterVM(cfg), "Soft-dirty bits must track the dirty pages without write-protect faults")
+
+	// activated as by activateTestVM, except for the first page fault
+	state := manager.instances["vm"]
+	require.NoError(t, state.mapGuestMemory(context.Background()), "Failed to map guest memory")
+	state.setupStateOnActivate()
+	state.vmPid = os.Getpid()
+	_, vm := newFakeUFFD(t, state)
+	readyCh := make(chan error)
+	go state.pollUserPageFaults(readyCh)
+	require.NoError(t, <-readyCh, "Failed to register the epoller")
+
+	for _, page := range []uint64{0, 2, 5} {
+		vm.fault(t, testStartAddress+page*pageSize)
+	}
+	waitServedPages(t, state, 3)
+	require.Equal(t, 1, clears, "Soft-dirty bits must be cleared upon the first page fault")
+	require.Empty(t, registrations, "Guest memory must not be registered for write-protect faults")
+	for _, mode := range modes {
+		require.Zero(t, mode&uffdCopyModeWP(), "Pages must not be installed write-protected")
+	}
+
+	// the guest writes pages 2 and 5
+	dirty.Set(2)
+	dirty.Set(5)
+
+	offsets, err := manager.DirtyPages("vm")
+	require.NoError(t, err, "Failed to get the dirty pages")
+	require.Equal(t, []uint64{2 * pageSize, 5 * pageSize}, offsets, "Soft-dirty pages must be dirty")
+
+	// the soft-dirty bits are collected upon the deactivation
+	dirty.Set(6)
+	require.NoError(t, manager.Deactivate("vm"), "Failed to deactivate VM")
+	dirty.Reset()
+
+	offsets, err = manager.DirtyPages("vm")
+	require.NoError(t, err, "Failed to get the dirty pages")
+	require.Equal(t, []uint64{2 * pageSize, 5 * pageSize, 6 * pageSize}, offsets,
+		"Pages written until the deactivation must be dirty")
+}
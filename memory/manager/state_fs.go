@@ -0,0 +1,125 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+)
+
+// StateFS File system that the state files of the VMs are read from, i.e., their VMM state, guest
+// memory, working set, base image and overlay pages files, by the paths in SnapshotStateCfg. Its files
+// must implement io.ReaderAt. The guest memory files are mapped, unless the ReadStrategy reads them
+// without mapping them, and the base images are mapped, so these must have a file descriptor, i.e.,
+// implement Fd() like *os.File. The files that the memory manager writes, i.e., the records and the
+// working set files of the recorded VMs, are written to the local file system.
+type StateFS interface {
+	Open(name string) (fs.File, error)
+	Stat(name string) (fs.FileInfo, error)
+}
+
+// OSFS The local file system, which the state files are read from by default
+type OSFS struct{}
+
+// Open Opens the local file for reading
+func (OSFS) Open(name string) (fs.File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Stat Returns the info of the local file
+func (OSFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+// stateFile A state file opened by the StateFS
+type stateFile interface {
+	fs.File
+	io.ReaderAt
+}
+
+// mappableFile A state file that can be mapped
+type mappableFile interface {
+	stateFile
+	Fd() uintptr
+}
+
+// openStateFile Opens the state file, which must support reads at any offset
+func openStateFile(fsys StateFS, path string) (stateFile, error) {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	sf, ok := f.(stateFile)
+	if !ok {
+		f.Close()
+		return nil, fmt.Errorf("%w: state file %s does not support reads at an offset", ErrInvalidConfig, path)
+	}
+
+	return sf, nil
+}
+
+// openMappableFile Opens the state file that is to be mapped
+func openMappableFile(fsys StateFS, path string) (mappableFile, error) {
+	f, err := openStateFile(fsys, path)
+	if err != nil {
+		return nil, err
+	}
+
+	mf, ok := f.(mappableFile)
+	if !ok {
+		f.Close()
+		return nil, fmt.Errorf("%w: state file %s has no file descriptor to be mapped", ErrInvalidConfig, path)
+	}
+
+	return mf, nil
+}
+
+// readStateFile Returns the contents of the state file
+func readStateFile(fsys StateFS, path string) ([]byte, error) {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ioutil.ReadAll(f)
+}
+
+// guestMemFS Returns the file system that the guest memory file is read from,
+// which is the local one for the pre-opened GuestMemFD
+func (cfg *SnapshotStateCfg) guestMemFS() StateFS {
+	if cfg.GuestMemFD != nil || cfg.stateFS == nil {
+		return OSFS{}
+	}
+
+	return cfg.stateFS
+}
@@ -0,0 +1,197 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// memFS Keeps the state files in memory, counting the opened ones
+type memFS struct {
+	sync.Mutex
+	files  map[string][]byte
+	opened map[string]int
+}
+
+// newMemFS Moves the state files of the VM that exist from the local file system into memory
+func newMemFS(t *testing.T, cfg SnapshotStateCfg) *memFS {
+	m := &memFS{files: make(map[string][]byte), opened: make(map[string]int)}
+	for _, path := range []string{cfg.VMMStatePath, cfg.GuestMemPath, cfg.WorkingSetPath} {
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		require.NoError(t, err, "Failed to read the state file")
+		require.NoError(t, os.Remove(path), "Failed to remove the local state file")
+		m.files[path] = data
+	}
+
+	return m
+}
+
+func (m *memFS) Open(name string) (fs.File, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	data, ok := m.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	m.opened[name]++
+
+	return &memFile{Reader: bytes.NewReader(data), name: name}, nil
+}
+
+func (m *memFS) Stat(name string) (fs.FileInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	data, ok := m.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+
+	return memFileInfo{name: name, size: int64(len(data))}, nil
+}
+
+func (m *memFS) openedFiles(name string) int {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.opened[name]
+}
+
+type memFile struct {
+	*bytes.Reader
+	name string
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	return memFileInfo{name: f.name, size: f.Size()}, nil
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+type memFileInfo struct {
+	name string
+	size int64
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) Mode() fs.FileMode  { return 0444 }
+func (i memFileInfo) ModTime() time.Time { return time.Time{} }
+func (i memFileInfo) IsDir() bool        { return false }
+func (i memFileInfo) Sys() interface{}   { return nil }
+
+func TestStateFSLazyVM(t *testing.T) {
+	const pages = 8
+
+	pageSize := os.Getpagesize()
+	cfg := prepareSnapshotStateCfg(t, "1", pages*pageSize)
+	cfg.IsLazyMode = true
+	cfg.ReadStrategy = PreadRead
+	stateFS := newMemFS(t, cfg)
+
+	contents := make(map[uint64][]byte)
+	defer stubCopyingInstallRegion(contents)()
+
+	manager := newTestManager(t, MemoryManagerCfg{StateFS: stateFS})
+	require.NoError(t, manager.ValidateConfig(cfg), "State files in the StateFS must be valid")
+	require.NoError(t, manager.RegisterVM(cfg), "Failed to register VM")
+
+	require.NoError(t, manager.FetchVMMState("1"), "Failed to fetch VMM state")
+	require.Equal(t, 1, stateFS.openedFiles(cfg.VMMStatePath), "VMM state file must be read from the StateFS")
+
+	state := manager.instances["1"]
+	require.NoError(t, state.mapGuestMemory(context.Background()), "Failed to open guest memory")
+	require.Equal(t, 1, stateFS.openedFiles(cfg.GuestMemPath), "Guest memory file must be opened from the StateFS")
+	state.setupStateOnActivate()
+	state.firstPageFaultOnce.Do(func() { state.startAddress = testStartAddress })
+
+	for _, page := range []int{3, 0, 6} {
+		require.NoError(t, state.servePageFault(-1, testStartAddress+uint64(page*pageSize)), "Failed to serve page fault")
+		content := contents[testStartAddress+uint64(page*pageSize)]
+		require.Len(t, content, pageSize, "Wrong size of the installed page")
+		require.Equal(t, byte(48+page), content[0], "Wrong contents of the installed page")
+	}
+
+	require.NoError(t, state.unmapGuestMemory(), "Failed to close guest memory")
+}
+
+func TestStateFSWorkingSet(t *testing.T) {
+	pageSize := uint64(os.Getpagesize())
+	cfg := prepareSnapshotStateCfg(t, "1", 8*os.Getpagesize())
+	persistRecord(t, cfg, []uint64{pageSize, 4 * pageSize, 5 * pageSize})
+	stateFS := newMemFS(t, cfg)
+
+	manager := newTestManager(t, MemoryManagerCfg{StateFS: stateFS})
+	require.NoError(t, manager.ValidateConfig(cfg), "State files in the StateFS must be valid")
+	require.NoError(t, manager.RegisterVM(cfg), "Failed to register VM")
+
+	pages, err := manager.FetchState("1")
+	require.NoError(t, err, "Failed to fetch state")
+	require.Equal(t, 3, pages, "Wrong number of the working set pages")
+	require.Equal(t, 1, stateFS.openedFiles(cfg.WorkingSetPath), "Working set file must be read from the StateFS")
+
+	workingSet := manager.instances["1"].workingSet
+	for i, page := range []int{1, 4, 5} {
+		require.Equal(t, byte(48+page), workingSet[i*int(pageSize)], "Wrong contents of the working set page")
+	}
+
+	// the working set file is corrupt unless it has all pages of the record
+	stateFS.files[cfg.WorkingSetPath] = stateFS.files[cfg.WorkingSetPath][:pageSize]
+	err = manager.ValidateConfig(cfg)
+	require.True(t, errors.Is(err, ErrInvalidConfig), "Truncated working set file must be reported")
+}
+
+func TestStateFSErrors(t *testing.T) {
+	cfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+	cfg.IsLazyMode = true
+	stateFS := newMemFS(t, cfg)
+
+	// the files in memory have no file descriptor to be mapped
+	manager := newTestManager(t, MemoryManagerCfg{StateFS: stateFS})
+	require.NoError(t, manager.RegisterVM(cfg), "Failed to register VM")
+	err := manager.instances["1"].mapGuestMemory(context.Background())
+	require.True(t, errors.Is(err, ErrInvalidConfig), "Guest memory without a file descriptor must not be mapped")
+
+	_, err = NewMemoryManager(MemoryManagerCfg{StateFS: stateFS, RemoteStore: newMemStore()})
+	require.True(t, errors.Is(err, ErrInvalidConfig), "Remote store must be rejected with a StateFS")
+
+	delete(stateFS.files, cfg.VMMStatePath)
+	err = newTestManager(t, MemoryManagerCfg{StateFS: stateFS}).ValidateConfig(cfg)
+	require.True(t, errors.Is(err, ErrInvalidConfig), "Missing VMM state file must be reported")
+}
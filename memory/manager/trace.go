@@ -23,15 +23,39 @@
 package manager
 
 import (
-	"encoding/csv"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"sort"
-	"strconv"
 	"sync"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// traceRecordSize is the size of a record in the trace file
+const traceRecordSize = 8
+
+// TraceCompression Format of the persisted trace files
+type TraceCompression string
+
+const (
+	// NoCompression Stores the offsets as little-endian uint64 values
+	NoCompression TraceCompression = ""
+	// GzipCompression Stores the deltas between the offsets, in pages, as uvarints compressed with gzip
+	GzipCompression TraceCompression = "gzip"
+)
+
+// gzipMagic starts every gzip stream, it is never a prefix of an uncompressed trace
+// since the first offset would not be page-aligned
+var gzipMagic = []byte{0x1f, 0x8b}
+
+func (c TraceCompression) isValid() bool {
+	return c == NoCompression || c == GzipCompression
+}
+
 // Record A tuple with an address
 type Record struct {
 	offset uint64
@@ -41,19 +65,30 @@ type Record struct {
 type Trace struct {
 	sync.Mutex
 	traceFileName string
+	pageSize      int
+	compression   TraceCompression
 
 	containedOffsets map[uint64]int
 	trace            []Record
 	regions          map[uint64]int
+
+	// offsets of the pages in the order of their first page faults, which are persisted
+	// to and loaded from sequenceFileName only if it is set, nil if there is no sequence
+	sequenceFileName string
+	sequence         []uint64
+
+	guestMemFS StateFS // file system that the working set pages are copied from
 }
 
-func initTrace(traceFileName string) *Trace {
+func initTrace(traceFileName string, pageSize int) *Trace {
 	t := new(Trace)
 
 	t.traceFileName = traceFileName
+	t.pageSize = pageSize
 	t.regions = make(map[uint64]int)
 	t.containedOffsets = make(map[uint64]int)
 	t.trace = make([]Record, 0)
+	t.guestMemFS = OSFS{}
 
 	return t
 }
@@ -67,61 +102,147 @@ func (t *Trace) AppendRecord(r Record) {
 	t.containedOffsets[r.offset] = 0
 }
 
-// WriteTrace Writes all the records to a file
-func (t *Trace) WriteTrace() {
+// WriteTrace Writes the offsets of all the records to a file, sorted in the
+// ascending order, as little-endian uint64 values or compressed as configured
+func (t *Trace) WriteTrace() error {
 	t.Lock()
 	defer t.Unlock()
 
-	file, err := os.Create(t.traceFileName)
-	if err != nil {
-		log.Fatalf("Failed to open trace file for writing: %v", err)
+	offsets := make([]uint64, 0, len(t.trace))
+	for _, rec := range t.trace {
+		offsets = append(offsets, rec.offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	var buf []byte
+	switch t.compression {
+	case GzipCompression:
+		var err error
+		if buf, err = t.compressOffsets(offsets); err != nil {
+			log.Errorf("Failed to compress the trace: %v", err)
+			return err
+		}
+	default:
+		buf = make([]byte, traceRecordSize*len(offsets))
+		for i, offset := range offsets {
+			binary.LittleEndian.PutUint64(buf[i*traceRecordSize:], offset)
+		}
 	}
-	defer file.Close()
 
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
+	if err := ioutil.WriteFile(t.traceFileName, buf, 0644); err != nil {
+		log.Errorf("Failed to write the trace file: %v", err)
+		return err
+	}
 
-	for _, rec := range t.trace {
-		err := writer.Write([]string{
-			strconv.FormatUint(rec.offset, 16)})
+	return nil
+}
+
+// readTrace Reads all the records from a trace file written by WriteTrace,
+// compressed trace files are detected regardless of the configured compression
+func (t *Trace) readTrace() error {
+	buf, err := ioutil.ReadFile(t.traceFileName)
+	if err != nil {
+		log.Errorf("Failed to read from the trace file: %v", err)
+		return err
+	}
+
+	if bytes.HasPrefix(buf, gzipMagic) {
+		offsets, err := t.decompressOffsets(buf)
 		if err != nil {
-			log.Fatalf("Failed to write trace: %v", err)
+			return err
+		}
+		for _, offset := range offsets {
+			t.AppendRecord(Record{offset: offset})
 		}
+
+		return nil
 	}
-}
 
-// readTrace Reads all the records from a CSV file
-//nolint:deadcode,unused
-func (t *Trace) readTrace() {
-	f, err := os.Open(t.traceFileName)
-	if err != nil {
-		log.Fatalf("Failed to open trace file for reading: %v", err)
+	if len(buf)%traceRecordSize != 0 {
+		return fmt.Errorf("file size %d is not a multiple of the record size %d", len(buf), traceRecordSize)
 	}
-	defer f.Close()
 
-	lines, err := csv.NewReader(f).ReadAll()
-	if err != nil {
-		log.Fatalf("Failed to read from the trace file: %v", err)
+	pageSize := uint64(t.pageSize)
+	for i := 0; i < len(buf); i += traceRecordSize {
+		offset := binary.LittleEndian.Uint64(buf[i:])
+		if offset%pageSize != 0 {
+			return fmt.Errorf("offset %#x of record %d is not page-aligned", offset, i/traceRecordSize)
+		}
+		if i > 0 && offset <= binary.LittleEndian.Uint64(buf[i-traceRecordSize:]) {
+			return fmt.Errorf("offset %#x of record %d is out of order", offset, i/traceRecordSize)
+		}
+		t.AppendRecord(Record{offset: offset})
 	}
 
-	for _, line := range lines {
-		rec := readRecord(line)
-		t.AppendRecord(rec)
+	return nil
+}
+
+// compressOffsets Delta-encodes the sorted offsets in pages, so that the contiguous
+// regions become runs of ones, and compresses them with gzip
+func (t *Trace) compressOffsets(offsets []uint64) ([]byte, error) {
+	var (
+		out  bytes.Buffer
+		last uint64
+	)
+
+	zw := gzip.NewWriter(&out)
+	varint := make([]byte, binary.MaxVarintLen64)
+	for _, offset := range offsets {
+		page := offset / uint64(t.pageSize)
+		n := binary.PutUvarint(varint, page-last)
+		if _, err := zw.Write(varint[:n]); err != nil {
+			return nil, err
+		}
+		last = page
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
 	}
+
+	return out.Bytes(), nil
 }
 
-// readRecord Parses a record from a line
-//nolint:deadcode,unused
-func readRecord(line []string) Record {
-	offset, err := strconv.ParseUint(line[0], 16, 64)
+// decompressOffsets Decodes the offsets written by compressOffsets
+func (t *Trace) decompressOffsets(buf []byte) ([]uint64, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(buf))
 	if err != nil {
-		log.Fatalf("Failed to convert string to offset: %v", err)
+		return nil, fmt.Errorf("invalid compressed trace: %w", err)
 	}
+	defer zr.Close()
 
-	rec := Record{
-		offset: offset,
+	deltas, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid compressed trace: %w", err)
 	}
-	return rec
+
+	var (
+		offsets []uint64
+		page    uint64
+	)
+	for i := 0; len(deltas) > 0; i++ {
+		delta, n := binary.Uvarint(deltas)
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid delta of record %d", i)
+		}
+		if i > 0 && delta == 0 {
+			return nil, fmt.Errorf("record %d is out of order", i)
+		}
+		deltas = deltas[n:]
+
+		page += delta
+		offsets = append(offsets, page*uint64(t.pageSize))
+	}
+
+	return offsets, nil
+}
+
+// Len Returns the number of records in the trace
+func (t *Trace) Len() int {
+	t.Lock()
+	defer t.Unlock()
+
+	return len(t.trace)
 }
 
 // Search trace for the record with the same offset
@@ -133,9 +254,91 @@ func (t *Trace) containsRecord(rec Record) bool {
 
 // ProcessRecord Prepares the trace, the regions map, and the working set file for replay
 // Must be called when record is done (i.e., it is not concurrency-safe vs. AppendRecord)
-func (t *Trace) ProcessRecord(GuestMemPath, WorkingSetPath string) {
+func (t *Trace) ProcessRecord(GuestMemPath, WorkingSetPath string) error {
 	log.Debug("Preparing replay structures")
 
+	if t.sequenceFileName != "" {
+		// the records are in the order of the page faults until buildRegions sorts them
+		t.sequence = t.faultOrder()
+		if err := t.writeSequence(); err != nil {
+			return err
+		}
+	}
+
+	t.buildRegions()
+	t.writeWorkingSetPagesToFile(GuestMemPath, WorkingSetPath)
+
+	return t.WriteTrace()
+}
+
+// faultOrder Returns the offsets of the records in the order they were appended,
+// each offset once
+func (t *Trace) faultOrder() []uint64 {
+	seen := make(map[uint64]bool, len(t.trace))
+	offsets := make([]uint64, 0, len(t.trace))
+	for _, rec := range t.trace {
+		if !seen[rec.offset] {
+			seen[rec.offset] = true
+			offsets = append(offsets, rec.offset)
+		}
+	}
+
+	return offsets
+}
+
+// writeSequence Writes the sequence file, which stores the offsets of the sequence
+// as little-endian uint64 values in the order of the page faults
+func (t *Trace) writeSequence() error {
+	buf := make([]byte, traceRecordSize*len(t.sequence))
+	for i, offset := range t.sequence {
+		binary.LittleEndian.PutUint64(buf[i*traceRecordSize:], offset)
+	}
+
+	if err := ioutil.WriteFile(t.sequenceFileName, buf, 0644); err != nil {
+		log.Errorf("Failed to write the sequence file: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// readSequence Reads the sequence file written by writeSequence, which must contain
+// every record of the trace exactly once. Leaves the sequence nil if there is no such file.
+func (t *Trace) readSequence() error {
+	t.sequence = nil
+
+	buf, err := ioutil.ReadFile(t.sequenceFileName)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if len(buf)%traceRecordSize != 0 {
+		return fmt.Errorf("file size %d is not a multiple of the record size %d", len(buf), traceRecordSize)
+	}
+	if n := len(buf) / traceRecordSize; n != len(t.containedOffsets) {
+		return fmt.Errorf("%d records do not match the %d records of the trace", n, len(t.containedOffsets))
+	}
+
+	seen := make(map[uint64]bool, len(t.containedOffsets))
+	sequence := make([]uint64, 0, len(t.containedOffsets))
+	for i := 0; i < len(buf); i += traceRecordSize {
+		offset := binary.LittleEndian.Uint64(buf[i:])
+		if _, ok := t.containedOffsets[offset]; !ok || seen[offset] {
+			return fmt.Errorf("offset %#x of record %d is not in the trace or repeated", offset, i/traceRecordSize)
+		}
+		seen[offset] = true
+		sequence = append(sequence, offset)
+	}
+
+	t.sequence = sequence
+
+	return nil
+}
+
+// buildRegions Sorts the trace records and builds the map of contiguous regions
+func (t *Trace) buildRegions() {
 	// sort trace records in the ascending order by offset
 	sort.Slice(t.trace, func(i, j int) bool {
 		return t.trace[i].offset < t.trace[j].offset
@@ -143,8 +346,8 @@ func (t *Trace) ProcessRecord(GuestMemPath, WorkingSetPath string) {
 
 	// build the map of contiguous regions from the trace records
 	var last, regionStart uint64
-	for _, rec := range t.trace {
-		if rec.offset != last+uint64(os.Getpagesize()) {
+	for i, rec := range t.trace {
+		if i == 0 || rec.offset != last+uint64(t.pageSize) {
 			regionStart = rec.offset
 			t.regions[regionStart] = 1
 		} else {
@@ -153,14 +356,12 @@ func (t *Trace) ProcessRecord(GuestMemPath, WorkingSetPath string) {
 
 		last = rec.offset
 	}
-
-	t.writeWorkingSetPagesToFile(GuestMemPath, WorkingSetPath)
 }
 
 func (t *Trace) writeWorkingSetPagesToFile(guestMemFileName, WorkingSetPath string) {
 	log.Debug("Writing the working set pages to a disk")
 
-	fSrc, err := os.Open(guestMemFileName)
+	fSrc, err := openStateFile(t.guestMemFS, guestMemFileName)
 	if err != nil {
 		log.Fatalf("Failed to open guest memory file for reading")
 	}
@@ -185,7 +386,7 @@ func (t *Trace) writeWorkingSetPagesToFile(guestMemFileName, WorkingSetPath stri
 
 	for _, offset := range keys {
 		regLength := t.regions[offset]
-		copyLen := regLength * os.Getpagesize()
+		copyLen := regLength * t.pageSize
 
 		buf := make([]byte, copyLen)
 
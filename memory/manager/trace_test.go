@@ -0,0 +1,184 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// realisticTrace Creates a trace of a working set made of contiguous regions of
+// various lengths scattered across a 1GB guest memory
+func realisticTrace(fileName string, compression TraceCompression) *Trace {
+	pageSize := os.Getpagesize()
+
+	trace := initTrace(fileName, pageSize)
+	trace.compression = compression
+
+	r := rand.New(rand.NewSource(42))
+	page := 0
+	for page < (1<<30)/pageSize {
+		for i := r.Intn(32) + 1; i > 0; i-- {
+			trace.AppendRecord(Record{offset: uint64(page * pageSize)})
+			page++
+		}
+		page += r.Intn(512) + 1
+	}
+
+	return trace
+}
+
+func TestTraceCompressionRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+
+	written := realisticTrace(filepath.Join(dir, "trace_gzip"), GzipCompression)
+	require.NoError(t, written.WriteTrace(), "Failed to write the trace")
+
+	// the compressed trace is detected regardless of the configured compression
+	read := initTrace(written.traceFileName, os.Getpagesize())
+	require.NoError(t, read.readTrace(), "Failed to read the trace")
+	require.Equal(t, written.trace, read.trace, "Offsets must survive the round trip")
+
+	raw := realisticTrace(filepath.Join(dir, "trace_raw"), NoCompression)
+	require.NoError(t, raw.WriteTrace(), "Failed to write the trace")
+
+	rawInfo, err := os.Stat(raw.traceFileName)
+	require.NoError(t, err, "Failed to stat the trace")
+	gzipInfo, err := os.Stat(written.traceFileName)
+	require.NoError(t, err, "Failed to stat the trace")
+
+	require.EqualValues(t, traceRecordSize*raw.Len(), rawInfo.Size(), "Raw trace must store 8 bytes per record")
+	require.Less(t, gzipInfo.Size()*4, rawInfo.Size(), "Compressed trace must be at least 4 times smaller")
+}
+
+func TestTraceCompressionCorrupt(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "trace")
+
+	written := realisticTrace(fileName, GzipCompression)
+	require.NoError(t, written.WriteTrace(), "Failed to write the trace")
+
+	buf, err := os.ReadFile(fileName)
+	require.NoError(t, err, "Failed to read the trace")
+	require.NoError(t, os.WriteFile(fileName, buf[:len(buf)/2], 0644), "Failed to truncate the trace")
+
+	read := initTrace(fileName, os.Getpagesize())
+	require.Error(t, read.readTrace(), "Truncated compressed trace must be reported")
+}
+
+func TestRegisterVMWorkingSetCompression(t *testing.T) {
+	_, err := NewMemoryManager(MemoryManagerCfg{WorkingSetCompression: "lz4"})
+	require.True(t, errors.Is(err, ErrInvalidConfig), "Unsupported compression must be reported")
+
+	cfg := prepareSnapshotStateCfg(t, "vm", 4*os.Getpagesize())
+	manager := newTestManager(t, MemoryManagerCfg{WorkingSetCompression: GzipCompression})
+	require.NoError(t, manager.RegisterVM(cfg), "Failed to register VM")
+
+	// the record persisted upon deactivation is compressed and loaded back
+	state := manager.instances["vm"]
+	offsets := []uint64{0, uint64(os.Getpagesize()), 3 * uint64(os.Getpagesize())}
+	for _, offset := range offsets {
+		state.trace.AppendRecord(Record{offset: offset})
+	}
+	err = state.trace.ProcessRecord(cfg.GuestMemPath, cfg.WorkingSetPath)
+	require.NoError(t, err, "Failed to persist the record")
+
+	pages, _, err := manager.WorkingSetSize("vm")
+	require.NoError(t, err, "Failed to get the working set size")
+	require.Equal(t, len(offsets), pages, "Wrong number of pages in the compressed record")
+
+	reloaded := NewSnapshotState(cfg)
+	require.NoError(t, reloaded.loadRecord(), "Failed to load the compressed record")
+	require.Equal(t, len(offsets), reloaded.trace.Len(), "Wrong number of records loaded")
+}
+
+func TestFaultOrderReplay(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	pageSize := uint64(os.Getpagesize())
+	manager := newTestManager(t, MemoryManagerCfg{FaultOrderReplay: true})
+	stateCfg := prepareSnapshotStateCfg(t, "1", 8*os.Getpagesize())
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+
+	// the records are appended in the order of the page faults
+	sequence := []uint64{5 * pageSize, pageSize, 2 * pageSize, 7 * pageSize, 3 * pageSize}
+	state := manager.instances["1"]
+	for _, offset := range sequence {
+		state.trace.AppendRecord(Record{offset: offset})
+	}
+	err := state.trace.ProcessRecord(stateCfg.GuestMemPath, stateCfg.WorkingSetPath)
+	require.NoError(t, err, "Failed to persist the record")
+
+	buf, err := ioutil.ReadFile(filepath.Join(stateCfg.BaseDir, "sequence"))
+	require.NoError(t, err, "Failed to read the sequence file")
+	require.Len(t, buf, traceRecordSize*len(sequence), "Sequence file must store 8 bytes per page")
+	for i, offset := range sequence {
+		require.Equal(t, offset, binary.LittleEndian.Uint64(buf[i*traceRecordSize:]),
+			"Sequence file must store the offsets in the order of the page faults")
+	}
+
+	// the record is loaded back by a new manager
+	vms := serveFakeUFFDs(t, &stateCfg)
+	manager = newTestManager(t, MemoryManagerCfg{FaultOrderReplay: true})
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+	_, err = manager.FetchState("1")
+	require.NoError(t, err, "Failed to fetch state")
+
+	require.NoError(t, manager.Activate("1"), "Failed to activate VM")
+	vm := <-vms
+	vm.fault(t, testStartAddress)
+	waitServedPages(t, manager.instances["1"], int64(len(sequence)))
+
+	expected := []installCall{
+		{dst: testStartAddress + 5*pageSize, len: pageSize},
+		{dst: testStartAddress + pageSize, len: 2 * pageSize},
+		{dst: testStartAddress + 7*pageSize, len: pageSize},
+		{dst: testStartAddress + 3*pageSize, len: pageSize},
+	}
+	require.Equal(t, expected, installs, "Working set must be installed in the order of the page faults")
+
+	require.NoError(t, manager.Deactivate("1"), "Failed to deactivate VM")
+}
+
+func TestFaultOrderReplayStaleSequence(t *testing.T) {
+	pageSize := uint64(os.Getpagesize())
+	stateCfg := prepareSnapshotStateCfg(t, "1", 8*os.Getpagesize())
+	persistRecord(t, stateCfg, []uint64{0, 2 * pageSize})
+
+	buf := make([]byte, traceRecordSize)
+	binary.LittleEndian.PutUint64(buf, 4*pageSize)
+	err := ioutil.WriteFile(filepath.Join(stateCfg.BaseDir, "sequence"), buf, 0644)
+	require.NoError(t, err, "Failed to write the sequence file")
+
+	// the pages are installed in the order of the offsets if the sequence does not match the trace
+	manager := newTestManager(t, MemoryManagerCfg{FaultOrderReplay: true})
+	require.NoError(t, manager.RegisterVM(stateCfg), "Failed to register VM")
+	require.Nil(t, manager.instances["1"].trace.sequence, "Stale sequence must be ignored")
+}
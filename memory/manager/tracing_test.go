@@ -0,0 +1,117 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type parentKey struct{}
+
+// recordingTracer Records the finished spans
+type recordingTracer struct {
+	sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	tracer     *recordingTracer
+	name       string
+	parent     interface{}
+	attributes map[string]interface{}
+}
+
+func (r *recordingTracer) Start(ctx context.Context, spanName string) (context.Context, Span) {
+	span := &recordedSpan{
+		tracer:     r,
+		name:       spanName,
+		parent:     ctx.Value(parentKey{}),
+		attributes: make(map[string]interface{}),
+	}
+
+	return context.WithValue(ctx, parentKey{}, spanName), span
+}
+
+func (s *recordedSpan) SetAttribute(key string, value interface{}) {
+	s.attributes[key] = value
+}
+
+func (s *recordedSpan) End() {
+	s.tracer.Lock()
+	defer s.tracer.Unlock()
+
+	s.tracer.spans = append(s.tracer.spans, s)
+}
+
+func TestServePageFaultSpans(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	pageSize := os.Getpagesize()
+	tracer := new(recordingTracer)
+
+	state := newTestSnapshotState(4, 1)
+	state.tracer = tracer
+	state.traceCtx = context.WithValue(context.Background(), parentKey{}, "invocation")
+	copy(state.guestMem[pageSize:2*pageSize], zeroPage)
+
+	for page := 0; page < 2; page++ {
+		err := state.servePageFault(-1, testStartAddress+uint64(page*pageSize))
+		require.NoError(t, err, "Failed to serve page fault")
+	}
+
+	require.Len(t, tracer.spans, 2, "Every page fault must be traced")
+	for page, span := range tracer.spans {
+		require.Equal(t, "memory_manager.ServePageFault", span.name)
+		require.Equal(t, "invocation", span.parent, "Page fault span must be a child of the invocation span")
+		require.Equal(t, "test", span.attributes["vmID"])
+		require.Equal(t, uint64(page*pageSize), span.attributes["offset"])
+		require.Equal(t, page == 1, span.attributes["zeroPage"])
+		require.Contains(t, span.attributes, "installLatencyUs")
+	}
+}
+
+func TestFetchStateSpan(t *testing.T) {
+	tracer := new(recordingTracer)
+	manager := newTestManager(t, MemoryManagerCfg{Tracer: tracer})
+
+	stateCfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+	persistRecord(t, stateCfg, []uint64{0, uint64(os.Getpagesize())})
+
+	err := manager.RegisterVM(stateCfg)
+	require.NoError(t, err, "Failed to register VM")
+
+	ctx := context.WithValue(context.Background(), parentKey{}, "invocation")
+	_, err = manager.FetchStateWithContext(ctx, stateCfg.VMID)
+	require.NoError(t, err, "Failed to fetch state")
+
+	require.Len(t, tracer.spans, 1, "Fetching state must be traced")
+	require.Equal(t, "memory_manager.FetchState", tracer.spans[0].name)
+	require.Equal(t, "invocation", tracer.spans[0].parent)
+	require.Equal(t, 2, tracer.spans[0].attributes["pages"])
+}
@@ -35,8 +35,22 @@
 // constants for use from Go
 int const_UFFDIO_WAKE = UFFDIO_WAKE;
 int const_UFFDIO_COPY = UFFDIO_COPY;
+int const_UFFDIO_ZEROPAGE = UFFDIO_ZEROPAGE;
 int const_UFFD_EVENT_PAGEFAULT = UFFD_EVENT_PAGEFAULT;
+int const_UFFD_EVENT_REMOVE = UFFD_EVENT_REMOVE;
+int const_UFFD_EVENT_UNMAP = UFFD_EVENT_UNMAP;
 int const_UFFDIO_COPY_MODE_DONTWAKE = UFFDIO_COPY_MODE_DONTWAKE;
+int const_UFFDIO_COPY_MODE_WP = UFFDIO_COPY_MODE_WP;
+int const_UFFDIO_REGISTER = UFFDIO_REGISTER;
+int const_UFFDIO_REGISTER_MODE_MISSING = UFFDIO_REGISTER_MODE_MISSING;
+int const_UFFDIO_REGISTER_MODE_WP = UFFDIO_REGISTER_MODE_WP;
+int const_UFFDIO_WRITEPROTECT = UFFDIO_WRITEPROTECT;
+int const_UFFDIO_WRITEPROTECT_MODE_WP = UFFDIO_WRITEPROTECT_MODE_WP;
+int const_UFFD_PAGEFAULT_FLAG_WP = UFFD_PAGEFAULT_FLAG_WP;
+int const_UFFD_PAGEFAULT_FLAG_WRITE = UFFD_PAGEFAULT_FLAG_WRITE;
+int const_UFFDIO_REGISTER_MODE_MINOR = UFFDIO_REGISTER_MODE_MINOR;
+int const_UFFDIO_CONTINUE = UFFDIO_CONTINUE;
+int const_UFFD_PAGEFAULT_FLAG_MINOR = UFFD_PAGEFAULT_FLAG_MINOR;
 
 #define errExit(msg) \
     do { perror(msg); exit(EXIT_FAILURE); } while (0)
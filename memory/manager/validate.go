@@ -0,0 +1,147 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ValidateConfig Checks the configuration of the VM like RegisterVM does, along with its state
+// files, without registering the VM. The files fetched from the remote store may be missing locally.
+// Returns a *ConfigErrors that lists every problem found, or nil if there are none.
+func (m *MemoryManager) ValidateConfig(cfg SnapshotStateCfg) error {
+	pageSize := cfg.PageSize
+	if pageSize == 0 {
+		pageSize = m.sysPageSize
+	}
+
+	var errs []error
+	if cfg.FirecrackerState {
+		if err := m.applyFirecrackerState(&cfg); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	errs = append(errs, m.checkConfig(cfg, pageSize)...)
+	if pageSize > 0 {
+		cfg.stateFS = m.StateFS
+		errs = append(errs, checkStateFiles(cfg, pageSize, m.RemoteStore != nil)...)
+	}
+
+	if len(errs) > 0 {
+		return &ConfigErrors{VMID: cfg.VMID, Errs: errs}
+	}
+
+	return nil
+}
+
+// checkStateFiles Returns the problems of the state files of the VM: the files that are missing,
+// unless they may be fetched from the remote store, have the wrong size or are corrupt
+func checkStateFiles(cfg SnapshotStateCfg, pageSize int, remote bool) []error {
+	var errs []error
+	pages := cfg.GuestMemSize / pageSize
+
+	// stat Returns the size of the file, or -1 if it is missing and may be fetched
+	stat := func(fsys StateFS, name, path string) int64 {
+		fileInfo, err := fsys.Stat(path)
+		switch {
+		case errors.Is(err, fs.ErrNotExist) && remote:
+			return -1
+		case err != nil:
+			errs = append(errs, fmt.Errorf("%w: %s: %v", ErrInvalidConfig, name, err))
+			return -1
+		case !fileInfo.Mode().IsRegular():
+			errs = append(errs, fmt.Errorf("%w: %s %s is not a regular file", ErrInvalidConfig, name, path))
+			return -1
+		}
+		return fileInfo.Size()
+	}
+
+	stat(cfg.stateFS, "VMM state file", cfg.VMMStatePath)
+
+	if cfg.BaseImagePath == "" || cfg.OverlayPagesPath != "" {
+		if size := stat(cfg.guestMemFS(), "guest memory file", cfg.guestMemFilePath()); size >= 0 {
+			if cfg.ReadStrategy == CompressedRead {
+				errs = append(errs, checkCompressedMemory(cfg.guestMemFS(), cfg.guestMemFilePath(), cfg.GuestMemSize)...)
+			} else if size < int64(cfg.GuestMemSize) {
+				errs = append(errs, fmt.Errorf("%w: guest memory file %s is truncated: expected %d bytes, found %d",
+					ErrInvalidConfig, cfg.GuestMemPath, cfg.GuestMemSize, size))
+			}
+		}
+	}
+
+	if cfg.BaseImagePath != "" {
+		if size := stat(cfg.stateFS, "base image", cfg.BaseImagePath); size >= 0 && size < int64(cfg.GuestMemSize) {
+			errs = append(errs, fmt.Errorf("%w: base image %s is truncated: expected %d bytes, found %d",
+				ErrInvalidConfig, cfg.BaseImagePath, cfg.GuestMemSize, size))
+		}
+		if _, err := loadOverlayPages(cfg.stateFS, cfg.OverlayPagesPath, pages); err != nil {
+			errs = append(errs, fmt.Errorf("%w: overlay pages file: %v", ErrInvalidConfig, err))
+		}
+	}
+
+	if cfg.IsLazyMode {
+		path := filepath.Join(cfg.BaseDir, "residency")
+		if data, err := ioutil.ReadFile(path); err == nil {
+			if _, err := decodePageBitmap(data, pages); err != nil {
+				errs = append(errs, fmt.Errorf("%w: residency file %s is corrupt: %v", ErrInvalidConfig, path, err))
+			}
+		}
+		return errs
+	}
+
+	// the record of a cold VM does not exist yet
+	trace := initTrace(filepath.Join(cfg.BaseDir, "trace"), pageSize)
+	if _, err := os.Stat(trace.traceFileName); err != nil {
+		return errs
+	}
+	if err := trace.readTrace(); err != nil {
+		return append(errs, fmt.Errorf("%w: trace file %s is corrupt: %v", ErrInvalidConfig, trace.traceFileName, err))
+	}
+	if size := stat(cfg.stateFS, "working set file", cfg.WorkingSetPath); size >= 0 && size != int64(trace.Len()*pageSize) {
+		errs = append(errs, fmt.Errorf("%w: working set file %s is corrupt: expected %d bytes for %d pages, found %d bytes",
+			ErrInvalidConfig, cfg.WorkingSetPath, trace.Len()*pageSize, trace.Len(), size))
+	}
+
+	return errs
+}
+
+// checkCompressedMemory Returns the problem of the block-compressed guest memory file, if any
+func checkCompressedMemory(fsys StateFS, path string, size int) []error {
+	f, err := openStateFile(fsys, path)
+	if err != nil {
+		return []error{fmt.Errorf("%w: guest memory file: %v", ErrInvalidConfig, err)}
+	}
+	defer f.Close()
+
+	if _, err := openCompressedMemory(f, size); err != nil {
+		return []error{fmt.Errorf("%w: guest memory file %s is corrupt: %v", ErrInvalidConfig, path, err)}
+	}
+
+	return nil
+}
@@ -0,0 +1,93 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateConfig(t *testing.T) {
+	manager := newTestManager(t, MemoryManagerCfg{})
+
+	pageSize := uint64(os.Getpagesize())
+	stateCfg := prepareSnapshotStateCfg(t, "1", 4*int(pageSize))
+	persistRecord(t, stateCfg, []uint64{0, 2 * pageSize})
+
+	require.NoError(t, manager.ValidateConfig(stateCfg), "Valid configuration must pass")
+	require.Empty(t, manager.instances, "Validation must not register the VM")
+}
+
+func TestValidateConfigMissingFile(t *testing.T) {
+	manager := newTestManager(t, MemoryManagerCfg{})
+
+	stateCfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+	require.NoError(t, os.Remove(stateCfg.VMMStatePath), "Failed to remove the VMM state file")
+	stateCfg.GuestMemPath += ".missing"
+
+	err := manager.ValidateConfig(stateCfg)
+	require.True(t, errors.Is(err, ErrInvalidConfig), "Missing files must be reported")
+
+	var configErrs *ConfigErrors
+	require.True(t, errors.As(err, &configErrs), "Validation must return the list of problems")
+	require.Len(t, configErrs.Errs, 2, "Both missing files must be reported")
+	require.Contains(t, err.Error(), "VMM state file")
+	require.Contains(t, err.Error(), "guest memory file")
+}
+
+func TestValidateConfigSizeMismatch(t *testing.T) {
+	manager := newTestManager(t, MemoryManagerCfg{})
+
+	pageSize := os.Getpagesize()
+	stateCfg := prepareSnapshotStateCfg(t, "1", 4*pageSize)
+	persistRecord(t, stateCfg, []uint64{0, uint64(pageSize)})
+	require.NoError(t, os.Truncate(stateCfg.WorkingSetPath, int64(pageSize)), "Failed to truncate the working set")
+	stateCfg.GuestMemSize = 8 * pageSize
+	stateCfg.FaultRateLimit = -1
+
+	err := manager.ValidateConfig(stateCfg)
+	var configErrs *ConfigErrors
+	require.True(t, errors.As(err, &configErrs), "Validation must return the list of problems")
+	require.Len(t, configErrs.Errs, 3, "Every problem must be reported")
+	require.Contains(t, err.Error(), "fault rate limit")
+	require.Contains(t, err.Error(), "is truncated")
+	require.Contains(t, err.Error(), "working set file")
+}
+
+func TestValidateConfigCorruptWorkingSet(t *testing.T) {
+	manager := newTestManager(t, MemoryManagerCfg{})
+
+	stateCfg := prepareSnapshotStateCfg(t, "1", 4*os.Getpagesize())
+	persistRecord(t, stateCfg, []uint64{0})
+	trace := initTrace(stateCfg.BaseDir+"/trace", os.Getpagesize())
+	require.NoError(t, ioutil.WriteFile(trace.traceFileName, []byte("not a trace\n"), 0644), "Failed to corrupt the trace")
+
+	err := manager.ValidateConfig(stateCfg)
+	require.True(t, errors.Is(err, ErrInvalidConfig), "Corrupt trace must be reported")
+	require.True(t, strings.Contains(err.Error(), "trace file"), "Corrupt trace must be named")
+}
@@ -0,0 +1,168 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"container/list"
+	"io"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// defaultWindowSize Size of the windows mapped by the WindowedRead strategy if WindowSize is unset
+	defaultWindowSize = 256 << 20
+	// maxMappedWindows Number of the windows of the guest memory file that are mapped at a time
+	maxMappedWindows = 4
+)
+
+// windowSize Returns the size of the windows of the guest memory file mapped by WindowedRead
+func (cfg *SnapshotStateCfg) windowSize() int {
+	if cfg.WindowSize > 0 {
+		return cfg.WindowSize
+	}
+
+	return defaultWindowSize
+}
+
+// windowedMapping Reads the guest memory file through the mappings of its windows, at most
+// maxMappedWindows of which are mapped at a time. Reading a window that is not mapped unmaps
+// the least recently read window once the limit is reached.
+type windowedMapping struct {
+	sync.Mutex // held while a window is mapped or copied from, so it is not unmapped meanwhile
+
+	f          mappableFile
+	size       int64
+	windowSize int64
+
+	windows map[int64]*list.Element // indexed by the window number
+	lru     *list.List              // mapped windows, the most recently read first
+}
+
+type mappedWindow struct {
+	num int64
+	mem []byte
+}
+
+func newWindowedMapping(f mappableFile, size, windowSize int) *windowedMapping {
+	return &windowedMapping{
+		f:          f,
+		size:       int64(size),
+		windowSize: int64(windowSize),
+		windows:    make(map[int64]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// ReadAt Copies the guest memory at the offset from the windows that it spans,
+// mapping the ones that are not mapped
+func (w *windowedMapping) ReadAt(p []byte, off int64) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos < 0 || pos >= w.size {
+			return n, io.EOF
+		}
+
+		mem, err := w.window(pos / w.windowSize)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], mem[pos%w.windowSize:])
+	}
+
+	return n, nil
+}
+
+// window Returns the mapping of the window, mapping it if it is not mapped yet.
+// Must be called with the mapping locked.
+func (w *windowedMapping) window(num int64) ([]byte, error) {
+	if elem, ok := w.windows[num]; ok {
+		w.lru.MoveToFront(elem)
+		return elem.Value.(*mappedWindow).mem, nil
+	}
+
+	if w.lru.Len() >= maxMappedWindows {
+		if err := w.unmap(w.lru.Back()); err != nil {
+			return nil, err
+		}
+	}
+
+	start := num * w.windowSize
+	length := w.windowSize
+	if start+length > w.size {
+		length = w.size - start
+	}
+
+	mem, err := unix.Mmap(int(w.f.Fd()), start, int(length), unix.PROT_READ, unix.MAP_PRIVATE)
+	if err != nil {
+		return nil, err
+	}
+	w.windows[num] = w.lru.PushFront(&mappedWindow{num: num, mem: mem})
+
+	return mem, nil
+}
+
+// unmap Unmaps the window. Must be called with the mapping locked.
+func (w *windowedMapping) unmap(elem *list.Element) error {
+	win := w.lru.Remove(elem).(*mappedWindow)
+	delete(w.windows, win.num)
+
+	return unix.Munmap(win.mem)
+}
+
+// mappedWindows Returns the numbers of the mapped windows, the most recently read first
+func (w *windowedMapping) mappedWindows() []int64 {
+	w.Lock()
+	defer w.Unlock()
+
+	nums := make([]int64, 0, w.lru.Len())
+	for elem := w.lru.Front(); elem != nil; elem = elem.Next() {
+		nums = append(nums, elem.Value.(*mappedWindow).num)
+	}
+
+	return nums
+}
+
+// Close Unmaps all windows and closes the guest memory file
+func (w *windowedMapping) Close() error {
+	w.Lock()
+	defer w.Unlock()
+
+	var firstErr error
+	for w.lru.Len() > 0 {
+		if err := w.unmap(w.lru.Front()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if err := w.f.Close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+
+	return firstErr
+}
@@ -0,0 +1,130 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWindowedMappingEvictsLeastRecentlyRead(t *testing.T) {
+	const pages = 12
+
+	pageSize := os.Getpagesize()
+	path := t.TempDir() + "/mem_file"
+	prepareGuestMemoryFile(path, pages*pageSize)
+
+	f, err := os.Open(path)
+	require.NoError(t, err, "Failed to open guest memory file")
+
+	// windows of two pages
+	w := newWindowedMapping(f, pages*pageSize, 2*pageSize)
+	defer w.Close()
+
+	// a read across the boundary of two windows maps both of them
+	buf := make([]byte, 2*pageSize)
+	n, err := w.ReadAt(buf, int64(pageSize))
+	require.NoError(t, err, "Failed to read across the windows")
+	require.Equal(t, len(buf), n, "Wrong number of bytes read")
+	require.Equal(t, byte(48+1), buf[0], "Wrong contents of the first window")
+	require.Equal(t, byte(48+2), buf[pageSize], "Wrong contents of the second window")
+	require.Equal(t, []int64{1, 0}, w.mappedWindows(), "Wrong mapped windows")
+
+	for _, page := range []int{4, 6, 0} {
+		_, err := w.ReadAt(buf[:pageSize], int64(page*pageSize))
+		require.NoError(t, err, "Failed to read page")
+		require.Equal(t, byte(48+page), buf[0], "Wrong contents of the page")
+	}
+	require.Equal(t, []int64{0, 3, 2, 1}, w.mappedWindows(), "Wrong mapped windows")
+
+	// the least recently read window is unmapped
+	_, err = w.ReadAt(buf[:pageSize], int64(11*pageSize))
+	require.NoError(t, err, "Failed to read the last page")
+	require.Equal(t, byte(48+11), buf[0], "Wrong contents of the last page")
+	require.Equal(t, []int64{5, 0, 3, 2}, w.mappedWindows(), "Wrong mapped windows")
+
+	_, err = w.ReadAt(buf[:pageSize], int64(pages*pageSize))
+	require.Error(t, err, "Read past the guest memory must fail")
+}
+
+func TestWindowedReadServesFaultsAcrossWindows(t *testing.T) {
+	const pages = 16
+
+	pageSize := os.Getpagesize()
+	manager := newTestManager(t, MemoryManagerCfg{InstallChunkPages: 4})
+
+	contents := make(map[uint64][]byte)
+	defer stubCopyingInstallRegion(contents)()
+
+	cfg := prepareSnapshotStateCfg(t, "vm", pages*pageSize)
+	cfg.IsLazyMode = true
+	cfg.ReadStrategy = WindowedRead
+	cfg.WindowSize = 3 * pageSize
+	require.NoError(t, manager.RegisterVM(cfg), "Failed to register VM")
+
+	state := manager.instances["vm"]
+	require.NoError(t, state.mapGuestMemory(context.Background()), "Failed to map guest memory")
+	state.setupStateOnActivate()
+	state.firstPageFaultOnce.Do(func() { state.startAddress = testStartAddress })
+	require.Nil(t, state.guestMem, "Guest memory must not be mapped as a whole")
+
+	// the chunks of pages 4-7 and 12-15 span two windows each
+	for _, page := range []int{5, 13} {
+		err := state.servePageFault(-1, testStartAddress+uint64(page*pageSize))
+		require.NoError(t, err, "Failed to serve page fault")
+	}
+
+	for _, first := range []int{4, 12} {
+		content := contents[testStartAddress+uint64(first*pageSize)]
+		require.Len(t, content, 4*pageSize, "Wrong size of the installed chunk")
+		for i := 0; i < 4; i++ {
+			require.Equal(t, byte(48+first+i), content[i*pageSize], "Wrong contents of the installed page")
+		}
+	}
+	require.Equal(t, []int64{5, 4, 2, 1}, state.guestMemFile.(*windowedMapping).mappedWindows(),
+		"Wrong mapped windows")
+
+	require.NoError(t, state.unmapGuestMemory(), "Failed to unmap guest memory")
+	require.Nil(t, state.guestMemFile, "Guest memory file must be closed")
+}
+
+func TestWindowSizeValidation(t *testing.T) {
+	cfg := prepareSnapshotStateCfg(t, "vm", 4*os.Getpagesize())
+	cfg.IsLazyMode = true
+
+	cfg.WindowSize = os.Getpagesize()
+	err := newTestManager(t, MemoryManagerCfg{}).RegisterVM(cfg)
+	require.True(t, errors.Is(err, ErrInvalidConfig), "Window size must require the windowed read strategy")
+
+	cfg.ReadStrategy = WindowedRead
+	cfg.WindowSize = os.Getpagesize() + 1
+	err = newTestManager(t, MemoryManagerCfg{}).RegisterVM(cfg)
+	require.True(t, errors.Is(err, ErrInvalidConfig), "Unaligned window size must be rejected")
+
+	cfg.WindowSize = 0
+	require.NoError(t, newTestManager(t, MemoryManagerCfg{}).RegisterVM(cfg), "Default window size must be accepted")
+}
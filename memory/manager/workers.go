@@ -0,0 +1,234 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"container/heap"
+	"fmt"
+	"sync"
+)
+
+const workerQueueSize = 16
+
+// faultKind Kind of an event of a uffd that is served by a worker
+type faultKind int
+
+const (
+	missingFault      faultKind = iota // page fault on a missing page
+	writeProtectFault                  // write to a write-protected page
+	minorFault                         // page fault on a page that is present in the page cache
+	removal                            // removal of the pages in the range [address, end)
+)
+
+// faultRequest An event of a uffd to be served by a worker
+type faultRequest struct {
+	state   *SnapshotState
+	kind    faultKind
+	fd      int
+	address uint64
+	end     uint64
+}
+
+// queuedRequest A request in the queue of a worker, ordered by the priority of its VM
+// and then by its arrival
+type queuedRequest struct {
+	faultRequest
+	priority int
+	seq      uint64
+}
+
+// requestHeap Implements heap.Interface, the request to serve next is at the root
+type requestHeap []queuedRequest
+
+func (h requestHeap) Len() int { return len(h) }
+
+func (h requestHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h requestHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *requestHeap) Push(x interface{}) { *h = append(*h, x.(queuedRequest)) }
+
+func (h *requestHeap) Pop() interface{} {
+	old := *h
+	req := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return req
+}
+
+// workerQueue The queue of the requests to a worker, which holds at most workerQueueSize requests.
+// The requests of the VMs with a higher priority are served first, and the requests of the same
+// priority in the order of their arrival, which preserves the order of the faults of each VM.
+type workerQueue struct {
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	reqs     requestHeap
+	seq      uint64
+	closed   bool
+}
+
+func newWorkerQueue() *workerQueue {
+	q := new(workerQueue)
+	q.notEmpty = sync.NewCond(&q.mu)
+	q.notFull = sync.NewCond(&q.mu)
+
+	return q
+}
+
+// push Queues the request, blocks while the queue is full
+func (q *workerQueue) push(req faultRequest) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.reqs) >= workerQueueSize && !q.closed {
+		q.notFull.Wait()
+	}
+
+	heap.Push(&q.reqs, queuedRequest{faultRequest: req, priority: req.state.Priority, seq: q.seq})
+	q.seq++
+	q.notEmpty.Signal()
+}
+
+// pop Returns the request to serve next, blocks while the queue is empty.
+// It returns false once the queue is closed and empty.
+func (q *workerQueue) pop() (faultRequest, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.reqs) == 0 && !q.closed {
+		q.notEmpty.Wait()
+	}
+
+	if len(q.reqs) == 0 {
+		return faultRequest{}, false
+	}
+
+	req := heap.Pop(&q.reqs).(queuedRequest)
+	q.notFull.Signal()
+
+	return req.faultRequest, true
+}
+
+// close Makes the worker quit once it has served the queued requests
+func (q *workerQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+}
+
+// workerPool Serves the page faults of all VMs on a fixed set of workers.
+// A VM is always served by the same worker, which preserves the order of its faults,
+// and its polling loop blocks when the queue of the worker is full.
+type workerPool struct {
+	sync.Mutex
+	queues []*workerQueue
+	next   int
+}
+
+func newWorkerPool(size int) *workerPool {
+	p := new(workerPool)
+	p.queues = make([]*workerQueue, size)
+
+	for i := range p.queues {
+		p.queues[i] = newWorkerQueue()
+		go p.worker(p.queues[i])
+	}
+
+	return p
+}
+
+// assign Returns the queue of the worker that serves the VM
+func (p *workerPool) assign() *workerQueue {
+	p.Lock()
+	defer p.Unlock()
+
+	q := p.queues[p.next%len(p.queues)]
+	p.next++
+
+	return q
+}
+
+// stop Stops the workers once they have served the queued page faults
+func (p *workerPool) stop() {
+	for _, q := range p.queues {
+		q.close()
+	}
+}
+
+func (p *workerPool) worker(queue *workerQueue) {
+	for {
+		req, ok := queue.pop()
+		if !ok {
+			return
+		}
+		req.state.serveQueuedRequest(req)
+	}
+}
+
+// dispatch Serves the request in the polling loop or, if the VM is assigned
+// to a worker, queues it to the worker after the requests that precede it
+func (s *SnapshotState) dispatch(req faultRequest) error {
+	if s.faultQueue == nil {
+		return s.serveRequest(req)
+	}
+
+	s.inflightFaults.Add(1)
+	s.faultQueue.push(req)
+
+	return nil
+}
+
+// dispatchPageFault Dispatches the page fault on a missing page
+func (s *SnapshotState) dispatchPageFault(fd int, address uint64) error {
+	return s.dispatch(faultRequest{state: s, kind: missingFault, fd: fd, address: address})
+}
+
+func (s *SnapshotState) serveRequest(req faultRequest) error {
+	switch req.kind {
+	case writeProtectFault:
+		return s.serveWriteProtectFault(req.fd, req.address)
+	case minorFault:
+		return s.serveMinorFault(req.fd, req.address)
+	case removal:
+		s.removePages(req.address, req.end)
+		return nil
+	default:
+		return s.servePageFault(req.fd, req.address)
+	}
+}
+
+func (s *SnapshotState) serveQueuedRequest(req faultRequest) {
+	defer s.inflightFaults.Done()
+
+	if err := s.serveRequest(req); err != nil {
+		s.reportError(fmt.Errorf("failed to serve page fault at 0x%x: %w", req.address, err))
+	}
+}
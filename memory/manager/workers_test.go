@@ -0,0 +1,175 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkerPoolPreservesFaultOrder(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	pageSize := uint64(os.Getpagesize())
+	pool := newWorkerPool(1)
+	defer pool.stop()
+
+	state := newTestSnapshotState(8, 1)
+	state.faultQueue = pool.assign()
+
+	for page := uint64(0); page < 8; page++ {
+		err := state.dispatchPageFault(-1, testStartAddress+page*pageSize)
+		require.NoError(t, err, "Failed to dispatch page fault")
+	}
+	state.inflightFaults.Wait()
+
+	require.Len(t, installs, 8, "All page faults must be served")
+	for i, install := range installs {
+		require.Equal(t, testStartAddress+uint64(i)*pageSize, install.dst, "Page faults served out of order")
+	}
+}
+
+func TestWorkerPoolServesHigherPriorityFirst(t *testing.T) {
+	const highStartAddress = testStartAddress + 1<<30
+
+	pageSize := uint64(os.Getpagesize())
+
+	var installs []uint64
+	started, release := make(chan struct{}), make(chan struct{})
+	installer, restore := stubInstaller()
+	defer restore()
+	installer.copy = func(fd int, src, dst, mode, len uint64) error {
+		if dst == testStartAddress {
+			close(started)
+			<-release
+		}
+		installs = append(installs, dst)
+		return nil
+	}
+
+	pool := newWorkerPool(1)
+	defer pool.stop()
+
+	low := newTestSnapshotState(4, 1)
+	low.faultQueue = pool.assign()
+	high := newTestSnapshotState(4, 1)
+	high.Priority = 1
+	high.startAddress = highStartAddress
+	high.faultQueue = pool.assign()
+
+	// the worker is busy serving the first page fault of the low priority VM
+	require.NoError(t, low.dispatchPageFault(-1, testStartAddress), "Failed to dispatch page fault")
+	<-started
+
+	for page := uint64(1); page < 4; page++ {
+		require.NoError(t, low.dispatchPageFault(-1, testStartAddress+page*pageSize), "Failed to dispatch page fault")
+		require.NoError(t, high.dispatchPageFault(-1, highStartAddress+page*pageSize), "Failed to dispatch page fault")
+	}
+	close(release)
+	low.inflightFaults.Wait()
+	high.inflightFaults.Wait()
+
+	require.Equal(t, []uint64{
+		testStartAddress,
+		highStartAddress + pageSize, highStartAddress + 2*pageSize, highStartAddress + 3*pageSize,
+		testStartAddress + pageSize, testStartAddress + 2*pageSize, testStartAddress + 3*pageSize,
+	}, installs, "Queued page faults of the higher priority VM must be served first, in order")
+}
+
+func BenchmarkWorkerPool(b *testing.B) {
+	const (
+		numFaults = 100000
+		numVMs    = 100
+	)
+
+	var installed int64
+	installer, restore := stubInstaller()
+	defer restore()
+	installer.copy = func(fd int, src, dst, mode, len uint64) error {
+		atomic.AddInt64(&installed, 1)
+		return nil
+	}
+
+	// a pool size of 0 is the baseline that serves every page fault in a goroutine of its own,
+	// and only serializes the page faults of the same VM
+	for _, poolSize := range []int{0, 1, 4, 16} {
+		name := fmt.Sprintf("Workers%d", poolSize)
+		if poolSize == 0 {
+			name = "Unbounded"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			pool := newWorkerPool(poolSize)
+			defer pool.stop()
+
+			maxGoroutines := runtime.NumGoroutine()
+
+			states := make([]*SnapshotState, numVMs)
+			locks := make([]sync.Mutex, numVMs)
+			for i := range states {
+				states[i] = newTestSnapshotState(numFaults/numVMs, 1)
+				if poolSize > 0 {
+					states[i].faultQueue = pool.assign()
+				}
+			}
+
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				for i := 0; i < numFaults; i++ {
+					state, lock := states[i%numVMs], &locks[i%numVMs]
+					address := testStartAddress + uint64(i/numVMs)*uint64(os.Getpagesize())
+
+					if poolSize > 0 {
+						_ = state.dispatchPageFault(-1, address)
+					} else {
+						state.inflightFaults.Add(1)
+						go func() {
+							defer state.inflightFaults.Done()
+
+							lock.Lock()
+							defer lock.Unlock()
+							_ = state.dispatchPageFault(-1, address)
+						}()
+					}
+
+					if g := runtime.NumGoroutine(); g > maxGoroutines {
+						maxGoroutines = g
+					}
+				}
+
+				for _, state := range states {
+					state.inflightFaults.Wait()
+				}
+			}
+
+			b.ReportMetric(float64(maxGoroutines), "max-goroutines")
+		})
+	}
+}
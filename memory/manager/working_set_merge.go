@@ -0,0 +1,143 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// recordingTraceGlob Matches the trace files of the recordings of a VM in its base directory,
+// which are named trace.<run>
+const recordingTraceGlob = "trace.*"
+
+// MergePolicy Selects the pages of the working set merged from several recordings of a VM
+// by the number of the recordings that touched them
+type MergePolicy struct {
+	minRuns int
+}
+
+// Union Merges the pages touched in any of the recordings
+var Union = MergePolicy{minRuns: 1}
+
+// FrequencyThreshold Merges the pages touched in at least k of the recordings
+func FrequencyThreshold(k int) MergePolicy {
+	return MergePolicy{minRuns: k}
+}
+
+// MergeWorkingSets Merges the traces of several recordings of the inactive VM, named trace.<run>
+// in its base directory, into its trace and working set files, selecting the pages by the policy.
+// The VM replays the merged working set upon its next activation.
+func (m *MemoryManager) MergeWorkingSets(vmID string, policy MergePolicy) error {
+	logger := log.WithFields(log.Fields{"vmID": vmID})
+
+	logger.Debug("Merging the working sets of the recordings")
+
+	state, err := m.getInstance(vmID)
+	if err != nil {
+		return err
+	}
+
+	if policy.minRuns < 1 {
+		return &VMError{VMID: vmID, Err: fmt.Errorf(
+			"%w: frequency threshold %d is not positive", ErrInvalidConfig, policy.minRuns)}
+	}
+
+	state.opMu.Lock()
+	defer state.opMu.Unlock()
+
+	if state.isActive {
+		return &VMError{VMID: vmID, Err: ErrVMStillActive}
+	}
+
+	trace, err := state.mergeRecordings(policy.minRuns)
+	if err != nil {
+		return &VMError{VMID: vmID, Err: err}
+	}
+
+	state.trace = trace
+	state.workingSet = nil
+	state.isRecordReady = true
+
+	return nil
+}
+
+// mergeRecordings Counts the recordings that touched every page, and persists the pages
+// touched in at least minRuns recordings as the trace and the working set of the VM
+func (s *SnapshotState) mergeRecordings(minRuns int) (*Trace, error) {
+	if s.ReadStrategy == CompressedRead {
+		return nil, fmt.Errorf("%w: working sets cannot be copied from compressed guest memory", ErrInvalidConfig)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(s.BaseDir, recordingTraceGlob))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no recordings found in %s", s.BaseDir)
+	}
+
+	runs := make(map[uint64]int)
+	for _, path := range paths {
+		recording := initTrace(path, s.PageSize)
+		if err := recording.readTrace(); err != nil {
+			return nil, fmt.Errorf("trace file %s is corrupt: %w", path, err)
+		}
+
+		for _, rec := range recording.trace {
+			if rec.offset >= uint64(s.GuestMemSize) {
+				return nil, fmt.Errorf("trace file %s is corrupt: offset %#x is outside of the guest memory",
+					path, rec.offset)
+			}
+			runs[rec.offset]++
+		}
+	}
+
+	merged := initTrace(s.getTraceFile(), s.PageSize)
+	merged.compression = s.compression
+	merged.guestMemFS = s.guestMemFS()
+	for offset, n := range runs {
+		if n >= minRuns {
+			merged.AppendRecord(Record{offset: offset})
+		}
+	}
+
+	log.WithFields(log.Fields{"vmID": s.VMID, "recordings": len(paths), "pages": len(merged.trace)}).
+		Debug("Merged the working sets of the recordings")
+
+	if err := merged.ProcessRecord(s.guestMemFilePath(), s.WorkingSetPath); err != nil {
+		return nil, err
+	}
+	// the merged working set has no order of the page faults
+	if err := os.Remove(s.getSequenceFile()); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := s.persistVersion(); err != nil {
+		return nil, err
+	}
+
+	return merged, nil
+}
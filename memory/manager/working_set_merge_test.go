@@ -0,0 +1,134 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeRecordings Writes the traces of the recordings, given as page numbers, to the base directory
+func writeRecordings(t *testing.T, baseDir string, recordings [][]int) {
+	pageSize := os.Getpagesize()
+
+	for i, pages := range recordings {
+		trace := initTrace(filepath.Join(baseDir, fmt.Sprintf("trace.%d", i)), pageSize)
+		if i%2 == 1 {
+			trace.compression = GzipCompression
+		}
+		for _, page := range pages {
+			trace.AppendRecord(Record{offset: uint64(page * pageSize)})
+		}
+		require.NoError(t, trace.WriteTrace(), "Failed to write the trace")
+	}
+}
+
+// tracePages Returns the page numbers of the records of the trace in the ascending order
+func tracePages(trace *Trace) []int {
+	var pages []int
+	for _, rec := range trace.trace {
+		pages = append(pages, int(rec.offset)/os.Getpagesize())
+	}
+
+	return pages
+}
+
+func TestMergeWorkingSets(t *testing.T) {
+	const vmID = "vm"
+
+	pageSize := os.Getpagesize()
+	recordings := [][]int{
+		{0, 1, 2, 5},
+		{1, 2, 6},
+		{2, 5, 7},
+	}
+
+	for _, tc := range []struct {
+		name   string
+		policy MergePolicy
+		pages  []int
+	}{
+		{name: "union", policy: Union, pages: []int{0, 1, 2, 5, 6, 7}},
+		{name: "threshold-2", policy: FrequencyThreshold(2), pages: []int{1, 2, 5}},
+		{name: "threshold-3", policy: FrequencyThreshold(3), pages: []int{2}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			manager := newTestManager(t, MemoryManagerCfg{})
+
+			cfg := prepareSnapshotStateCfg(t, vmID, 8*pageSize)
+			require.NoError(t, manager.RegisterVM(cfg), "Failed to register VM")
+			writeRecordings(t, cfg.BaseDir, recordings)
+
+			require.NoError(t, manager.MergeWorkingSets(vmID, tc.policy), "Failed to merge the working sets")
+
+			state := manager.instances[vmID]
+			require.True(t, state.isRecordReady, "Merged working set must be replayed")
+			require.Equal(t, tc.pages, tracePages(state.trace), "Wrong merged pages")
+
+			persisted := initTrace(state.getTraceFile(), pageSize)
+			require.NoError(t, persisted.readTrace(), "Failed to read the merged trace")
+			require.Equal(t, tc.pages, tracePages(persisted), "Wrong persisted pages")
+
+			workingSet, err := ioutil.ReadFile(cfg.WorkingSetPath)
+			require.NoError(t, err, "Failed to read the working set file")
+			require.Len(t, workingSet, len(tc.pages)*pageSize, "Wrong working set size")
+			for i, page := range tc.pages {
+				require.Equal(t, byte(48+page), workingSet[i*pageSize], "Wrong working set page")
+			}
+		})
+	}
+}
+
+func TestMergeWorkingSetsErrors(t *testing.T) {
+	const vmID = "vm"
+
+	manager := newTestManager(t, MemoryManagerCfg{})
+
+	err := manager.MergeWorkingSets(vmID, Union)
+	require.True(t, errors.Is(err, ErrVMNotRegistered), "Unregistered VM must be rejected")
+
+	cfg := prepareSnapshotStateCfg(t, vmID, 8*os.Getpagesize())
+	require.NoError(t, manager.RegisterVM(cfg), "Failed to register VM")
+
+	err = manager.MergeWorkingSets(vmID, FrequencyThreshold(0))
+	require.True(t, errors.Is(err, ErrInvalidConfig), "Non-positive threshold must be rejected")
+
+	err = manager.MergeWorkingSets(vmID, Union)
+	require.Error(t, err, "Merging no recordings must fail")
+
+	writeRecordings(t, cfg.BaseDir, [][]int{{1}, {8}})
+	err = manager.MergeWorkingSets(vmID, Union)
+	require.Error(t, err, "Page outside of the guest memory must be rejected")
+	require.False(t, manager.instances[vmID].isRecordReady, "Failed merge must not be replayed")
+
+	manager.instances[vmID].isActive = true
+	err = manager.MergeWorkingSets(vmID, Union)
+	require.True(t, errors.Is(err, ErrVMStillActive), "Active VM must be rejected")
+	manager.instances[vmID].isActive = false
+}
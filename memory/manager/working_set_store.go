@@ -0,0 +1,161 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// WorkingSetRecord Recorded working set of a function, i.e., the contents of the files of its record
+type WorkingSetRecord struct {
+	Trace      []byte // offsets of the working set pages, see TraceFile
+	WorkingSet []byte // contents of the working set pages, see WorkingSetFile
+	Sequence   []byte // offsets of the pages in the order of the page faults, if recorded, see SequenceFile
+}
+
+// WorkingSetStore Central store of the recorded working sets of the functions, so that the VMs of
+// a function restored on any node replay its best-known working set, e.g., the client of the
+// WorkingSetStore service of proto/working_set_store.proto returned by NewGRPCWorkingSetStore.
+// The working sets are keyed by the FunctionID and the FunctionVersion of the VMs. Download must
+// return an error that wraps os.ErrNotExist if the store has no working set of the function version.
+type WorkingSetStore interface {
+	Upload(ctx context.Context, functionID, version string, record *WorkingSetRecord) error
+	Download(ctx context.Context, functionID, version string) (*WorkingSetRecord, error)
+}
+
+// usesWorkingSetStore Returns true if the working set of the instance is kept in the working set store
+func (s *SnapshotState) usesWorkingSetStore() bool {
+	return s.wsStore != nil && s.FunctionID != "" && !s.IsLazyMode
+}
+
+// uploadWorkingSet Uploads the record that the instance has persisted to the working set store
+func (s *SnapshotState) uploadWorkingSet(ctx context.Context) error {
+	var (
+		record = new(WorkingSetRecord)
+		err    error
+	)
+
+	if record.Trace, err = ioutil.ReadFile(s.trace.traceFileName); err != nil {
+		return err
+	}
+	if record.WorkingSet, err = ioutil.ReadFile(s.WorkingSetPath); err != nil {
+		return err
+	}
+	if s.faultOrder {
+		if record.Sequence, err = ioutil.ReadFile(s.getSequenceFile()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if err := s.wsStore.Upload(ctx, s.FunctionID, s.FunctionVersion, record); err != nil {
+		return fmt.Errorf("failed to upload the working set of function %s: %w", s.FunctionID, err)
+	}
+
+	return nil
+}
+
+// downloadWorkingSet Replaces the record files of the instance with the working set of its function
+// in the working set store, returns false if the store has none
+func (s *SnapshotState) downloadWorkingSet(ctx context.Context) (bool, error) {
+	record, err := s.wsStore.Download(ctx, s.FunctionID, s.FunctionVersion)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("failed to download the working set of function %s: %w", s.FunctionID, err)
+	case len(record.WorkingSet)%s.PageSize != 0:
+		return false, fmt.Errorf("working set of function %s is corrupt: %d bytes are not a multiple of the page size",
+			s.FunctionID, len(record.WorkingSet))
+	}
+
+	files := map[string][]byte{
+		s.trace.traceFileName: record.Trace,
+		s.WorkingSetPath:      record.WorkingSet,
+	}
+	if s.faultOrder && len(record.Sequence) > 0 {
+		files[s.getSequenceFile()] = record.Sequence
+	} else if s.faultOrder {
+		// the pages are installed in the order of the offsets without a sequence
+		if err := os.Remove(s.getSequenceFile()); err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+	for path, contents := range files {
+		if err := replaceFile(path, contents); err != nil {
+			return false, err
+		}
+	}
+
+	// the downloaded working set was recorded by the version it is keyed by
+	if err := s.persistVersion(); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// fetchStoredWorkingSet Caches the working set of the function of the instance from the working set
+// store in its record files. The record files cached earlier, if any, are used if the store fails.
+func (s *SnapshotState) fetchStoredWorkingSet(ctx context.Context) {
+	logger := log.WithFields(log.Fields{"vmID": s.VMID, "functionID": s.FunctionID})
+
+	downloaded, err := s.downloadWorkingSet(ctx)
+	switch {
+	case err != nil:
+		logger.Warnf("Using the local working set: %v", err)
+	case downloaded:
+		logger.Debug("Downloaded the working set from the working set store")
+	default:
+		logger.Debug("No working set in the working set store")
+	}
+}
+
+// replaceFile Writes the file by renaming a complete temporary file over it
+func replaceFile(path string, contents []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".download")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(contents); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
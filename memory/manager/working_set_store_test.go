@@ -0,0 +1,165 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeWorkingSetStore Keeps the working sets in memory, fails every request if err is set
+type fakeWorkingSetStore struct {
+	sync.Mutex
+	records map[string]*WorkingSetRecord
+	err     error
+}
+
+func newFakeWorkingSetStore() *fakeWorkingSetStore {
+	return &fakeWorkingSetStore{records: make(map[string]*WorkingSetRecord)}
+}
+
+func (f *fakeWorkingSetStore) Upload(ctx context.Context, functionID, version string, record *WorkingSetRecord) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.err != nil {
+		return f.err
+	}
+	f.records[functionID+"/"+version] = record
+
+	return nil
+}
+
+func (f *fakeWorkingSetStore) Download(ctx context.Context, functionID, version string) (*WorkingSetRecord, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.err != nil {
+		return nil, f.err
+	}
+	record, ok := f.records[functionID+"/"+version]
+	if !ok {
+		return nil, fmt.Errorf("working set of %s/%s: %w", functionID, version, os.ErrNotExist)
+	}
+
+	return record, nil
+}
+
+func TestWorkingSetStoreUploadOnDeactivate(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	store := newFakeWorkingSetStore()
+	manager := newTestManager(t, MemoryManagerCfg{WorkingSetStore: store})
+
+	pageSize := uint64(os.Getpagesize())
+	stateCfg := prepareSnapshotStateCfg(t, "1", 8*os.Getpagesize())
+	stateCfg.FunctionID = "helloworld"
+	stateCfg.FunctionVersion = "v1"
+
+	err := manager.RegisterVM(stateCfg)
+	require.NoError(t, err, "Failed to register VM")
+
+	state, _ := activateTestVM(t, manager, stateCfg.VMID)
+	for _, page := range []uint64{5, 1, 6} {
+		err := state.servePageFault(-1, testStartAddress+page*pageSize)
+		require.NoError(t, err, "Failed to serve page fault")
+	}
+
+	err = manager.Deactivate(stateCfg.VMID)
+	require.NoError(t, err, "Failed to deactivate VM")
+
+	record, err := store.Download(context.Background(), "helloworld", "v1")
+	require.NoError(t, err, "The recorded working set must be uploaded")
+
+	trace, err := ioutil.ReadFile(filepath.Join(stateCfg.BaseDir, "trace"))
+	require.NoError(t, err, "Failed to read the trace file")
+	require.Equal(t, trace, record.Trace, "Wrong uploaded trace")
+	require.Len(t, record.WorkingSet, 3*os.Getpagesize(), "Wrong size of the uploaded working set")
+	require.EqualValues(t, 48+1, record.WorkingSet[0], "Wrong contents of the uploaded working set")
+}
+
+func TestWorkingSetStoreDownloadOnFetch(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	store := newFakeWorkingSetStore()
+	manager := newTestManager(t, MemoryManagerCfg{WorkingSetStore: store})
+
+	// the working set is recorded by a VM of the function on another node
+	recorded := prepareSnapshotStateCfg(t, "recorded", 8*os.Getpagesize())
+	persistRecord(t, recorded, []uint64{0, 2 * uint64(os.Getpagesize()), 3 * uint64(os.Getpagesize())})
+
+	record := new(WorkingSetRecord)
+	var err error
+	record.Trace, err = ioutil.ReadFile(filepath.Join(recorded.BaseDir, "trace"))
+	require.NoError(t, err, "Failed to read the trace file")
+	record.WorkingSet, err = ioutil.ReadFile(recorded.WorkingSetPath)
+	require.NoError(t, err, "Failed to read the working set file")
+
+	err = store.Upload(context.Background(), "helloworld", "v1", record)
+	require.NoError(t, err, "Failed to upload the working set")
+
+	stateCfg := prepareSnapshotStateCfg(t, "1", 8*os.Getpagesize())
+	stateCfg.FunctionID = "helloworld"
+	stateCfg.FunctionVersion = "v1"
+
+	err = manager.RegisterVM(stateCfg)
+	require.NoError(t, err, "Failed to register VM")
+
+	pages, err := manager.FetchState(stateCfg.VMID)
+	require.NoError(t, err, "Failed to fetch state")
+	require.Equal(t, 3, pages, "The downloaded working set must be prefetched")
+
+	ws, err := ioutil.ReadFile(stateCfg.WorkingSetPath)
+	require.NoError(t, err, "The downloaded working set must be cached locally")
+	require.Equal(t, record.WorkingSet, ws, "Wrong cached working set")
+}
+
+func TestWorkingSetStoreFallback(t *testing.T) {
+	var installs []installCall
+	defer stubInstallRegion(&installs)()
+
+	store := newFakeWorkingSetStore()
+	store.err = errors.New("store is unavailable")
+	manager := newTestManager(t, MemoryManagerCfg{WorkingSetStore: store})
+
+	stateCfg := prepareSnapshotStateCfg(t, "1", 8*os.Getpagesize())
+	stateCfg.FunctionID = "helloworld"
+	persistRecord(t, stateCfg, []uint64{0, uint64(os.Getpagesize())})
+
+	err := manager.RegisterVM(stateCfg)
+	require.NoError(t, err, "Failed to register VM")
+
+	pages, err := manager.FetchState(stateCfg.VMID)
+	require.NoError(t, err, "The local record must be used if the store fails")
+	require.Equal(t, 2, pages, "Wrong number of prefetched pages")
+}
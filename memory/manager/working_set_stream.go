@@ -0,0 +1,216 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// workingSetStream Working set of a VM that is fetched in the background, see StreamWorkingSet.
+// The page faults of the VM are served on demand meanwhile, and the fetched pages that have not been
+// served are installed as they arrive, both sides skipping the pages set in the served pages bitmap.
+type workingSetStream struct {
+	workingSet []byte
+	fetched    int64 // number of the pages of the working set read so far, set atomically
+	installed  int   // number of the fetched pages installed, or skipped as they were served already
+	fd         int   // uffd that the pages are installed to, set upon the first page fault
+
+	cancel context.CancelFunc
+	done   chan struct{} // closed once the working set is fetched or the fetch has failed
+	err    error         // error of the fetch, set before done is closed
+}
+
+// startWorkingSetStream Fetches the VMM state file, and starts fetching the working set file of the
+// loaded record in the background, or fetches the whole guest memory if there is no working set file.
+// Returns the number of the working set pages. The progress of the background fetch is reported
+// from its goroutine.
+func (s *SnapshotState) startWorkingSetStream(every int, progress func(fetched, total int)) (int, error) {
+	s.stopWorkingSetStream()
+
+	if err := s.fetchVMMState(); err != nil {
+		return 0, err
+	}
+
+	f, err := s.openWorkingSet()
+	if err != nil {
+		return 0, err
+	}
+	if f == nil {
+		return 0, s.fetchGuestMemory(newFetchProgress(context.Background(), every, progress))
+	}
+
+	// the fetch outlives the call of FetchState, it is aborted upon deactivation instead
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := &workingSetStream{
+		workingSet: AlignedBlock(len(s.trace.trace) * s.PageSize), // direct io requires aligned buffer
+		fd:         -1,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+
+	// the page faults of an active VM pick the stream up once no page fault is being served
+	s.pauseMu.Lock()
+	s.inflightFaults.Wait()
+	s.wsStream = stream
+	s.pauseMu.Unlock()
+
+	go func() {
+		defer close(stream.done)
+		defer f.Close()
+
+		stream.err = s.fetchStreamedWorkingSet(stream, f, newFetchProgress(ctx, every, progress))
+	}()
+
+	return len(s.trace.trace), nil
+}
+
+// fetchStreamedWorkingSet Reads the working set file into the stream, installing the pages after every chunk
+// once the guest memory is set up. If the whole working set is fetched before the first page fault,
+// it is installed upon the first page fault like a working set fetched by FetchState.
+func (s *SnapshotState) fetchStreamedWorkingSet(stream *workingSetStream, f fs.File,
+	progress *fetchProgress) error {
+	logger := log.WithFields(log.Fields{"vmID": s.VMID})
+
+	err := s.readWorkingSet(f, stream.workingSet, progress, func(fetched int) error {
+		atomic.StoreInt64(&stream.fetched, int64(fetched))
+
+		// no page fault is served meanwhile, see PauseVM
+		s.pauseMu.Lock()
+		defer s.pauseMu.Unlock()
+		s.inflightFaults.Wait()
+
+		if _, err := s.installStreamedPages(stream); err != nil {
+			return fmt.Errorf("failed to install the streamed working set: %w", err)
+		}
+
+		return nil
+	})
+
+	s.pauseMu.Lock()
+	s.inflightFaults.Wait()
+	switch {
+	case err != nil:
+	case atomic.LoadUint64(&s.startAddress) == 0:
+		s.workingSet = stream.workingSet
+	default:
+		atomic.StoreInt64(&s.prefetchedAt, time.Now().UnixNano())
+	}
+	s.pauseMu.Unlock()
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		logger.Debug("Stopped streaming the working set")
+	case err != nil:
+		// the pages that have not been fetched are served on demand
+		logger.Warnf("Failed to stream the working set: %v", err)
+	default:
+		logger.Debug("Streamed the entire working set")
+	}
+
+	return err
+}
+
+// installStreamedPages Installs the pages of the working set that have been fetched but neither
+// installed nor served yet, unless the guest memory is set up only upon the first page fault, which
+// installs them. Returns the number of the installed pages. Must be called with no page fault being
+// served, i.e., by the first page fault or with pauseMu held and inflightFaults drained.
+func (s *SnapshotState) installStreamedPages(stream *workingSetStream) (int, error) {
+	if s.startAddress == 0 {
+		return 0, nil
+	}
+
+	mode := uint64(0)
+	if s.usesUFFDWriteProtect() {
+		mode |= uffdCopyModeWP()
+	}
+
+	var (
+		fetched   = int(atomic.LoadInt64(&stream.fetched))
+		records   = s.trace.trace
+		installed int
+	)
+	for stream.installed < fetched {
+		i := stream.installed
+		page := int(records[i].offset) / s.PageSize
+		if s.servedPages.Test(page) {
+			stream.installed++
+			continue
+		}
+
+		// the working set file stores the pages in the order of their offsets
+		n := 1
+		for i+n < fetched && int(records[i+n].offset)/s.PageSize == page+n && !s.servedPages.Test(page+n) {
+			n++
+		}
+		_, n = s.clipToRegion(page, page, n)
+
+		src := uint64(uintptr(unsafe.Pointer(&stream.workingSet[i*s.PageSize])))
+		err := s.installer.Copy(stream.fd, src, s.pageAddress(page), mode, uint64(n*s.PageSize))
+		switch {
+		case errors.Is(err, errAlreadyPresent):
+			atomic.AddInt64(&s.alreadyPresent, int64(n))
+		case err != nil:
+			return installed, err
+		default:
+			installed += n
+		}
+
+		atomic.AddInt64(&s.servedPagesNum, int64(s.servedPages.SetRange(page, n)))
+		stream.installed += n
+	}
+
+	atomic.AddInt64(&s.workingSetInstalls, int64(installed))
+	atomic.AddInt64(&s.prefetchedPages, int64(installed))
+
+	return installed, nil
+}
+
+// stopWorkingSetStream Aborts fetching the working set in the background, if it is being fetched,
+// and drops the streamed working set
+func (s *SnapshotState) stopWorkingSetStream() {
+	s.pauseMu.Lock()
+	stream := s.wsStream
+	s.pauseMu.Unlock()
+
+	if stream == nil {
+		return
+	}
+
+	stream.cancel()
+	<-stream.done
+
+	s.pauseMu.Lock()
+	s.inflightFaults.Wait()
+	if s.wsStream == stream {
+		s.wsStream = nil
+	}
+	s.pauseMu.Unlock()
+}
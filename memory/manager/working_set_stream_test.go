@@ -0,0 +1,213 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/require"
+)
+
+// gatedFS Reads the working set file one chunk per value received from gate, if set
+type gatedFS struct {
+	OSFS
+	workingSetPath string
+	gate           chan struct{}
+}
+
+func (g *gatedFS) Open(name string) (fs.File, error) {
+	f, err := g.OSFS.Open(name)
+	if err != nil || name != g.workingSetPath || g.gate == nil {
+		return f, err
+	}
+
+	return &gatedFile{File: f, gate: g.gate}, nil
+}
+
+type gatedFile struct {
+	fs.File
+	gate chan struct{}
+}
+
+func (f *gatedFile) Read(p []byte) (int, error) {
+	<-f.gate
+	return f.File.Read(p)
+}
+
+// stubCountingInstaller Counts the installations of every page at its address, checking that
+// the installed contents are those of the page in the guest memory file
+func stubCountingInstaller(t *testing.T, installs map[uint64]int) func() {
+	pageSize := uint64(os.Getpagesize())
+
+	installer, restore := stubInstaller()
+	installer.copy = func(fd int, src, dst, mode, len uint64) error {
+		mem := (*[1 << 30]byte)(*(*unsafe.Pointer)(unsafe.Pointer(&src)))
+		for off := uint64(0); off < len; off += pageSize {
+			page := (dst + off - testStartAddress) / pageSize
+			require.Equal(t, byte(48+page), mem[off], "Wrong contents of the installed page")
+			installs[dst+off]++
+		}
+		return nil
+	}
+	installer.zeroPage = func(fd int, dst, mode, len uint64) error {
+		for off := uint64(0); off < len; off += pageSize {
+			installs[dst+off]++
+		}
+		return nil
+	}
+
+	return restore
+}
+
+// registerStreamingVM Registers a VM with a recorded working set of the first wsPages pages that is
+// streamed through the gate, fetches its state and maps its guest memory as if it was activated
+func registerStreamingVM(t *testing.T, vmID string, pages, wsPages int, gate chan struct{}) *SnapshotState {
+	cfg := prepareSnapshotStateCfg(t, vmID, pages*os.Getpagesize())
+	cfg.GuestPhysBase = testStartAddress
+
+	var offsets []uint64
+	for i := 0; i < wsPages; i++ {
+		offsets = append(offsets, uint64(i*os.Getpagesize()))
+	}
+	persistRecord(t, cfg, offsets)
+
+	manager := newTestManager(t, MemoryManagerCfg{
+		StreamWorkingSet: true,
+		StateFS:          &gatedFS{workingSetPath: cfg.WorkingSetPath, gate: gate},
+	})
+	require.NoError(t, manager.RegisterVM(cfg), "Failed to register VM")
+	state := manager.instances[vmID]
+
+	n, err := manager.FetchStateWithProgress(context.Background(), vmID, 1, nil)
+	require.NoError(t, err, "Failed to fetch the state")
+	require.Equal(t, wsPages, n, "Wrong number of the working set pages")
+
+	require.NoError(t, state.mapGuestMemory(context.Background()), "Failed to map the guest memory")
+	state.setupStateOnActivate()
+
+	return state
+}
+
+// serveStreamingFault Serves the page fault like the polling loop, i.e., not while the stream installs pages
+func serveStreamingFault(t *testing.T, state *SnapshotState, page int) {
+	address := testStartAddress + uint64(page*os.Getpagesize())
+	err := state.dispatchUnlessPaused(faultRequest{state: state, kind: missingFault, fd: -1, address: address})
+	require.NoError(t, err, "Failed to serve page fault")
+}
+
+func TestStreamWorkingSet(t *testing.T) {
+	installs := make(map[uint64]int)
+	defer stubCountingInstaller(t, installs)()
+
+	pageSize := os.Getpagesize()
+	gate := make(chan struct{})
+	state := registerStreamingVM(t, "1", 8, 6, gate)
+	stream := state.wsStream
+	require.NotNil(t, stream, "Working set must be streamed")
+
+	// the first pages arrive before the VM faults and are installed upon its first page fault
+	gate <- struct{}{}
+	gate <- struct{}{}
+	for atomic.LoadInt64(&stream.fetched) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	require.Empty(t, installs, "No page must be installed before the first page fault")
+
+	serveStreamingFault(t, state, 1)
+	require.Equal(t, map[uint64]int{testStartAddress: 1, testStartAddress + uint64(pageSize): 1}, installs,
+		"Fetched pages must be installed upon the first page fault")
+
+	// a working set page that has not arrived yet is served on demand
+	serveStreamingFault(t, state, 4)
+	require.Equal(t, 1, installs[testStartAddress+uint64(4*pageSize)], "Faulting page must be installed")
+
+	for i := 0; i < 4; i++ {
+		gate <- struct{}{}
+	}
+	<-stream.done
+	require.NoError(t, stream.err, "Failed to stream the working set")
+
+	for page := 0; page < 8; page++ {
+		count := installs[testStartAddress+uint64(page*pageSize)]
+		if page < 6 {
+			require.Equal(t, 1, count, "Working set page must be installed exactly once")
+		} else {
+			require.Zero(t, count, "Page outside of the working set must not be installed")
+		}
+		require.Equal(t, page < 6, state.servedPages.Test(page), "Wrong served pages bitmap")
+	}
+	require.EqualValues(t, 6, atomic.LoadInt64(&state.servedPagesNum), "Wrong number of the served pages")
+	require.EqualValues(t, 5, atomic.LoadInt64(&state.workingSetInstalls), "Wrong number of the streamed pages")
+	require.NotZero(t, atomic.LoadInt64(&state.prefetchedAt), "Streamed working set must count as prefetched")
+}
+
+func TestStreamWorkingSetRacingFaults(t *testing.T) {
+	installs := make(map[uint64]int)
+	defer stubCountingInstaller(t, installs)()
+
+	const pages = 64
+
+	pageSize := os.Getpagesize()
+	gate := make(chan struct{})
+	state := registerStreamingVM(t, "1", pages, pages, gate)
+	stream := state.wsStream
+
+	go func() {
+		for i := 0; i < pages; i++ {
+			gate <- struct{}{}
+		}
+	}()
+
+	// the VM touches the pages from the end while the working set arrives from the start
+	for page := pages - 1; page >= 0; page-- {
+		serveStreamingFault(t, state, page)
+	}
+	<-stream.done
+	require.NoError(t, stream.err, "Failed to stream the working set")
+
+	for page := 0; page < pages; page++ {
+		require.Equal(t, 1, installs[testStartAddress+uint64(page*pageSize)], "Page must be installed exactly once")
+		require.True(t, state.servedPages.Test(page), "Page must be marked as served")
+	}
+	require.EqualValues(t, pages, atomic.LoadInt64(&state.servedPagesNum), "Wrong number of the served pages")
+}
+
+func TestStreamWorkingSetBeforeFirstFault(t *testing.T) {
+	installs := make(map[uint64]int)
+	defer stubCountingInstaller(t, installs)()
+
+	state := registerStreamingVM(t, "1", 8, 4, nil)
+	<-state.wsStream.done
+
+	// the whole working set has arrived, it is installed upon the first page fault as if fetched by FetchState
+	require.NotNil(t, state.workingSet, "Streamed working set must be kept for the first page fault")
+	serveStreamingFault(t, state, 0)
+	require.Len(t, installs, 4, "Working set must be installed upon the first page fault")
+	require.EqualValues(t, 4, atomic.LoadInt64(&state.servedPagesNum), "Wrong number of the served pages")
+}
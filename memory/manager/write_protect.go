@@ -0,0 +1,69 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"fmt"
+)
+
+// usesUFFDWriteProtect Returns true if the pages written by the guest are tracked with
+// write-protect faults, i.e., the pages are installed write-protected
+func (s *SnapshotState) usesUFFDWriteProtect() bool {
+	return s.WriteProtect && !s.softDirty
+}
+
+// serveWriteProtectFault Marks the page as dirty and lets the guest write to it
+func (s *SnapshotState) serveWriteProtectFault(fd int, address uint64) error {
+	address &^= uint64(s.PageSize - 1)
+	offset, err := s.faultOffset(address)
+	if err != nil {
+		return fmt.Errorf("write-protect fault: %w", err)
+	}
+	page := int(offset) / s.PageSize
+
+	s.dirtyMu.Lock()
+	s.dirtyPages.Set(page)
+	s.dirtyMu.Unlock()
+
+	// un-protecting the page wakes up the faulting thread
+	return writeProtectFunc(fd, address, uint64(s.PageSize), false)
+}
+
+// dirtyOffsets Returns the sorted offsets of the pages written by the guest
+func (s *SnapshotState) dirtyOffsets() []uint64 {
+	s.dirtyMu.Lock()
+	defer s.dirtyMu.Unlock()
+
+	offsets := make([]uint64, 0)
+	if s.dirtyPages == nil {
+		return offsets
+	}
+
+	for page := 0; page < s.dirtyPages.Len(); page++ {
+		if s.dirtyPages.Test(page) {
+			offsets = append(offsets, uint64(page*s.PageSize))
+		}
+	}
+
+	return offsets
+}
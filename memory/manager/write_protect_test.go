@@ -0,0 +1,170 @@
+// MIT License
+//
+// Copyright (c) 2020 Dmitrii Ustiugov, Plamen Petrov and EASE lab
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"encoding/binary"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type writeProtectCall struct {
+	start, len uint64
+	protect    bool
+}
+
+// stubWriteProtect Records the write-protect registrations and (un)protected ranges
+// instead of issuing the ioctls, returns the function that restores the real implementation
+func stubWriteProtect(registrations, calls *[]writeProtectCall) func() {
+	registerWriteProtectFunc = func(fd int, start, len uint64) error {
+		*registrations = append(*registrations, writeProtectCall{start: start, len: len, protect: true})
+		return nil
+	}
+	writeProtectFunc = func(fd int, start, len uint64, protect bool) error {
+		*calls = append(*calls, writeProtectCall{start: start, len: len, protect: protect})
+		return nil
+	}
+
+	return func() {
+		registerWriteProtectFunc = registerWriteProtect
+		writeProtectFunc = writeProtect
+	}
+}
+
+// writeFault Writes a write-protect page fault uffd message for the address
+func (v *fakeVM) writeFault(t *testing.T, address uint64) {
+	msg := make([]byte, sizeOfUFFDMsg())
+	msg[0] = uffdPageFault()
+	binary.LittleEndian.PutUint64(msg[8:], uffdPageFaultFlagWP())
+	binary.LittleEndian.PutUint64(msg[16:], address)
+
+	_, err := v.w.Write(msg)
+	require.NoError(t, err, "Failed to write uffd message")
+}
+
+func TestParsePageFault(t *testing.T) {
+	const address = testStartAddress + 0x3000
+
+	for _, tc := range []struct {
+		name  string
+		flags uint64
+		kind  faultKind
+	}{
+		{"read of a missing page", 0, missingFault},
+		{"write to a missing page", uffdPageFaultFlagWrite(), missingFault},
+		{"write to a write-protected page", uffdPageFaultFlagWP() | uffdPageFaultFlagWrite(), writeProtectFault},
+		{"read of a page in the page cache", uffdPageFaultFlagMinor(), minorFault},
+		{"write to a page in the page cache", uffdPageFaultFlagMinor() | uffdPageFaultFlagWrite(), minorFault},
+	} {
+		msg := make([]byte, sizeOfUFFDMsg())
+		msg[0] = uffdPageFault()
+		binary.LittleEndian.PutUint64(msg[8:], tc.flags)
+		binary.LittleEndian.PutUint64(msg[16:], address)
+
+		gotAddress, gotFlags, kind := parsePageFault(msg)
+		require.Equal(t, address, gotAddress, "Wrong address of the "+tc.name)
+		require.Equal(t, tc.flags, gotFlags, "Wrong flags of the "+tc.name)
+		require.Equal(t, tc.kind, kind, "Wrong kind of the "+tc.name)
+	}
+}
+
+func TestWriteProtectDirtyPages(t *testing.T) {
+	var (
+		installs              []installCall
+		registrations, unprot []writeProtectCall
+		modes                 []uint64
+	)
+	defer stubInstallRegion(&installs)()
+	defer stubWriteProtect(&registrations, &unprot)()
+	defer stubCapabilities(Capabilities{ZeroPage: true, WriteProtect: true})()
+
+	installer, _ := stubInstaller()
+	installer.copy = func(fd int, src, dst, mode, len uint64) error {
+		installs = append(installs, installCall{dst: dst, len: len})
+		modes = append(modes, mode)
+		return nil
+	}
+
+	pageSize := uint64(os.Getpagesize())
+
+	manager := newTestManager(t, MemoryManagerCfg{})
+	cfg := prepareSnapshotStateCfg(t, "vm", 8*int(pageSize))
+	cfg.WriteProtect = true
+	cfg.IsLazyMode = true
+	require.NoError(t, manager.RegisterVM(cfg), "Failed to register VM")
+
+	state := manager.instances["vm"]
+	state.guestMem = make([]byte, state.GuestMemSize) // all-zero pages are copied as well
+	state.setupStateOnActivate()
+	uffd, fakeVM := newFakeUFFD(t, state)
+	events := []syscall.EpollEvent{{Events: syscall.EPOLLIN, Fd: int32(uffd)}}
+
+	// the guest reads pages 0, 2 and 5
+	for _, page := range []uint64{0, 2, 5} {
+		fakeVM.fault(t, testStartAddress+page*pageSize)
+		require.NoError(t, state.handleEvents(events), "Failed to handle events")
+	}
+	require.Equal(t, []writeProtectCall{{start: testStartAddress, len: 8 * pageSize, protect: true}}, registrations,
+		"Guest memory must be registered for write-protect faults once")
+	require.Len(t, installs, 3, "Every read page must be installed")
+	for _, inst := range installs {
+		require.False(t, inst.zero, "Zero pages cannot be write-protected")
+	}
+	for _, mode := range modes {
+		require.NotZero(t, mode&uffdCopyModeWP(), "Pages must be installed write-protected")
+	}
+
+	// the guest writes pages 2 and 5, the latter twice
+	for _, page := range []uint64{2, 5, 5} {
+		fakeVM.writeFault(t, testStartAddress+page*pageSize+8)
+		require.NoError(t, state.handleEvents(events), "Failed to handle events")
+	}
+	require.Len(t, installs, 3, "Write-protect faults must not install pages")
+	require.Equal(t, writeProtectCall{start: testStartAddress + 2*pageSize, len: pageSize}, unprot[0],
+		"Written page must be un-protected")
+
+	dirty, err := manager.DirtyPages("vm")
+	require.NoError(t, err, "Failed to get the dirty pages")
+	require.Equal(t, []uint64{2 * pageSize, 5 * pageSize}, dirty, "Only the written pages must be dirty")
+
+	// the dirty pages are tracked per activation
+	state.setupStateOnActivate()
+	dirty, err = manager.DirtyPages("vm")
+	require.NoError(t, err, "Failed to get the dirty pages")
+	require.Empty(t, dirty, "Dirty pages must be reset upon activation")
+}
+
+func TestDirtyPagesWithoutWriteProtect(t *testing.T) {
+	manager := newTestManager(t, MemoryManagerCfg{})
+	cfg := prepareSnapshotStateCfg(t, "vm", 4*os.Getpagesize())
+	require.NoError(t, manager.RegisterVM(cfg), "Failed to register VM")
+
+	_, err := manager.DirtyPages("vm")
+	require.Error(t, err, "VM not in the write-protect mode must be reported")
+
+	_, err = manager.DirtyPages("missing")
+	require.Error(t, err, "Unregistered VM must be reported")
+}
@@ -23,6 +23,9 @@ type TimeseriesClient interface {
 	// ==============
 	StartExperiment(ctx context.Context, in *ExperimentDefinition, opts ...grpc.CallOption) (*empty.Empty, error)
 	EndExperiment(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (*ExperimentResult, error)
+	// GetPartialResults returns the results recorded so far without ending
+	// the experiment.
+	GetPartialResults(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (*ExperimentResult, error)
 }
 
 type timeseriesClient struct {
@@ -51,6 +54,15 @@ func (c *timeseriesClient) EndExperiment(ctx context.Context, in *empty.Empty, o
 	return out, nil
 }
 
+func (c *timeseriesClient) GetPartialResults(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (*ExperimentResult, error) {
+	out := new(ExperimentResult)
+	err := c.cc.Invoke(ctx, "/Timeseries/GetPartialResults", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // TimeseriesServer is the server API for Timeseries service.
 // All implementations must embed UnimplementedTimeseriesServer
 // for forward compatibility
@@ -59,6 +71,9 @@ type TimeseriesServer interface {
 	// ==============
 	StartExperiment(context.Context, *ExperimentDefinition) (*empty.Empty, error)
 	EndExperiment(context.Context, *empty.Empty) (*ExperimentResult, error)
+	// GetPartialResults returns the results recorded so far without ending
+	// the experiment.
+	GetPartialResults(context.Context, *empty.Empty) (*ExperimentResult, error)
 	mustEmbedUnimplementedTimeseriesServer()
 }
 
@@ -72,6 +87,9 @@ func (UnimplementedTimeseriesServer) StartExperiment(context.Context, *Experimen
 func (UnimplementedTimeseriesServer) EndExperiment(context.Context, *empty.Empty) (*ExperimentResult, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method EndExperiment not implemented")
 }
+func (UnimplementedTimeseriesServer) GetPartialResults(context.Context, *empty.Empty) (*ExperimentResult, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetPartialResults not implemented")
+}
 func (UnimplementedTimeseriesServer) mustEmbedUnimplementedTimeseriesServer() {}
 
 // UnsafeTimeseriesServer may be embedded to opt out of forward compatibility for this service.
@@ -121,6 +139,24 @@ func _Timeseries_EndExperiment_Handler(srv interface{}, ctx context.Context, dec
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Timeseries_GetPartialResults_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(empty.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TimeseriesServer).GetPartialResults(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Timeseries/GetPartialResults",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TimeseriesServer).GetPartialResults(ctx, req.(*empty.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Timeseries_ServiceDesc is the grpc.ServiceDesc for Timeseries service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -136,6 +172,10 @@ var Timeseries_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "EndExperiment",
 			Handler:    _Timeseries_EndExperiment_Handler,
 		},
+		{
+			MethodName: "GetPartialResults",
+			Handler:    _Timeseries_GetPartialResults_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "timeseries.proto",
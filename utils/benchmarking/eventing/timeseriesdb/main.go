@@ -26,6 +26,7 @@ import (
 	"encoding/base64"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 
 	cloudevents "github.com/cloudevents/sdk-go/v2"
@@ -34,6 +35,7 @@ import (
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/reflection"
+	protobuf "google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
@@ -44,6 +46,9 @@ import (
 type Server struct {
 	proto.UnimplementedTimeseriesServer
 
+	// mu guards workflows, which the gRPC handlers and the CloudEvents
+	// receiver access concurrently.
+	mu        sync.Mutex
 	workflows map[string]*Workflow
 }
 
@@ -61,6 +66,9 @@ type Invocation struct {
 func (s *Server) StartExperiment(_ context.Context, definition *proto.ExperimentDefinition) (*empty.Empty, error) {
 	log.Infoln("starting experiment")
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	s.workflows = make(map[string]*Workflow)
 	for _, wd := range definition.WorkflowDefinitions {
 		s.workflows[wd.Id] = &Workflow{
@@ -76,16 +84,35 @@ func (s *Server) StartExperiment(_ context.Context, definition *proto.Experiment
 
 func (s *Server) EndExperiment(_ context.Context, _ *empty.Empty) (*proto.ExperimentResult, error) {
 	log.Infoln("ending current experiment")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.results(), nil
+}
+
+// GetPartialResults returns the results recorded so far, while the experiment
+// continues to register events.
+func (s *Server) GetPartialResults(_ context.Context, _ *empty.Empty) (*proto.ExperimentResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.results(), nil
+}
+
+// results returns a copy of the invocations registered so far, so that the
+// result can be marshalled after the lock is released. The caller must hold mu.
+func (s *Server) results() *proto.ExperimentResult {
 	results := make(map[string]*proto.WorkflowResult)
 	for _, wrk := range s.workflows {
 		invocations := make([]*proto.InvocationDescriptor, 0)
 		for _, inv := range wrk.invocations {
-			invocations = append(invocations, inv.descriptor)
+			invocations = append(invocations, protobuf.Clone(inv.descriptor).(*proto.InvocationDescriptor))
 		}
 		results[wrk.id] = &proto.WorkflowResult{Invocations: invocations}
 
 	}
-	return &proto.ExperimentResult{WorkflowResults: results}, nil
+	return &proto.ExperimentResult{WorkflowResults: results}
 }
 
 func getProtoEventFromCloudEvent(d []byte) *proto.VHiveMetadata {
@@ -202,6 +229,9 @@ func (s *Server) registerEvent(_ context.Context, cloudEvent cloudevents.Event)
 		event.Attributes["source"], event.Attributes["type"],
 	)
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	workflow, ok := s.workflows[event.VHiveMetadata.WorkflowId]
 	if !ok {
 		log.Fatalf("failed to register an event to an unknown workflow: `%s`", event.VHiveMetadata.WorkflowId)
@@ -149,3 +149,68 @@ func TestDefaultEndToEnd(t *testing.T) {
 	require.True(t, eventRecordA2.IsCompletion)
 	require.Equal(t, &eventA2, eventRecordA2.Event)
 }
+
+func TestPartialResults(t *testing.T) {
+	var server Server
+
+	exDef := proto.ExperimentDefinition{
+		WorkflowDefinitions: map[string]*proto.WorkflowDefinition{
+			workflowId: {
+				Id: workflowId,
+				CompletionEventDescriptors: []*proto.CompletionEventDescriptor{
+					{
+						AttrMatchers: map[string]string{
+							"type":   "greeting",
+							"source": "consumer",
+						},
+					},
+				},
+			},
+		}}
+	vHiveMetadataBytes := base64.StdEncoding.EncodeToString(vhivemetadata.MakeVHiveMetadata(workflowId, "A", time.Now().UTC()))
+
+	cEventA1 := cloudevents.NewEvent("1.0")
+	cEventA1.SetID("A")
+	cEventA1.SetSource("producer")
+	cEventA1.SetType("greeting")
+	cEventA1.SetExtension("vhivemetadata", vHiveMetadataBytes)
+
+	cEventA2 := cloudevents.NewEvent("1.0")
+	cEventA2.SetID("A")
+	cEventA2.SetSource("consumer")
+	cEventA2.SetType("greeting")
+	cEventA2.SetExtension("vhivemetadata", vHiveMetadataBytes)
+
+	if _, err := server.StartExperiment(context.Background(), &exDef); err != nil {
+		t.Error("StartExperiment", err)
+	}
+	if _, err := server.registerEvent(context.Background(), cEventA1); err != nil {
+		t.Error("RegisterEvent(A1)", err)
+	}
+
+	// the invoker polls for the results before the consumer has completed:
+	partial, err := server.GetPartialResults(context.Background(), nil)
+	if err != nil {
+		t.Error("GetPartialResults", err)
+	}
+
+	if _, err := server.registerEvent(context.Background(), cEventA2); err != nil {
+		t.Error("RegisterEvent(A2)", err)
+	}
+
+	res, err := server.EndExperiment(context.Background(), nil)
+	if err != nil {
+		t.Error("EndExperiment", err)
+	}
+
+	// The partial results must not change as later events are registered.
+	require.Len(t, partial.WorkflowResults[workflowId].Invocations, 1)
+	invocation := partial.WorkflowResults[workflowId].Invocations[0]
+	require.Equal(t, proto.InvocationStatus_CANCELLED, invocation.Status)
+	require.Len(t, invocation.EventRecords, 1)
+
+	require.Len(t, res.WorkflowResults[workflowId].Invocations, 1)
+	invocation = res.WorkflowResults[workflowId].Invocations[0]
+	require.Equal(t, proto.InvocationStatus_COMPLETED, invocation.Status)
+	require.Len(t, invocation.EventRecords, 2)
+}
@@ -70,6 +70,7 @@ func main() {
 	rand.Seed(42)
 	snapshotter := flag.String("ss", "devmapper", "snapshotter name")
 	debug := flag.Bool("dbg", false, "Enable debug logging")
+	traceLogs := flag.Bool("trace", false, "Enable trace logging, which logs every page fault served by the memory manager")
 
 	isSaveMemory = flag.Bool("ms", false, "Enable memory saving")
 	isSnapshotsEnabled = flag.Bool("snapshots", false, "Use VM snapshots when adding function instances")
@@ -106,7 +107,10 @@ func main() {
 
 	log.SetOutput(os.Stdout)
 
-	if *debug {
+	if *traceLogs {
+		log.SetLevel(log.TraceLevel)
+		log.Trace("Trace logging is enabled")
+	} else if *debug {
 		log.SetLevel(log.DebugLevel)
 		log.Debug("Debug logging is enabled")
 	} else {